@@ -3,18 +3,32 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"net"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/containernetworking/cni/pkg/invoke"
 	"github.com/containernetworking/cni/pkg/skel"
 	"github.com/containernetworking/cni/pkg/types"
 	"github.com/containernetworking/cni/pkg/types/current"
 	"github.com/containernetworking/cni/pkg/version"
+	"github.com/gitlayzer/tsunami/pkg/bridge"
+	"github.com/gitlayzer/tsunami/pkg/cniapi"
+	"github.com/gitlayzer/tsunami/pkg/cninet"
 	"github.com/gitlayzer/tsunami/pkg/config"
+	"github.com/gitlayzer/tsunami/pkg/dhcp"
+	"github.com/gitlayzer/tsunami/pkg/podevent"
 	"github.com/gitlayzer/tsunami/pkg/podroute"
+	"github.com/gitlayzer/tsunami/pkg/store"
 	"github.com/gitlayzer/tsunami/utils/restapi"
 	"github.com/gitlayzer/tsunami/utils/skelargs"
 	"github.com/gitlayzer/tsunami/utils/utilfile"
+	"github.com/vishvananda/netlink"
 	"k8s.io/klog"
 )
 
@@ -23,24 +37,121 @@ var (
 	versionAll = version.PluginSupports(ver)
 )
 
+// cmdContext 返回插件执行期间使用的 context, 容器运行时终止插件时取消正在进行的请求
+func cmdContext() (context.Context, context.CancelFunc) {
+	return signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+}
+
+// serverError 将访问 cni server 的错误转换为 cni 错误, 不可达时提示容器运行时稍后重试
+func serverError(err error) error {
+	// 1.1 版本的 server 返回的错误码即为 cni 错误码
+	var apiErr *restapi.APIError
+	if errors.As(err, &apiErr) && apiErr.Code != 0 {
+		return &types.Error{Code: apiErr.Code, Msg: apiErr.Message, Details: apiErr.Details}
+	}
+	if restapi.IsUnreachable(err) {
+		return &types.Error{Code: config.ErrTryAgainLater, Msg: "cni server is unreachable", Details: err.Error()}
+	}
+	if restapi.IsRejected(err) {
+		return &types.Error{Code: config.ErrServerRejected, Msg: "cni server rejected the request", Details: err.Error()}
+	}
+	return err
+}
+
+// makeStaticResult 根据 cni server 返回的地址生成 cni 结果, 主网卡为每个地址族添加一条默认路由
+func makeStaticResult(ips []cniapi.IPConfig, primary bool) (res *current.Result, err error) {
+	res = &current.Result{CNIVersion: ver}
+	hasDefault := map[string]bool{}
+	for i := range ips {
+		addr, gw, err := ips[i].Parse()
+		if err != nil {
+			return nil, err
+		}
+		family := ips[i].Version()
+		res.IPs = append(res.IPs, &current.IPConfig{Version: family, Address: *addr, Gateway: gw})
+
+		// 只有主网卡才有默认路由.
+		if !primary || gw == nil || hasDefault[family] {
+			continue
+		}
+		dst := net.IPNet{IP: net.IPv4zero.To4(), Mask: net.CIDRMask(0, 32)}
+		if family == "6" {
+			dst = net.IPNet{IP: net.IPv6zero, Mask: net.CIDRMask(0, 128)}
+		}
+		res.Routes = append(res.Routes, &types.Route{Dst: dst, GW: gw})
+		hasDefault[family] = true
+	}
+	return res, nil
+}
+
+// recordIPs 在 attachment 中记录结果中的全部地址, IPAddress 与 Gateway 优先使用第一个 IPv4 地址
+func recordIPs(attachment *store.Attachment, res *current.Result) {
+	attachment.IPs = nil
+	var first *current.IPConfig
+	for _, ipc := range res.IPs {
+		attachment.IPs = append(attachment.IPs, ipc.Address.String())
+		if first == nil || (first.Version != "4" && ipc.Version == "4") {
+			first = ipc
+		}
+	}
+	if first == nil {
+		return
+	}
+	attachment.IPAddress, attachment.Gateway = first.Address.String(), ""
+	if first.Gateway != nil {
+		attachment.Gateway = first.Gateway.String()
+	}
+}
+
+// queryDHCPLease 从 dhcp 守护进程查询租约中的 MTU 与 DNS, 使用 cni dhcp 插件的 daemon 时没有这些信息, 返回 nil
+func queryDHCPLease(ctx context.Context, netConf *config.NetConf, args *skel.CmdArgs) *dhcp.LeaseInfo {
+	if netConf.Delegate.IPAMType() != "dhcp" {
+		return nil
+	}
+	info, err := dhcp.QueryLease(ctx, netConf.Delegate.DHCPSocketPath(), &dhcp.LeaseArgs{
+		ContainerID: args.ContainerID,
+		Network:     netConf.Delegate.Name,
+		IfName:      args.IfName,
+	})
+	if err != nil {
+		klog.Infof("no dhcp options of container %s: %s", args.ContainerID, err)
+		return nil
+	}
+	return info
+}
+
 // cmdAdd: 在调用此函数时, 以由kubelet创建好pause容器, 正是需要为其部署网络的时候.
 // 而对应的业务容器此时还未创建.
 func cmdAdd(args *skel.CmdArgs) (err error) {
 	klog.Infof("cmdAdd args: %+v", args)
-	netConf := &config.NetConf{}
-	err = json.Unmarshal(args.StdinData, netConf)
+	netConf, err := config.LoadNetConf(args.StdinData)
 	if err != nil {
-		return
+		return err
 	}
+	ctx, cancel := cmdContext()
+	defer cancel()
+
+	// 作为次要网络时(网卡名称为 net1, net2 等), 根据网络名称选择网桥与 VLAN.
+	primary := args.IfName == podroute.PrimaryIfName
+	serviceRoute := netConf.SelectNetwork(primary)
+	fallbackTimeout := netConf.SetDHCPTimeout()
 	delegateBytes, err := json.Marshal(netConf.Delegate)
 	if err != nil {
 		return
 	}
 
 	// cni插件创建的, 默认的网络设备(名称一般为cni0).
-	cni0 := netConf.Delegate["bridge"].(string)
+	cni0 := netConf.Delegate.Bridge
 	var resp *restapi.PodResponse
 	var result types.Result
+	var lease *dhcp.LeaseInfo
+	attachment := &store.Attachment{
+		ContainerID: args.ContainerID,
+		IfName:      args.IfName,
+		NetNs:       args.Netns,
+		Bridge:      cni0,
+		CreatedAt:   time.Now(),
+	}
 	podName, err := skelargs.ParseValueFromArgs("K8S_POD_NAME", args.Args)
 	if err != nil {
 		return err
@@ -49,71 +160,584 @@ func cmdAdd(args *skel.CmdArgs) (err error) {
 	if err != nil {
 		return err
 	}
+	attachment.PodName, attachment.PodNamespace = podName, podNS
 
 	// 先判断 cniserver 进程是否存在.
+	var client *restapi.CNIServerClient
+	podReq := &restapi.PodRequest{
+		PodName:      podName,
+		PodNamespace: podNS,
+		ContainerID:  args.ContainerID,
+		NetNs:        args.Netns,
+		CNI0:         cni0,
+		IfName:       args.IfName,
+		Network:      netConf.Name,
+		Vlan:         netConf.Delegate.Vlan,
+	}
 	if utilfile.Exists(netConf.ServerSocket) {
-		client := restapi.NewCNIServerClient(netConf.ServerSocket)
-		resp, err = client.Add(&restapi.PodRequest{
-			PodName:      podName,
-			PodNamespace: podNS,
-			ContainerID:  args.ContainerID,
-			NetNs:        args.Netns,
-			CNI0:         cni0,
-		})
+		client = restapi.NewCNIServerClient(netConf.ServerSocket, netConf.ClientOptions())
+		resp, err = client.Add(ctx, podReq)
 
 		if err != nil {
 			klog.Errorf("failed to set network for pod: %s", err)
+			return serverError(err)
+		}
+	}
+
+	// cni server 返回的网卡调优配置, 在设置路由时一并应用.
+	var tuning *podroute.Tuning
+	if resp != nil {
+		tuning, err = podroute.NewTuning(resp.MTU, resp.MAC, resp.Sysctls)
+		if err != nil {
+			klog.Errorf("invalid tuning for pod %s/%s: %s", podNS, podName, err)
 			return err
 		}
 	}
 
 	// if 条件满足说明当前的Pod的确设置了静态IP, 需要为其生成 result 结果.
-	if resp != nil {
-		_, podIP, _ := net.ParseCIDR(resp.IPAddress)
-		_, defnet, _ := net.ParseCIDR("0.0.0.0/0")
-		gatewayIP := net.ParseIP(resp.Gateway).To4()
-		result = &current.Result{
-			CNIVersion: ver,
-			IPs: []*current.IPConfig{
-				{
-					Version: "4",
-					Address: *podIP,
-					Gateway: gatewayIP,
-				},
-			},
-			Routes: []*types.Route{
-				{
-					Dst: *defnet,
-					GW:  gatewayIP,
-				},
-			},
+	useStatic := resp != nil && !resp.DoNothing && len(resp.GetIPs()) > 0
+	if !useStatic {
+		// dhcp 租约在 bridge 插件中按 veth 原本的 MAC 获取, 之后再修改 MAC 会导致续租与服务器上的记录不一致
+		if tuning != nil && tuning.MAC != nil && netConf.Delegate.IPAMType() == "dhcp" {
+			err = fmt.Errorf("annotation %s is not supported for pods using dhcp", podroute.AnnotationMAC)
+			klog.Errorf("invalid tuning for pod %s/%s: %s", podNS, podName, err)
+			return err
 		}
-	} else {
-		ipamType := netConf.Delegate["type"].(string)
-		result, err = invoke.DelegateAdd(context.TODO(), ipamType, delegateBytes, nil)
 
+		var timedOut bool
+		result, timedOut, err = delegateAdd(ctx, netConf, delegateBytes, fallbackTimeout)
 		if err != nil {
 			klog.Errorf("faliled to run bridge plugin: %s", err)
+			if !timedOut {
+				return err
+			}
+
+			// dhcp 超时, 改为使用 cni server 分配的备用地址
+			resp, err = requestFallback(ctx, netConf, client, podReq, delegateBytes, err)
+			if err != nil {
+				return err
+			}
+			if tuning, err = podroute.NewTuning(resp.MTU, resp.MAC, resp.Sysctls); err != nil {
+				klog.Errorf("invalid tuning for pod %s/%s: %s", podNS, podName, err)
+				return err
+			}
+			useStatic = true
+		}
+	}
+
+	if useStatic {
+		var staticResult *current.Result
+		staticResult, err = makeStaticResult(resp.GetIPs(), primary)
+		if err != nil {
+			klog.Errorf("invalid addresses of pod %s/%s from cni server: %s", podNS, podName, err)
 			return err
 		}
+		result = staticResult
+		recordIPs(attachment, staticResult)
+		attachment.Source = store.SourceStatic
+		if podReq.Fallback {
+			attachment.Source = store.SourceFallback
+		}
 
+		// 确认静态 IP 没有被同网段中 Kubernetes 之外的主机占用, 否则释放该地址并拒绝创建.
+		for _, ipc := range staticResult.IPs {
+			err = podroute.ProbeInBridge(cni0, args.Netns, args.IfName, ipc.Address.IP, netConf.GetProbeTimeout())
+			if err != nil {
+				return rejectStaticIP(ctx, netConf, args, podNS, podName, err)
+			}
+		}
+	} else {
 		klog.Infof("run bridge plugin success: %s", result.String())
+
+		// cni server 没有指定 MTU 时使用 dhcp 下发的, 不能超过网桥的 MTU
+		lease = queryDHCPLease(ctx, netConf, args)
+		if lease != nil && lease.MTU != 0 && (tuning == nil || tuning.MTU == 0) {
+			if link, err := netlink.LinkByName(cni0); err == nil && lease.MTU > link.Attrs().MTU {
+				klog.Warningf("ignore dhcp mtu %d of pod %s/%s, it exceeds the mtu %d of bridge %s", lease.MTU, podNS, podName, link.Attrs().MTU, cni0)
+			} else if tuning == nil {
+				tuning = &podroute.Tuning{MTU: lease.MTU}
+			} else {
+				tuning.MTU = lease.MTU
+			}
+		}
+
+		attachment.Source = store.SourceDHCP
+		if curResult, err := current.NewResultFromResult(result); err == nil {
+			recordIPs(attachment, curResult)
+			for _, iface := range curResult.Interfaces {
+				if iface.Sandbox != "" {
+					attachment.MAC = iface.Mac
+				}
+			}
+			// 次要网卡上 dhcp 下发的默认路由会在 SetRouteInPod 中被移除, 结果中也不再体现.
+			if !primary {
+				routes := curResult.Routes[:0]
+				for _, route := range curResult.Routes {
+					if ones, _ := route.Dst.Mask.Size(); ones != 0 {
+						routes = append(routes, route)
+					}
+				}
+				curResult.Routes = routes
+				result = curResult
+			}
+		}
+
+		dhcpConf, confErr := netConf.Delegate.DHCPConf()
+		if netConf.Delegate.IPAMType() == "dhcp" && confErr == nil && dhcpConf.IPv6 != "" {
+			// ipv6 为 slaac 时, 地址来自路由通告, 需要等待其生成后加入结果;
+			// 为 dhcpv6 时, 地址已经在结果中, cni dhcp 插件的 daemon 不支持 DHCPv6, 结果中没有 IPv6 地址
+			var v6Result *current.Result
+			v6Result, err = addIPv6(args, result, primary, dhcpConf)
+			if err != nil {
+				klog.Errorf("faliled to get ipv6 address of pod %s/%s: %s", podNS, podName, err)
+				// 不保留已经获取的 dhcp 租约
+				if delErr := invoke.DelegateDel(ctx, netConf.Delegate.Type, delegateBytes, nil); delErr != nil {
+					klog.Warningf("failed to release dhcp lease of pod %s/%s: %s", podNS, podName, delErr)
+				}
+				return err
+			}
+			result = v6Result
+			recordIPs(attachment, v6Result)
+		}
+	}
+
+	// DNS 按字段合并, 优先使用 cni server 返回的(来自 IPPool 或 Pod), 其次是网络配置与 delegate 结果中的, 最后是 dhcp 下发的.
+	curResult, err := current.NewResultFromResult(result)
+	if err != nil {
+		klog.Errorf("faliled to convert result of pod %s/%s: %s", podNS, podName, err)
+		return
+	}
+	var serverDNS types.DNS
+	if resp != nil && resp.DNS != nil {
+		serverDNS = types.DNS{
+			Nameservers: resp.DNS.Nameservers,
+			Domain:      resp.DNS.Domain,
+			Search:      resp.DNS.Search,
+			Options:     resp.DNS.Options,
+		}
+	}
+	var leaseDNS types.DNS
+	if lease != nil {
+		leaseDNS = lease.DNS
 	}
+	curResult.DNS = config.MergeDNS(serverDNS, netConf.NetworkDNS(), curResult.DNS, leaseDNS)
+	result = curResult
 
 	// 为 Pod 获取IP后, 检测是否存在默认路由, 并且添加Pod到ServiceCIRD的路由.
-	_, err = podroute.SetRouteInPod(cni0, args.Netns, netConf.ServiceIPCIDR)
+	podIP, _, _ := net.ParseCIDR(attachment.IPAddress)
+	_, err = podroute.SetRouteInPod(&podroute.PodRouteOpts{
+		BridgeName:    cni0,
+		NetnsPath:     args.Netns,
+		IfName:        args.IfName,
+		ServiceIPCIDR: netConf.ServiceIPCIDR,
+		Primary:       primary,
+		ServiceRoute:  serviceRoute,
+		PodIP:         podIP,
+		Policy:        netConf.PolicyRouting.PolicyOpts(),
+		Tuning:        tuning,
+	})
 	if err != nil {
 		klog.Errorf("faliled to add route to the pod %s: %s", args.Args, err)
 		return
 	}
-	return result.Print()
+
+	// 静态 IP 可能刚从其他节点迁移过来, 需要让上游交换机刷新 ARP 表项, 失败不影响 Pod 创建.
+	if attachment.Source == store.SourceStatic || attachment.Source == store.SourceFallback {
+		if err := podroute.AnnounceInPod(args.Netns, args.IfName, netConf.GetAnnounceCount()); err != nil {
+			klog.Warningf("failed to announce address of pod %s/%s: %s", podNS, podName, err)
+		}
+	}
+
+	// 来自 IPPool 或 Pod 注解的额外路由.
+	if resp != nil && len(resp.Routes) > 0 {
+		if err = podroute.AddRoutes(args.Netns, args.IfName, resp.Routes); err != nil {
+			klog.Errorf("faliled to add custom routes to the pod %s: %s", args.Args, err)
+			return
+		}
+		attachment.Routes = resp.Routes
+	}
+
+	if tuning != nil && tuning.MAC != nil {
+		// 结果中 Pod 网卡的 MAC 需要与修改后的保持一致
+		for _, iface := range curResult.Interfaces {
+			if iface.Sandbox != "" {
+				iface.Mac = tuning.MAC.String()
+			}
+		}
+	}
+
+	// 带宽限制优先使用运行时注入的 runtimeConfig, 其次使用 cni server 读取的 Pod 注解.
+	bandwidth := netConf.RuntimeConfig.Bandwidth
+	if bandwidth == nil && resp != nil {
+		bandwidth = resp.Bandwidth
+	}
+	if bandwidth != nil {
+		if err = podroute.SetBandwidth(args.Netns, args.IfName, bandwidth); err != nil {
+			klog.Errorf("faliled to set bandwidth of pod %s/%s: %s", podNS, podName, err)
+			return
+		}
+		attachment.Bandwidth = bandwidth
+	}
+
+	// 记录宿主机一侧的 veth, 防欺骗规则以及之后的清理都需要它.
+	veth, err := podroute.GetVethInfo(args.Netns, args.IfName)
+	if err != nil {
+		klog.Errorf("faliled to get veth of pod %s/%s: %s", podNS, podName, err)
+		return
+	}
+	attachment.HostVeth, attachment.MAC = veth.HostVeth, veth.PodMAC.String()
+
+	// 静态 IP 的 veth 不是由 bridge 插件创建的, 因此所有端口都在这里统一设置 hairpin 模式.
+	hostLink, err := netlink.LinkByIndex(veth.HostIndex)
+	if err != nil {
+		klog.Errorf("faliled to get host veth of pod %s/%s: %s", podNS, podName, err)
+		return
+	}
+	if err = bridge.ConfigurePort(hostLink, netConf.Delegate.HairpinMode); err != nil {
+		klog.Errorf("faliled to configure bridge port of pod %s/%s: %s", podNS, podName, err)
+		return
+	}
+
+	// 防欺骗规则由 daemon 安装, 开启时安装失败需要拒绝创建 Pod.
+	if netConf.AntiSpoofing {
+		req := &restapi.AntiSpoofRequest{
+			ContainerID: args.ContainerID,
+			HostVeth:    attachment.HostVeth,
+			MAC:         attachment.MAC,
+		}
+		for _, ip := range attachment.AllIPs() {
+			req.IPs = append(req.IPs, ip.String())
+		}
+		err = restapi.NewCtlClient(netConf.GetCtlSocket(), netConf.ClientOptions()).AddAntiSpoof(ctx, req)
+		if err != nil {
+			klog.Errorf("faliled to add anti spoofing rules for pod %s/%s: %s", podNS, podName, err)
+			return
+		}
+	}
+
+	// HostPort 由 daemon 通过 nftables 做 DNAT, 映射失败时拒绝创建 Pod.
+	if len(netConf.RuntimeConfig.PortMappings) > 0 {
+		req := &restapi.HostPortRequest{
+			ContainerID:  args.ContainerID,
+			PortMappings: netConf.RuntimeConfig.PortMappings,
+		}
+		for _, ip := range attachment.AllIPs() {
+			req.IPs = append(req.IPs, ip.String())
+		}
+		err = restapi.NewCtlClient(netConf.GetCtlSocket(), netConf.ClientOptions()).AddHostPorts(ctx, req)
+		if err != nil {
+			klog.Errorf("faliled to add host ports for pod %s/%s: %s", podNS, podName, err)
+			return
+		}
+		attachment.PortMappings = netConf.RuntimeConfig.PortMappings
+	}
+
+	if attachment.Source == store.SourceFallback {
+		flagFallback(ctx, netConf, attachment)
+	}
+
+	// 记录 Pod 的网络信息, 供 tsunamictl 查询, 记录失败不影响 Pod 创建
+	if err = store.New(store.DefaultDir).Save(attachment); err != nil {
+		klog.Warningf("failed to save attachment of pod %s/%s: %s", podNS, podName, err)
+	}
+	// NewResultFromResult 会将结果的版本改为 0.4.0, 输出时需要转换回配置中的版本
+	cniVersion := netConf.CNIVersion
+	if cniVersion == "" {
+		cniVersion = ver
+	}
+	return types.PrintResult(result, cniVersion)
+}
+
+// addIPv6 确认 dhcpv6 的地址已经在结果中, 或等待 Pod 网卡上根据路由通告生成的地址并追加到结果中,
+// 此时主网卡同时添加 IPv6 默认路由. ipam 中的 timeoutMs 同时作为等待路由通告的时间.
+func addIPv6(args *skel.CmdArgs, result types.Result, primary bool, conf *dhcp.ClientConf) (res *current.Result, err error) {
+	res, err = current.NewResultFromResult(result)
+	if err != nil {
+		return nil, err
+	}
+	if conf.IPv6 == dhcp.IPv6DHCP {
+		for _, ipc := range res.IPs {
+			if ipc.Version == "6" {
+				return res, nil
+			}
+		}
+		return nil, fmt.Errorf("no dhcpv6 address in the ipam result, dhcpv6 requires the builtin dhcp daemon")
+	}
+
+	addrs, gw, err := podroute.WaitSLAAC(args.Netns, args.IfName, primary, time.Duration(conf.TimeoutMs)*time.Millisecond)
+	if err != nil {
+		return nil, err
+	}
+
+	var ifIndex *int
+	for i, iface := range res.Interfaces {
+		if iface.Sandbox != "" {
+			ifIndex = current.Int(i)
+		}
+	}
+	for _, addr := range addrs {
+		res.IPs = append(res.IPs, &current.IPConfig{Version: "6", Interface: ifIndex, Address: *addr, Gateway: gw})
+	}
+	if primary && gw != nil {
+		res.Routes = append(res.Routes, &types.Route{Dst: net.IPNet{IP: net.IPv6zero, Mask: net.CIDRMask(0, 128)}, GW: gw})
+	}
+	return res, nil
+}
+
+// fallbackGrace 超过 ipam 中的等待时间之后再终止 bridge 插件, 内置的 dhcp 守护进程会先返回超时错误
+const fallbackGrace = 5 * time.Second
+
+// delegateAdd 执行 bridge 插件, fallbackTimeout 不为 0 时最多等待 fallbackTimeout+fallbackGrace.
+// 使用 cni dhcp 插件的 daemon 时不会读取 ipam 中的等待时间, 由插件终止 bridge 插件.
+func delegateAdd(ctx context.Context, netConf *config.NetConf, delegateBytes []byte, fallbackTimeout time.Duration) (result types.Result, timedOut bool, err error) {
+	if fallbackTimeout == 0 {
+		result, err = invoke.DelegateAdd(ctx, netConf.Delegate.Type, delegateBytes, nil)
+		return result, false, err
+	}
+
+	dctx, cancel := context.WithTimeout(ctx, fallbackTimeout+fallbackGrace)
+	defer cancel()
+	result, err = invoke.DelegateAdd(dctx, netConf.Delegate.Type, delegateBytes, nil)
+	if err != nil && (dctx.Err() == context.DeadlineExceeded || dhcp.IsTimeout(err)) {
+		return nil, true, err
+	}
+	return result, false, err
+}
+
+// requestFallback dhcp 超时后清理 bridge 插件创建了一半的网络, 然后向 cni server 申请 IPPool 中的备用地址.
+// server 不支持或没有备用地址时返回 dhcp 的错误.
+func requestFallback(ctx context.Context, netConf *config.NetConf, client *restapi.CNIServerClient, req *restapi.PodRequest, delegateBytes []byte, dhcpErr error) (resp *restapi.PodResponse, err error) {
+	if client == nil {
+		return nil, dhcpErr
+	}
+	v, err := client.ServerVersion()
+	if err != nil {
+		klog.Errorf("failed to get version of cni server for dhcp fallback: %s", err)
+		return nil, dhcpErr
+	}
+	if !v.SupportsFallback() {
+		klog.Warningf("cni server of version %s does not support dhcp fallback", v)
+		return nil, dhcpErr
+	}
+
+	// bridge 插件在执行 ipam 之前已经创建了 veth, 备用地址的 veth 由 cni server 重新创建
+	if err = invoke.DelegateDel(ctx, netConf.Delegate.Type, delegateBytes, nil); err != nil {
+		klog.Errorf("failed to clean up bridge plugin of pod %s/%s: %s", req.PodNamespace, req.PodName, err)
+		return nil, err
+	}
+
+	req.Fallback = true
+	resp, err = client.Add(ctx, req)
+	if err != nil {
+		klog.Errorf("failed to request fallback address for pod %s/%s: %s", req.PodNamespace, req.PodName, err)
+		return nil, serverError(err)
+	}
+	if resp.DoNothing || len(resp.GetIPs()) == 0 {
+		klog.Warningf("no fallback address for pod %s/%s", req.PodNamespace, req.PodName)
+		return nil, dhcpErr
+	}
+
+	klog.Infof("dhcp timed out, pod %s/%s uses fallback addresses %v", req.PodNamespace, req.PodName, resp.GetIPs())
+	return resp, nil
+}
+
+// flagFallback 通过 daemon 为使用备用地址的 Pod 添加注解与 Event, daemon 不可用时只记录日志
+func flagFallback(ctx context.Context, netConf *config.NetConf, attachment *store.Attachment) {
+	var ips []string
+	for _, ip := range attachment.AllIPs() {
+		ips = append(ips, ip.String())
+	}
+	err := restapi.NewCtlClient(netConf.GetCtlSocket(), netConf.ClientOptions()).Event(ctx, &restapi.PodEventRequest{
+		PodName:      attachment.PodName,
+		PodNamespace: attachment.PodNamespace,
+		Type:         "Warning",
+		Reason:       "DHCPFallback",
+		Message:      fmt.Sprintf("dhcp timed out on %s, using fallback address %s", attachment.IfName, strings.Join(ips, ",")),
+		Annotations:  map[string]string{podevent.FallbackAnnotation: strings.Join(ips, ",")},
+	})
+	if err != nil {
+		klog.Warningf("failed to flag fallback address of pod %s/%s: %s", attachment.PodNamespace, attachment.PodName, err)
+	}
+}
+
+// rejectStaticIP 重复地址检测失败时, 通知 cni server 释放地址, 并为 Pod 创建 Event
+func rejectStaticIP(ctx context.Context, netConf *config.NetConf, args *skel.CmdArgs, podNS, podName string, probeErr error) error {
+	klog.Errorf("duplicate address detection failed for pod %s/%s: %s", podNS, podName, probeErr)
+
+	client := restapi.NewCNIServerClient(netConf.ServerSocket, netConf.ClientOptions())
+	err := client.Del(ctx, &restapi.PodRequest{
+		PodName:      podName,
+		PodNamespace: podNS,
+		ContainerID:  args.ContainerID,
+		NetNs:        args.Netns,
+		CNI0:         netConf.Delegate.Bridge,
+		IfName:       args.IfName,
+		Network:      netConf.Name,
+	})
+	if err != nil {
+		klog.Warningf("failed to release address of pod %s/%s: %s", podNS, podName, err)
+	}
+
+	// Event 由 daemon 代为创建, daemon 不可用时只记录日志.
+	err = restapi.NewCtlClient(netConf.GetCtlSocket(), netConf.ClientOptions()).Event(ctx, &restapi.PodEventRequest{
+		PodName:      podName,
+		PodNamespace: podNS,
+		Type:         "Warning",
+		Reason:       "AddressConflict",
+		Message:      probeErr.Error(),
+	})
+	if err != nil {
+		klog.Warningf("failed to record event for pod %s/%s: %s", podNS, podName, err)
+	}
+
+	if _, ok := probeErr.(*cninet.AddressConflictError); !ok {
+		return probeErr
+	}
+	return &types.Error{
+		Code:    config.ErrAddressInUse,
+		Msg:     "static address is already in use",
+		Details: probeErr.Error(),
+	}
 }
 
 func cmdDel(args *skel.CmdArgs) error {
+	ctx, cancel := cmdContext()
+	defer cancel()
+	podStore := store.New(store.DefaultDir)
+
+	// 网络命名空间已经不存在时, 其中的路由也随之消失, 不需要清理.
+	attachment, err := podStore.Load(args.ContainerID, args.IfName)
+	if err == nil && args.Netns != "" && utilfile.Exists(args.Netns) {
+		if err = podroute.DelRoutes(args.Netns, args.IfName, attachment.Routes); err != nil {
+			klog.Errorf("failed to delete custom routes of container %s: %s", args.ContainerID, err)
+			return err
+		}
+	}
+
+	// 宿主机上的回程路由与防欺骗规则不会随 Pod 网络命名空间删除, 需要根据记录清理.
+	netConf, confErr := config.LoadNetConf(args.StdinData)
+	// keepRecord 为 true 时保留记录, 由 tsunamictl gc 在 daemon 恢复后清理残留的规则
+	var keepRecord bool
+	if attachment != nil {
+		netnsPath := args.Netns
+		if netnsPath != "" && !utilfile.Exists(netnsPath) {
+			netnsPath = ""
+		}
+		if err = podroute.DelBandwidth(attachment.HostVeth, netnsPath, args.IfName, attachment.Bandwidth); err != nil {
+			klog.Errorf("failed to delete bandwidth limits of container %s: %s", args.ContainerID, err)
+			return err
+		}
+
+		var ctlClient *restapi.CtlClient
+		if confErr == nil {
+			ctlClient = restapi.NewCtlClient(netConf.GetCtlSocket(), netConf.ClientOptions())
+		} else {
+			ctlClient = restapi.NewCtlClient(restapi.DefaultCtlSocketPath, nil)
+		}
+		if confErr == nil && netConf.AntiSpoofing && attachment.HostVeth != "" {
+			err = ctlClient.DelAntiSpoof(ctx, &restapi.AntiSpoofRequest{
+				ContainerID: args.ContainerID,
+				HostVeth:    attachment.HostVeth,
+			})
+			// daemon 不可用时不阻塞删除, 残留的规则由 tsunamictl gc 清理.
+			if err != nil {
+				klog.Warningf("failed to delete anti spoofing rules of container %s: %s", args.ContainerID, err)
+			}
+		}
+		podIP, _, _ := net.ParseCIDR(attachment.IPAddress)
+		// DNAT 规则残留会将流量转发到之后复用该 IP 的 Pod, daemon 不可用时保留记录, 由 tsunamictl gc 清理.
+		var ips []string
+		for _, ip := range attachment.AllIPs() {
+			ips = append(ips, ip.String())
+		}
+		if len(attachment.PortMappings) > 0 && len(ips) > 0 {
+			err = ctlClient.DelHostPorts(ctx, &restapi.HostPortRequest{
+				ContainerID:  args.ContainerID,
+				IPs:          ips,
+				PortMappings: attachment.PortMappings,
+			})
+			if err != nil {
+				klog.Warningf("failed to delete host ports of container %s, keep the attachment for tsunamictl gc: %s", args.ContainerID, err)
+				keepRecord = true
+			}
+		}
+		if confErr == nil && netConf.PolicyRouting != nil && podIP.To4() != nil {
+			if err = podroute.DelHostPolicy(netConf.PolicyRouting.PolicyOpts(), podIP); err != nil {
+				klog.Errorf("failed to delete host policy routes of container %s: %s", args.ContainerID, err)
+				return err
+			}
+		}
+	}
+
+	// dhcp 分配的地址通过 bridge 与 ipam 插件释放, 否则要等到租约过期才会被服务器回收.
+	// 没有记录时 cmdAdd 可能在获取租约之后失败, 重复释放不会出错.
+	if confErr == nil && netConf.Delegate.IPAMType() == "dhcp" && (attachment == nil || attachment.Source == store.SourceDHCP) {
+		netConf.SelectNetwork(args.IfName == podroute.PrimaryIfName)
+		if delegateBytes, err := json.Marshal(netConf.Delegate); err == nil {
+			// 守护进程不可用时不阻塞删除, 租约过期后由服务器回收
+			if err = invoke.DelegateDel(ctx, netConf.Delegate.Type, delegateBytes, nil); err != nil {
+				klog.Warningf("failed to release dhcp lease of container %s: %s", args.ContainerID, err)
+			}
+		}
+	}
+
+	if keepRecord {
+		return nil
+	}
+	if err = podStore.Delete(args.ContainerID, args.IfName); err != nil {
+		klog.Warningf("failed to delete attachment of container %s: %s", args.ContainerID, err)
+	}
 	return nil
 }
 
 func cmdCheck(args *skel.CmdArgs) error {
+	ctx, cancel := cmdContext()
+	defer cancel()
+
+	// 升级前创建的 Pod 或 ADD 中途失败时没有记录, 没有需要检查的内容
+	attachment, err := store.New(store.DefaultDir).Load(args.ContainerID, args.IfName)
+	if os.IsNotExist(err) {
+		klog.Infof("no attachment of container %s %s, nothing to check", args.ContainerID, args.IfName)
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to load attachment of container %s: %s", args.ContainerID, err)
+	}
+
+	if err = podroute.CheckRoutes(args.Netns, args.IfName, attachment.Routes); err != nil {
+		return err
+	}
+
+	// 静态 IP 与备用地址由 cni server 分配, 请求 server 确认分配仍然有效
+	netConf, err := config.LoadNetConf(args.StdinData)
+	if err != nil {
+		return err
+	}
+	if (attachment.Source != store.SourceStatic && attachment.Source != store.SourceFallback) || !utilfile.Exists(netConf.ServerSocket) {
+		return nil
+	}
+	req := &restapi.PodRequest{
+		PodName:      attachment.PodName,
+		PodNamespace: attachment.PodNamespace,
+		ContainerID:  args.ContainerID,
+		NetNs:        args.Netns,
+		CNI0:         attachment.Bridge,
+		IfName:       args.IfName,
+		Network:      netConf.Name,
+		Vlan:         netConf.Delegate.Vlan,
+		IPs:          attachment.IPs,
+	}
+	if len(req.IPs) == 0 && attachment.IPAddress != "" {
+		req.IPs = []string{attachment.IPAddress}
+	}
+	err = restapi.NewCNIServerClient(netConf.ServerSocket, netConf.ClientOptions()).Check(ctx, req)
+	if err == restapi.ErrCheckUnsupported {
+		klog.Infof("skip checking container %s with cni server: %s", args.ContainerID, err)
+		return nil
+	}
+	if err != nil {
+		return serverError(err)
+	}
 	return nil
 }
 
@@ -3,12 +3,23 @@ package main
 import (
 	"context"
 	"flag"
+	"fmt"
+	"net"
 	"os"
 
 	"github.com/gitlayzer/tsunami/pkg/bridge"
+	"github.com/gitlayzer/tsunami/pkg/cninet"
 	"github.com/gitlayzer/tsunami/pkg/config"
+	"github.com/gitlayzer/tsunami/pkg/ctlserver"
 	"github.com/gitlayzer/tsunami/pkg/dhcp"
+	"github.com/gitlayzer/tsunami/pkg/firewall"
+	"github.com/gitlayzer/tsunami/pkg/netpol"
+	"github.com/gitlayzer/tsunami/pkg/podevent"
 	"github.com/gitlayzer/tsunami/pkg/signals"
+	"github.com/gitlayzer/tsunami/pkg/store"
+	"github.com/gitlayzer/tsunami/utils/utilfile"
+	"github.com/vishvananda/netlink"
+	corev1 "k8s.io/api/core/v1"
 	"k8s.io/klog"
 )
 
@@ -17,37 +28,273 @@ var (
 	netConf        config.NetConf
 	cmdFlags       = flag.NewFlagSet("cni-tsunami", flag.ExitOnError)
 	dhcpBinPath    = "/opt/cni/bin/dhcp"
-	dhcpSockPath   = "/run/cni/dhcp.sock"
+	dhcpSockPath   = dhcp.DefaultSocketPath
 	dhcpLogPath    = "/run/cni/dhcp.log"
 	dhcpProc       *os.Process
+	dhcpDaemon     *dhcp.DHCP
 	cniNetConfPath = "/etc/cni/net.d/10-cni-tsunami.conf"
+	snapshotPath   = store.DefaultDir + "/snapshot.json"
+	ctlServer      *ctlserver.Server
+	hostPorts      bool
+	netpolStopCh   chan struct{}
+	fallbackStopCh chan struct{}
 )
 
 func init() {
 	cmdFlags.StringVar(&cmdOpts.Eth0Name, "iface", "", "the network interface using to communicate with kubernetes cluster")
 	cmdFlags.StringVar(&cmdOpts.BridgeName, "bridge", "mybr0", "this plugin will create a bridge device, named by this option")
+	cmdFlags.StringVar(&cmdOpts.CtlSocket, "ctl-socket", ctlserver.DefaultSocketPath, "the unix socket used by tsunamictl")
+	cmdFlags.IntVar(&cmdOpts.AnnounceCount, "announce-count", cninet.DefaultAnnounceCount, "how many gratuitous arp / unsolicited na to send after moving addresses to the bridge, 0 to disable")
+	cmdFlags.BoolVar(&cmdOpts.AntiSpoofing, "anti-spoofing", false, "bind each pod veth port to its assigned ip and mac with nftables bridge rules")
+	cmdFlags.StringVar(&cmdOpts.DHCPDaemon, "dhcp-daemon", config.DHCPDaemonExternal, "the dhcp daemon serving the dhcp ipam plugin, external runs the cni dhcp plugin, builtin sends pod identity and honours routes, mtu and dns options")
+	cmdFlags.DurationVar(&cmdOpts.DHCPFallbackProbeInterval, "dhcp-fallback-probe-interval", 0, "how often to check whether dhcp is available again for pods using fallback addresses, at least 5m, 0 to disable")
+	cmdFlags.BoolVar(&cmdOpts.NetworkPolicy, "network-policy", false, "enforce kubernetes network policies on pod veth ports with nftables bridge rules")
+	cmdFlags.BoolVar(&cmdOpts.HairpinMode, "hairpin-mode", true, "enable hairpin mode on pod veth ports, so that a pod can reach itself through a service")
+	cmdFlags.BoolVar(&cmdOpts.PromiscMode, "promisc-mode", false, "set the bridge device into promiscuous mode")
+	cmdFlags.BoolVar(&cmdOpts.MulticastSnooping, "multicast-snooping", true, "enable multicast snooping on the bridge")
+	cmdFlags.BoolVar(&cmdOpts.STP, "stp", false, "enable spanning tree protocol on the bridge")
+	cmdFlags.IntVar(&cmdOpts.AgeingTime, "ageing-time", 300, "the ageing time in seconds of mac entries on the bridge")
+	cmdFlags.BoolVar(&cmdOpts.BootstrapCNIConfig, "bootstrap-cni-config", false, "render the cni config from flags and cluster discovery instead of completing an existing file")
+	cmdFlags.StringVar(&cmdOpts.ServerSocket, "server-socket", "/var/run/cniserver.sock", "the unix socket of cni server, written into the rendered cni config")
+	cmdFlags.StringVar(&cmdOpts.IPAM, "ipam", "dhcp", "the ipam plugin type used by the bridge delegate, written into the rendered cni config")
+	cmdFlags.DurationVar(&cmdOpts.DHCPFallbackTimeout, "dhcp-fallback-timeout", 0, "how long to wait for dhcp before asking the cni server for a fallback address, written into the rendered cni config, 0 to disable")
+	cmdFlags.DurationVar(&cmdOpts.ProbeTimeout, "probe-timeout", 0, "how long to probe static ips for duplicate addresses before the pod starts, written into the rendered cni config, adds this delay to every static ip, 0 to disable")
+	cmdFlags.IntVar(&cmdOpts.MTU, "mtu", 0, "the mtu of pod interfaces, defaults to the mtu of the main network interface")
+	cmdFlags.StringVar(&cmdOpts.ServiceIPCIDR, "service-cidr", "", "the service ip cidr, discovered from kube-apiserver if empty")
+	cmdFlags.StringVar(&cniNetConfPath, "cni-conf", cniNetConfPath, "the path of cni config file")
 	cmdFlags.Parse(os.Args[1:])
 }
 
 // stopHandler 执行退出时的清理操作, 如停止dhcp进程, 恢复原本的网络拓扑等.
 func stopHandler(cmdOpts *config.CmdOpts, doneCh chan<- bool) {
-	var err error
 	klog.Infof("receive stop signal")
+	teardown(cmdOpts)
+	doneCh <- true
+}
 
-	err = dhcp.StopDHCP(dhcpProc, dhcpSockPath)
-	if err != nil {
-		klog.Errorf("receive signal, but stop dhcp process failed: %s", err)
+// teardown 按照与启动相反的顺序清理, 启动中途失败时也会调用, 此时尚未启动的部分会被跳过
+func teardown(cmdOpts *config.CmdOpts) {
+	var err error
+
+	// 首先移除由 daemon 生成的 cni 配置, kubelet 会因此将节点标记为 NotReady, 不再调度新的 Pod
+	if cmdOpts.BootstrapCNIConfig {
+		if err = os.Remove(cniNetConfPath); err != nil && !os.IsNotExist(err) {
+			klog.Errorf("remove cni config failed: %s", err)
+		}
+	}
+
+	if ctlServer != nil {
+		if err = ctlServer.Stop(); err != nil {
+			klog.Errorf("stop ctl server failed: %s", err)
+		}
+	}
+
+	if fallbackStopCh != nil {
+		close(fallbackStopCh)
+	}
+
+	if netpolStopCh != nil {
+		close(netpolStopCh)
+		if err = netpol.Cleanup(); err != nil {
+			klog.Errorf("cleanup network policy rules failed: %s", err)
+		}
+	}
+
+	if cmdOpts.AntiSpoofing {
+		if err = firewall.CleanupAntiSpoofing(); err != nil {
+			klog.Errorf("cleanup anti spoofing rules failed: %s", err)
+		}
+	}
+
+	if hostPorts {
+		if err = firewall.CleanupHostPorts(); err != nil {
+			klog.Errorf("cleanup host port rules failed: %s", err)
+		}
+	}
+
+	if dhcpDaemon != nil || dhcpProc != nil {
+		if dhcpDaemon != nil {
+			err = dhcpDaemon.Stop()
+		} else {
+			err = dhcp.StopDHCP(dhcpProc, dhcpSockPath)
+		}
+		if err != nil {
+			klog.Errorf("stop dhcp process failed: %s", err)
+		}
 	}
 
+	// 网桥安装到一半时无法正常卸载, 根据快照恢复物理网卡的配置
 	err = bridge.UninstallBridgeNetwork(cmdOpts.BridgeName, cmdOpts.Eth0Name)
 	if err != nil {
-		klog.Errorf("receive signal, but uninstall bridge network failed, you should check it: %s", err)
+		klog.Errorf("uninstall bridge network failed, try to restore from snapshot: %s", err)
+		snap, loadErr := bridge.LoadSnapshot(snapshotPath)
+		if loadErr != nil {
+			klog.Errorf("load snapshot failed, you should check the network of %s: %s", cmdOpts.Eth0Name, loadErr)
+			return
+		}
+		if err = bridge.RestoreFromSnapshot(snap); err != nil {
+			klog.Errorf("restore from snapshot failed, you should check the network of %s: %s", cmdOpts.Eth0Name, err)
+			return
+		}
 	}
-	doneCh <- true
+	if err = os.Remove(snapshotPath); err != nil && !os.IsNotExist(err) {
+		klog.Errorf("remove snapshot failed: %s", err)
+	}
+}
+
+// flagRecovered dhcp 恢复后为使用备用地址的 Pod 添加注解与 Event, 提示重建 Pod 以重新获取租约
+func flagRecovered(events *podevent.Recorder, a *store.Attachment, offered net.IP) {
+	if events == nil {
+		return
+	}
+	err := events.Annotate(a.PodNamespace, a.PodName, map[string]string{podevent.RecoveredAnnotation: offered.String()})
+	if err != nil {
+		klog.Warningf("failed to annotate pod %s/%s: %s", a.PodNamespace, a.PodName, err)
+	}
+	message := fmt.Sprintf("dhcp is available again on %s and offered %s, recreate the pod to replace fallback address %s with a dhcp lease", a.IfName, offered, a.IPAddress)
+	if err = events.Event(a.PodNamespace, a.PodName, corev1.EventTypeNormal, "DHCPRecovered", message); err != nil {
+		klog.Warningf("failed to record event for pod %s/%s: %s", a.PodNamespace, a.PodName, err)
+	}
+}
+
+// configurePorts 为本节点上已有 Pod 的网桥端口设置 hairpin 模式
+func configurePorts(podStore *store.Store, hairpin bool) {
+	attachments, err := podStore.List()
+	if err != nil {
+		klog.Warningf("failed to list attachments: %s", err)
+		return
+	}
+
+	for _, a := range attachments {
+		if a.HostVeth == "" {
+			continue
+		}
+		port, err := netlink.LinkByName(a.HostVeth)
+		if err != nil {
+			continue
+		}
+		if err = bridge.ConfigurePort(port, hairpin); err != nil {
+			klog.Warningf("failed to configure port %s: %s", a.HostVeth, err)
+		}
+	}
+}
+
+// validateConfig 校验 cni 配置文件, 与 cni 插件中 cmdAdd 使用的是同一套检查
+func validateConfig(netConfPath string) {
+	if _, err := config.LoadNetConfFile(netConfPath); err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %s\n", netConfPath, err)
+		os.Exit(1)
+	}
+	fmt.Printf("%s: ok\n", netConfPath)
+}
+
+// run 在网桥安装完成后启动 daemon 的各个组件.
+// bootstrap 模式下 cni 配置最后生成, 此时 dhcp 守护进程与 ctl server(防欺骗, HostPort 与事件)都已就绪,
+// 否则 kubelet 在这之间执行的 ADD 会因为访问不到 daemon 而缺少端口规则.
+func run() (err error) {
+	// 主机 IP 迁移到网桥后, 主动通告一次地址, 避免上游交换机与同网段主机中的表项失效导致断流
+	if linkBridge, err := netlink.LinkByName(cmdOpts.BridgeName); err == nil {
+		if err = cninet.AnnounceAddrs(linkBridge, cmdOpts.AnnounceCount); err != nil {
+			klog.Warningf("failed to announce addresses of %s: %s", cmdOpts.BridgeName, err)
+		}
+	}
+
+	if cmdOpts.AntiSpoofing {
+		if err = firewall.InitAntiSpoofing(); err != nil {
+			return fmt.Errorf("failed to init anti spoofing rules: %s", err)
+		}
+		klog.Info("init anti spoofing rules success")
+	}
+
+	// HostPort 不是必需的功能, 初始化失败时(如内核不支持 inet 族的 nat)只是拒绝端口映射请求
+	if err = firewall.InitHostPorts(cmdOpts.BridgeName); err != nil {
+		klog.Warningf("host ports are disabled: %s", err)
+	} else {
+		hostPorts = true
+		klog.Info("init host port rules success")
+	}
+
+	podStore := store.New(store.DefaultDir)
+	if cmdOpts.DHCPDaemon == config.DHCPDaemonBuiltin {
+		dhcpDaemon = dhcp.NewDHCP(podStore)
+		err = dhcpDaemon.Start(dhcpSockPath)
+	} else {
+		dhcpProc, err = dhcp.StartDHCP(context.Background(), dhcpBinPath, dhcpSockPath, dhcpLogPath)
+	}
+	if err != nil {
+		return fmt.Errorf("faliled to run dhcp daemon: %s", err)
+	}
+	klog.Infof("run %s dhcp daemon success", cmdOpts.DHCPDaemon)
+
+	// 事件只用于提示, 无法获取集群凭证时不影响 daemon 运行
+	nodeName := os.Getenv("NODE_NAME")
+	if nodeName == "" {
+		nodeName, _ = os.Hostname()
+	}
+	events, err := podevent.NewInClusterRecorder(nodeName)
+	if err != nil {
+		klog.Warningf("pod events are disabled: %s", err)
+	}
+
+	ctlServer = ctlserver.New(ctlserver.Options{
+		SocketPath:   cmdOpts.CtlSocket,
+		BridgeName:   cmdOpts.BridgeName,
+		Eth0Name:     cmdOpts.Eth0Name,
+		SnapshotPath: snapshotPath,
+		DHCPSockPath: dhcpSockPath,
+		DHCPProc:     dhcpProc,
+		DHCPBuiltin:  dhcpDaemon != nil,
+		Store:        podStore,
+		Events:       events,
+		AntiSpoofing: cmdOpts.AntiSpoofing,
+		HostPorts:    hostPorts,
+	})
+	if err = ctlServer.Start(); err != nil {
+		return fmt.Errorf("failed to start ctl server: %s", err)
+	}
+
+	if cmdOpts.BootstrapCNIConfig {
+		if err = netConf.Render(&cmdOpts, cniNetConfPath); err != nil {
+			return err
+		}
+		klog.Infof("render cni config to %s", cniNetConfPath)
+	}
+
+	// daemon 重启后, 已有 Pod 的端口同样需要使用最新的 hairpin 配置
+	configurePorts(podStore, cmdOpts.HairpinMode)
+
+	// 使用备用地址的 Pod 在 dhcp 恢复后需要重建才能重新获取租约, 这里只负责提示
+	if cmdOpts.DHCPFallbackProbeInterval > 0 {
+		fallbackStopCh = make(chan struct{})
+		go dhcp.NewFallbackWatcher(podStore, cmdOpts.DHCPFallbackProbeInterval, func(a *store.Attachment, offered net.IP) {
+			flagRecovered(events, a, offered)
+		}).Run(fallbackStopCh)
+	}
+
+	if cmdOpts.NetworkPolicy {
+		controller, err := netpol.NewInClusterController(podStore)
+		if err != nil {
+			return fmt.Errorf("failed to create network policy controller: %s", err)
+		}
+		netpolStopCh = make(chan struct{})
+		go controller.Run(netpolStopCh)
+	}
+
+	return nil
 }
 
 func main() {
 	var err error
+	// tsunami validate-config [path]
+	if cmdFlags.Arg(0) == "validate-config" {
+		netConfPath := cniNetConfPath
+		if cmdFlags.NArg() > 1 {
+			netConfPath = cmdFlags.Arg(1)
+		}
+		validateConfig(netConfPath)
+		return
+	}
+
 	klog.Info("Starting tsunami pod plugin")
 	err = cmdOpts.Complete()
 	if err != nil {
@@ -56,25 +303,42 @@ func main() {
 	}
 	klog.Infof("cmd opt: %+v", cmdOpts)
 
-	err = netConf.Complete(cniNetConfPath)
-	if err != nil {
-		klog.Error(err)
-		return
+	// bootstrap 模式下, cni 配置在网桥与 dhcp 就绪后才生成, 避免 kubelet 过早地认为节点网络已就绪
+	if !cmdOpts.BootstrapCNIConfig {
+		err = netConf.Complete(&cmdOpts, cniNetConfPath)
+		if err != nil {
+			klog.Error(err)
+			return
+		}
 	}
 
+	// 快照已存在说明上一次 daemon 没有正常卸载桥接网络, 物理网卡上的配置已经迁移到了网桥, 不能覆盖
+	if !utilfile.Exists(snapshotPath) {
+		snap, err := bridge.TakeSnapshot(cmdOpts.BridgeName, cmdOpts.Eth0Name)
+		if err != nil {
+			klog.Error(err)
+			return
+		}
+		if err = bridge.SaveSnapshot(snapshotPath, snap); err != nil {
+			klog.Error(err)
+			return
+		}
+		klog.Infof("save snapshot of %s to %s", cmdOpts.Eth0Name, snapshotPath)
+	}
 
-	err = bridge.InstallBridgeNetwork(cmdOpts.BridgeName, cmdOpts.Eth0Name)
+	err = bridge.InstallBridgeNetwork(cmdOpts.BridgeName, cmdOpts.Eth0Name, cmdOpts.BridgeOptions())
 	if err != nil {
+		klog.Errorf("failed to install bridge network: %s", err)
+		teardown(&cmdOpts)
 		return
 	}
 	klog.Info("link bridge success")
-
-	dhcpProc, err = dhcp.StartDHCP(context.Background(), dhcpBinPath, dhcpSockPath, dhcpLogPath)
-	if err != nil {
-		klog.Errorf("faliled to run dhcp plugin: %s", err)
+	// 之后启动失败时需要恢复物理网卡的配置, 不能让节点停留在只配置了一半的状态
+	if err = run(); err != nil {
+		klog.Error(err)
+		teardown(&cmdOpts)
 		return
 	}
-	klog.Info("run dhcp plugin success")
 
 	// 退出的时机由doneCh决定.
 	doneCh := make(chan bool, 1)
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"github.com/gitlayzer/tsunami/pkg/ctlserver"
+	"github.com/gitlayzer/tsunami/utils/restapi"
+)
+
+var (
+	socketPath string
+	namespace  string
+	dryRun     bool
+	timeout    time.Duration
+	cmdFlags   = flag.NewFlagSet("tsunamictl", flag.ExitOnError)
+)
+
+const usage = `Usage: tsunamictl [flags] <command> [args]
+
+Commands:
+  status          show bridge, uplink, migrated addresses and routes, dhcp process
+  pods            list pods attached by tsunami on this node
+  leases          list dhcp leases of pods on this node
+  routes <pod>    dump routes inside the pod network namespace
+  gc              remove attachments whose network namespace is gone
+  restore         uninstall the bridge network from the saved snapshot
+
+Flags:
+`
+
+func init() {
+	cmdFlags.StringVar(&socketPath, "socket", ctlserver.DefaultSocketPath, "the unix socket of tsunami daemon")
+	cmdFlags.StringVar(&namespace, "n", "default", "the namespace of pod, used by routes command")
+	cmdFlags.BoolVar(&dryRun, "dry-run", false, "only print what gc would remove")
+	cmdFlags.DurationVar(&timeout, "timeout", restapi.DefaultTimeout, "the timeout of each request to tsunami daemon")
+	cmdFlags.Usage = func() {
+		fmt.Fprint(os.Stderr, usage)
+		cmdFlags.PrintDefaults()
+	}
+}
+
+func main() {
+	// 允许 flag 出现在子命令之后, 如 `tsunamictl gc --dry-run`
+	var args []string
+	rest := os.Args[1:]
+	for {
+		cmdFlags.Parse(rest)
+		if cmdFlags.NArg() == 0 {
+			break
+		}
+		args = append(args, cmdFlags.Arg(0))
+		rest = cmdFlags.Args()[1:]
+	}
+	if len(args) == 0 {
+		cmdFlags.Usage()
+		os.Exit(2)
+	}
+
+	// Ctrl-C 时取消正在进行的请求与重试
+	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer cancel()
+
+	client := restapi.NewCtlClient(socketPath, &restapi.ClientOptions{Timeout: timeout})
+	var err error
+	switch args[0] {
+	case "status":
+		err = runStatus(ctx, client)
+	case "pods":
+		err = runPods(ctx, client)
+	case "leases":
+		err = runLeases(ctx, client)
+	case "routes":
+		if len(args) < 2 {
+			err = fmt.Errorf("routes requires a pod name")
+			break
+		}
+		err = runRoutes(ctx, client, args[1])
+	case "gc":
+		err = runGC(ctx, client)
+	case "restore":
+		err = client.Restore(ctx)
+		if err == nil {
+			fmt.Println("bridge network restored from snapshot")
+		}
+	default:
+		err = fmt.Errorf("unknown command %q", args[0])
+	}
+
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %s\n", err)
+		if restapi.IsUnreachable(err) {
+			fmt.Fprintf(os.Stderr, "is tsunami daemon running on this node?\n")
+		}
+		os.Exit(1)
+	}
+}
+
+func printLink(title string, link restapi.LinkStatus) {
+	fmt.Printf("%s:\t%s\n", title, link.Name)
+	if link.Error != "" {
+		fmt.Printf("  error:\t%s\n", link.Error)
+		return
+	}
+	fmt.Printf("  index:\t%d\n", link.Index)
+	fmt.Printf("  state:\t%s\n", link.State)
+	fmt.Printf("  mtu:\t%d\n", link.MTU)
+	if link.Master != "" {
+		fmt.Printf("  master:\t%s\n", link.Master)
+	}
+	fmt.Printf("  addrs:\t%s\n", strings.Join(link.Addrs, ", "))
+}
+
+func runStatus(ctx context.Context, client *restapi.CtlClient) error {
+	status, err := client.Status(ctx)
+	if err != nil {
+		return err
+	}
+
+	printLink("bridge", status.Bridge)
+	printLink("uplink", status.Uplink)
+	fmt.Println("routes:")
+	for _, route := range status.Routes {
+		fmt.Printf("  %s\n", route)
+	}
+	fmt.Println("dhcp:")
+	if status.DHCP.Builtin {
+		fmt.Println("  daemon:\tbuiltin")
+	} else if status.DHCP.Pid > 0 {
+		fmt.Printf("  pid:\t%d (running: %t)\n", status.DHCP.Pid, status.DHCP.Running)
+	} else {
+		fmt.Println("  pid:\tnot started by daemon")
+	}
+	fmt.Printf("  socket:\t%s (exists: %t)\n", status.DHCP.Socket, status.DHCP.SocketExists)
+	if status.Snapshot != "" {
+		fmt.Printf("snapshot:\t%s\n", status.Snapshot)
+	} else {
+		fmt.Println("snapshot:\tnone")
+	}
+
+	return nil
+}
+
+func printPods(pods []restapi.PodInfo) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "NAMESPACE\tNAME\tIFACE\tADDRESS\tGATEWAY\tMAC\tSOURCE\tCONTAINER\tSTALE")
+	for _, pod := range pods {
+		containerID := pod.ContainerID
+		if len(containerID) > 12 {
+			containerID = containerID[:12]
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%t\n",
+			pod.PodNamespace, pod.PodName, pod.IfName, pod.IPAddress, pod.Gateway,
+			pod.MAC, pod.Source, containerID, pod.Stale)
+	}
+	w.Flush()
+}
+
+func runPods(ctx context.Context, client *restapi.CtlClient) error {
+	pods, err := client.Pods(ctx)
+	if err != nil {
+		return err
+	}
+
+	printPods(pods)
+	return nil
+}
+
+// formatTime 以本地时间输出, 零值表示永不
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return "never"
+	}
+	return t.Local().Format("2006-01-02 15:04:05")
+}
+
+func printLeases(leases []restapi.LeaseStatus) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "NAMESPACE\tNAME\tIFACE\tADDRESS\tMAC\tSERVER\tSTATE\tRENEW\tEXPIRES")
+	for _, l := range leases {
+		renew, expires := formatTime(l.RenewAt), formatTime(l.ExpiresAt)
+		if l.State == restapi.LeaseUnknown {
+			renew, expires = "-", "-"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
+			l.PodNamespace, l.PodName, l.IfName, l.IPAddress, l.MAC, l.Server, l.State, renew, expires)
+	}
+	w.Flush()
+}
+
+func runLeases(ctx context.Context, client *restapi.CtlClient) error {
+	leases, err := client.Leases(ctx)
+	if err != nil {
+		return err
+	}
+
+	printLeases(leases)
+	return nil
+}
+
+func runRoutes(ctx context.Context, client *restapi.CtlClient, pod string) error {
+	// 同时支持 `routes ns/name` 与 `routes -n ns name` 两种写法
+	ns, name := namespace, pod
+	if parts := strings.SplitN(pod, "/", 2); len(parts) == 2 {
+		ns, name = parts[0], parts[1]
+	}
+
+	resp, err := client.Routes(ctx, ns, name)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("pod %s, netns %s\n", resp.Pod, resp.NetNs)
+	for _, route := range resp.Routes {
+		fmt.Println(route)
+	}
+	return nil
+}
+
+func runGC(ctx context.Context, client *restapi.CtlClient) error {
+	resp, err := client.GC(ctx, dryRun)
+	if err != nil {
+		return err
+	}
+
+	if len(resp.Removed) == 0 {
+		fmt.Println("nothing to collect")
+		return nil
+	}
+	if resp.DryRun {
+		fmt.Println("would remove:")
+	} else {
+		fmt.Println("removed:")
+	}
+	printPods(resp.Removed)
+	return nil
+}
@@ -3,24 +3,26 @@ package bridge
 import (
 	"k8s.io/klog"
 
+	"github.com/gitlayzer/tsunami/pkg/nlwrap"
 	"github.com/vishvananda/netlink"
 )
 
 // GetBridgeDevice 获取目标网桥设备, 如果不存在则创建然后返回
-func GetBridgeDevice(name string) (link netlink.Link, err error) {
+// opts 不为 nil 时, 无论网桥是否已经存在, 都会将参数设置到网桥上
+func GetBridgeDevice(name string, opts *Options) (link netlink.Link, err error) {
 	// 获取网桥设备, 如果不存在则创建
-	link, err = netlink.LinkByName(name)
+	link, err = nl.LinkByName(name)
 	if err == nil {
-		return
+		return link, opts.Apply(link)
 	}
 
-	// 如果有错误信息, 则判断是否是 Link not found, 不是则报错
-	if err.Error() != "Link not found" {
+	// 如果有错误信息, 则判断是否是网卡不存在, 不是则报错
+	if !nlwrap.IsLinkNotFound(err) {
 		klog.Errorf("failed to get bridge device %s: %s.", name, err)
 		return
 	}
 
-	// 如果是 Link not found, 则创建网桥设备
+	// 如果是网卡不存在, 则创建网桥设备
 	klog.Warningf("bridge: %s doesn`t exist, try to create it manually.", name)
 
 	// 创建网桥设备
@@ -30,25 +32,26 @@ func GetBridgeDevice(name string) (link netlink.Link, err error) {
 		},
 	}
 
-	// 添加网桥设备
-	if err = netlink.LinkAdd(bridge); err != nil {
-		klog.Warningf("failed to create bridge device %s: %s.", name, err)
+	// 添加网桥设备, 已存在说明在此期间被其他进程创建了, 可以继续使用
+	if err = nl.LinkAdd(bridge); err != nil && !nlwrap.IsExist(err) {
+		klog.Errorf("failed to create bridge device %s: %s.", name, err)
+		return nil, err
 	}
 
 	// 启动网桥设备
-	if err = netlink.LinkSetUp(bridge); err != nil {
+	if err = nl.LinkSetUp(bridge); err != nil {
 		klog.Warningf("failed to set up bridge device %s: %s.", name, err)
 		return
 	}
 
 	// 再次尝试获取网桥设备
-	link, err = netlink.LinkByName(name)
-	if err == nil {
+	link, err = nl.LinkByName(name)
+	if err != nil {
 		klog.Warningf("failed to get bridge device %s: %s.", name, err)
 		return
 	}
 
-	return
+	return link, opts.Apply(link)
 }
 
 // MigrateIPAddrs 在桥接网络中, 需要 bridge 网桥设备接管物理网卡的 IP 地址, 而物理网卡则作为网线连接到外部网络
@@ -61,7 +64,7 @@ func MigrateIPAddrs(src, dst netlink.Link) (err error) {
 	dstName := dst.Attrs().Name
 
 	// 获取指定设备上的相关路由, 这里是获取物理网卡的路由
-	addrs, err := netlink.AddrList(src, netlink.FAMILY_V4)
+	addrs, err := nl.AddrList(src, netlink.FAMILY_V4)
 	if err != nil {
 		klog.Errorf("failed to get addresses of %s: %s.", srcName, err)
 		return
@@ -71,7 +74,7 @@ func MigrateIPAddrs(src, dst netlink.Link) (err error) {
 	klog.V(3).Infof("get addresses of device %s, len: %d: %+v", srcName, len(addrs), addrs)
 
 	// 从 src 迁移 IP 时, 相关的路由就会同时被删除, 所以这里需要先获取, 之后要由 dst 设备接管 src 设备上的所有路由
-	routes, err := netlink.RouteList(src, netlink.FAMILY_V4)
+	routes, err := nl.RouteList(src, netlink.FAMILY_V4)
 	if err != nil {
 		klog.Errorf("failed to get routes of %s: %s.", srcName, err)
 		return
@@ -83,7 +86,7 @@ func MigrateIPAddrs(src, dst netlink.Link) (err error) {
 	// 迁移 IP 地址
 	for _, addr := range addrs {
 		// 从一个接口上移除 IP 地址, 对应的路由也会被移除
-		if err = netlink.AddrDel(src, &addr); err != nil {
+		if err = nl.AddrDel(src, &addr); err != nil {
 			klog.Errorf("failed to delete address on %s: %s.", srcName, err)
 			continue
 		}
@@ -93,7 +96,7 @@ func MigrateIPAddrs(src, dst netlink.Link) (err error) {
 		addr.Label = dstName
 
 		// 添加 IP 地址到另一个接口上
-		if err = netlink.AddrAdd(dst, &addr); err != nil {
+		if err = nl.AddrAdd(dst, &addr); err != nil {
 			klog.Errorf("failed to add address to %s: %s.", dstName, err)
 			return
 		}
@@ -115,9 +118,9 @@ func ModifyRoutes(routes []netlink.Route, devIndex int) (err error) {
 	for i := 0; i < rlength; i++ {
 		// 逆向遍历
 		route := routes[rlength-i-1]
-		if err = netlink.RouteDel(&route); err != nil {
+		if err = nl.RouteDel(&route); err != nil {
 			// 有可能在移除物理网卡的 IP 时, 对应的路由就自动被移除了, 所以这里出错的话不 return
-			if err.Error() != "no such process" {
+			if !nlwrap.IsNotExist(err) {
 				klog.Errorf("failed to delete route %+v: %s.", route, err)
 				return
 			}
@@ -126,8 +129,8 @@ func ModifyRoutes(routes []netlink.Route, devIndex int) (err error) {
 		// 变更路由主要是将路由条目的 dev 字段修改为网桥设备的索引
 		route.LinkIndex = devIndex
 		// 添加路由
-		if err = netlink.RouteAdd(&route); err != nil {
-			if err.Error() != "file exists" {
+		if err = nl.RouteAdd(&route); err != nil {
+			if !nlwrap.IsExist(err) {
 				klog.Errorf("failed to add route %+v: %s.", route, err)
 				return
 			}
@@ -138,14 +141,14 @@ func ModifyRoutes(routes []netlink.Route, devIndex int) (err error) {
 }
 
 // GetBridgeAndEth0 获取网桥设备和物理网卡设备, 如果不存在则创建
-func GetBridgeAndEth0(bridgeName, eth0Name string) (bridge netlink.Link, eth0 netlink.Link, err error) {
+func GetBridgeAndEth0(bridgeName, eth0Name string, opts *Options) (bridge netlink.Link, eth0 netlink.Link, err error) {
 	// 获取网桥设备
-	bridge, err = GetBridgeDevice(bridgeName)
+	bridge, err = GetBridgeDevice(bridgeName, opts)
 	if err != nil {
 		return
 	}
 
-	eth0, err = netlink.LinkByName(eth0Name)
+	eth0, err = nl.LinkByName(eth0Name)
 	if err != nil {
 		klog.Warningf("failed to get target device %s: %s", eth0Name, err)
 		return
@@ -157,15 +160,15 @@ func GetBridgeAndEth0(bridgeName, eth0Name string) (bridge netlink.Link, eth0 ne
 // InstallBridgeNetwork 部署桥接网络
 // 手动创建 mybr0 接口, 然后将宿主机的主网卡 eth0 接入
 // 因为如果不完成接入, invoke 调用 bridge + dhcp 插件时请求会失败
-func InstallBridgeNetwork(bridgeName, eth0Name string) (err error) {
+func InstallBridgeNetwork(bridgeName, eth0Name string, opts *Options) (err error) {
 	// 调用 GetBridgeAntEth0() 函数获取网桥设备和物理网卡设备
-	linkBridge, linkEth0, err := GetBridgeAndEth0(bridgeName, eth0Name)
+	linkBridge, linkEth0, err := GetBridgeAndEth0(bridgeName, eth0Name, opts)
 	if err != nil {
 		return
 	}
 
 	// 将 eth0 接入网桥设备
-	if err = netlink.LinkSetMaster(linkEth0, linkBridge); err != nil {
+	if err = nl.LinkSetMaster(linkEth0, linkBridge); err != nil {
 		klog.Errorf("failed to set %s master to %s: %s", eth0Name, bridgeName, err)
 		return err
 	}
@@ -185,13 +188,13 @@ func InstallBridgeNetwork(bridgeName, eth0Name string) (err error) {
 // 最终移除 mybr0 网桥设备
 func UninstallBridgeNetwork(bridgeName, eth0Name string) (err error) {
 	// 调用 GetBridgeAntEth0() 函数获取网桥设备和物理网卡设备
-	linkBridge, linkEth0, err := GetBridgeAndEth0(bridgeName, eth0Name)
+	linkBridge, linkEth0, err := GetBridgeAndEth0(bridgeName, eth0Name, nil)
 	if err != nil {
 		return
 	}
 
 	// 将 eth0 从网桥设备中拔出
-	if err = netlink.LinkSetNoMaster(linkEth0); err != nil {
+	if err = nl.LinkSetNoMaster(linkEth0); err != nil {
 		klog.Errorf("failed to set no master for %s: %s", eth0Name, err)
 		return
 	}
@@ -204,7 +207,7 @@ func UninstallBridgeNetwork(bridgeName, eth0Name string) (err error) {
 	}
 
 	// 移除网桥设备
-	if err = netlink.LinkDel(linkBridge); err != nil {
+	if err = nl.LinkDel(linkBridge); err != nil {
 		klog.Errorf("failed to remove bridge device %s: %s", bridgeName, err)
 		return
 	}
@@ -0,0 +1,262 @@
+package bridge
+
+import (
+	"net"
+	"sort"
+	"testing"
+
+	"github.com/gitlayzer/tsunami/pkg/nlwrap/nlfake"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// newHost 创建一个带有物理网卡 eth0 的宿主机, 地址与路由与 dhcp 获取到的一致
+func newHost(t *testing.T) *nlfake.Handle {
+	t.Helper()
+	h := nlfake.New()
+	t.Cleanup(SetNetlinkHandle(h))
+
+	eth0 := &netlink.Device{LinkAttrs: netlink.LinkAttrs{Name: "eth0"}}
+	if err := h.LinkAdd(eth0); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.LinkSetUp(eth0); err != nil {
+		t.Fatal(err)
+	}
+	addr, _ := netlink.ParseAddr("192.168.1.10/24")
+	if err := h.AddrAdd(eth0, addr); err != nil {
+		t.Fatal(err)
+	}
+	_, static, _ := net.ParseCIDR("10.10.0.0/16")
+	routes := []*netlink.Route{
+		{LinkIndex: eth0.Index, Gw: net.ParseIP("192.168.1.1"), Protocol: unix.RTPROT_DHCP, Src: addr.IP, Priority: 100},
+		{LinkIndex: eth0.Index, Dst: static, Gw: net.ParseIP("192.168.1.254")},
+	}
+	for _, r := range routes {
+		if err := h.RouteAdd(r); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return h
+}
+
+// state 网卡上的地址与 main 表路由, 路由中不包含网卡索引, 便于比较不同网卡上的配置
+type state struct {
+	addrs  []string
+	routes []string
+}
+
+func linkState(t *testing.T, h *nlfake.Handle, name string) state {
+	t.Helper()
+	link, err := h.LinkByName(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var s state
+	addrs, _ := h.AddrList(link, netlink.FAMILY_V4)
+	for _, a := range addrs {
+		s.addrs = append(s.addrs, a.IPNet.String())
+	}
+	routes, _ := h.RouteList(link, netlink.FAMILY_V4)
+	for _, r := range routes {
+		s.routes = append(s.routes, (&netlink.Route{
+			Dst: r.Dst, Gw: r.Gw, Src: r.Src, Scope: r.Scope, Protocol: r.Protocol, Priority: r.Priority,
+		}).String())
+	}
+	sort.Strings(s.routes)
+	return s
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestInstallUninstallBridgeNetwork(t *testing.T) {
+	h := newHost(t)
+	before := linkState(t, h, "eth0")
+
+	if err := InstallBridgeNetwork("br0", "eth0", nil); err != nil {
+		t.Fatalf("install: %v", err)
+	}
+
+	br, err := h.LinkByName("br0")
+	if err != nil {
+		t.Fatalf("bridge should be created: %v", err)
+	}
+	eth0, _ := h.LinkByName("eth0")
+	if eth0.Attrs().MasterIndex != br.Attrs().Index {
+		t.Errorf("eth0 should be attached to br0")
+	}
+	if br.Attrs().Flags&net.FlagUp == 0 {
+		t.Errorf("br0 should be up")
+	}
+
+	installed := linkState(t, h, "br0")
+	if !equalStrings(installed.addrs, before.addrs) || !equalStrings(installed.routes, before.routes) {
+		t.Errorf("br0 should take over eth0's config\nwant: %+v\ngot:  %+v", before, installed)
+	}
+	if left := linkState(t, h, "eth0"); len(left.addrs) != 0 || len(left.routes) != 0 {
+		t.Errorf("eth0 should have no addresses or routes left: %+v", left)
+	}
+
+	if err = UninstallBridgeNetwork("br0", "eth0"); err != nil {
+		t.Fatalf("uninstall: %v", err)
+	}
+	if _, err = h.LinkByName("br0"); err == nil {
+		t.Errorf("br0 should be removed")
+	}
+	after := linkState(t, h, "eth0")
+	if !equalStrings(after.addrs, before.addrs) || !equalStrings(after.routes, before.routes) {
+		t.Errorf("eth0 should be restored\nwant: %+v\ngot:  %+v", before, after)
+	}
+}
+
+func TestInstallBridgeNetworkTwice(t *testing.T) {
+	h := newHost(t)
+	before := linkState(t, h, "eth0")
+
+	for i := 0; i < 2; i++ {
+		if err := InstallBridgeNetwork("br0", "eth0", nil); err != nil {
+			t.Fatalf("install #%d: %v", i+1, err)
+		}
+	}
+	if got := linkState(t, h, "br0"); !equalStrings(got.routes, before.routes) {
+		t.Errorf("second install should keep routes\nwant: %v\ngot:  %v", before.routes, got.routes)
+	}
+}
+
+func TestModifyRoutesAddsDefaultRouteLast(t *testing.T) {
+	h := newHost(t)
+	br := &netlink.Bridge{LinkAttrs: netlink.LinkAttrs{Name: "br0"}}
+	if err := h.LinkAdd(br); err != nil {
+		t.Fatal(err)
+	}
+	eth0, _ := h.LinkByName("eth0")
+
+	addrs, _ := h.AddrList(eth0, netlink.FAMILY_V4)
+	routes, _ := h.RouteList(eth0, netlink.FAMILY_V4)
+	if err := h.AddrDel(eth0, &addrs[0]); err != nil {
+		t.Fatal(err)
+	}
+	addrs[0].Label = "br0"
+	if err := h.AddrAdd(br, &addrs[0]); err != nil {
+		t.Fatal(err)
+	}
+
+	// 网关只有在直连路由添加之后才可达, 正向遍历时默认路由会添加失败
+	if err := ModifyRoutes(routes, br.Index); err != nil {
+		t.Fatalf("modify routes: %v", err)
+	}
+	if got := linkState(t, h, "br0"); len(got.routes) != 3 {
+		t.Errorf("got routes %v, want 3", got.routes)
+	}
+}
+
+func TestGetBridgeDevice(t *testing.T) {
+	h := newHost(t)
+
+	on, ageing := true, uint32(30)
+	opts := &Options{PromiscMode: &on, MulticastSnooping: &on, AgeingTime: &ageing}
+	link, err := GetBridgeDevice("br0", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 返回的是设置参数之前获取的网卡, 需要重新获取
+	if link, err = h.LinkByName("br0"); err != nil {
+		t.Fatal(err)
+	}
+	br, ok := link.(*netlink.Bridge)
+	if !ok {
+		t.Fatalf("got %T, want *netlink.Bridge", link)
+	}
+	if br.Promisc != 1 {
+		t.Errorf("promisc mode should be on")
+	}
+	if br.AgeingTime == nil || *br.AgeingTime != 30*userHZ {
+		t.Errorf("ageing time should be set in centiseconds: %v", br.AgeingTime)
+	}
+
+	again, err := GetBridgeDevice("br0", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again.Attrs().Index != link.Attrs().Index {
+		t.Errorf("existing bridge should be reused")
+	}
+	if links, _ := h.LinkList(); len(links) != 3 {
+		t.Errorf("got %d links, want lo, eth0 and br0", len(links))
+	}
+}
+
+func TestConfigurePort(t *testing.T) {
+	h := newHost(t)
+	br, err := GetBridgeDevice("br0", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	veth := &netlink.Veth{LinkAttrs: netlink.LinkAttrs{Name: "veth0"}, PeerName: "eth0"}
+	if err = h.LinkAdd(veth); err != nil {
+		t.Fatal(err)
+	}
+	if err = h.LinkSetMaster(veth, br); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = ConfigurePort(veth, true); err != nil {
+		t.Fatal(err)
+	}
+	if !h.Hairpin("veth0") {
+		t.Errorf("hairpin should be on")
+	}
+	if err = ConfigurePort(veth, false); err != nil {
+		t.Fatal(err)
+	}
+	if h.Hairpin("veth0") {
+		t.Errorf("hairpin should be off")
+	}
+}
+
+func TestRestoreFromSnapshot(t *testing.T) {
+	h := newHost(t)
+	before := linkState(t, h, "eth0")
+
+	snap, err := TakeSnapshot("br0", "eth0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(snap.Addrs) != 1 || len(snap.Routes) != 3 {
+		t.Fatalf("unexpected snapshot: %+v", snap)
+	}
+	if err = InstallBridgeNetwork("br0", "eth0", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = RestoreFromSnapshot(snap); err != nil {
+		t.Fatalf("restore: %v", err)
+	}
+	if _, err = h.LinkByName("br0"); err == nil {
+		t.Errorf("br0 should be removed")
+	}
+	eth0, _ := h.LinkByName("eth0")
+	if eth0.Attrs().MasterIndex != 0 {
+		t.Errorf("eth0 should be detached")
+	}
+	after := linkState(t, h, "eth0")
+	if !equalStrings(after.addrs, before.addrs) || !equalStrings(after.routes, before.routes) {
+		t.Errorf("eth0 should be restored\nwant: %+v\ngot:  %+v", before, after)
+	}
+
+	// 网桥已经不存在时可以再次恢复
+	if err = RestoreFromSnapshot(snap); err != nil {
+		t.Errorf("restore without bridge: %v", err)
+	}
+}
@@ -0,0 +1,15 @@
+package bridge
+
+import (
+	"github.com/gitlayzer/tsunami/pkg/nlwrap"
+)
+
+// nl 本包所有 netlink 操作使用的句柄
+var nl = nlwrap.NewHandle()
+
+// SetNetlinkHandle 替换本包使用的 netlink 句柄, 返回恢复原句柄的函数, 用于单元测试
+func SetNetlinkHandle(h nlwrap.Handle) (restore func()) {
+	old := nl
+	nl = h
+	return func() { nl = old }
+}
@@ -0,0 +1,103 @@
+package bridge
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/vishvananda/netlink"
+	"k8s.io/klog"
+)
+
+// Options 网桥设备的参数, 为 nil 的字段保持内核中的当前值
+// 每次 daemon 启动时都会重新设置, 与网桥是否由 daemon 创建无关
+type Options struct {
+	// PromiscMode 网桥设备的混杂模式, 部分环境中 hairpin 流量需要网桥处于混杂模式才能送达
+	PromiscMode *bool
+	// MulticastSnooping 网桥的组播侦听, 关闭后组播报文会发往网桥的所有端口
+	MulticastSnooping *bool
+	// STP 网桥的生成树协议, 网桥下只有一个物理网卡时一般不需要开启
+	STP *bool
+	// AgeingTime MAC 地址表项的老化时间(秒), Pod 迁移后上游交换机与网桥都需要及时更新表项
+	AgeingTime *uint32
+}
+
+// userHZ 内核与用户态之间交换时间参数使用的单位, 网桥的老化时间以 1/100 秒为单位
+const userHZ = 100
+
+// Apply 将参数设置到网桥设备上, 可以重复调用
+func (o *Options) Apply(link netlink.Link) (err error) {
+	if o == nil {
+		return nil
+	}
+	name := link.Attrs().Name
+
+	if o.PromiscMode != nil {
+		if *o.PromiscMode {
+			err = nl.SetPromiscOn(link)
+		} else {
+			err = nl.SetPromiscOff(link)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to set promisc mode of %s: %v", name, err)
+		}
+	}
+
+	if o.MulticastSnooping != nil || o.AgeingTime != nil {
+		// 使用 NewLinkAttrs 的默认值, 零值的 TxQLen 会把网桥的发送队列长度改为 0
+		la := netlink.NewLinkAttrs()
+		la.Name, la.Index = name, link.Attrs().Index
+		attrs := &netlink.Bridge{LinkAttrs: la, MulticastSnooping: o.MulticastSnooping}
+		if o.AgeingTime != nil {
+			ageing := *o.AgeingTime * userHZ
+			attrs.AgeingTime = &ageing
+		}
+		if err = nl.LinkModify(attrs); err != nil {
+			return fmt.Errorf("failed to set bridge attributes of %s: %v", name, err)
+		}
+	}
+
+	// 当前依赖的 netlink 库不支持 IFLA_BR_STP_STATE, 通过 sysfs 设置
+	if o.STP != nil {
+		state := "0"
+		if *o.STP {
+			state = "1"
+		}
+		path := filepath.Join("/sys/class/net", name, "bridge", "stp_state")
+		if err = os.WriteFile(path, []byte(state), 0644); err != nil {
+			return fmt.Errorf("failed to set stp state of %s: %v", name, err)
+		}
+	}
+
+	klog.V(3).Infof("apply options to bridge %s: %s", name, o)
+
+	return nil
+}
+
+// String 返回参数的可读形式, 用于日志
+func (o *Options) String() string {
+	format := func(v interface{}) string {
+		switch p := v.(type) {
+		case *bool:
+			if p != nil {
+				return fmt.Sprintf("%t", *p)
+			}
+		case *uint32:
+			if p != nil {
+				return fmt.Sprintf("%d", *p)
+			}
+		}
+		return "unchanged"
+	}
+	return fmt.Sprintf("promisc: %s, multicast snooping: %s, stp: %s, ageing time: %s",
+		format(o.PromiscMode), format(o.MulticastSnooping), format(o.STP), format(o.AgeingTime))
+}
+
+// ConfigurePort 设置网桥端口(Pod 在宿主机一侧的 veth)的参数, 可以重复调用
+// hairpin 开启后, 从端口进入的帧可以再从该端口发出, Pod 通过 service 访问到自己时需要它
+func ConfigurePort(port netlink.Link, hairpin bool) (err error) {
+	if err = nl.LinkSetHairpin(port, hairpin); err != nil {
+		return fmt.Errorf("failed to set hairpin mode of %s: %v", port.Attrs().Name, err)
+	}
+	return nil
+}
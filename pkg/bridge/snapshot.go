@@ -0,0 +1,189 @@
+package bridge
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"time"
+
+	"github.com/gitlayzer/tsunami/pkg/nlwrap"
+	"github.com/vishvananda/netlink"
+	"k8s.io/klog"
+
+	"github.com/gitlayzer/tsunami/utils/utilfile"
+)
+
+// RouteSnapshot 路由条目的快照, 只保留恢复时需要的字段
+type RouteSnapshot struct {
+	// Dst 为空表示默认路由
+	Dst      string `json:"dst,omitempty"`
+	Gw       string `json:"gw,omitempty"`
+	Src      string `json:"src,omitempty"`
+	Scope    uint8  `json:"scope"`
+	Protocol int    `json:"protocol"`
+	Priority int    `json:"priority"`
+	Table    int    `json:"table"`
+}
+
+// Snapshot 部署桥接网络之前物理网卡的网络配置快照
+// 在 daemon 异常退出, 没有执行 UninstallBridgeNetwork 时, 可以通过快照恢复物理网卡
+type Snapshot struct {
+	Bridge    string          `json:"bridge"`
+	Uplink    string          `json:"uplink"`
+	Addrs     []string        `json:"addrs"`
+	Routes    []RouteSnapshot `json:"routes"`
+	CreatedAt time.Time       `json:"created_at"`
+}
+
+// TakeSnapshot 记录物理网卡当前的 IP 地址与路由, 需要在 InstallBridgeNetwork 之前调用
+func TakeSnapshot(bridgeName, eth0Name string) (snap *Snapshot, err error) {
+	linkEth0, err := nl.LinkByName(eth0Name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get target device %s: %s", eth0Name, err)
+	}
+
+	addrs, err := nl.AddrList(linkEth0, netlink.FAMILY_V4)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get addresses of %s: %s", eth0Name, err)
+	}
+
+	routes, err := nl.RouteList(linkEth0, netlink.FAMILY_V4)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get routes of %s: %s", eth0Name, err)
+	}
+
+	snap = &Snapshot{
+		Bridge:    bridgeName,
+		Uplink:    eth0Name,
+		CreatedAt: time.Now(),
+	}
+	for _, addr := range addrs {
+		snap.Addrs = append(snap.Addrs, addr.IPNet.String())
+	}
+	for _, route := range routes {
+		rs := RouteSnapshot{
+			Scope:    uint8(route.Scope),
+			Protocol: int(route.Protocol),
+			Priority: route.Priority,
+			Table:    route.Table,
+		}
+		if route.Dst != nil {
+			rs.Dst = route.Dst.String()
+		}
+		if route.Gw != nil {
+			rs.Gw = route.Gw.String()
+		}
+		if route.Src != nil {
+			rs.Src = route.Src.String()
+		}
+		snap.Routes = append(snap.Routes, rs)
+	}
+
+	return
+}
+
+// SaveSnapshot 将快照写入文件
+func SaveSnapshot(path string, snap *Snapshot) (err error) {
+	content, err := json.Marshal(snap)
+	if err != nil {
+		return fmt.Errorf("failed to marshal snapshot: %v", err)
+	}
+
+	if err = utilfile.WriteFileAtomic(path, content, 0644); err != nil {
+		return fmt.Errorf("failed to write snapshot: %v", err)
+	}
+
+	return
+}
+
+// LoadSnapshot 从文件中读取快照
+func LoadSnapshot(path string) (snap *Snapshot, err error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read snapshot: %v", err)
+	}
+
+	snap = &Snapshot{}
+	if err = json.Unmarshal(content, snap); err != nil {
+		return nil, fmt.Errorf("failed to parse snapshot: %v", err)
+	}
+
+	return
+}
+
+// RestoreFromSnapshot 根据快照卸载桥接网络
+// 与 UninstallBridgeNetwork 不同, 这里不依赖网桥上当前的配置, 而是将快照中的地址与路由写回物理网卡
+func RestoreFromSnapshot(snap *Snapshot) (err error) {
+	linkEth0, err := nl.LinkByName(snap.Uplink)
+	if err != nil {
+		return fmt.Errorf("failed to get target device %s: %s", snap.Uplink, err)
+	}
+
+	// 网桥可能已经不存在了, 此时只需要恢复物理网卡
+	linkBridge, err := nl.LinkByName(snap.Bridge)
+	if err != nil {
+		klog.Warningf("failed to get bridge device %s: %s, skip it.", snap.Bridge, err)
+		linkBridge = nil
+	}
+
+	if linkEth0.Attrs().MasterIndex != 0 {
+		if err = nl.LinkSetNoMaster(linkEth0); err != nil {
+			return fmt.Errorf("failed to set no master for %s: %s", snap.Uplink, err)
+		}
+	}
+
+	for _, a := range snap.Addrs {
+		addr, err := netlink.ParseAddr(a)
+		if err != nil {
+			return fmt.Errorf("failed to parse address %s: %s", a, err)
+		}
+
+		// 先从网桥上移除, 否则物理网卡上添加同一地址后会出现两条冲突的直连路由
+		if linkBridge != nil {
+			if err = nl.AddrDel(linkBridge, addr); err != nil {
+				klog.V(3).Infof("failed to delete address %s on %s: %s.", a, snap.Bridge, err)
+			}
+		}
+
+		addr.Label = snap.Uplink
+		if err = nl.AddrAdd(linkEth0, addr); err != nil {
+			if !nlwrap.IsExist(err) {
+				return fmt.Errorf("failed to add address %s to %s: %s", a, snap.Uplink, err)
+			}
+		}
+	}
+
+	// 与 ModifyRoutes 一样逆向遍历, 保证默认路由最后添加
+	for i := len(snap.Routes) - 1; i >= 0; i-- {
+		rs := snap.Routes[i]
+		route := netlink.Route{
+			LinkIndex: linkEth0.Attrs().Index,
+			Scope:     netlink.Scope(rs.Scope),
+			Protocol:  netlink.RouteProtocol(rs.Protocol),
+			Priority:  rs.Priority,
+			Table:     rs.Table,
+			Gw:        net.ParseIP(rs.Gw),
+			Src:       net.ParseIP(rs.Src),
+		}
+		if rs.Dst != "" {
+			if _, route.Dst, err = net.ParseCIDR(rs.Dst); err != nil {
+				return fmt.Errorf("failed to parse route dst %s: %s", rs.Dst, err)
+			}
+		}
+
+		if err = nl.RouteAdd(&route); err != nil {
+			if !nlwrap.IsExist(err) {
+				return fmt.Errorf("failed to add route %+v: %s", route, err)
+			}
+		}
+	}
+
+	if linkBridge != nil {
+		if err = nl.LinkDel(linkBridge); err != nil {
+			return fmt.Errorf("failed to remove bridge device %s: %s", snap.Bridge, err)
+		}
+	}
+
+	return nil
+}
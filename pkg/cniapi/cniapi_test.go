@@ -0,0 +1,172 @@
+package cniapi
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestNegotiate(t *testing.T) {
+	tests := []struct {
+		peer    string
+		want    APIVersion
+		wantErr bool
+	}{
+		{peer: "", want: Legacy},
+		{peer: "1.0", want: Legacy},
+		{peer: "1.1", want: APIVersion{Major: 1, Minor: 1}},
+		{peer: "1.2", want: Version},
+		// 更新的 minor 版本按照自己的版本交互
+		{peer: "1.7", want: Version},
+		{peer: "2.0", wantErr: true},
+		{peer: "1", wantErr: true},
+		{peer: "a.b", wantErr: true},
+	}
+	for _, tt := range tests {
+		peer, err := ParseVersion(tt.peer)
+		if err == nil {
+			peer, err = Version.Negotiate(peer)
+		}
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("%q: expected error, got %s", tt.peer, peer)
+			}
+			continue
+		}
+		if err != nil || peer != tt.want {
+			t.Errorf("%q: got %s %v, want %s", tt.peer, peer, err, tt.want)
+		}
+	}
+	if Legacy.SupportsCheck() || !Version.SupportsCheck() {
+		t.Errorf("only 1.1 and later support check")
+	}
+	if (APIVersion{Major: 1, Minor: 1}).SupportsFallback() || !Version.SupportsFallback() {
+		t.Errorf("only 1.2 and later support fallback")
+	}
+}
+
+func TestNegotiateRequest(t *testing.T) {
+	r := httptest.NewRequest(http.MethodPost, PathAdd, nil)
+	r.Header.Set(VersionHeader, "2.0")
+	w := httptest.NewRecorder()
+	if _, ok := NegotiateRequest(w, r); ok {
+		t.Fatalf("major version 2 should be rejected")
+	}
+	resp := &ErrorResponse{}
+	if err := json.NewDecoder(w.Body).Decode(resp); err != nil {
+		t.Fatal(err)
+	}
+	if w.Code != http.StatusBadRequest || resp.Code != CodeIncompatibleVersion || w.Header().Get(VersionHeader) != Version.String() {
+		t.Errorf("unexpected response: %d %+v %v", w.Code, resp, w.Header())
+	}
+
+	r.Header.Del(VersionHeader)
+	w = httptest.NewRecorder()
+	if v, ok := NegotiateRequest(w, r); !ok || v != Legacy {
+		t.Errorf("request without version should use 1.0, got %s", v)
+	}
+}
+
+func TestPodResponseIPs(t *testing.T) {
+	resp := &PodResponse{}
+	resp.SetIPs([]IPConfig{
+		{Address: "fd00::10/64", Gateway: "fd00::1"},
+		{Address: "10.0.0.10/24", Gateway: "10.0.0.1"},
+	})
+	if resp.IPAddress != "10.0.0.10/24" || resp.Gateway != "10.0.0.1" {
+		t.Errorf("legacy fields should use the first IPv4 address: %+v", resp)
+	}
+
+	// 1.0 版本的 server 只返回 address 与 gateway
+	legacy := &PodResponse{}
+	if err := json.Unmarshal([]byte(`{"address":"10.0.0.10/24","gateway":"10.0.0.1"}`), legacy); err != nil {
+		t.Fatal(err)
+	}
+	ips := legacy.GetIPs()
+	if len(ips) != 1 || ips[0].Address != "10.0.0.10/24" || ips[0].Version() != "4" {
+		t.Errorf("unexpected ips: %+v", ips)
+	}
+	if (&PodResponse{DoNothing: true}).GetIPs() != nil {
+		t.Errorf("do nothing response should have no ips")
+	}
+}
+
+func TestIPConfigParse(t *testing.T) {
+	addr, gw, err := (&IPConfig{Address: "fd00::10/64", Gateway: "fd00::1"}).Parse()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if addr.String() != "fd00::10/64" || gw.String() != "fd00::1" {
+		t.Errorf("unexpected result: %s %s", addr, gw)
+	}
+
+	for _, c := range []IPConfig{
+		{Address: "10.0.0.10"},
+		{Address: "10.0.0.10/24", Gateway: "gw"},
+		{Address: "10.0.0.10/24", Gateway: "fd00::1"},
+	} {
+		if _, _, err := c.Parse(); err == nil {
+			t.Errorf("%+v should be invalid", c)
+		}
+	}
+}
+
+// jsonFields 返回结构体的 json 字段名
+func jsonFields(v interface{}) (fields []string) {
+	typ := reflect.TypeOf(v)
+	for i := 0; i < typ.NumField(); i++ {
+		name := strings.Split(typ.Field(i).Tag.Get("json"), ",")[0]
+		fields = append(fields, name)
+	}
+	sort.Strings(fields)
+	return fields
+}
+
+// TestOpenAPI 确认 OpenAPI 文档中的 schema 与结构体保持一致
+func TestOpenAPI(t *testing.T) {
+	doc := struct {
+		Info  struct{ Version string }
+		Paths map[string]map[string]interface{}
+		// Components.Schemas 中只关心字段名
+		Components struct {
+			Schemas map[string]struct {
+				Properties map[string]interface{}
+			}
+		}
+	}{}
+	if err := json.Unmarshal(OpenAPI, &doc); err != nil {
+		t.Fatalf("invalid openapi document: %v", err)
+	}
+	if doc.Info.Version != Version.String() {
+		t.Errorf("document version %s, want %s", doc.Info.Version, Version)
+	}
+	for _, path := range []string{PathAdd, PathDel, PathCheck} {
+		if _, ok := doc.Paths[path]["post"]; !ok {
+			t.Errorf("path %s is not documented", path)
+		}
+	}
+
+	schemas := map[string]interface{}{
+		"PodRequest":    PodRequest{},
+		"PodResponse":   PodResponse{},
+		"IPConfig":      IPConfig{},
+		"RouteSpec":     RouteSpec{},
+		"DNS":           DNS{},
+		"BandwidthSpec": BandwidthSpec{},
+		"ErrorResponse": ErrorResponse{},
+	}
+	for name, v := range schemas {
+		var documented []string
+		for field := range doc.Components.Schemas[name].Properties {
+			documented = append(documented, field)
+		}
+		sort.Strings(documented)
+		if want := jsonFields(v); !reflect.DeepEqual(documented, want) {
+			t.Errorf("schema %s: documented %v, want %v", name, documented, want)
+		}
+	}
+}
@@ -0,0 +1,63 @@
+package cniapi
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// 错误码与 cni 错误码一致, 插件将其原样作为 cni 错误返回给容器运行时.
+// 1-99 为 CNI spec 中定义的错误码, 100 及以上为 tsunami 自定义的错误码.
+const (
+	// CodeIncompatibleVersion 插件与 server 的 major 版本不同
+	CodeIncompatibleVersion uint = 1
+	// CodeUnknownContainer check 时 server 中没有该容器的记录
+	CodeUnknownContainer uint = 3
+	// CodeDecodingFailure 请求无法解析
+	CodeDecodingFailure uint = 6
+	// CodeTryAgainLater 暂时性错误, 如 server 还没有同步完 Pod 信息, 容器运行时可以稍后重试
+	CodeTryAgainLater uint = 11
+	// CodeAddressInUse 静态 IP 已被其他 Pod 或主机占用
+	CodeAddressInUse uint = 100
+	// CodeRejected 其他原因导致 server 拒绝了请求
+	CodeRejected uint = 101
+	// CodePoolExhausted IPPool 中没有可用的地址
+	CodePoolExhausted uint = 102
+	// CodeAddressMismatch check 时 Pod 网卡上的地址与 server 分配的不一致
+	CodeAddressMismatch uint = 103
+)
+
+// ErrorResponse 接口出错时返回的内容
+type ErrorResponse struct {
+	Error string `json:"error"`
+	// Code 错误码, 为 0 时由插件根据状态码选择
+	Code    uint   `json:"code,omitempty"`
+	Details string `json:"details,omitempty"`
+}
+
+// statusCodes 错误码对应的 http 状态码
+var statusCodes = map[uint]int{
+	CodeIncompatibleVersion: http.StatusBadRequest,
+	CodeUnknownContainer:    http.StatusNotFound,
+	CodeDecodingFailure:     http.StatusBadRequest,
+	CodeTryAgainLater:       http.StatusServiceUnavailable,
+	CodeAddressInUse:        http.StatusConflict,
+	CodeRejected:            http.StatusForbidden,
+	CodePoolExhausted:       http.StatusConflict,
+	CodeAddressMismatch:     http.StatusConflict,
+}
+
+// StatusCode 返回错误码对应的 http 状态码, 未知的错误码为 500
+func StatusCode(code uint) int {
+	if status, ok := statusCodes[code]; ok {
+		return status
+	}
+	return http.StatusInternalServerError
+}
+
+// WriteError 供 server 使用, 以错误码对应的状态码返回 ErrorResponse
+func WriteError(w http.ResponseWriter, code uint, msg, details string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set(VersionHeader, Version.String())
+	w.WriteHeader(StatusCode(code))
+	json.NewEncoder(w).Encode(&ErrorResponse{Error: msg, Code: code, Details: details})
+}
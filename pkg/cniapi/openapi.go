@@ -0,0 +1,10 @@
+package cniapi
+
+import (
+	_ "embed"
+)
+
+// OpenAPI 接口的 OpenAPI 3 文档, server 可以直接将其作为 /api/v1/openapi.json 返回
+//
+//go:embed openapi.json
+var OpenAPI []byte
@@ -0,0 +1,155 @@
+// Package cniapi cni 插件与 cni server 之间的 v1 接口定义.
+//
+// 接口的路径与格式见 openapi.json. 插件在每个请求的 Tsunami-Api-Version 头中带上自己的版本,
+// server 在响应头中返回它的版本, 双方按照两者中较低的 minor 版本交互, major 版本不同时 server 拒绝请求.
+// 因此插件与 daemon 可以分别升级: 新增字段只会出现在新的 minor 版本中, 旧版本的一方会忽略它们.
+package cniapi
+
+import (
+	"fmt"
+	"net"
+)
+
+// 接口路径
+const (
+	PathAdd   = "/api/v1/add"
+	PathDel   = "/api/v1/del"
+	PathCheck = "/api/v1/check"
+)
+
+// PodRequest 由CNI插件调用时传入的pause容器信息, add, del 与 check 共用
+type PodRequest struct {
+	PodName      string `json:"pod_name"`
+	PodNamespace string `json:"pod_namespace"`
+	ContainerID  string `json:"container_id"`
+	NetNs        string `json:"net_ns"`
+	// cni 插件使用的网桥设备的名称, 一般默认为cni0.
+	CNI0 string `json:"cni0"`
+	// Pod 中的网卡名称, 作为次要网络时为 net1, net2 等
+	IfName string `json:"if_name"`
+	// 网络名称, 即 cni 配置中的 name 字段
+	Network string `json:"network"`
+	Vlan    int    `json:"vlan,omitempty"`
+	// IPs Pod 网卡上当前的地址(带掩码), 只在 check 时使用
+	IPs []string `json:"ips,omitempty"`
+	// Fallback 为 true 表示 dhcp 超时, 请求从 IPPool 保留的备用范围中分配地址, 只在 add 时使用, 1.2 版本新增.
+	// 没有备用范围时返回 do_nothing.
+	Fallback bool `json:"fallback,omitempty"`
+}
+
+// IPConfig Pod 网卡上的一个地址
+type IPConfig struct {
+	// Address 地址+掩码字符串, 如`192.168.0.10/24`或`fd00::10/64`
+	Address string `json:"address"`
+	// Gateway 该地址所在网段的网关, 主网卡会通过它添加同一地址族的默认路由
+	Gateway string `json:"gateway,omitempty"`
+}
+
+// Version 返回地址族, "4" 或 "6", 与 cni 结果中 IPConfig 的 version 字段一致
+func (c *IPConfig) Version() string {
+	ip, _, err := net.ParseCIDR(c.Address)
+	if err == nil && ip.To4() == nil {
+		return "6"
+	}
+	return "4"
+}
+
+// Parse 解析地址与网关, 返回的 IPNet 中 IP 为 Pod 的地址而不是网络地址
+func (c *IPConfig) Parse() (addr *net.IPNet, gw net.IP, err error) {
+	ip, ipnet, err := net.ParseCIDR(c.Address)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid address %q: %v", c.Address, err)
+	}
+	ipnet.IP = ip
+	if c.Gateway != "" {
+		if gw = net.ParseIP(c.Gateway); gw == nil {
+			return nil, nil, fmt.Errorf("invalid gateway %q", c.Gateway)
+		}
+		if (gw.To4() == nil) != (ip.To4() == nil) {
+			return nil, nil, fmt.Errorf("gateway %s does not match address family of %s", c.Gateway, c.Address)
+		}
+	}
+	return ipnet, gw, nil
+}
+
+// RouteSpec 需要在 Pod 中额外添加的路由, 来自 IPPool 或 Pod 的 tsunami.io/routes 注解
+type RouteSpec struct {
+	// Dst 目标网段, 如`10.10.0.0/16`
+	Dst string `json:"dst"`
+	// Gw 网关, 为空时为直连路由
+	Gw     string `json:"gw,omitempty"`
+	Metric int    `json:"metric,omitempty"`
+	// Table 路由表, 为 0 时使用 main 表
+	Table int `json:"table,omitempty"`
+	// Scope universe, link 或 host, 为空时根据是否有网关自动选择
+	Scope string `json:"scope,omitempty"`
+}
+
+// DNS Pod 的 DNS 配置, 与 cni 结果中的 dns 字段一致
+type DNS struct {
+	Nameservers []string `json:"nameservers,omitempty"`
+	Domain      string   `json:"domain,omitempty"`
+	Search      []string `json:"search,omitempty"`
+	Options     []string `json:"options,omitempty"`
+}
+
+// BandwidthSpec Pod 的带宽限制, 单位为 bit/s 与 bit, 与 cni runtimeConfig 中 bandwidth 的格式一致
+// Ingress 为进入 Pod 的流量, Egress 为 Pod 发出的流量, Rate 为 0 表示该方向不限制
+type BandwidthSpec struct {
+	IngressRate  uint64 `json:"ingressRate,omitempty"`
+	IngressBurst uint64 `json:"ingressBurst,omitempty"`
+	EgressRate   uint64 `json:"egressRate,omitempty"`
+	EgressBurst  uint64 `json:"egressBurst,omitempty"`
+}
+
+// PortMapping 容器的端口映射, 与 cni runtimeConfig 中 portMappings 的格式一致
+type PortMapping struct {
+	HostPort      int    `json:"hostPort"`
+	ContainerPort int    `json:"containerPort"`
+	Protocol      string `json:"protocol,omitempty"`
+	HostIP        string `json:"hostIP,omitempty"`
+}
+
+// PodResponse add 的返回结果
+type PodResponse struct {
+	// IPAddress 点分十进制+掩码字符串, 如`192.168.0.1/24`.
+	// 1.0 版本的字段, 1.1 版本的 server 同时填写 IPs 与第一个 IPv4 地址对应的 IPAddress, Gateway.
+	IPAddress string `json:"address"`
+	Gateway   string `json:"gateway"`
+	DoNothing bool   `json:"do_nothing"`
+	// IPs Pod 网卡上的全部地址, 可以同时包含 IPv4 与 IPv6, 1.1 版本新增
+	IPs []IPConfig `json:"ips,omitempty"`
+	// 以下字段来自 Pod 的 tsunami.io/mtu, tsunami.io/mac 与 tsunami.io/sysctls 注解
+	MTU     int               `json:"mtu,omitempty"`
+	MAC     string            `json:"mac,omitempty"`
+	Sysctls map[string]string `json:"sysctls,omitempty"`
+	// Routes 由 cni server 合并 IPPool 与 Pod 注解后得到的额外路由
+	Routes []RouteSpec `json:"routes,omitempty"`
+	// DNS 写入 cni 结果的 DNS 配置, 1.1 版本新增
+	DNS *DNS `json:"dns,omitempty"`
+	// Bandwidth 来自 Pod 的 kubernetes.io/ingress-bandwidth 与 kubernetes.io/egress-bandwidth 注解
+	Bandwidth *BandwidthSpec `json:"bandwidth,omitempty"`
+}
+
+// GetIPs 返回 Pod 的全部地址, 1.0 版本的 server 只返回 IPAddress 与 Gateway
+func (r *PodResponse) GetIPs() []IPConfig {
+	if len(r.IPs) > 0 {
+		return r.IPs
+	}
+	if r.IPAddress == "" {
+		return nil
+	}
+	return []IPConfig{{Address: r.IPAddress, Gateway: r.Gateway}}
+}
+
+// SetIPs 设置 IPs, 并填写供 1.0 版本的插件使用的 IPAddress 与 Gateway
+func (r *PodResponse) SetIPs(ips []IPConfig) {
+	r.IPs = ips
+	r.IPAddress, r.Gateway = "", ""
+	for _, ip := range ips {
+		if ip.Version() == "4" {
+			r.IPAddress, r.Gateway = ip.Address, ip.Gateway
+			return
+		}
+	}
+}
@@ -0,0 +1,84 @@
+package cniapi
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// VersionHeader 请求与响应中携带接口版本的 http 头
+const VersionHeader = "Tsunami-Api-Version"
+
+// APIVersion 接口版本, major 与路径中的 v1 对应, minor 每次新增字段或接口时加 1
+type APIVersion struct {
+	Major int
+	Minor int
+}
+
+var (
+	// Version 当前的接口版本.
+	// 1.1 新增 IPs, DNS 字段, check 接口与 ErrorResponse 中的错误码.
+	// 1.2 新增 PodRequest 中的 Fallback 字段.
+	Version = APIVersion{Major: 1, Minor: 2}
+	// Legacy 不携带版本头的一方, 即只支持 add 与 del 的旧版本
+	Legacy = APIVersion{Major: 1, Minor: 0}
+)
+
+// ParseVersion 解析`1.1`格式的版本, 为空时返回 Legacy
+func ParseVersion(s string) (v APIVersion, err error) {
+	if s == "" {
+		return Legacy, nil
+	}
+	parts := strings.SplitN(s, ".", 2)
+	if len(parts) != 2 {
+		return v, fmt.Errorf("invalid api version %q", s)
+	}
+	if v.Major, err = strconv.Atoi(parts[0]); err != nil {
+		return v, fmt.Errorf("invalid api version %q", s)
+	}
+	if v.Minor, err = strconv.Atoi(parts[1]); err != nil {
+		return v, fmt.Errorf("invalid api version %q", s)
+	}
+	return v, nil
+}
+
+func (v APIVersion) String() string {
+	return fmt.Sprintf("%d.%d", v.Major, v.Minor)
+}
+
+// Negotiate 与对端的版本协商, 返回双方都支持的版本; major 版本不同时无法交互
+func (v APIVersion) Negotiate(peer APIVersion) (APIVersion, error) {
+	if v.Major != peer.Major {
+		return APIVersion{}, fmt.Errorf("incompatible api version %s, expect %d.x", peer, v.Major)
+	}
+	if peer.Minor < v.Minor {
+		return peer, nil
+	}
+	return v, nil
+}
+
+// SupportsCheck 是否支持 check 接口
+func (v APIVersion) SupportsCheck() bool {
+	return v.Minor >= 1
+}
+
+// SupportsFallback 是否支持在 dhcp 超时后申请备用地址
+func (v APIVersion) SupportsFallback() bool {
+	return v.Minor >= 2
+}
+
+// NegotiateRequest 供 server 使用, 根据请求头协商版本并在响应头中返回 server 的版本.
+// 协商失败时返回 CodeIncompatibleVersion 错误, ok 为 false.
+func NegotiateRequest(w http.ResponseWriter, r *http.Request) (v APIVersion, ok bool) {
+	w.Header().Set(VersionHeader, Version.String())
+	peer, err := ParseVersion(r.Header.Get(VersionHeader))
+	if err == nil {
+		v, err = Version.Negotiate(peer)
+	}
+	if err != nil {
+		WriteError(w, CodeIncompatibleVersion, "incompatible api version", err.Error())
+		return v, false
+	}
+	return v, true
+}
@@ -0,0 +1,175 @@
+package cninet
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+	"k8s.io/klog"
+)
+
+// DefaultAnnounceCount 免费 ARP / 非请求 NA 的默认发送次数
+const DefaultAnnounceCount = 3
+
+// announceInterval 多次发送之间的间隔, cmdAdd 会同步等待, 因此不宜过长
+const announceInterval = 200 * time.Millisecond
+
+const (
+	ethHeaderLen = 14
+	etherTypeARP = 0x0806
+	etherTypeV6  = 0x86dd
+)
+
+// htons 将主机字节序转换为网络字节序, AF_PACKET 套接字的协议号需要网络字节序
+func htons(v uint16) uint16 {
+	return v<<8 | v>>8
+}
+
+// ethHeader 构造以太网头部
+func ethHeader(dst, src net.HardwareAddr, etherType uint16) []byte {
+	b := make([]byte, ethHeaderLen)
+	copy(b[0:6], dst)
+	copy(b[6:12], src)
+	binary.BigEndian.PutUint16(b[12:14], etherType)
+	return b
+}
+
+// MakeGratuitousARP 构造免费 ARP 报文(RFC 5227 中的 ARP Announcement), 发送者与目标 IP 均为 ip
+func MakeGratuitousARP(mac net.HardwareAddr, ip net.IP) []byte {
+	broadcast := net.HardwareAddr{0xff, 0xff, 0xff, 0xff, 0xff, 0xff}
+	frame := ethHeader(broadcast, mac, etherTypeARP)
+
+	arp := make([]byte, 28)
+	binary.BigEndian.PutUint16(arp[0:2], 1)      // 硬件类型: 以太网
+	binary.BigEndian.PutUint16(arp[2:4], 0x0800) // 协议类型: IPv4
+	arp[4] = 6                                   // 硬件地址长度
+	arp[5] = 4                                   // 协议地址长度
+	binary.BigEndian.PutUint16(arp[6:8], 1)      // 操作码: request
+	copy(arp[8:14], mac)
+	copy(arp[14:18], ip.To4())
+	// 目标 MAC 保持全 0
+	copy(arp[24:28], ip.To4())
+
+	return append(frame, arp...)
+}
+
+// MakeUnsolicitedNA 构造发往 ff02::1 的非请求邻居通告(RFC 4861 7.2.6), 设置 Override 标志
+func MakeUnsolicitedNA(mac net.HardwareAddr, ip net.IP) []byte {
+	allNodes := net.ParseIP("ff02::1")
+	// ff02::1 对应的组播 MAC 为 33:33:00:00:00:01
+	frame := ethHeader(net.HardwareAddr{0x33, 0x33, 0x00, 0x00, 0x00, 0x01}, mac, etherTypeV6)
+
+	// ICMPv6 报文: 类型, 代码, 校验和, 标志, 目标地址, 目标链路层地址选项
+	icmp := make([]byte, 32)
+	icmp[0] = 136
+	binary.BigEndian.PutUint32(icmp[4:8], 0x20000000)
+	copy(icmp[8:24], ip.To16())
+	icmp[24] = 2 // 选项类型: Target Link-Layer Address
+	icmp[25] = 1 // 选项长度, 单位为 8 字节
+	copy(icmp[26:32], mac)
+
+	ipv6 := make([]byte, 40)
+	ipv6[0] = 0x60
+	binary.BigEndian.PutUint16(ipv6[4:6], uint16(len(icmp)))
+	ipv6[6] = unix.IPPROTO_ICMPV6
+	ipv6[7] = 255 // NDP 报文的跳数限制必须为 255
+	copy(ipv6[8:24], ip.To16())
+	copy(ipv6[24:40], allNodes)
+
+	binary.BigEndian.PutUint16(icmp[2:4], icmpv6Checksum(ip.To16(), allNodes, icmp))
+
+	frame = append(frame, ipv6...)
+	return append(frame, icmp...)
+}
+
+// icmpv6Checksum 计算包含 IPv6 伪首部的 ICMPv6 校验和
+func icmpv6Checksum(src, dst net.IP, payload []byte) uint16 {
+	var sum uint32
+	add := func(b []byte) {
+		for i := 0; i+1 < len(b); i += 2 {
+			sum += uint32(binary.BigEndian.Uint16(b[i : i+2]))
+		}
+		if len(b)%2 == 1 {
+			sum += uint32(b[len(b)-1]) << 8
+		}
+	}
+
+	add(src)
+	add(dst)
+	sum += uint32(len(payload))
+	sum += unix.IPPROTO_ICMPV6
+	add(payload)
+
+	for sum>>16 != 0 {
+		sum = sum&0xffff + sum>>16
+	}
+	return ^uint16(sum)
+}
+
+// sendFrames 通过 AF_PACKET 原始套接字在网卡上发送以太网帧, 需要在目标网络命名空间中调用
+func sendFrames(link netlink.Link, frames [][]byte, count int) (err error) {
+	fd, err := unix.Socket(unix.AF_PACKET, unix.SOCK_RAW, int(htons(unix.ETH_P_ALL)))
+	if err != nil {
+		return fmt.Errorf("failed to create packet socket: %v", err)
+	}
+	defer unix.Close(fd)
+
+	addr := &unix.SockaddrLinklayer{
+		Ifindex: link.Attrs().Index,
+		Halen:   6,
+	}
+	for i := 0; i < count; i++ {
+		if i > 0 {
+			time.Sleep(announceInterval)
+		}
+		for _, frame := range frames {
+			copy(addr.Addr[:], frame[0:6])
+			addr.Protocol = htons(binary.BigEndian.Uint16(frame[12:14]))
+			if err = unix.Sendto(fd, frame, 0, addr); err != nil {
+				return fmt.Errorf("failed to send frame on %s: %v", link.Attrs().Name, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// AnnounceAddrs 在网卡上为其所有 IPv4 地址发送免费 ARP, 为 IPv6 全局地址发送非请求 NA,
+// 让上游交换机与同网段主机刷新 ARP / 邻居表项. count 小于等于 0 时不发送.
+func AnnounceAddrs(link netlink.Link, count int) (err error) {
+	if count <= 0 {
+		return nil
+	}
+
+	mac := link.Attrs().HardwareAddr
+	if len(mac) != 6 {
+		return fmt.Errorf("%s has no ethernet address", link.Attrs().Name)
+	}
+
+	addrs, err := nl.AddrList(link, netlink.FAMILY_ALL)
+	if err != nil {
+		return fmt.Errorf("failed to get addresses of %s: %v", link.Attrs().Name, err)
+	}
+
+	var frames [][]byte
+	for _, addr := range addrs {
+		if addr.IP.To4() != nil {
+			frames = append(frames, MakeGratuitousARP(mac, addr.IP))
+		} else if addr.IP.IsGlobalUnicast() {
+			frames = append(frames, MakeUnsolicitedNA(mac, addr.IP))
+		}
+	}
+	if len(frames) == 0 {
+		return nil
+	}
+
+	if err = sendFrames(link, frames, count); err != nil {
+		return err
+	}
+	klog.V(3).Infof("announce %d addresses on %s, count: %d", len(frames), link.Attrs().Name, count)
+
+	return nil
+}
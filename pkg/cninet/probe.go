@@ -0,0 +1,179 @@
+package cninet
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+	"k8s.io/klog"
+)
+
+// probeCount 探测报文的发送次数
+const probeCount = 3
+
+// AddressConflictError 重复地址检测发现地址已被占用
+type AddressConflictError struct {
+	IP  net.IP
+	MAC net.HardwareAddr
+	Dev string
+}
+
+func (e *AddressConflictError) Error() string {
+	return fmt.Sprintf("address %s is already in use by %s on the segment of %s", e.IP, e.MAC, e.Dev)
+}
+
+// MakeARPProbe 构造 ARP 探测报文(RFC 5227 2.1.1), 发送者 IP 为 0.0.0.0, 目标 IP 为待检测的地址
+func MakeARPProbe(mac net.HardwareAddr, ip net.IP) []byte {
+	frame := MakeGratuitousARP(mac, ip)
+	// 将发送者 IP 清零即为探测报文
+	copy(frame[ethHeaderLen+14:ethHeaderLen+18], net.IPv4zero.To4())
+	return frame
+}
+
+// MakeDADSolicitation 构造 IPv6 重复地址检测使用的邻居请求(RFC 4862 5.4.2)
+// 源地址为 ::, 目的地址为目标地址对应的请求节点组播地址, 且不携带源链路层地址选项
+func MakeDADSolicitation(mac net.HardwareAddr, ip net.IP) []byte {
+	ip16 := ip.To16()
+	solicited := net.IP{0xff, 0x02, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0x01, 0xff, ip16[13], ip16[14], ip16[15]}
+	dstMAC := net.HardwareAddr{0x33, 0x33, solicited[12], solicited[13], solicited[14], solicited[15]}
+	frame := ethHeader(dstMAC, mac, etherTypeV6)
+
+	icmp := make([]byte, 24)
+	icmp[0] = 135
+	copy(icmp[8:24], ip16)
+
+	ipv6 := make([]byte, 40)
+	ipv6[0] = 0x60
+	binary.BigEndian.PutUint16(ipv6[4:6], uint16(len(icmp)))
+	ipv6[6] = unix.IPPROTO_ICMPV6
+	ipv6[7] = 255
+	copy(ipv6[8:24], net.IPv6unspecified)
+	copy(ipv6[24:40], solicited)
+
+	binary.BigEndian.PutUint16(icmp[2:4], icmpv6Checksum(net.IPv6unspecified, solicited, icmp))
+
+	frame = append(frame, ipv6...)
+	return append(frame, icmp...)
+}
+
+// arpConflict 判断收到的 ARP 报文是否说明 ip 已被其他主机占用, 返回对方的 MAC
+// 对方的应答, 对方以该地址发出的请求, 以及对方同时在探测该地址, 都视为冲突
+func arpConflict(frame []byte, ip net.IP) net.HardwareAddr {
+	if len(frame) < ethHeaderLen+28 || binary.BigEndian.Uint16(frame[12:14]) != etherTypeARP {
+		return nil
+	}
+	arp := frame[ethHeaderLen:]
+	senderMAC := net.HardwareAddr(arp[8:14])
+	senderIP := net.IP(arp[14:18])
+	targetIP := net.IP(arp[24:28])
+
+	if senderIP.Equal(ip) {
+		return senderMAC
+	}
+	if binary.BigEndian.Uint16(arp[6:8]) == 1 && senderIP.Equal(net.IPv4zero) && targetIP.Equal(ip) {
+		return senderMAC
+	}
+	return nil
+}
+
+// dadConflict 判断收到的 ICMPv6 报文是否说明 ip 已被其他主机占用, 返回对方的 MAC
+func dadConflict(frame []byte, ip net.IP) net.HardwareAddr {
+	if len(frame) < ethHeaderLen+40+24 || binary.BigEndian.Uint16(frame[12:14]) != etherTypeV6 {
+		return nil
+	}
+	ipv6 := frame[ethHeaderLen:]
+	if ipv6[6] != unix.IPPROTO_ICMPV6 {
+		return nil
+	}
+	icmp := ipv6[40:]
+	// 136 为邻居通告, 135 为其他主机同时在做重复地址检测
+	if icmp[0] != 136 && icmp[0] != 135 {
+		return nil
+	}
+	if !net.IP(icmp[8:24]).Equal(ip) {
+		return nil
+	}
+	return net.HardwareAddr(frame[6:12])
+}
+
+// Probe 在网卡所在的二层网络中检测 ip 是否已被占用, IPv4 使用 ARP 探测, IPv6 使用重复地址检测.
+// ignore 中的 MAC 发出的报文不视为冲突, 如地址已经配置在 Pod 网卡上时, Pod 自己的应答.
+// 发现冲突时返回 *AddressConflictError.
+func Probe(link netlink.Link, ip net.IP, timeout time.Duration, ignore []net.HardwareAddr) (err error) {
+	mac := link.Attrs().HardwareAddr
+	if len(mac) != 6 {
+		return fmt.Errorf("%s has no ethernet address", link.Attrs().Name)
+	}
+
+	var proto uint16
+	var probe []byte
+	var conflict func([]byte, net.IP) net.HardwareAddr
+	if ip.To4() != nil {
+		proto, probe, conflict = etherTypeARP, MakeARPProbe(mac, ip), arpConflict
+		ip = ip.To4()
+	} else {
+		proto, probe, conflict = etherTypeV6, MakeDADSolicitation(mac, ip), dadConflict
+	}
+
+	fd, err := unix.Socket(unix.AF_PACKET, unix.SOCK_RAW, int(htons(proto)))
+	if err != nil {
+		return fmt.Errorf("failed to create packet socket: %v", err)
+	}
+	defer unix.Close(fd)
+
+	// 先绑定网卡再发送探测报文, 避免错过应答
+	addr := &unix.SockaddrLinklayer{Ifindex: link.Attrs().Index, Protocol: htons(proto), Halen: 6}
+	if err = unix.Bind(fd, addr); err != nil {
+		return fmt.Errorf("failed to bind packet socket on %s: %v", link.Attrs().Name, err)
+	}
+	tv := unix.NsecToTimeval(int64(announceInterval))
+	if err = unix.SetsockoptTimeval(fd, unix.SOL_SOCKET, unix.SO_RCVTIMEO, &tv); err != nil {
+		return fmt.Errorf("failed to set socket timeout: %v", err)
+	}
+
+	copy(addr.Addr[:], probe[0:6])
+	deadline := time.Now().Add(timeout)
+	buf := make([]byte, 1500)
+	for sent := 0; time.Now().Before(deadline); {
+		if sent < probeCount {
+			if err = unix.Sendto(fd, probe, 0, addr); err != nil {
+				return fmt.Errorf("failed to send probe on %s: %v", link.Attrs().Name, err)
+			}
+			sent++
+		}
+
+		n, from, err := unix.Recvfrom(fd, buf, 0)
+		if err != nil {
+			if err == unix.EAGAIN || err == unix.EINTR {
+				continue
+			}
+			return fmt.Errorf("failed to receive on %s: %v", link.Attrs().Name, err)
+		}
+		// 忽略自己发出的报文
+		if ll, ok := from.(*unix.SockaddrLinklayer); ok && ll.Pkttype == unix.PACKET_OUTGOING {
+			continue
+		}
+
+		other := conflict(buf[:n], ip)
+		if other == nil || bytes.Equal(other, mac) {
+			continue
+		}
+		ignored := false
+		for _, m := range ignore {
+			if bytes.Equal(other, m) {
+				ignored = true
+				break
+			}
+		}
+		if !ignored {
+			return &AddressConflictError{IP: ip, MAC: append(net.HardwareAddr{}, other...), Dev: link.Attrs().Name}
+		}
+	}
+	klog.V(3).Infof("probe %s on %s: no conflict", ip, link.Attrs().Name)
+
+	return nil
+}
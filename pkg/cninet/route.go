@@ -3,8 +3,10 @@ package cninet
 import (
 	"fmt"
 	"net"
+	"strings"
 
 	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
 )
 
 // GetDefaultRoute 获取默认路由
@@ -12,7 +14,7 @@ import (
 // 如果没有默认路由，则返回 nil。
 func GetDefaultRoute() (route *netlink.Route, err error) {
 	// 获取默认路由, 这里只获取 IPv4 路由
-	routes, err := netlink.RouteList(nil, netlink.FAMILY_V4)
+	routes, err := nl.RouteList(nil, netlink.FAMILY_V4)
 	if err != nil {
 		return nil, fmt.Errorf("failed to get default route: %s", err)
 	}
@@ -39,3 +41,72 @@ func MakeDefaultRoute(gw net.IP) *netlink.Route {
 		Gw: gw,
 	}
 }
+
+// isZeroPrefix 判断网段是否为 0.0.0.0/0 或 ::/0
+func isZeroPrefix(dst *net.IPNet) bool {
+	ones, _ := dst.Mask.Size()
+	return ones == 0
+}
+
+// FormatRoute 将路由对象格式化为与 `ip route` 输出类似的字符串, linkNames 为设备索引到名称的映射
+func FormatRoute(route netlink.Route, linkNames map[int]string) string {
+	var b strings.Builder
+
+	// netlink 库返回的默认路由 Dst 为 0.0.0.0/0 而不是 nil
+	if route.Dst == nil || isZeroPrefix(route.Dst) {
+		b.WriteString("default")
+	} else {
+		b.WriteString(route.Dst.String())
+	}
+	if route.Gw != nil {
+		fmt.Fprintf(&b, " via %s", route.Gw)
+	}
+	if name, ok := linkNames[route.LinkIndex]; ok {
+		fmt.Fprintf(&b, " dev %s", name)
+	} else if route.LinkIndex != 0 {
+		fmt.Fprintf(&b, " dev if%d", route.LinkIndex)
+	}
+	if route.Protocol != 0 {
+		fmt.Fprintf(&b, " proto %s", route.Protocol)
+	}
+	if route.Scope != netlink.SCOPE_UNIVERSE {
+		fmt.Fprintf(&b, " scope %s", route.Scope)
+	}
+	if route.Src != nil {
+		fmt.Fprintf(&b, " src %s", route.Src)
+	}
+	if route.Priority != 0 {
+		fmt.Fprintf(&b, " metric %d", route.Priority)
+	}
+	if route.Table != 0 && route.Table != unix.RT_TABLE_MAIN {
+		fmt.Fprintf(&b, " table %d", route.Table)
+	}
+
+	return b.String()
+}
+
+// ListAllRoutes 获取当前网络命名空间中所有路由表(local 表除外)的路由, 并格式化为字符串
+func ListAllRoutes(family int) (routes []string, err error) {
+	links, err := nl.LinkList()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list links: %s", err)
+	}
+	linkNames := make(map[int]string, len(links))
+	for _, link := range links {
+		linkNames[link.Attrs().Index] = link.Attrs().Name
+	}
+
+	// 指定 RT_FILTER_TABLE 且 Table 为 0 时, 会返回所有路由表中的路由
+	list, err := nl.RouteListFiltered(family, &netlink.Route{}, netlink.RT_FILTER_TABLE)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list routes: %s", err)
+	}
+	for _, route := range list {
+		if route.Table == unix.RT_TABLE_LOCAL {
+			continue
+		}
+		routes = append(routes, FormatRoute(route, linkNames))
+	}
+
+	return
+}
@@ -0,0 +1,104 @@
+package cninet
+
+import (
+	"net"
+	"testing"
+
+	"github.com/gitlayzer/tsunami/pkg/nlwrap/nlfake"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// newHost 创建带有 eth0 与一个地址的网络命名空间
+func newHost(t *testing.T) (*nlfake.Handle, netlink.Link) {
+	t.Helper()
+	h := nlfake.New()
+	t.Cleanup(SetNetlinkHandle(h))
+
+	eth0 := &netlink.Device{LinkAttrs: netlink.LinkAttrs{Name: "eth0"}}
+	if err := h.LinkAdd(eth0); err != nil {
+		t.Fatal(err)
+	}
+	addr, _ := netlink.ParseAddr("192.168.1.10/24")
+	if err := h.AddrAdd(eth0, addr); err != nil {
+		t.Fatal(err)
+	}
+	return h, eth0
+}
+
+func TestGetDefaultRoute(t *testing.T) {
+	h, eth0 := newHost(t)
+
+	if _, err := GetDefaultRoute(); err == nil {
+		t.Errorf("expected error without default route")
+	}
+
+	route := MakeDefaultRoute(net.ParseIP("192.168.1.1"))
+	route.LinkIndex = eth0.Attrs().Index
+	if err := h.RouteAdd(route); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := GetDefaultRoute()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !got.Gw.Equal(net.ParseIP("192.168.1.1")) || got.LinkIndex != eth0.Attrs().Index {
+		t.Errorf("unexpected default route: %s", got)
+	}
+}
+
+func TestFormatRoute(t *testing.T) {
+	_, dst, _ := net.ParseCIDR("10.0.0.0/8")
+	_, zero, _ := net.ParseCIDR("0.0.0.0/0")
+	names := map[int]string{2: "eth0"}
+
+	tests := []struct {
+		route netlink.Route
+		want  string
+	}{
+		{netlink.Route{Gw: net.ParseIP("192.168.1.1"), LinkIndex: 2}, "default via 192.168.1.1 dev eth0"},
+		{netlink.Route{Dst: zero, Gw: net.ParseIP("192.168.1.1"), LinkIndex: 2, Protocol: unix.RTPROT_DHCP, Priority: 100},
+			"default via 192.168.1.1 dev eth0 proto dhcp metric 100"},
+		{netlink.Route{Dst: dst, LinkIndex: 3, Scope: netlink.SCOPE_LINK, Src: net.ParseIP("192.168.1.10"), Table: 100},
+			"10.0.0.0/8 dev if3 scope link src 192.168.1.10 table 100"},
+	}
+	for _, tt := range tests {
+		if got := FormatRoute(tt.route, names); got != tt.want {
+			t.Errorf("got %q, want %q", got, tt.want)
+		}
+	}
+}
+
+func TestListAllRoutes(t *testing.T) {
+	h, eth0 := newHost(t)
+
+	_, dst, _ := net.ParseCIDR("10.0.0.0/8")
+	routes := []*netlink.Route{
+		{LinkIndex: eth0.Attrs().Index, Gw: net.ParseIP("192.168.1.1")},
+		{LinkIndex: eth0.Attrs().Index, Dst: dst, Gw: net.ParseIP("192.168.1.1"), Table: 100},
+	}
+	for _, r := range routes {
+		if err := h.RouteAdd(r); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	got, err := ListAllRoutes(netlink.FAMILY_V4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"10.0.0.0/8 via 192.168.1.1 dev eth0 proto boot table 100",
+		"default via 192.168.1.1 dev eth0 proto boot",
+		"192.168.1.0/24 dev eth0 proto kernel scope link src 192.168.1.10",
+	}
+	if len(got) != len(want) {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("route %d: got %q, want %q", i, got[i], want[i])
+		}
+	}
+}
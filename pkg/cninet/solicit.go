@@ -0,0 +1,62 @@
+package cninet
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// MakeRouterSolicitation 构造发往 ff02::2 的路由器请求(RFC 4861 4.1).
+// src 为未指定地址时不能带源链路层地址选项.
+func MakeRouterSolicitation(mac net.HardwareAddr, src net.IP) []byte {
+	allRouters := net.ParseIP("ff02::2")
+	// ff02::2 对应的组播 MAC 为 33:33:00:00:00:02
+	frame := ethHeader(net.HardwareAddr{0x33, 0x33, 0x00, 0x00, 0x00, 0x02}, mac, etherTypeV6)
+
+	// ICMPv6 报文: 类型, 代码, 校验和, 保留字段, 源链路层地址选项
+	icmp := make([]byte, 8)
+	icmp[0] = 133
+	if !src.IsUnspecified() {
+		icmp = append(icmp, 1, 1) // 选项类型: Source Link-Layer Address, 长度为 8 字节
+		icmp = append(icmp, mac...)
+	}
+
+	ipv6 := make([]byte, 40)
+	ipv6[0] = 0x60
+	binary.BigEndian.PutUint16(ipv6[4:6], uint16(len(icmp)))
+	ipv6[6] = unix.IPPROTO_ICMPV6
+	ipv6[7] = 255 // NDP 报文的跳数限制必须为 255
+	copy(ipv6[8:24], src.To16())
+	copy(ipv6[24:40], allRouters)
+
+	binary.BigEndian.PutUint16(icmp[2:4], icmpv6Checksum(src.To16(), allRouters, icmp))
+
+	frame = append(frame, ipv6...)
+	return append(frame, icmp...)
+}
+
+// SolicitRouters 从网卡的链路本地地址发送一次路由器请求, 让路由器立即发送路由通告, 不必等待周期性的通告.
+// 链路本地地址还未完成重复地址检测时使用未指定地址.
+func SolicitRouters(link netlink.Link) (err error) {
+	mac := link.Attrs().HardwareAddr
+	if len(mac) != 6 {
+		return fmt.Errorf("%s has no ethernet address", link.Attrs().Name)
+	}
+
+	addrs, err := nl.AddrList(link, netlink.FAMILY_V6)
+	if err != nil {
+		return fmt.Errorf("failed to get addresses of %s: %v", link.Attrs().Name, err)
+	}
+	src := net.IPv6unspecified
+	for _, addr := range addrs {
+		if addr.IP.IsLinkLocalUnicast() && addr.Flags&unix.IFA_F_TENTATIVE == 0 {
+			src = addr.IP
+			break
+		}
+	}
+
+	return sendFrames(link, [][]byte{MakeRouterSolicitation(mac, src)}, 1)
+}
@@ -1,13 +1,23 @@
 package config
 
 import (
+	"fmt"
+	"time"
+
 	"k8s.io/klog"
 
 	"github.com/vishvananda/netlink"
 
+	"github.com/gitlayzer/tsunami/pkg/bridge"
 	"github.com/gitlayzer/tsunami/pkg/cninet"
 )
 
+// --dhcp-daemon 的取值
+const (
+	DHCPDaemonBuiltin  = "builtin"
+	DHCPDaemonExternal = "external"
+)
+
 // CmdOpts 命令行参数对象
 // 这个结构体不需要构建函数, 由 main 入口程序通过 flag 标准库自动填充
 type CmdOpts struct {
@@ -16,10 +26,55 @@ type CmdOpts struct {
 	// 集群之间通信所使用的主网卡
 	// 如果不是多网卡环境, 一般是 eth0 或者 ens33
 	Eth0Name string
+	// tsunamictl 与 daemon 通信的 unix socket 路径
+	CtlSocket string
+	// IP 迁移到网桥后发送免费 ARP / 非请求 NA 的次数, 小于等于 0 时不发送
+	AnnounceCount int
+	// 是否在 Pod veth 端口上安装防欺骗规则
+	AntiSpoofing bool
+	// 是否在 Pod veth 端口上执行 Kubernetes NetworkPolicy
+	NetworkPolicy bool
+	// dhcp 守护进程, builtin 为 daemon 内置的实现, external 为运行 cni dhcp 插件
+	DHCPDaemon string
+	// 检测使用备用地址的 Pod 所在网段 dhcp 是否恢复的间隔, 为 0 时不检测
+	DHCPFallbackProbeInterval time.Duration
+
+	// 以下为网桥及其端口的参数, 每次启动时都会重新设置
+	// 网桥端口的 hairpin 模式, 写入 cni netconf 的 delegate.hairpinMode 中, 由 cni 插件设置到每个端口
+	HairpinMode bool
+	// 网桥设备的混杂模式
+	PromiscMode bool
+	// 网桥的组播侦听
+	MulticastSnooping bool
+	// 网桥的生成树协议
+	STP bool
+	// 网桥 MAC 地址表项的老化时间(秒)
+	AgeingTime int
+
+	// 以下选项只在 BootstrapCNIConfig 为 true 时使用, 用于由 daemon 生成 cni netconf
+	BootstrapCNIConfig bool
+	// cni server 的 socket 路径
+	ServerSocket string
+	// 网桥插件使用的 ipam 插件类型
+	IPAM string
+	// Pod 网卡的 MTU, 为 0 时使用物理网卡的 MTU
+	MTU int
+	// 显式指定 service cidr, 为空时从 apiserver 获取
+	ServiceIPCIDR string
+	// 等待 dhcp 的时间, 超时后使用 cni server 分配的备用地址, 为 0 时不开启
+	DHCPFallbackTimeout time.Duration
+	// 静态 IP 重复地址检测的等待时间, 为 0 时不检测
+	ProbeTimeout time.Duration
 }
 
 // Complete 使用默认值补全 CmdOpts 对象中未指定的选项
 func (c *CmdOpts) Complete() (err error) {
+	switch c.DHCPDaemon {
+	case DHCPDaemonBuiltin, DHCPDaemonExternal:
+	default:
+		return fmt.Errorf("unknown dhcp daemon %q, must be builtin or external", c.DHCPDaemon)
+	}
+
 	// 如果未显式指定目标网络接口, 则尝试通过宿主机的默认路由获取其绑定的接口
 	if c.Eth0Name == "" {
 		klog.Info("doesn`t specify main network interface, try to find it")
@@ -40,5 +95,25 @@ func (c *CmdOpts) Complete() (err error) {
 		c.Eth0Name = link.Attrs().Name
 	}
 
+	// Pod 网卡通过网桥桥接到物理网卡上, 默认与物理网卡保持一致
+	if c.BootstrapCNIConfig && c.MTU == 0 {
+		link, err := netlink.LinkByName(c.Eth0Name)
+		if err != nil {
+			return err
+		}
+		c.MTU = link.Attrs().MTU
+	}
+
 	return
 }
+
+// BridgeOptions 根据命令行参数生成网桥设备的参数
+func (c *CmdOpts) BridgeOptions() *bridge.Options {
+	ageing := uint32(c.AgeingTime)
+	return &bridge.Options{
+		PromiscMode:       &c.PromiscMode,
+		MulticastSnooping: &c.MulticastSnooping,
+		STP:               &c.STP,
+		AgeingTime:        &ageing,
+	}
+}
@@ -0,0 +1,48 @@
+package config
+
+import (
+	"net"
+
+	"github.com/containernetworking/cni/pkg/types"
+)
+
+// NetworkDNS 返回当前网络在配置中的 DNS, networks 中的配置优先于顶层的 dns 字段
+func (n *NetConf) NetworkDNS() types.DNS {
+	if network, ok := n.Networks[n.Name]; ok && network.DNS != nil {
+		return *network.DNS
+	}
+	return n.DNS
+}
+
+// MergeDNS 按字段合并多个来源的 DNS 配置, 排在前面的来源优先.
+// 例如 cni server 只指定了 search 时, nameservers 仍然来自配置或 dhcp.
+func MergeDNS(sources ...types.DNS) (dns types.DNS) {
+	for _, s := range sources {
+		if len(dns.Nameservers) == 0 {
+			dns.Nameservers = s.Nameservers
+		}
+		if dns.Domain == "" {
+			dns.Domain = s.Domain
+		}
+		if len(dns.Search) == 0 {
+			dns.Search = s.Search
+		}
+		if len(dns.Options) == 0 {
+			dns.Options = s.Options
+		}
+	}
+	return dns
+}
+
+// validateDNS 检查 nameservers 是否为合法的 IP
+func validateDNS(field string, dns *types.DNS) error {
+	if dns == nil {
+		return nil
+	}
+	for _, ns := range dns.Nameservers {
+		if net.ParseIP(ns) == nil {
+			return invalidNetConf("%s.nameservers %q is not a valid ip", field, ns)
+		}
+	}
+	return nil
+}
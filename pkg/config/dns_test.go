@@ -0,0 +1,65 @@
+package config
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/containernetworking/cni/pkg/types"
+)
+
+func TestMergeDNS(t *testing.T) {
+	server := types.DNS{Search: []string{"team.svc.cluster.local"}}
+	conf := types.DNS{Nameservers: []string{"10.96.0.10"}, Search: []string{"svc.cluster.local"}, Options: []string{"ndots:5"}}
+	dhcp := types.DNS{Nameservers: []string{"192.168.1.1"}, Domain: "example.com"}
+
+	got := MergeDNS(server, conf, dhcp)
+	want := types.DNS{
+		Nameservers: []string{"10.96.0.10"},
+		Domain:      "example.com",
+		Search:      []string{"team.svc.cluster.local"},
+		Options:     []string{"ndots:5"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+
+	if got := MergeDNS(); !reflect.DeepEqual(got, types.DNS{}) {
+		t.Errorf("merging nothing should be empty, got %+v", got)
+	}
+}
+
+func TestNetworkDNS(t *testing.T) {
+	n := &NetConf{
+		NetConf: types.NetConf{Name: "storage", DNS: types.DNS{Nameservers: []string{"10.96.0.10"}}},
+		Networks: map[string]*NetworkConf{
+			"storage": {Bridge: "br1", DNS: &types.DNS{Nameservers: []string{"172.16.0.53"}}},
+			"backup":  {Bridge: "br2"},
+		},
+	}
+	if got := n.NetworkDNS().Nameservers; !reflect.DeepEqual(got, []string{"172.16.0.53"}) {
+		t.Errorf("network dns should be preferred, got %v", got)
+	}
+
+	n.Name = "backup"
+	if got := n.NetworkDNS().Nameservers; !reflect.DeepEqual(got, []string{"10.96.0.10"}) {
+		t.Errorf("top level dns should be used, got %v", got)
+	}
+}
+
+func TestValidateDNS(t *testing.T) {
+	conf := `{"name":"net","type":"cni-tsunami","delegate":{"type":"bridge","bridge":"br0","ipam":{"type":"dhcp"}},%s}`
+	for _, tt := range []struct {
+		dns   string
+		valid bool
+	}{
+		{`"dns":{"nameservers":["10.96.0.10","fd00::a"]}`, true},
+		{`"dns":{"nameservers":["dns.example.com"]}`, false},
+		{`"networks":{"net":{"bridge":"br1","dns":{"nameservers":["300.1.1.1"]}}}`, false},
+	} {
+		_, err := LoadNetConf([]byte(fmt.Sprintf(conf, tt.dns)))
+		if (err == nil) != tt.valid {
+			t.Errorf("%s: valid %t, got %v", tt.dns, tt.valid, err)
+		}
+	}
+}
@@ -3,24 +3,309 @@ package config
 import (
 	"encoding/json"
 	"fmt"
+	"net"
 	"os"
+	"reflect"
+	"strings"
+	"time"
 
 	"github.com/containernetworking/cni/pkg/types"
+	"github.com/gitlayzer/tsunami/pkg/cninet"
+	"github.com/gitlayzer/tsunami/pkg/dhcp"
+	"github.com/gitlayzer/tsunami/pkg/podroute"
 	"github.com/gitlayzer/tsunami/pkg/svcipcidr"
+	"github.com/gitlayzer/tsunami/utils/restapi"
+	"github.com/gitlayzer/tsunami/utils/utilfile"
 	"k8s.io/klog"
 )
 
+// 渲染 CNI 配置时使用的固定字段
+const (
+	cniVersion  = "0.3.1"
+	networkName = "mycninet"
+	pluginType  = "cni-tsunami"
+)
+
+// DelegateConf 委托给 bridge 插件的配置, cmdAdd 中序列化后传给 bridge 插件.
+// 这里只列出 tsunami 需要读取或修改的字段, 其他字段(如 ipMasq, promiscMode, dataDir)保存在 extra 中, 序列化时原样写回.
+type DelegateConf struct {
+	CNIVersion string `json:"cniVersion,omitempty"`
+	Name       string `json:"name,omitempty"`
+	// Type 被委托的插件类型, 一般为 bridge
+	Type string `json:"type"`
+	// Bridge cni插件创建的, 默认的网络设备(名称一般为cni0).
+	Bridge           string `json:"bridge"`
+	IsGateway        bool   `json:"isGateway"`
+	IsDefaultGateway bool   `json:"isDefaultGateway,omitempty"`
+	HairpinMode      bool   `json:"hairpinMode,omitempty"`
+	MTU              int    `json:"mtu,omitempty"`
+	Vlan             int    `json:"vlan,omitempty"`
+	// IPAM ipam 插件的配置因插件而异, 这里只要求必须有 type 字段
+	IPAM map[string]interface{} `json:"ipam"`
+
+	extra map[string]json.RawMessage
+}
+
+// delegateKeys DelegateConf 中已知字段的 json 名称
+var delegateKeys = func() map[string]bool {
+	keys := map[string]bool{}
+	t := reflect.TypeOf(DelegateConf{})
+	for i := 0; i < t.NumField(); i++ {
+		if name := strings.Split(t.Field(i).Tag.Get("json"), ",")[0]; name != "" {
+			keys[name] = true
+		}
+	}
+	return keys
+}()
+
+// UnmarshalJSON 解析已知字段, 其余字段保存在 extra 中
+func (d *DelegateConf) UnmarshalJSON(data []byte) error {
+	type plain DelegateConf
+	if err := json.Unmarshal(data, (*plain)(d)); err != nil {
+		return err
+	}
+	fields := map[string]json.RawMessage{}
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return err
+	}
+	d.extra = nil
+	for key, value := range fields {
+		if delegateKeys[key] {
+			continue
+		}
+		if d.extra == nil {
+			d.extra = map[string]json.RawMessage{}
+		}
+		d.extra[key] = value
+	}
+	return nil
+}
+
+// MarshalJSON 序列化已知字段, 并写回 extra 中的字段
+func (d DelegateConf) MarshalJSON() ([]byte, error) {
+	type plain DelegateConf
+	data, err := json.Marshal(plain(d))
+	if err != nil || len(d.extra) == 0 {
+		return data, err
+	}
+	fields := map[string]json.RawMessage{}
+	if err = json.Unmarshal(data, &fields); err != nil {
+		return nil, err
+	}
+	for key, value := range d.extra {
+		fields[key] = value
+	}
+	return json.Marshal(fields)
+}
+
+// IPAMType 返回 ipam 插件的类型, 不存在时返回空字符串
+func (d *DelegateConf) IPAMType() string {
+	ipamType, _ := d.IPAM["type"].(string)
+	return ipamType
+}
+
+// DHCPConf 解析 ipam 中的 dhcp 客户端配置
+func (d *DelegateConf) DHCPConf() (conf *dhcp.ClientConf, err error) {
+	data, err := json.Marshal(d.IPAM)
+	if err != nil {
+		return nil, err
+	}
+	conf = &dhcp.ClientConf{}
+	if err = json.Unmarshal(data, conf); err != nil {
+		return nil, err
+	}
+	return conf, nil
+}
+
+// setDHCPConf 将 dhcp 客户端配置写回 ipam 中, 不影响 ipam 中的其他字段
+func (d *DelegateConf) setDHCPConf(conf *dhcp.ClientConf) {
+	data, _ := json.Marshal(conf)
+	fields := map[string]interface{}{}
+	_ = json.Unmarshal(data, &fields)
+	for k, v := range fields {
+		d.IPAM[k] = v
+	}
+}
+
+// DHCPSocketPath 返回 dhcp ipam 插件访问的守护进程 socket 路径
+func (d *DelegateConf) DHCPSocketPath() string {
+	if path, _ := d.IPAM["daemonSocketPath"].(string); path != "" {
+		return path
+	}
+	return dhcp.DefaultSocketPath
+}
+
+// NetworkConf 按网络名称覆盖 delegate 中的网桥与 VLAN, 用于作为 Multus 等方案的次要网络
+type NetworkConf struct {
+	Bridge string `json:"bridge"`
+	Vlan   int    `json:"vlan,omitempty"`
+	// ServiceRoute 次要网卡上默认不添加 service cidr 路由, 为 true 时添加
+	ServiceRoute bool `json:"serviceRoute,omitempty"`
+	// DNS 写入该网络 cni 结果的 DNS 配置, 为空时使用顶层的 dns 字段
+	DNS *types.DNS `json:"dns,omitempty"`
+	// DHCP 覆盖 delegate.ipam 中的 dhcp 客户端配置, 如 client-id 与是否使用下发的路由
+	DHCP *dhcp.ClientConf `json:"dhcp,omitempty"`
+}
+
+// defaultFallbackTimeout 开启备用地址时等待 dhcp 的默认时间
+const defaultFallbackTimeout = 15 * time.Second
+
+// DHCPFallbackConf dhcp 超时后向 cni server 申请 IPPool 中保留的备用地址, 避免 Pod 一直处于 ContainerCreating
+type DHCPFallbackConf struct {
+	// TimeoutMs 等待 dhcp 的时间(毫秒), 为 0 时使用默认值
+	TimeoutMs int `json:"timeoutMs,omitempty"`
+}
+
+// PolicyRoutingConf 策略路由的配置, 字段为 0 时使用 podroute 中的默认值
+type PolicyRoutingConf struct {
+	PodTable     int `json:"podTable,omitempty"`
+	HostTable    int `json:"hostTable,omitempty"`
+	RulePriority int `json:"rulePriority,omitempty"`
+	// ClusterCIDRs 除 service cidr 之外需要经过节点转发的网段
+	ClusterCIDRs []string `json:"clusterCIDRs,omitempty"`
+}
+
+// PolicyOpts 转换为 podroute 使用的参数, CIDR 格式已在 Validate 中检查
+func (p *PolicyRoutingConf) PolicyOpts() *podroute.PolicyOpts {
+	if p == nil {
+		return nil
+	}
+
+	opts := &podroute.PolicyOpts{
+		PodTable:     p.PodTable,
+		HostTable:    p.HostTable,
+		RulePriority: p.RulePriority,
+	}
+	if opts.PodTable == 0 {
+		opts.PodTable = podroute.DefaultPodTable
+	}
+	if opts.HostTable == 0 {
+		opts.HostTable = podroute.DefaultHostTable
+	}
+	if opts.RulePriority == 0 {
+		opts.RulePriority = podroute.DefaultRulePriority
+	}
+	for _, cidr := range p.ClusterCIDRs {
+		if _, ipNet, err := net.ParseCIDR(cidr); err == nil {
+			opts.ClusterCIDRs = append(opts.ClusterCIDRs, ipNet)
+		}
+	}
+
+	return opts
+}
+
 type NetConf struct {
 	types.NetConf
-	ServiceIPCIDR string `json:"serviceIPCIDR"`
-	Delegate      map[string]interface{}
+	ServiceIPCIDR string        `json:"serviceIPCIDR"`
+	Delegate      *DelegateConf `json:"delegate"`
 	// ServerSocket cni server 的 socket 路径
 	// cni server 是用来设置容器内部为固定 IP 的
 	ServerSocket string `json:"server_socket"`
+	// CtlSocket daemon 的 unix socket 路径, 由 daemon 根据 --ctl-socket 写入, 为空时使用默认值
+	CtlSocket string `json:"ctlSocket,omitempty"`
+	// Networks 以网络名称(即 name 字段)为 key 的网络配置
+	Networks map[string]*NetworkConf `json:"networks,omitempty"`
+	// PolicyRouting 不为空时启用策略路由
+	PolicyRouting *PolicyRoutingConf `json:"policyRouting,omitempty"`
+	// AnnounceCount 为静态 IP 发送免费 ARP / 非请求 NA 的次数, 为 0 时使用默认值, 小于 0 时不发送
+	AnnounceCount int `json:"announceCount,omitempty"`
+	// ProbeTimeoutMs 静态 IP 重复地址检测的等待时间(毫秒), 小于等于 0 时不检测.
+	// 检测在 cni server 分配地址之后进行, 每个静态 IP 都会让 ADD 增加这段时间, 建议为 1000 左右
+	ProbeTimeoutMs int `json:"probeTimeoutMs,omitempty"`
+	// ServerTimeoutMs 访问 cni server 与 daemon 时单次请求的超时时间(毫秒), 为 0 时使用默认值
+	ServerTimeoutMs int `json:"serverTimeoutMs,omitempty"`
+	// DHCPFallback 不为空时, dhcp 超时后使用 cni server 分配的备用地址
+	DHCPFallback *DHCPFallbackConf `json:"dhcpFallback,omitempty"`
+	// AntiSpoofing 为 true 时, 由 daemon 在 Pod veth 端口上限制只能使用分配的 IP 与 MAC
+	AntiSpoofing bool `json:"antiSpoofing,omitempty"`
+	// RuntimeConfig 由容器运行时根据 capabilities 注入的参数
+	RuntimeConfig RuntimeConfig `json:"runtimeConfig,omitempty"`
+}
+
+// RuntimeConfig 容器运行时注入的参数, 需要在 capabilities 中声明
+type RuntimeConfig struct {
+	// Bandwidth 运行时根据 Pod 的带宽注解生成, 对应 capabilities 中的 bandwidth
+	Bandwidth *restapi.BandwidthSpec `json:"bandwidth,omitempty"`
+	// PortMappings 运行时根据容器的 hostPort 生成, 对应 capabilities 中的 portMappings
+	PortMappings []restapi.PortMapping `json:"portMappings,omitempty"`
+}
+
+// GetProbeTimeout 返回重复地址检测的等待时间, 为 0 表示不检测
+func (n *NetConf) GetProbeTimeout() time.Duration {
+	if n.ProbeTimeoutMs <= 0 {
+		return 0
+	}
+	return time.Duration(n.ProbeTimeoutMs) * time.Millisecond
+}
+
+// ClientOptions 返回访问 cni server 与 daemon 的客户端参数
+func (n *NetConf) ClientOptions() *restapi.ClientOptions {
+	return &restapi.ClientOptions{Timeout: time.Duration(n.ServerTimeoutMs) * time.Millisecond}
+}
+
+// GetCtlSocket 返回 daemon 的 unix socket 路径
+func (n *NetConf) GetCtlSocket() string {
+	if n.CtlSocket == "" {
+		return restapi.DefaultCtlSocketPath
+	}
+	return n.CtlSocket
+}
+
+// GetAnnounceCount 返回实际使用的免费 ARP / 非请求 NA 发送次数
+func (n *NetConf) GetAnnounceCount() int {
+	if n.AnnounceCount == 0 {
+		return cninet.DefaultAnnounceCount
+	}
+	return n.AnnounceCount
+}
+
+// SetDHCPTimeout 开启备用地址时, 将等待 dhcp 的时间写入 ipam 配置, 内置的 dhcp 守护进程据此放弃获取租约.
+// 返回等待的时间, 没有开启或 ipam 不是 dhcp 时返回 0.
+func (n *NetConf) SetDHCPTimeout() time.Duration {
+	if n.DHCPFallback == nil || n.Delegate.IPAMType() != "dhcp" {
+		return 0
+	}
+	timeout := defaultFallbackTimeout
+	if n.DHCPFallback.TimeoutMs > 0 {
+		timeout = time.Duration(n.DHCPFallback.TimeoutMs) * time.Millisecond
+	}
+
+	conf, err := n.Delegate.DHCPConf()
+	if err != nil {
+		return timeout
+	}
+	// 按网络覆盖的更短的时间优先
+	if conf.TimeoutMs > 0 && time.Duration(conf.TimeoutMs)*time.Millisecond < timeout {
+		return time.Duration(conf.TimeoutMs) * time.Millisecond
+	}
+	conf.TimeoutMs = int(timeout / time.Millisecond)
+	n.Delegate.setDHCPConf(conf)
+	return timeout
 }
 
-// Complete 从 apiserver 获取 service cidr 范围, 然后写入到 cni netconf 中
-func (n *NetConf) Complete(netConfPath string) (err error) {
+// SelectNetwork 根据网络名称选择网桥与 VLAN, 并返回是否需要在网卡上添加 service cidr 路由
+// 主网卡总是添加 service cidr 路由, 次要网卡只在网络配置中显式开启时添加
+func (n *NetConf) SelectNetwork(primary bool) (serviceRoute bool) {
+	serviceRoute = primary
+
+	network, ok := n.Networks[n.Name]
+	if !ok {
+		return
+	}
+	n.Delegate.Bridge = network.Bridge
+	n.Delegate.Vlan = network.Vlan
+	if network.DHCP != nil && n.Delegate.IPAMType() == "dhcp" {
+		if conf, err := n.Delegate.DHCPConf(); err == nil {
+			conf.Override(network.DHCP)
+			n.Delegate.setDHCPConf(conf)
+		}
+	}
+
+	return serviceRoute || network.ServiceRoute
+}
+
+// Complete 从 apiserver 获取 service cidr 范围, 并写入 daemon 的 socket 路径与 hairpin 模式, 然后写入到 cni netconf 中
+func (n *NetConf) Complete(cmdOpts *CmdOpts, netConfPath string) (err error) {
 	// 读取配置文件
 	netConfContent, err := os.ReadFile(netConfPath)
 	if err != nil {
@@ -31,25 +316,86 @@ func (n *NetConf) Complete(netConfPath string) (err error) {
 	if err = json.Unmarshal(netConfContent, n); err != nil {
 		return fmt.Errorf("failed to parse netconf file: %v", err)
 	}
+	if err = n.Validate(); err != nil {
+		return fmt.Errorf("invalid netconf file: %v", err)
+	}
 
 	// 从 apiserver 获取 service cidr 范围
+	if err = n.discoverServiceIPCIDR(); err != nil {
+		return
+	}
+	n.CtlSocket = cmdOpts.CtlSocket
+	n.Delegate.HairpinMode = cmdOpts.HairpinMode
+
+	return n.WriteFile(netConfPath)
+}
+
+// Render 根据命令行参数与集群信息生成完整的 cni netconf, 然后写入到 netConfPath 中
+// 用于取代 initContainer 拷贝 ConfigMap 的方式
+func (n *NetConf) Render(cmdOpts *CmdOpts, netConfPath string) (err error) {
+	n.CNIVersion = cniVersion
+	n.Name = networkName
+	n.Type = pluginType
+	// 声明能力后, 容器运行时会将 Pod 的带宽注解与 hostPort 通过 runtimeConfig 传给插件
+	n.Capabilities = map[string]bool{"bandwidth": true, "portMappings": true}
+	n.ServerSocket = cmdOpts.ServerSocket
+	n.CtlSocket = cmdOpts.CtlSocket
+	// 配置中的 0 表示使用默认值, 参数为 0 时写入 -1 关闭发送
+	n.AnnounceCount = cmdOpts.AnnounceCount
+	if n.AnnounceCount == 0 {
+		n.AnnounceCount = -1
+	}
+	n.AntiSpoofing = cmdOpts.AntiSpoofing
+	n.ProbeTimeoutMs = int(cmdOpts.ProbeTimeout / time.Millisecond)
+	if cmdOpts.DHCPFallbackTimeout > 0 && cmdOpts.IPAM == "dhcp" {
+		n.DHCPFallback = &DHCPFallbackConf{TimeoutMs: int(cmdOpts.DHCPFallbackTimeout / time.Millisecond)}
+	}
+	n.Delegate = &DelegateConf{
+		CNIVersion:  cniVersion,
+		Name:        networkName,
+		Type:        "bridge",
+		Bridge:      cmdOpts.BridgeName,
+		IsGateway:   false,
+		HairpinMode: cmdOpts.HairpinMode,
+		MTU:         cmdOpts.MTU,
+		IPAM: map[string]interface{}{
+			"type": cmdOpts.IPAM,
+		},
+	}
+
+	// 显式指定了 service cidr 时不再访问 apiserver
+	if cmdOpts.ServiceIPCIDR != "" {
+		n.ServiceIPCIDR = cmdOpts.ServiceIPCIDR
+	} else if err = n.discoverServiceIPCIDR(); err != nil {
+		return
+	}
+	if err = n.Validate(); err != nil {
+		return fmt.Errorf("invalid rendered netconf: %v", err)
+	}
+
+	return n.WriteFile(netConfPath)
+}
+
+// discoverServiceIPCIDR 从 apiserver 获取 service cidr 范围, 写入到 NetConf 结构体中
+func (n *NetConf) discoverServiceIPCIDR() (err error) {
 	serviceIPCIDR, err := svcipcidr.GetServiceIPCIDR()
 	if err != nil {
 		return fmt.Errorf("failed to get service IP CIDR: %v", err)
 	}
 	klog.Infof("get service ip cidr: %s", serviceIPCIDR)
 
-	// 写入到 NetConf 结构体中
 	n.ServiceIPCIDR = serviceIPCIDR
+	return
+}
 
-	// 重新写入配置文件
-	netConfContent, err = json.Marshal(n)
+// WriteFile 将 NetConf 原子地写入配置文件, kubelet 不会读到写了一半的文件
+func (n *NetConf) WriteFile(netConfPath string) (err error) {
+	netConfContent, err := json.Marshal(n)
 	if err != nil {
 		return fmt.Errorf("failed to marshal netconf: %v", err)
 	}
 
-	// 写入配置文件
-	if err = os.WriteFile(netConfPath, netConfContent, 0644); err != nil {
+	if err = utilfile.WriteFileAtomic(netConfPath, netConfContent, 0644); err != nil {
 		return fmt.Errorf("failed to write into netconf file: %v", err)
 	}
 
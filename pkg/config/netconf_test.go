@@ -0,0 +1,161 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSelectNetworkDHCP(t *testing.T) {
+	n, err := LoadNetConf([]byte(`{
+		"name": "storage",
+		"type": "cni-tsunami",
+		"delegate": {"type": "bridge", "bridge": "br0", "ipam": {"type": "dhcp", "daemonSocketPath": "/run/dhcp.sock", "vendorClass": "tsunami", "useDNS": false}},
+		"networks": {"storage": {"bridge": "br1", "dhcp": {"clientID": "mac", "useMTU": false}}}
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	n.SelectNetwork(false)
+
+	conf, err := n.Delegate.DHCPConf()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conf.ClientID != "mac" || conf.VendorClass != "tsunami" || *conf.UseDNS || *conf.UseMTU || conf.UseRoutes != nil {
+		t.Errorf("network dhcp config should override ipam: %+v", conf)
+	}
+	// ipam 中的其他字段保持不变
+	if n.Delegate.IPAMType() != "dhcp" || n.Delegate.DHCPSocketPath() != "/run/dhcp.sock" {
+		t.Errorf("unexpected ipam: %v", n.Delegate.IPAM)
+	}
+}
+
+func TestValidateDHCP(t *testing.T) {
+	conf := `{"name":"net","type":"cni-tsunami","delegate":{"type":"bridge","bridge":"br0","ipam":%s}%s}`
+	for _, tt := range []struct {
+		ipam     string
+		networks string
+		valid    bool
+	}{
+		{`{"type":"dhcp","clientID":"pod","sendHostname":false}`, "", true},
+		{`{"type":"dhcp","clientID":"hostname"}`, "", false},
+		{`{"type":"dhcp","useDNS":"no"}`, "", false},
+		{`{"type":"dhcp"}`, `,"networks":{"net":{"bridge":"br1","dhcp":{"clientID":"uuid"}}}`, false},
+		// 其他 ipam 插件不检查 dhcp 字段
+		{`{"type":"host-local","clientID":"hostname"}`, "", true},
+		{`{"type":"dhcp"}`, `,"dhcpFallback":{"timeoutMs":5000}`, true},
+		{`{"type":"dhcp"}`, `,"dhcpFallback":{"timeoutMs":-1}`, false},
+		{`{"type":"host-local"}`, `,"dhcpFallback":{}`, false},
+		{`{"type":"dhcp"}`, `,"policyRouting":{"podTable":100,"hostTable":1000}`, true},
+		{`{"type":"dhcp"}`, `,"policyRouting":{"podTable":252,"hostTable":256}`, true},
+		{`{"type":"dhcp"}`, `,"policyRouting":{"podTable":253}`, false},
+		{`{"type":"dhcp"}`, `,"policyRouting":{"hostTable":254}`, false},
+		{`{"type":"dhcp"}`, `,"policyRouting":{"podTable":255}`, false},
+	} {
+		_, err := LoadNetConf([]byte(fmt.Sprintf(conf, tt.ipam, tt.networks)))
+		if (err == nil) != tt.valid {
+			t.Errorf("%s%s: valid %t, got %v", tt.ipam, tt.networks, tt.valid, err)
+		}
+	}
+}
+
+func TestSetDHCPTimeout(t *testing.T) {
+	conf := `{"name":"net","type":"cni-tsunami","delegate":{"type":"bridge","bridge":"br0","ipam":%s}%s}`
+	for _, tt := range []struct {
+		ipam     string
+		fallback string
+		want     time.Duration
+	}{
+		{`{"type":"dhcp"}`, "", 0},
+		{`{"type":"dhcp"}`, `,"dhcpFallback":{}`, defaultFallbackTimeout},
+		{`{"type":"dhcp"}`, `,"dhcpFallback":{"timeoutMs":5000}`, 5 * time.Second},
+		// ipam 中更短的时间优先
+		{`{"type":"dhcp","timeoutMs":2000}`, `,"dhcpFallback":{"timeoutMs":5000}`, 2 * time.Second},
+	} {
+		n, err := LoadNetConf([]byte(fmt.Sprintf(conf, tt.ipam, tt.fallback)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := n.SetDHCPTimeout(); got != tt.want {
+			t.Errorf("%s%s: got %s, want %s", tt.ipam, tt.fallback, got, tt.want)
+		}
+		dhcpConf, err := n.Delegate.DHCPConf()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tt.want != 0 && time.Duration(dhcpConf.TimeoutMs)*time.Millisecond != tt.want {
+			t.Errorf("%s%s: ipam timeout %dms, want %s", tt.ipam, tt.fallback, dhcpConf.TimeoutMs, tt.want)
+		}
+	}
+}
+
+// TestDelegateRoundTrip 未列出的 bridge 插件字段在传给 bridge 插件与写回配置文件时保留
+func TestDelegateRoundTrip(t *testing.T) {
+	n, err := LoadNetConf([]byte(`{
+		"name": "mycninet",
+		"type": "cni-tsunami",
+		"delegate": {"type": "bridge", "bridge": "br0", "ipMasq": true, "promiscMode": true, "dataDir": "/run/ipam", "ipam": {"type": "dhcp"}},
+		"networks": {"mycninet": {"bridge": "br1", "vlan": 100}}
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	n.SelectNetwork(true)
+
+	data, err := json.Marshal(n.Delegate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := map[string]interface{}{}
+	if err = json.Unmarshal(data, &got); err != nil {
+		t.Fatal(err)
+	}
+	if got["ipMasq"] != true || got["promiscMode"] != true || got["dataDir"] != "/run/ipam" {
+		t.Errorf("unknown delegate fields should be kept: %s", data)
+	}
+	if got["bridge"] != "br1" || got["vlan"] != float64(100) {
+		t.Errorf("selected network should override the delegate: %s", data)
+	}
+
+	// 写回配置文件时同样保留
+	data, err = json.Marshal(n)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reloaded, err := LoadNetConf(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(reloaded.Delegate.extra["dataDir"]) != `"/run/ipam"` {
+		t.Errorf("unknown delegate fields should survive rewriting the conf file: %s", data)
+	}
+}
+
+// TestRender --announce-count=0 关闭发送, 而配置中没有该字段时使用默认值; --ctl-socket 写入配置供插件使用
+func TestRender(t *testing.T) {
+	for count, want := range map[int]int{0: -1, 5: 5} {
+		path := filepath.Join(t.TempDir(), "10-tsunami.conf")
+		opts := &CmdOpts{BridgeName: "br0", IPAM: "dhcp", ServiceIPCIDR: "10.96.0.0/12", AnnounceCount: count, CtlSocket: "/run/tsunami/ctl.sock"}
+		if err := (&NetConf{}).Render(opts, path); err != nil {
+			t.Fatal(err)
+		}
+		content, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		n, err := LoadNetConf(content)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n.GetAnnounceCount() != want {
+			t.Errorf("--announce-count=%d: got %d, want %d", count, n.GetAnnounceCount(), want)
+		}
+		if n.GetCtlSocket() != opts.CtlSocket {
+			t.Errorf("unexpected ctl socket %s", n.GetCtlSocket())
+		}
+	}
+}
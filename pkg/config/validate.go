@@ -0,0 +1,177 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/containernetworking/cni/pkg/types"
+	"github.com/gitlayzer/tsunami/pkg/cniapi"
+	"golang.org/x/sys/unix"
+)
+
+// CNI spec 中定义的错误码, 当前依赖的 cni v0.7.1 中还没有对应的常量
+const (
+	// ErrDecodingFailure 配置无法解析
+	ErrDecodingFailure uint = 6
+	// ErrInvalidNetworkConfig 配置可以解析, 但内容不合法
+	ErrInvalidNetworkConfig uint = 7
+	// ErrTryAgainLater 暂时性错误, 容器运行时可以稍后重试
+	ErrTryAgainLater = cniapi.CodeTryAgainLater
+)
+
+// tsunami 自定义的错误码, CNI spec 中 100 及以上的错误码由插件自行定义, 与 cni server 接口中的错误码共用
+const (
+	// ErrAddressInUse 重复地址检测发现静态 IP 已被其他主机占用
+	ErrAddressInUse = cniapi.CodeAddressInUse
+	// ErrServerRejected cni server 拒绝了请求, 如静态 IP 分配失败
+	ErrServerRejected = cniapi.CodeRejected
+)
+
+// LoadNetConf 解析并校验 cni 插件从标准输入读取的配置
+// 返回的错误均为 *types.Error, 由 skel 原样输出给 kubelet
+func LoadNetConf(data []byte) (n *NetConf, err error) {
+	n = &NetConf{}
+	if err = json.Unmarshal(data, n); err != nil {
+		return nil, &types.Error{Code: ErrDecodingFailure, Msg: "failed to parse netconf", Details: err.Error()}
+	}
+
+	if err = n.Validate(); err != nil {
+		return nil, err
+	}
+
+	return n, nil
+}
+
+// LoadNetConfFile 读取并校验配置文件, 用于 `tsunami validate-config`
+func LoadNetConfFile(path string) (n *NetConf, err error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read netconf file: %v", err)
+	}
+
+	return LoadNetConf(data)
+}
+
+// invalidNetConf 构造 ErrInvalidNetworkConfig 类型的错误
+func invalidNetConf(format string, a ...interface{}) *types.Error {
+	return &types.Error{Code: ErrInvalidNetworkConfig, Msg: "invalid netconf", Details: fmt.Sprintf(format, a...)}
+}
+
+// Validate 检查必填字段, CIDR 格式与 socket 路径
+func (n *NetConf) Validate() error {
+	if n.Name == "" {
+		return invalidNetConf("name is required")
+	}
+	if n.Type == "" {
+		return invalidNetConf("type is required")
+	}
+
+	// serviceIPCIDR 在 daemon 补全之前可以为空, 此时 Pod 中会使用默认的 10.96.0.0/12
+	if n.ServiceIPCIDR != "" {
+		if _, _, err := net.ParseCIDR(n.ServiceIPCIDR); err != nil {
+			return invalidNetConf("serviceIPCIDR %q is not a valid CIDR: %v", n.ServiceIPCIDR, err)
+		}
+	}
+
+	if n.ServerSocket != "" && !filepath.IsAbs(n.ServerSocket) {
+		return invalidNetConf("server_socket %q must be an absolute path", n.ServerSocket)
+	}
+
+	d := n.Delegate
+	if d == nil {
+		return invalidNetConf("delegate is required")
+	}
+	if d.Type == "" {
+		return invalidNetConf("delegate.type is required")
+	}
+	if d.Bridge == "" {
+		return invalidNetConf("delegate.bridge is required")
+	}
+	if d.MTU < 0 || d.MTU > 65535 {
+		return invalidNetConf("delegate.mtu %d is out of range", d.MTU)
+	}
+	if d.IPAMType() == "" {
+		return invalidNetConf("delegate.ipam.type is required")
+	}
+	if d.Vlan < 0 || d.Vlan > 4094 {
+		return invalidNetConf("delegate.vlan %d is out of range", d.Vlan)
+	}
+	if d.IPAMType() == "dhcp" {
+		conf, err := d.DHCPConf()
+		if err != nil {
+			return invalidNetConf("delegate.ipam is not a valid dhcp config: %v", err)
+		}
+		if err = conf.Validate(); err != nil {
+			return invalidNetConf("delegate.ipam: %v", err)
+		}
+	}
+
+	if f := n.DHCPFallback; f != nil {
+		if d.IPAMType() != "dhcp" {
+			return invalidNetConf("dhcpFallback requires the dhcp ipam")
+		}
+		if f.TimeoutMs < 0 {
+			return invalidNetConf("dhcpFallback.timeoutMs must not be negative")
+		}
+	}
+
+	if p := n.PolicyRouting; p != nil {
+		if p.PodTable < 0 || p.HostTable < 0 || p.RulePriority < 0 {
+			return invalidNetConf("policyRouting tables and priority must not be negative")
+		}
+		if reservedTable(p.PodTable) || reservedTable(p.HostTable) {
+			return invalidNetConf("policyRouting tables must not be the reserved local, main or default table")
+		}
+		for _, cidr := range p.ClusterCIDRs {
+			if _, _, err := net.ParseCIDR(cidr); err != nil {
+				return invalidNetConf("policyRouting.clusterCIDRs %q is not a valid CIDR: %v", cidr, err)
+			}
+		}
+	}
+
+	if err := validateDNS("dns", &n.DNS); err != nil {
+		return err
+	}
+
+	for name, network := range n.Networks {
+		if network == nil || network.Bridge == "" {
+			return invalidNetConf("networks.%s.bridge is required", name)
+		}
+		if network.Vlan < 0 || network.Vlan > 4094 {
+			return invalidNetConf("networks.%s.vlan %d is out of range", name, network.Vlan)
+		}
+		if err := validateDNS("networks."+name+".dns", network.DNS); err != nil {
+			return err
+		}
+		if network.DHCP != nil {
+			if err := network.DHCP.Validate(); err != nil {
+				return invalidNetConf("networks.%s.dhcp: %v", name, err)
+			}
+		}
+	}
+
+	for i, pm := range n.RuntimeConfig.PortMappings {
+		if pm.HostPort <= 0 || pm.HostPort > 65535 || pm.ContainerPort <= 0 || pm.ContainerPort > 65535 {
+			return invalidNetConf("runtimeConfig.portMappings[%d] port is out of range", i)
+		}
+		switch strings.ToLower(pm.Protocol) {
+		case "", "tcp", "udp", "sctp":
+		default:
+			return invalidNetConf("runtimeConfig.portMappings[%d].protocol %q is not supported", i, pm.Protocol)
+		}
+		if pm.HostIP != "" && net.ParseIP(pm.HostIP) == nil {
+			return invalidNetConf("runtimeConfig.portMappings[%d].hostIP %q is not a valid ip", i, pm.HostIP)
+		}
+	}
+
+	return nil
+}
+
+// reservedTable 255, 254, 253 分别为 local, main, default 表, 更大的表 ID 可以正常使用
+func reservedTable(table int) bool {
+	return table == unix.RT_TABLE_LOCAL || table == unix.RT_TABLE_MAIN || table == unix.RT_TABLE_DEFAULT
+}
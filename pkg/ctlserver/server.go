@@ -0,0 +1,650 @@
+package ctlserver
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/vishvananda/netlink"
+	"k8s.io/klog"
+
+	"github.com/gitlayzer/tsunami/pkg/bridge"
+	"github.com/gitlayzer/tsunami/pkg/cninet"
+	"github.com/gitlayzer/tsunami/pkg/firewall"
+	"github.com/gitlayzer/tsunami/pkg/podevent"
+	"github.com/gitlayzer/tsunami/pkg/store"
+	"github.com/gitlayzer/tsunami/utils/restapi"
+	"github.com/gitlayzer/tsunami/utils/utilfile"
+)
+
+// DefaultSocketPath tsunamictl 与 daemon 通信的 unix socket 路径
+const DefaultSocketPath = restapi.DefaultCtlSocketPath
+
+// Options daemon 中与诊断相关的状态, 由 main 入口程序填充
+type Options struct {
+	SocketPath   string
+	BridgeName   string
+	Eth0Name     string
+	SnapshotPath string
+	DHCPSockPath string
+	// DHCPProc 由 daemon 启动的 dhcp 子进程, 如果 dhcp.sock 已存在则为 nil
+	DHCPProc *os.Process
+	// DHCPBuiltin 为 true 时 dhcp 守护进程运行在 daemon 中
+	DHCPBuiltin bool
+	Store       *store.Store
+	// Events 为空时(如无法获取集群凭证) /api/v1/events 接口不可用
+	Events *podevent.Recorder
+	// AntiSpoofing 为 true 时才接受防欺骗规则的请求
+	AntiSpoofing bool
+	// HostPorts 为 true 时才接受端口映射的请求, nat 表初始化失败时为 false
+	HostPorts bool
+}
+
+// Server tsunamictl 使用的诊断服务, 监听在 unix socket 上
+type Server struct {
+	opts   Options
+	server *http.Server
+}
+
+// New 创建 Server 对象
+func New(opts Options) *Server {
+	if opts.SocketPath == "" {
+		opts.SocketPath = DefaultSocketPath
+	}
+
+	s := &Server{opts: opts}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v1/status", s.handleStatus)
+	mux.HandleFunc("/api/v1/pods", s.handlePods)
+	mux.HandleFunc("/api/v1/leases", s.handleLeases)
+	mux.HandleFunc("/api/v1/routes", s.handleRoutes)
+	mux.HandleFunc("/api/v1/gc", s.handleGC)
+	mux.HandleFunc("/api/v1/restore", s.handleRestore)
+	mux.HandleFunc("/api/v1/events", s.handleEvents)
+	mux.HandleFunc("/api/v1/antispoof/add", s.handleAntiSpoofAdd)
+	mux.HandleFunc("/api/v1/antispoof/del", s.handleAntiSpoofDel)
+	mux.HandleFunc("/api/v1/hostport/add", s.handleHostPortAdd)
+	mux.HandleFunc("/api/v1/hostport/del", s.handleHostPortDel)
+	s.server = &http.Server{Handler: mux}
+
+	return s
+}
+
+// Start 开始监听 unix socket, 非阻塞
+func (s *Server) Start() (err error) {
+	if err = os.MkdirAll(filepath.Dir(s.opts.SocketPath), 0755); err != nil {
+		return fmt.Errorf("failed to create socket dir: %v", err)
+	}
+
+	// 上一次 daemon 退出时可能没有清理 socket 文件
+	if utilfile.Exists(s.opts.SocketPath) {
+		if err = os.Remove(s.opts.SocketPath); err != nil {
+			return fmt.Errorf("failed to remove stale socket: %v", err)
+		}
+	}
+
+	listener, err := net.Listen("unix", s.opts.SocketPath)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %v", s.opts.SocketPath, err)
+	}
+
+	go func() {
+		if err := s.server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			klog.Errorf("ctl server exited: %s", err)
+		}
+	}()
+	klog.Infof("ctl server listening on %s", s.opts.SocketPath)
+
+	return nil
+}
+
+// Stop 停止服务并移除 socket 文件
+func (s *Server) Stop() error {
+	return s.server.Shutdown(context.Background())
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		klog.Errorf("failed to write response: %s", err)
+	}
+}
+
+func writeError(w http.ResponseWriter, code int, err error) {
+	writeJSON(w, code, &restapi.ErrorResponse{Error: err.Error()})
+}
+
+// linkStatus 获取网络设备的状态, 出错时将错误信息记录在 Error 字段中
+func linkStatus(name string) (status restapi.LinkStatus) {
+	status.Name = name
+	link, err := netlink.LinkByName(name)
+	if err != nil {
+		status.Error = err.Error()
+		return
+	}
+
+	attrs := link.Attrs()
+	status.Index = attrs.Index
+	status.State = attrs.OperState.String()
+	status.MTU = attrs.MTU
+	if attrs.MasterIndex != 0 {
+		if master, err := netlink.LinkByIndex(attrs.MasterIndex); err == nil {
+			status.Master = master.Attrs().Name
+		}
+	}
+
+	addrs, err := netlink.AddrList(link, netlink.FAMILY_V4)
+	if err != nil {
+		status.Error = err.Error()
+		return
+	}
+	for _, addr := range addrs {
+		status.Addrs = append(status.Addrs, addr.IPNet.String())
+	}
+
+	return
+}
+
+func (s *Server) handleStatus(w http.ResponseWriter, r *http.Request) {
+	resp := &restapi.StatusResponse{
+		Bridge: linkStatus(s.opts.BridgeName),
+		Uplink: linkStatus(s.opts.Eth0Name),
+		DHCP: restapi.DHCPStatus{
+			Socket:       s.opts.DHCPSockPath,
+			SocketExists: utilfile.Exists(s.opts.DHCPSockPath),
+			Builtin:      s.opts.DHCPBuiltin,
+			Running:      s.opts.DHCPBuiltin,
+		},
+	}
+
+	if link, err := netlink.LinkByName(s.opts.BridgeName); err == nil {
+		routes, err := netlink.RouteList(link, netlink.FAMILY_V4)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		linkNames := map[int]string{link.Attrs().Index: s.opts.BridgeName}
+		for _, route := range routes {
+			resp.Routes = append(resp.Routes, cninet.FormatRoute(route, linkNames))
+		}
+	}
+
+	if proc := s.opts.DHCPProc; proc != nil {
+		resp.DHCP.Pid = proc.Pid
+		// 发送 0 号信号只检查进程是否存在
+		resp.DHCP.Running = proc.Signal(syscall.Signal(0)) == nil
+	}
+
+	if utilfile.Exists(s.opts.SnapshotPath) {
+		resp.Snapshot = s.opts.SnapshotPath
+	}
+
+	writeJSON(w, http.StatusOK, resp)
+}
+
+func toPodInfo(a *store.Attachment) restapi.PodInfo {
+	return restapi.PodInfo{
+		PodName:      a.PodName,
+		PodNamespace: a.PodNamespace,
+		ContainerID:  a.ContainerID,
+		IfName:       a.IfName,
+		NetNs:        a.NetNs,
+		MAC:          a.MAC,
+		IPAddress:    a.IPAddress,
+		Gateway:      a.Gateway,
+		Source:       a.Source,
+		Stale:        !utilfile.Exists(a.NetNs),
+	}
+}
+
+// handlePods 列出 Pod 网络信息
+func (s *Server) handlePods(w http.ResponseWriter, r *http.Request) {
+	list, err := s.opts.Store.List()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	pods := []restapi.PodInfo{}
+	for _, a := range list {
+		pods = append(pods, toPodInfo(a))
+	}
+
+	writeJSON(w, http.StatusOK, pods)
+}
+
+// leaseStatus 根据租约记录与当前时间生成租约的状态
+func leaseStatus(l *store.Lease, now time.Time) restapi.LeaseStatus {
+	status := restapi.LeaseStatus{
+		PodName:      l.PodName,
+		PodNamespace: l.PodNamespace,
+		ContainerID:  l.ContainerID,
+		IfName:       l.IfName,
+		MAC:          l.MAC,
+		IPAddress:    l.IPAddress,
+		Server:       l.Server,
+		RenewAt:      l.RenewAt,
+		RebindAt:     l.RebindAt,
+		ExpiresAt:    l.ExpiresAt,
+		State:        restapi.LeaseBound,
+	}
+	// DHCPv6 服务器以 DUID 标识
+	if l.Family == store.FamilyIPv6 {
+		status.Server = l.ServerID
+	}
+	switch {
+	case !utilfile.Exists(l.NetNs):
+		status.State = restapi.LeaseStale
+	case l.Expired(now):
+		status.State = restapi.LeaseExpired
+	case l.ExpiresAt.IsZero():
+	case !now.Before(l.RebindAt):
+		status.State = restapi.LeaseRebinding
+	case !now.Before(l.RenewAt):
+		status.State = restapi.LeaseRenewing
+	}
+	return status
+}
+
+// handleLeases 使用内置 dhcp 守护进程时返回租约记录, 否则只能根据 Attachment 列出 dhcp 分配的地址
+func (s *Server) handleLeases(w http.ResponseWriter, r *http.Request) {
+	leases := []restapi.LeaseStatus{}
+	if s.opts.DHCPBuiltin {
+		list, err := s.opts.Store.ListLeases()
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		now := time.Now()
+		for _, l := range list {
+			leases = append(leases, leaseStatus(l, now))
+		}
+		writeJSON(w, http.StatusOK, leases)
+		return
+	}
+
+	list, err := s.opts.Store.List()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	for _, a := range list {
+		if a.Source != store.SourceDHCP {
+			continue
+		}
+		status := restapi.LeaseStatus{
+			PodName:      a.PodName,
+			PodNamespace: a.PodNamespace,
+			ContainerID:  a.ContainerID,
+			IfName:       a.IfName,
+			MAC:          a.MAC,
+			IPAddress:    a.IPAddress,
+			State:        restapi.LeaseUnknown,
+		}
+		if !utilfile.Exists(a.NetNs) {
+			status.State = restapi.LeaseStale
+		}
+		leases = append(leases, status)
+	}
+	writeJSON(w, http.StatusOK, leases)
+}
+
+func (s *Server) handleRoutes(w http.ResponseWriter, r *http.Request) {
+	namespace := r.URL.Query().Get("namespace")
+	name := r.URL.Query().Get("name")
+	if name == "" {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("pod name is required"))
+		return
+	}
+	if namespace == "" {
+		namespace = "default"
+	}
+
+	found, err := s.opts.Store.FindPod(namespace, name)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if len(found) == 0 {
+		writeError(w, http.StatusNotFound, fmt.Errorf("pod %s/%s not found on this node", namespace, name))
+		return
+	}
+
+	// 同一个 Pod 的多个接口处于同一个网络命名空间中
+	netnsPath := found[0].NetNs
+	netns, err := ns.GetNS(netnsPath)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, fmt.Errorf("failed to open netns %q: %v", netnsPath, err))
+		return
+	}
+	defer netns.Close()
+
+	resp := &restapi.RoutesResponse{
+		Pod:   namespace + "/" + name,
+		NetNs: netnsPath,
+	}
+	err = netns.Do(func(_ ns.NetNS) (err error) {
+		resp.Routes, err = cninet.ListAllRoutes(netlink.FAMILY_ALL)
+		return err
+	})
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, resp)
+}
+
+func (s *Server) handleGC(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+		return
+	}
+	dryRun, _ := strconv.ParseBool(r.URL.Query().Get("dry_run"))
+
+	list, err := s.opts.Store.List()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	resp := &restapi.GCResponse{DryRun: dryRun, Removed: []restapi.PodInfo{}}
+	for _, a := range list {
+		// 网络命名空间还存在, 说明 Pod 仍在运行
+		if utilfile.Exists(a.NetNs) {
+			continue
+		}
+		if !dryRun {
+			// cmdDel 时 daemon 不可用, 残留的端口映射会把流量转发到之后复用该 IP 的 Pod
+			if err = s.delHostPorts(a); err != nil {
+				klog.Warningf("gc: failed to delete host ports of %s/%s (%s): %s", a.PodNamespace, a.PodName, a.ContainerID, err)
+				continue
+			}
+			if err = s.opts.Store.Delete(a.ContainerID, a.IfName); err != nil {
+				writeError(w, http.StatusInternalServerError, err)
+				return
+			}
+			klog.Infof("gc: removed stale attachment %s/%s (%s)", a.PodNamespace, a.PodName, a.ContainerID)
+		}
+		resp.Removed = append(resp.Removed, toPodInfo(a))
+	}
+
+	// 清理网络命名空间已经不存在的租约记录, 对应的租约会在下一次续租时由 dhcp 守护进程停止维护
+	if s.opts.DHCPBuiltin && !dryRun {
+		leases, err := s.opts.Store.ListLeases()
+		if err != nil {
+			klog.Warningf("gc: failed to list dhcp leases: %s", err)
+		}
+		for _, l := range leases {
+			if utilfile.Exists(l.NetNs) {
+				continue
+			}
+			if err := s.opts.Store.DeleteLease(l.ContainerID, l.Network, l.IfName, l.Family); err != nil {
+				klog.Warningf("gc: failed to delete dhcp lease %s of %s: %s", l.IPAddress, l.ContainerID, err)
+				continue
+			}
+			klog.Infof("gc: removed stale dhcp lease %s of %s/%s", l.IPAddress, l.PodNamespace, l.PodName)
+		}
+	}
+
+	// 清理 veth 已经不存在的端口规则, 如 cmdDel 时 daemon 不可用
+	if s.opts.AntiSpoofing && !dryRun {
+		ports, err := firewall.ListAntiSpoofPorts()
+		if err != nil {
+			klog.Warningf("gc: failed to list anti spoofing ports: %s", err)
+		}
+		for _, port := range ports {
+			if _, err := netlink.LinkByName(port); err == nil {
+				continue
+			}
+			if err := firewall.DelAntiSpoofPort(port); err != nil {
+				klog.Warningf("gc: failed to delete anti spoofing port %s: %s", port, err)
+				continue
+			}
+			klog.Infof("gc: removed anti spoofing rules of %s", port)
+		}
+	}
+
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// delHostPorts 移除 Attachment 记录中的端口映射
+func (s *Server) delHostPorts(a *store.Attachment) error {
+	if len(a.PortMappings) == 0 || !s.opts.HostPorts {
+		return nil
+	}
+	var ips []string
+	for _, ip := range a.AllIPs() {
+		ips = append(ips, ip.String())
+	}
+	c, err := hostPortContainer(a.ContainerID, ips, a.PortMappings)
+	if err != nil {
+		return err
+	}
+	return firewall.DelHostPorts(c)
+}
+
+func (s *Server) handleRestore(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+		return
+	}
+
+	snap, err := bridge.LoadSnapshot(s.opts.SnapshotPath)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	if err = bridge.RestoreFromSnapshot(snap); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	klog.Infof("restore: uninstalled bridge %s from snapshot, uplink %s", snap.Bridge, snap.Uplink)
+
+	if err = os.Remove(s.opts.SnapshotPath); err != nil {
+		klog.Warningf("failed to remove snapshot: %s", err)
+	}
+
+	writeJSON(w, http.StatusOK, &restapi.ErrorResponse{})
+}
+
+func (s *Server) handleEvents(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+		return
+	}
+	if s.opts.Events == nil {
+		writeError(w, http.StatusServiceUnavailable, fmt.Errorf("event recorder is not available"))
+		return
+	}
+
+	req := &restapi.PodEventRequest{}
+	if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	if len(req.Annotations) > 0 {
+		if err := s.opts.Events.Annotate(req.PodNamespace, req.PodName, req.Annotations); err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+	}
+	err := s.opts.Events.Event(req.PodNamespace, req.PodName, req.Type, req.Reason, req.Message)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, &restapi.ErrorResponse{})
+}
+
+// decodeAntiSpoof 解析防欺骗规则请求, 出错时已写入响应
+func (s *Server) decodeAntiSpoof(w http.ResponseWriter, r *http.Request) *restapi.AntiSpoofRequest {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+		return nil
+	}
+	if !s.opts.AntiSpoofing {
+		writeError(w, http.StatusServiceUnavailable, fmt.Errorf("anti spoofing is not enabled on daemon"))
+		return nil
+	}
+
+	req := &restapi.AntiSpoofRequest{}
+	if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return nil
+	}
+	if req.HostVeth == "" {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("host_veth is required"))
+		return nil
+	}
+
+	return req
+}
+
+func (s *Server) handleAntiSpoofAdd(w http.ResponseWriter, r *http.Request) {
+	req := s.decodeAntiSpoof(w, r)
+	if req == nil {
+		return
+	}
+
+	port := &firewall.AntiSpoofPort{HostVeth: req.HostVeth}
+	var err error
+	if port.MAC, err = net.ParseMAC(req.MAC); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("failed to parse mac %q: %v", req.MAC, err))
+		return
+	}
+	for _, ip := range req.IPs {
+		parsed := net.ParseIP(ip)
+		if parsed == nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("failed to parse ip %q", ip))
+			return
+		}
+		port.IPs = append(port.IPs, parsed)
+	}
+
+	if err = firewall.AddAntiSpoofPort(port); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	klog.Infof("add anti spoofing rules for %s (container %s): mac %s, ips %v", req.HostVeth, req.ContainerID, req.MAC, req.IPs)
+
+	writeJSON(w, http.StatusOK, &restapi.ErrorResponse{})
+}
+
+func (s *Server) handleAntiSpoofDel(w http.ResponseWriter, r *http.Request) {
+	req := s.decodeAntiSpoof(w, r)
+	if req == nil {
+		return
+	}
+
+	if err := firewall.DelAntiSpoofPort(req.HostVeth); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	klog.Infof("delete anti spoofing rules for %s (container %s)", req.HostVeth, req.ContainerID)
+
+	writeJSON(w, http.StatusOK, &restapi.ErrorResponse{})
+}
+
+// decodeHostPort 解析端口映射请求并转换为 firewall 使用的结构, 出错时已写入响应
+func (s *Server) decodeHostPort(w http.ResponseWriter, r *http.Request) *firewall.HostPortContainer {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+		return nil
+	}
+	if !s.opts.HostPorts {
+		writeError(w, http.StatusServiceUnavailable, fmt.Errorf("host ports are not available on daemon"))
+		return nil
+	}
+
+	req := &restapi.HostPortRequest{}
+	if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return nil
+	}
+	if req.ContainerID == "" {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("container_id is required"))
+		return nil
+	}
+
+	c, err := hostPortContainer(req.ContainerID, req.IPs, req.PortMappings)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return nil
+	}
+
+	return c
+}
+
+// hostPortContainer 将请求或 Attachment 记录中的端口映射转换为 firewall 使用的结构
+func hostPortContainer(containerID string, ips []string, mappings []restapi.PortMapping) (c *firewall.HostPortContainer, err error) {
+	c = &firewall.HostPortContainer{ContainerID: containerID}
+	for _, ip := range ips {
+		parsed := net.ParseIP(ip)
+		if parsed == nil {
+			return nil, fmt.Errorf("failed to parse ip %q", ip)
+		}
+		c.IPs = append(c.IPs, parsed)
+	}
+	for _, pm := range mappings {
+		mapping := firewall.PortMapping{
+			HostPort:      pm.HostPort,
+			ContainerPort: pm.ContainerPort,
+			Protocol:      strings.ToLower(pm.Protocol),
+		}
+		if mapping.Protocol == "" {
+			mapping.Protocol = "tcp"
+		}
+		if pm.HostIP != "" {
+			if mapping.HostIP = net.ParseIP(pm.HostIP); mapping.HostIP == nil {
+				return nil, fmt.Errorf("failed to parse host ip %q", pm.HostIP)
+			}
+		}
+		c.PortMappings = append(c.PortMappings, mapping)
+	}
+
+	return c, nil
+}
+
+func (s *Server) handleHostPortAdd(w http.ResponseWriter, r *http.Request) {
+	c := s.decodeHostPort(w, r)
+	if c == nil {
+		return
+	}
+
+	if err := firewall.AddHostPorts(c); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	klog.Infof("add %d host ports for container %s, ips %v", len(c.PortMappings), c.ContainerID, c.IPs)
+
+	writeJSON(w, http.StatusOK, &restapi.ErrorResponse{})
+}
+
+func (s *Server) handleHostPortDel(w http.ResponseWriter, r *http.Request) {
+	c := s.decodeHostPort(w, r)
+	if c == nil {
+		return
+	}
+
+	if err := firewall.DelHostPorts(c); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	klog.Infof("delete host ports for container %s", c.ContainerID)
+
+	writeJSON(w, http.StatusOK, &restapi.ErrorResponse{})
+}
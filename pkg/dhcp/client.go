@@ -0,0 +1,202 @@
+package dhcp
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"strings"
+	"time"
+
+	"k8s.io/klog"
+)
+
+// 首次重传的间隔与上限, 每次重传间隔翻倍
+const (
+	retransmitInterval = 2 * time.Second
+	maxRetransmit      = 16 * time.Second
+)
+
+var (
+	errTimeout = errors.New("timed out waiting for dhcp reply")
+	errNak     = errors.New("dhcp server replied nak")
+)
+
+// IsTimeout 判断获取租约的错误是否为等待 dhcp 应答超时, 错误经过 ipam 插件转发后只剩下字符串
+func IsTimeout(err error) bool {
+	return err != nil && strings.Contains(err.Error(), errTimeout.Error())
+}
+
+// conn 收发 dhcp 报文, 实现需要绑定在 Pod 网卡上
+type conn interface {
+	// Send 发送报文, dst 为空时广播
+	Send(m *Message, dst net.IP, dstMAC net.HardwareAddr) error
+	// Recv 接收发给客户端的报文, 并返回发送方的 MAC, 超过 deadline 时返回 errTimeout
+	Recv(deadline time.Time) (m *Message, srcMAC net.HardwareAddr, err error)
+	Close() error
+}
+
+// client 使用 conn 为一个 Pod 网卡获取与维护租约
+type client struct {
+	conn conn
+	conf *ClientConf
+	id   *Identity
+	// retransmit 首次重传的间隔, 测试中可以调小
+	retransmit time.Duration
+}
+
+func newClient(c conn, conf *ClientConf, id *Identity) *client {
+	return &client{conn: c, conf: conf, id: id, retransmit: retransmitInterval}
+}
+
+// newMessage 生成带有客户端身份选项的请求报文
+func (c *client) newMessage(typ byte, xid uint32) *Message {
+	m := &Message{
+		Op:      opRequest,
+		XID:     xid,
+		CHAddr:  c.id.MAC,
+		Options: c.conf.requestOptions(c.id),
+	}
+	m.Options[OptMessageType] = []byte{typ}
+	return m
+}
+
+// exchange 发送报文并等待 accept 接受的应答, 没有应答时按指数退避重传, 直到 deadline
+func (c *client) exchange(req *Message, dst net.IP, dstMAC net.HardwareAddr, deadline time.Time, accept func(*Message) bool) (reply *Message, srcMAC net.HardwareAddr, err error) {
+	interval := c.retransmit
+	for time.Now().Before(deadline) {
+		if err = c.conn.Send(req, dst, dstMAC); err != nil {
+			return nil, nil, err
+		}
+
+		wait := time.Now().Add(interval)
+		if wait.After(deadline) {
+			wait = deadline
+		}
+		for {
+			reply, srcMAC, err = c.conn.Recv(wait)
+			if err == errTimeout {
+				break
+			}
+			if err != nil {
+				return nil, nil, err
+			}
+			if reply.Op == opReply && reply.XID == req.XID && bytes.Equal(reply.CHAddr, req.CHAddr) && accept(reply) {
+				return reply, srcMAC, nil
+			}
+		}
+
+		if interval *= 2; interval > maxRetransmit {
+			interval = maxRetransmit
+		}
+	}
+	return nil, nil, errTimeout
+}
+
+func isType(types ...byte) func(*Message) bool {
+	return func(m *Message) bool {
+		for _, t := range types {
+			if m.Type() == t {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// acquire 通过 DISCOVER, OFFER, REQUEST, ACK 获取新的租约, 收到 NAK 时重新开始.
+// requested 不为空时在 DISCOVER 中请求该地址.
+func (c *client) acquire(requested net.IP, deadline time.Time) (l *Lease, err error) {
+	for {
+		xid := rand.Uint32()
+		discover := c.newMessage(MsgDiscover, xid)
+		if requested != nil {
+			discover.Options[OptRequestedIP] = ip4(requested)
+		}
+		offer, _, err := c.exchange(discover, nil, nil, deadline, isType(MsgOffer))
+		if err != nil {
+			return nil, fmt.Errorf("failed to discover dhcp server on %s: %v", c.id.IfName, err)
+		}
+
+		request := c.newMessage(MsgRequest, xid)
+		request.Options[OptRequestedIP] = ip4(offer.YIAddr)
+		request.Options[OptServerID] = offer.Options[OptServerID]
+		ack, srcMAC, err := c.exchange(request, nil, nil, deadline, isType(MsgAck, MsgNak))
+		if err != nil {
+			return nil, fmt.Errorf("failed to request %s on %s: %v", offer.YIAddr, c.id.IfName, err)
+		}
+		if ack.Type() == MsgNak {
+			klog.Warningf("dhcp server nak the request of %s for %s, restart discovery", c.id.Key(), offer.YIAddr)
+			requested = nil
+			continue
+		}
+
+		if l, err = parseLease(ack, c.conf, time.Now()); err != nil {
+			return nil, err
+		}
+		l.ServerMAC = srcMAC
+		return l, nil
+	}
+}
+
+// discover 发送 DISCOVER, 返回服务器提供的地址, 不会确认租约, 用于检测 dhcp 服务是否可用.
+// 部分服务器在 OFFER 之后会为客户端保留地址一段时间, 因此收到 OFFER 后立即发送 RELEASE 释放该地址.
+func (c *client) discover(deadline time.Time) (offered net.IP, err error) {
+	offer, srcMAC, err := c.exchange(c.newMessage(MsgDiscover, rand.Uint32()), nil, nil, deadline, isType(MsgOffer))
+	if err != nil {
+		return nil, err
+	}
+	l := &Lease{IP: net.IPNet{IP: offer.YIAddr}, ServerMAC: srcMAC}
+	if id := offer.Options[OptServerID]; len(id) == net.IPv4len {
+		l.Server = net.IP(id)
+	}
+	if err = c.release(l); err != nil {
+		klog.Warningf("failed to release offered address %s of %s: %s", offer.YIAddr, c.id.Key(), err)
+	}
+	return offer.YIAddr, nil
+}
+
+// renew 续租, 单播给分配租约的服务器; rebind 为 true 时广播给所有服务器.
+// 服务器拒绝时返回 errNak, 租约需要立即停止使用.
+func (c *client) renew(l *Lease, rebind bool, deadline time.Time) (renewed *Lease, err error) {
+	request := c.newMessage(MsgRequest, rand.Uint32())
+	request.CIAddr = l.IP.IP
+
+	var dst net.IP
+	var dstMAC net.HardwareAddr
+	if !rebind && l.Server != nil && l.ServerMAC != nil {
+		dst, dstMAC = l.Server, l.ServerMAC
+	}
+	ack, srcMAC, err := c.exchange(request, dst, dstMAC, deadline, isType(MsgAck, MsgNak))
+	if err != nil {
+		return nil, err
+	}
+	if ack.Type() == MsgNak {
+		return nil, errNak
+	}
+
+	if renewed, err = parseLease(ack, c.conf, time.Now()); err != nil {
+		return nil, err
+	}
+	if !renewed.IP.IP.Equal(l.IP.IP) {
+		return nil, fmt.Errorf("dhcp server renewed %s with a different address %s", l.IP.IP, renewed.IP.IP)
+	}
+	renewed.ServerMAC = srcMAC
+	return renewed, nil
+}
+
+// release 通知服务器释放租约, 服务器不会应答
+func (c *client) release(l *Lease) error {
+	release := c.newMessage(MsgRelease, rand.Uint32())
+	release.CIAddr = l.IP.IP
+	delete(release.Options, OptParamRequest)
+	if l.Server != nil {
+		release.Options[OptServerID] = ip4(l.Server)
+	}
+	return c.conn.Send(release, l.Server, l.ServerMAC)
+}
+
+func (c *client) close() error {
+	return c.conn.Close()
+}
@@ -0,0 +1,261 @@
+package dhcp
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"time"
+
+	"k8s.io/klog"
+)
+
+// 首次重传的间隔, 即 RFC 8415 中的 SOL_TIMEOUT 与 REQ_TIMEOUT
+const retransmitInterval6 = time.Second
+
+// conn6 收发 DHCPv6 报文, 实现需要绑定在 Pod 网卡的链路本地地址上
+type conn6 interface {
+	// Send 发送给所有 dhcp 中继与服务器的组播地址 ff02::1:2
+	Send(m *Message6) error
+	// Recv 接收发给客户端的报文, 超过 deadline 时返回 errTimeout
+	Recv(deadline time.Time) (*Message6, error)
+	Close() error
+}
+
+// client6 使用 conn6 为一个 Pod 网卡获取与维护 IA_NA 中的地址
+type client6 struct {
+	conn conn6
+	conf *ClientConf
+	id   *Identity
+	// retransmit 首次重传的间隔, 测试中可以调小
+	retransmit time.Duration
+}
+
+func newClient6(c conn6, conf *ClientConf, id *Identity) *client6 {
+	return &client6{conn: c, conf: conf, id: id, retransmit: retransmitInterval6}
+}
+
+// newMessage 生成带有客户端身份选项的请求报文, addr 不为空时在 IA_NA 中带上该地址
+func (c *client6) newMessage(typ byte, addr net.IP) *Message6 {
+	m := &Message6{Type: typ, XID: rand.Uint32() & 0xffffff, Options: c.conf.requestOptions6(c.id)}
+	m.Add(Opt6ElapsedTime, []byte{0, 0})
+	ia := &iaNA{IAID: iaid(c.id)}
+	if addr != nil {
+		ia.Addrs = []iaAddr{{IP: addr}}
+	}
+	m.Add(Opt6IANA, ia.marshal())
+	return m
+}
+
+func isType6(typ byte) func(*Message6) bool {
+	return func(m *Message6) bool {
+		return m.Type == typ
+	}
+}
+
+// exchange 发送报文并等待 accept 接受的应答, 没有应答时按指数退避重传, 直到 deadline.
+// 每次重传时更新 option 8 中经过的时间.
+func (c *client6) exchange(req *Message6, deadline time.Time, accept func(*Message6) bool) (reply *Message6, err error) {
+	start := time.Now()
+	interval := c.retransmit
+	for time.Now().Before(deadline) {
+		for i := range req.Options {
+			if req.Options[i].Code == Opt6ElapsedTime {
+				elapsed := time.Since(start) / (10 * time.Millisecond)
+				if elapsed > 0xffff {
+					elapsed = 0xffff
+				}
+				req.Options[i].Data = binary.BigEndian.AppendUint16(nil, uint16(elapsed))
+			}
+		}
+		if err = c.conn.Send(req); err != nil {
+			return nil, err
+		}
+
+		wait := time.Now().Add(interval)
+		if wait.After(deadline) {
+			wait = deadline
+		}
+		for {
+			reply, err = c.conn.Recv(wait)
+			if err == errTimeout {
+				break
+			}
+			if err != nil {
+				return nil, err
+			}
+			if reply.XID == req.XID && accept(reply) {
+				return reply, nil
+			}
+		}
+
+		if interval *= 2; interval > maxRetransmit {
+			interval = maxRetransmit
+		}
+	}
+	return nil, errTimeout
+}
+
+// findIA 返回应答中属于该网卡的 IA_NA
+func (c *client6) findIA(m *Message6) (ia *iaNA, err error) {
+	for _, opt := range m.Options {
+		if opt.Code != Opt6IANA {
+			continue
+		}
+		if ia, err = parseIANA(opt.Data); err != nil {
+			return nil, err
+		}
+		if ia.IAID == iaid(c.id) {
+			return ia, nil
+		}
+	}
+	return nil, errors.New("dhcpv6 reply has no IA_NA")
+}
+
+// hasAddress 判断 ADVERTISE 中是否提供了地址
+func (c *client6) hasAddress(m *Message6) bool {
+	if m.Type != Msg6Advertise || m.Get(Opt6ServerID) == nil {
+		return false
+	}
+	ia, err := c.findIA(m)
+	return err == nil && ia.Status.Code == status6Success && len(ia.Addrs) > 0
+}
+
+// acquire 通过 SOLICIT, ADVERTISE, REQUEST, REPLY 获取新的地址, 服务器没有可用地址时重新开始.
+// requested 不为空时在 SOLICIT 中请求该地址.
+func (c *client6) acquire(requested net.IP, deadline time.Time) (l *Lease, err error) {
+	for {
+		advertise, err := c.exchange(c.newMessage(Msg6Solicit, requested), deadline, c.hasAddress)
+		if err != nil {
+			return nil, fmt.Errorf("failed to solicit dhcpv6 server on %s: %v", c.id.IfName, err)
+		}
+		ia, _ := c.findIA(advertise)
+
+		request := c.newMessage(Msg6Request, ia.Addrs[0].IP)
+		request.Add(Opt6ServerID, advertise.Get(Opt6ServerID))
+		reply, err := c.exchange(request, deadline, isType6(Msg6Reply))
+		if err != nil {
+			return nil, fmt.Errorf("failed to request %s on %s: %v", ia.Addrs[0].IP, c.id.IfName, err)
+		}
+
+		l, err = parseLease6(reply, c.conf, iaid(c.id), time.Now())
+		var status *status6
+		if errors.As(err, &status) && status.Code == status6NoAddrsAvail {
+			klog.Warningf("dhcpv6 server has no address for %s, restart solicitation", c.id.Key())
+			requested = nil
+			continue
+		}
+		return l, err
+	}
+}
+
+// renew 续租, 带上分配地址的服务器的 DUID; rebind 为 true 时不指定服务器.
+// 服务器没有该绑定或收回了地址时返回 errNak, 地址需要立即停止使用.
+func (c *client6) renew(l *Lease, rebind bool, deadline time.Time) (renewed *Lease, err error) {
+	typ := Msg6Renew
+	if rebind {
+		typ = Msg6Rebind
+	}
+	request := c.newMessage(typ, l.IP.IP)
+	if !rebind {
+		request.Add(Opt6ServerID, l.ServerID)
+	}
+	reply, err := c.exchange(request, deadline, isType6(Msg6Reply))
+	if err != nil {
+		return nil, err
+	}
+
+	renewed, err = parseLease6(reply, c.conf, iaid(c.id), time.Now())
+	var status *status6
+	if errors.As(err, &status) && (status.Code == status6NoBinding || status.Code == status6NoAddrsAvail) {
+		return nil, errNak
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !renewed.IP.IP.Equal(l.IP.IP) {
+		return nil, fmt.Errorf("dhcpv6 server renewed %s with a different address %s", l.IP.IP, renewed.IP.IP)
+	}
+	return renewed, nil
+}
+
+// release 通知服务器释放地址, 不等待应答
+func (c *client6) release(l *Lease) error {
+	release := c.newMessage(Msg6Release, l.IP.IP)
+	release.Add(Opt6ServerID, l.ServerID)
+	return c.conn.Send(release)
+}
+
+func (c *client6) close() error {
+	return c.conn.Close()
+}
+
+// parseLease6 根据 REPLY 生成租约, 地址的前缀长度为 128, 网关与路由来自路由通告.
+// IA_NA 的状态码不为成功时返回 *status6, 地址的有效期为 0 表示服务器收回了地址, 返回 errNak.
+func parseLease6(reply *Message6, conf *ClientConf, iaid uint32, now time.Time) (l *Lease, err error) {
+	if status := parseStatus6(reply.Options); status.Code != status6Success {
+		return nil, status
+	}
+	var ia *iaNA
+	for _, opt := range reply.Options {
+		if opt.Code != Opt6IANA {
+			continue
+		}
+		if ia, err = parseIANA(opt.Data); err != nil {
+			return nil, err
+		}
+		if ia.IAID == iaid {
+			break
+		}
+		ia = nil
+	}
+	if ia == nil {
+		return nil, errors.New("dhcpv6 reply has no IA_NA")
+	}
+	if ia.Status.Code != status6Success {
+		return nil, ia.Status
+	}
+	if len(ia.Addrs) == 0 {
+		return nil, errors.New("dhcpv6 reply has no address")
+	}
+	addr := ia.Addrs[0]
+	if addr.Valid == 0 {
+		return nil, errNak
+	}
+
+	l = &Lease{
+		IP:       net.IPNet{IP: addr.IP, Mask: net.CIDRMask(128, 128)},
+		ServerID: reply.Get(Opt6ServerID),
+		Acquired: now,
+	}
+	// 0xffffffff 表示永久有效; T1, T2 为 0 时按照首选生存期的 0.5 与 0.8 计算
+	if addr.Valid != 0xffffffff {
+		l.Duration = time.Duration(addr.Valid) * time.Second
+		preferred := time.Duration(addr.Preferred) * time.Second
+		if preferred == 0 || preferred > l.Duration {
+			preferred = l.Duration
+		}
+		l.T1, l.T2 = preferred/2, preferred*4/5
+		if ia.T1 != 0 && time.Duration(ia.T1)*time.Second < l.Duration {
+			l.T1 = time.Duration(ia.T1) * time.Second
+		}
+		if ia.T2 != 0 && time.Duration(ia.T2)*time.Second < l.Duration {
+			l.T2 = time.Duration(ia.T2) * time.Second
+		}
+		if l.T2 < l.T1 {
+			l.T2 = l.T1
+		}
+	}
+
+	if enabled(conf.UseDNS) {
+		for v := reply.Get(Opt6DNSServers); len(v) >= 16; v = v[16:] {
+			l.DNS.Nameservers = append(l.DNS.Nameservers, net.IP(v[:16]).String())
+		}
+		if l.DNS.Search, err = parseDomainList(reply.Get(Opt6DomainList)); err != nil {
+			return nil, err
+		}
+	}
+
+	return l, nil
+}
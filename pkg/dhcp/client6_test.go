@@ -0,0 +1,198 @@
+package dhcp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeServer6 内存中的 DHCPv6 服务器, 实现 conn6 接口, 总是分配同一个地址
+type fakeServer6 struct {
+	mu       sync.Mutex
+	ip       net.IP
+	duid     []byte
+	noAddrs  int
+	noBind   int
+	drop     int
+	requests []*Message6
+	replies  []*Message6
+}
+
+func newFakeServer6() *fakeServer6 {
+	return &fakeServer6{ip: net.ParseIP("2001:db8::100"), duid: []byte{0, 3, 0, 1, 0x02, 0, 0, 0, 0, 0x67}}
+}
+
+func (s *fakeServer6) reply(req *Message6, typ byte, status uint16) *Message6 {
+	ia, _ := parseIANA(req.Get(Opt6IANA))
+	reply := &Message6{Type: typ, XID: req.XID}
+	reply.Add(Opt6ClientID, req.Get(Opt6ClientID))
+	reply.Add(Opt6ServerID, s.duid)
+	if status != status6Success {
+		ia = &iaNA{IAID: ia.IAID}
+		b := append(ia.marshal(), marshalOptions6([]Option6{{Code: Opt6StatusCode, Data: []byte{0, byte(status)}}})...)
+		reply.Add(Opt6IANA, b)
+		return reply
+	}
+	ia = &iaNA{IAID: ia.IAID, Addrs: []iaAddr{{IP: s.ip, Preferred: 1800, Valid: 3600}}}
+	reply.Add(Opt6IANA, ia.marshal())
+	reply.Add(Opt6DNSServers, net.ParseIP("2001:db8::53"))
+	reply.Add(Opt6DomainList, append(encodeDomain("example.com"), 0))
+	return reply
+}
+
+func (s *fakeServer6) Send(m *Message6) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.requests = append(s.requests, m)
+	if s.drop > 0 {
+		s.drop--
+		return nil
+	}
+
+	switch m.Type {
+	case Msg6Solicit:
+		s.replies = append(s.replies, s.reply(m, Msg6Advertise, status6Success))
+	case Msg6Request:
+		if s.noAddrs > 0 {
+			s.noAddrs--
+			s.replies = append(s.replies, s.reply(m, Msg6Reply, status6NoAddrsAvail))
+		} else {
+			s.replies = append(s.replies, s.reply(m, Msg6Reply, status6Success))
+		}
+	case Msg6Renew, Msg6Rebind:
+		if s.noBind > 0 {
+			s.noBind--
+			s.replies = append(s.replies, s.reply(m, Msg6Reply, status6NoBinding))
+		} else {
+			s.replies = append(s.replies, s.reply(m, Msg6Reply, status6Success))
+		}
+	}
+	return nil
+}
+
+func (s *fakeServer6) Recv(deadline time.Time) (*Message6, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.replies) == 0 {
+		return nil, errTimeout
+	}
+	m := s.replies[0]
+	s.replies = s.replies[1:]
+	return m, nil
+}
+
+func (s *fakeServer6) Close() error {
+	return nil
+}
+
+func (s *fakeServer6) types() (types []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, m := range s.requests {
+		types = append(types, m.Type)
+	}
+	return types
+}
+
+func (s *fakeServer6) last() *Message6 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.requests[len(s.requests)-1]
+}
+
+func TestAcquire6(t *testing.T) {
+	s := newFakeServer6()
+	s.noAddrs = 1
+	c := newClient6(s, &ClientConf{}, testID)
+	c.retransmit = time.Millisecond
+
+	l, err := c.acquire(nil, time.Now().Add(time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l.IP.String() != "2001:db8::100/128" || !bytes.Equal(l.ServerID, s.duid) {
+		t.Errorf("unexpected lease: %+v", l)
+	}
+	// 没有 T1, T2 时按照首选生存期计算
+	if l.Duration != time.Hour || l.T1 != 15*time.Minute || l.T2 != 24*time.Minute {
+		t.Errorf("unexpected lease times: %s %s %s", l.Duration, l.T1, l.T2)
+	}
+	if len(l.DNS.Nameservers) != 1 || l.DNS.Nameservers[0] != "2001:db8::53" || len(l.DNS.Search) != 1 || l.DNS.Search[0] != "example.com" {
+		t.Errorf("unexpected dns: %+v", l.DNS)
+	}
+
+	// 没有可用地址时重新开始
+	if got := string(s.types()); got != string([]byte{Msg6Solicit, Msg6Request, Msg6Solicit, Msg6Request}) {
+		t.Errorf("unexpected message sequence %v", []byte(got))
+	}
+	req := s.last()
+	if !bytes.Equal(req.Get(Opt6ServerID), s.duid) || !bytes.Equal(req.Get(Opt6ClientID), (&ClientConf{}).duid(testID)) {
+		t.Errorf("request should carry both duids: %+v", req)
+	}
+	ia, err := parseIANA(req.Get(Opt6IANA))
+	if err != nil || ia.IAID != iaid(testID) || len(ia.Addrs) != 1 || !ia.Addrs[0].IP.Equal(s.ip) {
+		t.Errorf("request should select the advertised address: %+v %v", ia, err)
+	}
+	if fqdn := req.Get(Opt6ClientFQDN); string(fqdn) != "\x04\x05web-0" {
+		t.Errorf("unexpected client fqdn %q", fqdn)
+	}
+}
+
+func TestAcquire6Timeout(t *testing.T) {
+	s := newFakeServer6()
+	s.drop = 1 << 20
+	c := newClient6(s, &ClientConf{}, testID)
+	c.retransmit = time.Millisecond
+
+	if _, err := c.acquire(nil, time.Now().Add(20*time.Millisecond)); !IsTimeout(err) {
+		t.Fatalf("expected timeout, got %v", err)
+	}
+	if n := len(s.types()); n < 2 {
+		t.Errorf("solicit should be retransmitted, sent %d", n)
+	}
+	// 重传时更新经过的时间
+	if elapsed := binary.BigEndian.Uint16(s.last().Get(Opt6ElapsedTime)); elapsed == 0 {
+		t.Errorf("elapsed time should be updated on retransmission")
+	}
+}
+
+func TestRenew6(t *testing.T) {
+	s := newFakeServer6()
+	c := newClient6(s, &ClientConf{}, testID)
+	c.retransmit = time.Millisecond
+	l, err := c.acquire(nil, time.Now().Add(time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	renewed, err := c.renew(l, false, time.Now().Add(time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if last := s.last(); last.Type != Msg6Renew || !bytes.Equal(last.Get(Opt6ServerID), s.duid) {
+		t.Errorf("renew should be sent to the server that assigned the address: %+v", last)
+	}
+	if renewed.IP.String() != l.IP.String() || renewed.Duration != time.Hour {
+		t.Errorf("unexpected renewed lease: %+v", renewed)
+	}
+
+	// 重新绑定时不指定服务器
+	if _, err = c.renew(l, true, time.Now().Add(time.Second)); err != nil || s.last().Get(Opt6ServerID) != nil {
+		t.Errorf("rebind must not carry a server id: %v", err)
+	}
+
+	s.noBind = 1
+	if _, err = c.renew(l, false, time.Now().Add(time.Second)); err != errNak {
+		t.Errorf("expected nak, got %v", err)
+	}
+
+	if err = c.release(l); err != nil {
+		t.Fatal(err)
+	}
+	if last := s.last(); last.Type != Msg6Release || !bytes.Equal(last.Get(Opt6ServerID), s.duid) {
+		t.Errorf("unexpected release: %+v", last)
+	}
+}
@@ -0,0 +1,183 @@
+package dhcp
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeServer 内存中的 dhcp 服务器, 实现 conn 接口, 总是分配同一个地址
+type fakeServer struct {
+	mu       sync.Mutex
+	ip       net.IP
+	mac      net.HardwareAddr
+	nak      int
+	drop     int
+	requests []*Message
+	// dsts 记录每个报文的目的地址, 空表示广播
+	dsts    []net.IP
+	replies []*Message
+}
+
+func newFakeServer() *fakeServer {
+	return &fakeServer{ip: net.ParseIP("192.168.1.100").To4(), mac: net.HardwareAddr{0x02, 0, 0, 0, 0, 0x67}}
+}
+
+func (s *fakeServer) reply(req *Message, typ byte) *Message {
+	return &Message{
+		Op:     opReply,
+		XID:    req.XID,
+		YIAddr: s.ip,
+		CHAddr: req.CHAddr,
+		Options: map[byte][]byte{
+			OptMessageType: {typ},
+			OptServerID:    {192, 168, 1, 1},
+			OptSubnetMask:  {255, 255, 255, 0},
+			OptRouter:      {192, 168, 1, 1},
+			OptLeaseTime:   {0, 0, 0x0e, 0x10},
+			OptMTU:         {0x05, 0x78},
+			OptDNS:         {192, 168, 1, 53},
+		},
+	}
+}
+
+func (s *fakeServer) Send(m *Message, dst net.IP, dstMAC net.HardwareAddr) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.requests = append(s.requests, m)
+	s.dsts = append(s.dsts, dst)
+	if s.drop > 0 {
+		s.drop--
+		return nil
+	}
+
+	switch m.Type() {
+	case MsgDiscover:
+		s.replies = append(s.replies, s.reply(m, MsgOffer))
+	case MsgRequest:
+		if s.nak > 0 {
+			s.nak--
+			s.replies = append(s.replies, s.reply(m, MsgNak))
+		} else {
+			s.replies = append(s.replies, s.reply(m, MsgAck))
+		}
+	}
+	return nil
+}
+
+func (s *fakeServer) Recv(deadline time.Time) (*Message, net.HardwareAddr, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.replies) == 0 {
+		return nil, nil, errTimeout
+	}
+	m := s.replies[0]
+	s.replies = s.replies[1:]
+	return m, s.mac, nil
+}
+
+func (s *fakeServer) Close() error {
+	return nil
+}
+
+func (s *fakeServer) types() (types []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, m := range s.requests {
+		types = append(types, m.Type())
+	}
+	return types
+}
+
+var testID = &Identity{
+	ContainerID:  "abc",
+	Network:      "mycninet",
+	IfName:       "eth0",
+	PodName:      "web-0",
+	PodNamespace: "team",
+	MAC:          net.HardwareAddr{0x0a, 0x58, 0x0a, 0x00, 0x00, 0x01},
+}
+
+func TestAcquire(t *testing.T) {
+	s := newFakeServer()
+	s.nak = 1
+	c := newClient(s, &ClientConf{}, testID)
+	c.retransmit = time.Millisecond
+
+	l, err := c.acquire(nil, time.Now().Add(time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l.IP.String() != "192.168.1.100/24" || l.MTU != 1400 || l.ServerMAC.String() != s.mac.String() || l.Server.String() != "192.168.1.1" {
+		t.Errorf("unexpected lease: %+v", l)
+	}
+
+	// 收到 NAK 后重新开始
+	if got := string(s.types()); got != string([]byte{MsgDiscover, MsgRequest, MsgDiscover, MsgRequest}) {
+		t.Errorf("unexpected message sequence %v", []byte(got))
+	}
+	req := s.requests[len(s.requests)-1]
+	if string(req.Options[OptHostname]) != "web-0" || string(req.Options[OptClientID]) != "\x00team/web-0" {
+		t.Errorf("request should carry the pod identity: %q %q", req.Options[OptHostname], req.Options[OptClientID])
+	}
+	if !net.IP(req.Options[OptRequestedIP]).Equal(s.ip) || len(req.Options[OptServerID]) != 4 {
+		t.Errorf("request should select the offer: %v", req.Options)
+	}
+}
+
+func TestAcquireTimeout(t *testing.T) {
+	s := newFakeServer()
+	s.drop = 1 << 20
+	c := newClient(s, &ClientConf{}, testID)
+	c.retransmit = time.Millisecond
+
+	if _, err := c.acquire(nil, time.Now().Add(20*time.Millisecond)); err == nil {
+		t.Fatal("expected timeout")
+	}
+	if n := len(s.types()); n < 2 {
+		t.Errorf("discover should be retransmitted, sent %d", n)
+	}
+}
+
+func TestRenew(t *testing.T) {
+	s := newFakeServer()
+	c := newClient(s, &ClientConf{}, testID)
+	c.retransmit = time.Millisecond
+	l, err := c.acquire(nil, time.Now().Add(time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	renewed, err := c.renew(l, false, time.Now().Add(time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	last := s.requests[len(s.requests)-1]
+	if !last.CIAddr.Equal(s.ip) || !s.dsts[len(s.dsts)-1].Equal(l.Server) {
+		t.Errorf("renew should be unicast to the server with ciaddr: %s %s", last.CIAddr, s.dsts[len(s.dsts)-1])
+	}
+	if _, ok := last.Options[OptServerID]; ok {
+		t.Errorf("renew must not carry a server id")
+	}
+	if !renewed.Acquired.After(l.Acquired) {
+		t.Errorf("renewed lease should start later")
+	}
+
+	// 重新绑定时广播
+	if _, err = c.renew(l, true, time.Now().Add(time.Second)); err != nil || s.dsts[len(s.dsts)-1] != nil {
+		t.Errorf("rebind should be broadcast: %v %s", err, s.dsts[len(s.dsts)-1])
+	}
+
+	s.nak = 1
+	if _, err = c.renew(l, false, time.Now().Add(time.Second)); err != errNak {
+		t.Errorf("expected nak, got %v", err)
+	}
+
+	if err = c.release(l); err != nil {
+		t.Fatal(err)
+	}
+	if last := s.requests[len(s.requests)-1]; last.Type() != MsgRelease || !last.CIAddr.Equal(s.ip) {
+		t.Errorf("unexpected release: %+v", last)
+	}
+}
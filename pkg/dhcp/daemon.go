@@ -0,0 +1,312 @@
+package dhcp
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/rpc"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/containernetworking/cni/pkg/types"
+	"github.com/containernetworking/cni/pkg/types/current"
+	"github.com/gitlayzer/tsunami/pkg/store"
+	"github.com/gitlayzer/tsunami/utils/skelargs"
+	"k8s.io/klog"
+)
+
+// DefaultSocketPath dhcp ipam 插件默认访问的 socket 路径
+const DefaultSocketPath = "/run/cni/dhcp.sock"
+
+// acquireTimeout 为 Pod 获取租约的最长时间
+const acquireTimeout = 30 * time.Second
+
+// DHCP 内置的 dhcp 守护进程, 与 cni dhcp 插件的 daemon 使用相同的 rpc 接口,
+// 节点上的 dhcp ipam 插件不需要修改. 与之不同的是, 请求中会带上 Pod 的身份, 并使用租约中的路由, MTU 与 DNS.
+type DHCP struct {
+	mu     sync.Mutex
+	leases map[string]*holder
+
+	dial     dialFunc
+	dial6    dial6Func
+	timeout  time.Duration
+	store    *store.Store
+	listener net.Listener
+	sockPath string
+}
+
+// NewDHCP 创建 DHCP 对象, leaseStore 不为空时持久化租约, 重启后继续续租
+func NewDHCP(leaseStore *store.Store) *DHCP {
+	return &DHCP{
+		leases:  map[string]*holder{},
+		dial:    dialRaw,
+		dial6:   dialUDP6,
+		timeout: acquireTimeout,
+		store:   leaseStore,
+	}
+}
+
+// ipamConf Allocate 与 Release 只关心的网络名称与 ipam 中的客户端配置
+type ipamConf struct {
+	Name string     `json:"name"`
+	IPAM ClientConf `json:"ipam"`
+}
+
+// parseArgs 从 ipam 插件转发的参数中获取租约的身份与客户端配置
+func parseArgs(args *skel.CmdArgs) (id *Identity, conf *ClientConf, err error) {
+	c := &ipamConf{}
+	if err = json.Unmarshal(args.StdinData, c); err != nil {
+		return nil, nil, fmt.Errorf("error parsing netconf: %v", err)
+	}
+	if err = c.IPAM.Validate(); err != nil {
+		return nil, nil, err
+	}
+
+	id = &Identity{ContainerID: args.ContainerID, Network: c.Name, IfName: args.IfName}
+	// 不是由 kubelet 调用时没有 Pod 信息, 此时使用容器 ID 作为 client-id
+	id.PodName, _ = skelargs.ParseValueFromArgs("K8S_POD_NAME", args.Args)
+	id.PodNamespace, _ = skelargs.ParseValueFromArgs("K8S_POD_NAMESPACE", args.Args)
+	return id, &c.IPAM, nil
+}
+
+// Allocate 为 Pod 网卡获取租约, 并在后台维护, 直到调用 Release.
+// ipv6 为 dhcpv6 时同时获取 DHCPv6 的地址, 任一地址族失败时不保留另一个地址族的租约.
+func (d *DHCP) Allocate(args *skel.CmdArgs, result *current.Result) error {
+	id, conf, err := parseArgs(args)
+	if err != nil {
+		return err
+	}
+
+	// 容器运行时重试 ADD 时, 先停止之前的租约
+	d.stopLeases(id, false)
+
+	if conf.IPv4Enabled() {
+		h, err := d.acquire(args.Netns, id, conf, false)
+		if err != nil {
+			return err
+		}
+		l := h.Lease()
+		result.IPs = append(result.IPs, &current.IPConfig{Version: "4", Address: l.IP, Gateway: l.Gateway})
+		result.Routes = l.Routes
+		result.DNS = l.DNS
+	}
+	if conf.IPv6 == IPv6DHCP {
+		h, err := d.acquire(args.Netns, id, conf, true)
+		if err != nil {
+			d.stopLeases(id, true)
+			return err
+		}
+		l := h.Lease()
+		result.IPs = append(result.IPs, &current.IPConfig{Version: "6", Address: l.IP})
+		result.DNS = mergeDNS(result.DNS, l.DNS)
+	}
+	return nil
+}
+
+// acquire 获取一个地址族的租约, 持久化并在后台维护
+func (d *DHCP) acquire(netns string, id *Identity, conf *ClientConf, v6 bool) (h *holder, err error) {
+	open := open4(d.dial)
+	if v6 {
+		open = open6(d.dial6)
+	}
+	s, mac, err := open(netns, id, conf)
+	if err != nil {
+		return nil, err
+	}
+	id.MAC = mac
+	timeout := d.timeout
+	if conf.TimeoutMs > 0 {
+		timeout = time.Duration(conf.TimeoutMs) * time.Millisecond
+	}
+	l, err := s.acquire(nil, time.Now().Add(timeout))
+	s.close()
+	if err != nil {
+		return nil, err
+	}
+	if v6 {
+		klog.Infof("acquire dhcpv6 lease %s for %s, server: %x, expires at %s", l.IP.String(), id.Key(), l.ServerID, l.Expiry().Format(time.RFC3339))
+	} else {
+		klog.Infof("acquire dhcp lease %s for %s, server: %s, expires at %s", l.IP.String(), id.Key(), l.Server, l.Expiry().Format(time.RFC3339))
+	}
+
+	h = newHolder(id, conf, netns, open, l)
+	h.store = d.store
+	h.save()
+	d.setLease(h.key(), h)
+	go h.maintain()
+	return h, nil
+}
+
+// stopLeases 停止 Pod 网卡两个地址族的租约, release 为 true 时通知服务器释放地址
+func (d *DHCP) stopLeases(id *Identity, release bool) (stopped []*holder) {
+	for _, v6 := range []bool{false, true} {
+		key := leaseKey(id, v6)
+		if h := d.getLease(key); h != nil {
+			h.stop(release)
+			d.clearLease(key)
+			stopped = append(stopped, h)
+		}
+	}
+	return stopped
+}
+
+// mergeDNS 将 DHCPv6 的 DNS 追加到 DHCPv4 的 DNS 之后
+func mergeDNS(dns, dns6 types.DNS) types.DNS {
+	dns.Nameservers = append(append([]string{}, dns.Nameservers...), dns6.Nameservers...)
+	dns.Search = append([]string{}, dns.Search...)
+	for _, search := range dns6.Search {
+		found := false
+		for _, s := range dns.Search {
+			found = found || s == search
+		}
+		if !found {
+			dns.Search = append(dns.Search, search)
+		}
+	}
+	return dns
+}
+
+// Release 停止维护租约, 并通知服务器释放地址
+func (d *DHCP) Release(args *skel.CmdArgs, reply *struct{}) error {
+	id, _, err := parseArgs(args)
+	if err != nil {
+		return err
+	}
+
+	stopped := d.stopLeases(id, true)
+	for _, h := range stopped {
+		klog.Infof("release dhcp lease %s of %s", h.Lease().IP.String(), id.Key())
+	}
+	if len(stopped) == 0 && d.store != nil {
+		// daemon 重启前已经过期的租约没有被恢复, 只需要删除记录
+		if err = d.store.DeleteLease(id.ContainerID, id.Network, id.IfName, ""); err != nil {
+			return err
+		}
+		return d.store.DeleteLease(id.ContainerID, id.Network, id.IfName, store.FamilyIPv6)
+	}
+	return nil
+}
+
+// LeaseArgs 查询租约的参数, 与 Allocate 时使用的网络名称与网卡一致
+type LeaseArgs struct {
+	ContainerID string
+	Network     string
+	IfName      string
+}
+
+// LeaseInfo 租约中无法通过 ipam 结果传递的部分, bridge 插件会使用自己的配置覆盖结果中的 dns
+type LeaseInfo struct {
+	MTU int
+	DNS types.DNS
+}
+
+// Lease 返回租约中的 MTU 与 DNS, 由 cni 插件在 bridge 插件执行完成后查询
+func (d *DHCP) Lease(args *LeaseArgs, reply *LeaseInfo) error {
+	id := &Identity{ContainerID: args.ContainerID, Network: args.Network, IfName: args.IfName}
+	h, h6 := d.getLease(leaseKey(id, false)), d.getLease(leaseKey(id, true))
+	if h == nil && h6 == nil {
+		return fmt.Errorf("no dhcp lease for %s", id.Key())
+	}
+	if h != nil {
+		l := h.Lease()
+		reply.MTU, reply.DNS = l.MTU, l.DNS
+	}
+	if h6 != nil {
+		reply.DNS = mergeDNS(reply.DNS, h6.Lease().DNS)
+	}
+	return nil
+}
+
+func (d *DHCP) getLease(key string) *holder {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.leases[key]
+}
+
+func (d *DHCP) setLease(key string, h *holder) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.leases[key] = h
+}
+
+func (d *DHCP) clearLease(key string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	delete(d.leases, key)
+}
+
+// Start 恢复持久化的租约, 然后在 sockPath 上提供 rpc 服务, 上一次 daemon 异常退出残留的 socket 会被删除
+func (d *DHCP) Start(sockPath string) (err error) {
+	d.restore()
+
+	if err = os.MkdirAll(filepath.Dir(sockPath), 0700); err != nil {
+		return fmt.Errorf("failed to create dir of %s: %v", sockPath, err)
+	}
+	if err = os.Remove(sockPath); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove stale %s: %v", sockPath, err)
+	}
+
+	server := rpc.NewServer()
+	if err = server.RegisterName("DHCP", d); err != nil {
+		return err
+	}
+	mux := http.NewServeMux()
+	mux.Handle(rpc.DefaultRPCPath, server)
+
+	d.listener, err = net.Listen("unix", sockPath)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %v", sockPath, err)
+	}
+	d.sockPath = sockPath
+	go http.Serve(d.listener, mux)
+
+	klog.Infof("builtin dhcp daemon listening on %s", sockPath)
+	return nil
+}
+
+// Stop 停止 rpc 服务与所有租约的维护, 不释放地址, Pod 在租约过期之前仍然可以使用, 租约记录保留到下一次启动
+func (d *DHCP) Stop() (err error) {
+	d.mu.Lock()
+	leases := d.leases
+	d.leases = map[string]*holder{}
+	d.mu.Unlock()
+	for _, h := range leases {
+		h.stop(false)
+	}
+
+	if d.listener != nil {
+		if err = d.listener.Close(); err != nil {
+			return err
+		}
+	}
+	if err = os.Remove(d.sockPath); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// QueryLease 通过 sockPath 查询租约中的 MTU 与 DNS, 使用 cni dhcp 插件的 daemon 时返回错误
+func QueryLease(ctx context.Context, sockPath string, args *LeaseArgs) (info *LeaseInfo, err error) {
+	client, err := rpc.DialHTTP("unix", sockPath)
+	if err != nil {
+		return nil, fmt.Errorf("error dialing dhcp daemon: %v", err)
+	}
+	defer client.Close()
+
+	info = &LeaseInfo{}
+	call := client.Go("DHCP.Lease", args, info, make(chan *rpc.Call, 1))
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-call.Done:
+		if call.Error != nil {
+			return nil, call.Error
+		}
+		return info, nil
+	}
+}
@@ -0,0 +1,194 @@
+package dhcp
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"net/rpc"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/containernetworking/cni/pkg/types/current"
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/gitlayzer/tsunami/pkg/store"
+)
+
+func fakeDial(s *fakeServer) dialFunc {
+	return func(netnsPath, ifName string) (conn, net.HardwareAddr, error) {
+		return s, testID.MAC, nil
+	}
+}
+
+// ipamArgs 生成 dhcp ipam 插件转发给守护进程的参数
+func ipamArgs(conf string) *skel.CmdArgs {
+	return &skel.CmdArgs{
+		ContainerID: "abc",
+		Netns:       "/var/run/netns/test",
+		IfName:      "net1",
+		Args:        "IgnoreUnknown=1;K8S_POD_NAMESPACE=team;K8S_POD_NAME=web-0",
+		StdinData:   []byte(conf),
+	}
+}
+
+// TestDaemon 以 dhcp ipam 插件的方式调用 rpc 接口
+func TestDaemon(t *testing.T) {
+	s := newFakeServer()
+	d := NewDHCP(nil)
+	d.dial = fakeDial(s)
+	sockPath := filepath.Join(t.TempDir(), "dhcp.sock")
+	if err := d.Start(sockPath); err != nil {
+		t.Fatal(err)
+	}
+	defer d.Stop()
+
+	client, err := rpc.DialHTTP("unix", sockPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	args := ipamArgs(`{"name":"storage","ipam":{"type":"dhcp","clientID":"pod","vendorClass":"storage","useDNS":false}}`)
+	result := &current.Result{}
+	if err = client.Call("DHCP.Allocate", args, result); err != nil {
+		t.Fatal(err)
+	}
+	if len(result.IPs) != 1 || result.IPs[0].Address.String() != "192.168.1.100/24" || len(result.Routes) != 1 {
+		t.Errorf("unexpected result: %+v", result)
+	}
+	req := s.requests[0]
+	if string(req.Options[OptClientID]) != "\x00team/web-0/net1" || string(req.Options[OptVendorClass]) != "storage" {
+		t.Errorf("unexpected identity: %q %q", req.Options[OptClientID], req.Options[OptVendorClass])
+	}
+
+	info, err := QueryLease(context.Background(), sockPath, &LeaseArgs{ContainerID: "abc", Network: "storage", IfName: "net1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.MTU != 1400 || len(info.DNS.Nameservers) != 0 {
+		t.Errorf("unexpected lease info: %+v", info)
+	}
+
+	if err = client.Call("DHCP.Release", args, &struct{}{}); err != nil {
+		t.Fatal(err)
+	}
+	if last := s.requests[len(s.requests)-1]; last.Type() != MsgRelease {
+		t.Errorf("release should be sent, got %d", last.Type())
+	}
+	if _, err = QueryLease(context.Background(), sockPath, &LeaseArgs{ContainerID: "abc", Network: "storage", IfName: "net1"}); err == nil {
+		t.Errorf("released lease should not be found")
+	}
+
+	args.StdinData = []byte(`{"name":"storage","ipam":{"type":"dhcp","clientID":"hostname"}}`)
+	if err = client.Call("DHCP.Allocate", args, result); err == nil {
+		t.Errorf("invalid client id should be rejected")
+	}
+}
+
+func TestHolderRenew(t *testing.T) {
+	s := newFakeServer()
+	l := &Lease{
+		IP:        net.IPNet{IP: s.ip, Mask: net.CIDRMask(24, 32)},
+		Server:    net.ParseIP("192.168.1.1").To4(),
+		ServerMAC: s.mac,
+		Duration:  time.Second,
+		T1:        10 * time.Millisecond,
+		T2:        500 * time.Millisecond,
+		Acquired:  time.Now(),
+	}
+	h := newHolder(testID, &ClientConf{}, "/var/run/netns/test", open4(fakeDial(s)), l)
+	go h.maintain()
+
+	for i := 0; i < 100 && h.Lease() == l; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if h.Lease() == l || h.Lease().Duration != time.Hour {
+		t.Fatalf("lease should be renewed at t1")
+	}
+	h.stop(false)
+	if types := s.types(); len(types) != 1 || types[0] != MsgRequest {
+		t.Errorf("only one renewal should be sent, got %v", types)
+	}
+}
+
+func TestHolderNetnsGone(t *testing.T) {
+	l := &Lease{IP: net.IPNet{IP: net.ParseIP("192.168.1.100"), Mask: net.CIDRMask(24, 32)}, Duration: time.Second, T2: time.Second, Acquired: time.Now()}
+	dial := func(netnsPath, ifName string) (conn, net.HardwareAddr, error) {
+		return nil, nil, ns.NSPathNotExistErr{}
+	}
+	h := newHolder(testID, &ClientConf{}, "/var/run/netns/gone", open4(dial), l)
+	go h.maintain()
+
+	select {
+	case <-h.doneCh:
+	case <-time.After(time.Second):
+		t.Fatal("maintenance should stop when the netns is gone")
+	}
+}
+
+func fakeDial6(s *fakeServer6) dial6Func {
+	return func(netnsPath, ifName string) (conn6, net.HardwareAddr, error) {
+		return s, testID.MAC, nil
+	}
+}
+
+// TestAllocateDualStack 同时获取 DHCPv4 与 DHCPv6 的租约, 并分别持久化与释放
+func TestAllocateDualStack(t *testing.T) {
+	st := store.New(t.TempDir())
+	s, s6 := newFakeServer(), newFakeServer6()
+	d := NewDHCP(st)
+	d.dial, d.dial6 = fakeDial(s), fakeDial6(s6)
+	defer d.Stop()
+
+	args := ipamArgs(`{"name":"n","ipam":{"type":"dhcp","ipv6":"dhcpv6"}}`)
+	result := &current.Result{}
+	if err := d.Allocate(args, result); err != nil {
+		t.Fatal(err)
+	}
+	if len(result.IPs) != 2 || result.IPs[1].Version != "6" || result.IPs[1].Address.String() != "2001:db8::100/128" {
+		t.Errorf("unexpected result: %+v", result)
+	}
+	if want := []string{"192.168.1.53", "2001:db8::53"}; !reflect.DeepEqual(result.DNS.Nameservers, want) {
+		t.Errorf("dns should be merged, got %v", result.DNS.Nameservers)
+	}
+	list, err := st.ListLeases()
+	if err != nil || len(list) != 2 {
+		t.Fatalf("both leases should be saved: %v %v", list, err)
+	}
+
+	// 恢复 DHCPv6 租约的记录
+	for _, rec := range list {
+		if rec.Family != store.FamilyIPv6 {
+			continue
+		}
+		_, _, l, err := fromRecord(rec)
+		if err != nil || l.IP.String() != "2001:db8::100/128" || !bytes.Equal(l.ServerID, s6.duid) || l.Duration != time.Hour {
+			t.Errorf("unexpected dhcpv6 lease from record: %+v %v", l, err)
+		}
+	}
+
+	if err = d.Release(args, &struct{}{}); err != nil {
+		t.Fatal(err)
+	}
+	if s6.last().Type != Msg6Release {
+		t.Errorf("dhcpv6 lease should be released")
+	}
+	if list, _ = st.ListLeases(); len(list) != 0 {
+		t.Errorf("released leases should be deleted: %v", list)
+	}
+
+	// DHCPv6 失败时不保留 DHCPv4 的租约
+	s6.drop = 1 << 20
+	d.timeout = 20 * time.Millisecond
+	if err = d.Allocate(args, &current.Result{}); err == nil {
+		t.Fatal("allocate should fail without dhcpv6 reply")
+	}
+	if d.getLease("abc/n/net1") != nil {
+		t.Errorf("dhcpv4 lease should be released")
+	}
+	if last := s.requests[len(s.requests)-1]; last.Type() != MsgRelease {
+		t.Errorf("dhcpv4 release should be sent, got %d", last.Type())
+	}
+}
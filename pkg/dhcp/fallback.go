@@ -0,0 +1,118 @@
+package dhcp
+
+import (
+	"net"
+	"time"
+
+	"github.com/gitlayzer/tsunami/pkg/store"
+	"github.com/gitlayzer/tsunami/utils/utilfile"
+	"k8s.io/klog"
+)
+
+// probeTimeout 每次检测等待 OFFER 的最长时间
+const probeTimeout = 10 * time.Second
+
+// MinFallbackProbeInterval 检测的最小间隔, 避免频繁的 DISCOVER 让服务器不断为 Pod 保留地址
+const MinFallbackProbeInterval = 5 * time.Minute
+
+// FallbackWatcher 定期在使用备用地址的 Pod 网卡上发送 DISCOVER, 收到 OFFER 说明 dhcp 已经恢复.
+// 检测使用 Pod 自身的 client id, 收到 OFFER 后立即 RELEASE, 不会确认租约.
+// 更换运行中 Pod 的地址会中断已有的连接, 因此只通知一次, 由用户重建 Pod 后重新获取租约.
+type FallbackWatcher struct {
+	store     *store.Store
+	interval  time.Duration
+	recovered func(a *store.Attachment, offered net.IP)
+
+	dial    dialFunc
+	timeout time.Duration
+	// notified 已经通知过的网卡, 以 容器 ID/网卡名称 为 key
+	notified map[string]bool
+}
+
+// NewFallbackWatcher 创建 FallbackWatcher 对象, dhcp 恢复后对每个 Pod 网卡调用一次 recovered.
+// interval 小于 MinFallbackProbeInterval 时使用 MinFallbackProbeInterval.
+func NewFallbackWatcher(podStore *store.Store, interval time.Duration, recovered func(a *store.Attachment, offered net.IP)) *FallbackWatcher {
+	if interval < MinFallbackProbeInterval {
+		klog.Warningf("dhcp fallback probe interval %s is too short, use %s", interval, MinFallbackProbeInterval)
+		interval = MinFallbackProbeInterval
+	}
+	return &FallbackWatcher{
+		store:     podStore,
+		interval:  interval,
+		recovered: recovered,
+		dial:      dialRaw,
+		timeout:   probeTimeout,
+		notified:  map[string]bool{},
+	}
+}
+
+// Run 每隔 interval 检测一次, 直到 stopCh 关闭
+func (w *FallbackWatcher) Run(stopCh <-chan struct{}) {
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stopCh:
+			return
+		case <-ticker.C:
+			w.check()
+		}
+	}
+}
+
+// check 检测所有使用备用地址且还没有通知过的 Pod 网卡
+func (w *FallbackWatcher) check() {
+	list, err := w.store.List()
+	if err != nil {
+		klog.Warningf("failed to list attachments: %s", err)
+		return
+	}
+
+	current := map[string]bool{}
+	for _, a := range list {
+		if a.Source != store.SourceFallback || !utilfile.Exists(a.NetNs) {
+			continue
+		}
+		key := a.ContainerID + "/" + a.IfName
+		current[key] = true
+		if w.notified[key] {
+			continue
+		}
+
+		offered, err := w.probe(a)
+		if err != nil {
+			if !IsTimeout(err) {
+				klog.Warningf("failed to probe dhcp for pod %s/%s: %s", a.PodNamespace, a.PodName, err)
+			}
+			continue
+		}
+		klog.Infof("dhcp is available again for pod %s/%s, offered %s", a.PodNamespace, a.PodName, offered)
+		w.notified[key] = true
+		w.recovered(a, offered)
+	}
+
+	// Pod 删除后不再记录
+	for key := range w.notified {
+		if !current[key] {
+			delete(w.notified, key)
+		}
+	}
+}
+
+// probe 在 Pod 网卡上发送 DISCOVER, 返回服务器提供的地址, 提供的地址会被立即释放
+func (w *FallbackWatcher) probe(a *store.Attachment) (offered net.IP, err error) {
+	c, mac, err := w.dial(a.NetNs, a.IfName)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+
+	id := &Identity{
+		ContainerID:  a.ContainerID,
+		IfName:       a.IfName,
+		PodName:      a.PodName,
+		PodNamespace: a.PodNamespace,
+		MAC:          mac,
+	}
+	return newClient(c, &ClientConf{}, id).discover(time.Now().Add(w.timeout))
+}
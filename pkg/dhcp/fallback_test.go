@@ -0,0 +1,87 @@
+package dhcp
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gitlayzer/tsunami/pkg/store"
+)
+
+func TestFallbackWatcher(t *testing.T) {
+	dir := t.TempDir()
+	st := store.New(dir)
+	netns := filepath.Join(dir, "netns")
+	if err := os.WriteFile(netns, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	attachments := []*store.Attachment{
+		{ContainerID: "fallback", IfName: "eth0", PodName: "web-0", PodNamespace: "team", NetNs: netns, Source: store.SourceFallback},
+		{ContainerID: "dhcp", IfName: "eth0", PodName: "web-1", PodNamespace: "team", NetNs: netns, Source: store.SourceDHCP},
+		{ContainerID: "gone", IfName: "eth0", PodName: "web-2", PodNamespace: "team", NetNs: filepath.Join(dir, "gone"), Source: store.SourceFallback},
+	}
+	for _, a := range attachments {
+		if err := st.Save(a); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var recovered []string
+	s := newFakeServer()
+	s.drop = 1 << 20
+	w := NewFallbackWatcher(st, time.Minute, func(a *store.Attachment, offered net.IP) {
+		recovered = append(recovered, a.ContainerID+" "+offered.String())
+	})
+	w.dial = fakeDial(s)
+	w.timeout = 10 * time.Millisecond
+
+	// dhcp 仍然不可用
+	w.check()
+	if len(recovered) != 0 {
+		t.Fatalf("should not notify before dhcp recovers: %v", recovered)
+	}
+
+	s.mu.Lock()
+	s.drop = 0
+	s.requests, s.dsts = nil, nil
+	s.mu.Unlock()
+	w.check()
+	w.check()
+	if len(recovered) != 1 || recovered[0] != "fallback 192.168.1.100" {
+		t.Errorf("unexpected notifications: %v", recovered)
+	}
+	// 只发送 DISCOVER, 收到 OFFER 后立即释放, 不会占用租约
+	if got := s.types(); len(got) != 2 || got[0] != MsgDiscover || got[1] != MsgRelease {
+		t.Errorf("unexpected messages %v", got)
+	}
+	if release := s.requests[1]; !release.CIAddr.Equal(s.ip) || !s.dsts[1].Equal(net.IPv4(192, 168, 1, 1)) {
+		t.Errorf("offered address should be released to the server: %s %s", release.CIAddr, s.dsts[1])
+	}
+	if w.interval != MinFallbackProbeInterval {
+		t.Errorf("probe interval should be at least %s, got %s", MinFallbackProbeInterval, w.interval)
+	}
+	if opt := s.requests[0].Options[OptClientID]; string(opt[1:]) != "team/web-0" {
+		t.Errorf("probe should carry the pod identity, got %q", opt)
+	}
+
+	if err := st.Delete("fallback", "eth0"); err != nil {
+		t.Fatal(err)
+	}
+	w.check()
+	if len(w.notified) != 0 {
+		t.Errorf("deleted pods should be forgotten: %v", w.notified)
+	}
+}
+
+func TestIsTimeout(t *testing.T) {
+	// ipam 插件转发的错误只剩下字符串
+	if !IsTimeout(fmt.Errorf("error calling DHCP.Allocate: %s", errTimeout)) {
+		t.Errorf("forwarded timeout should be detected")
+	}
+	if IsTimeout(nil) || IsTimeout(errNak) {
+		t.Errorf("only timeout errors should be detected")
+	}
+}
@@ -0,0 +1,231 @@
+package dhcp
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/gitlayzer/tsunami/pkg/store"
+	"k8s.io/klog"
+)
+
+const (
+	// attemptTimeout 单次续租等待应答的最长时间
+	attemptTimeout = 30 * time.Second
+	// minRetryWait 续租失败后至少等待的时间
+	minRetryWait = 10 * time.Second
+)
+
+// dialFunc 打开 Pod 网卡上的 dhcp 连接, 测试中替换为内存实现
+type dialFunc func(netnsPath, ifName string) (conn, net.HardwareAddr, error)
+
+// dial6Func 打开 Pod 网卡上的 DHCPv6 连接
+type dial6Func func(netnsPath, ifName string) (conn6, net.HardwareAddr, error)
+
+// session 一个地址族的 dhcp 客户端, 由 client 与 client6 实现
+type session interface {
+	acquire(requested net.IP, deadline time.Time) (*Lease, error)
+	renew(l *Lease, rebind bool, deadline time.Time) (*Lease, error)
+	release(l *Lease) error
+	close() error
+}
+
+// opener 在 Pod 网卡上打开 session, 并返回网卡的 MAC
+type opener func(netnsPath string, id *Identity, conf *ClientConf) (session, net.HardwareAddr, error)
+
+func open4(dial dialFunc) opener {
+	return func(netnsPath string, id *Identity, conf *ClientConf) (session, net.HardwareAddr, error) {
+		c, mac, err := dial(netnsPath, id.IfName)
+		if err != nil {
+			return nil, nil, err
+		}
+		cid := *id
+		cid.MAC = mac
+		return newClient(c, conf, &cid), mac, nil
+	}
+}
+
+func open6(dial dial6Func) opener {
+	return func(netnsPath string, id *Identity, conf *ClientConf) (session, net.HardwareAddr, error) {
+		c, mac, err := dial(netnsPath, id.IfName)
+		if err != nil {
+			return nil, nil, err
+		}
+		cid := *id
+		cid.MAC = mac
+		return newClient6(c, conf, &cid), mac, nil
+	}
+}
+
+// holder 持有一个 Pod 网卡的租约, 在 T1 时向原服务器续租, T2 时广播重新绑定, 直到停止或租约过期
+type holder struct {
+	id    *Identity
+	conf  *ClientConf
+	netns string
+	open  opener
+	// v6 为 true 时持有 DHCPv6 的租约
+	v6 bool
+	// store 不为空时持久化租约, daemon 重启后继续续租
+	store *store.Store
+
+	mu    sync.Mutex
+	lease *Lease
+
+	stopCh chan struct{}
+	doneCh chan struct{}
+}
+
+func newHolder(id *Identity, conf *ClientConf, netns string, open opener, l *Lease) *holder {
+	return &holder{
+		id:     id,
+		conf:   conf,
+		netns:  netns,
+		open:   open,
+		v6:     l.IP.IP.To4() == nil,
+		lease:  l,
+		stopCh: make(chan struct{}),
+		doneCh: make(chan struct{}),
+	}
+}
+
+// key 租约在 daemon 中的索引, 同一网卡的 DHCPv6 租约带有后缀
+func (h *holder) key() string {
+	return leaseKey(h.id, h.v6)
+}
+
+func leaseKey(id *Identity, v6 bool) string {
+	if v6 {
+		return id.Key() + "/ipv6"
+	}
+	return id.Key()
+}
+
+// Lease 返回当前的租约
+func (h *holder) Lease() *Lease {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.lease
+}
+
+// sleep 等待 d, 停止时返回 false
+func (h *holder) sleep(d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-h.stopCh:
+		return false
+	case <-t.C:
+		return true
+	}
+}
+
+// maintain 维护租约, 在单独的 goroutine 中运行
+func (h *holder) maintain() {
+	defer close(h.doneCh)
+
+	for {
+		l := h.Lease()
+		if l.Duration == 0 {
+			<-h.stopCh
+			return
+		}
+
+		now := time.Now()
+		t1, t2, expiry := l.Acquired.Add(l.T1), l.Acquired.Add(l.T2), l.Expiry()
+		var rebind bool
+		var end time.Time
+		switch {
+		case now.Before(t1):
+			if !h.sleep(t1.Sub(now)) {
+				return
+			}
+			continue
+		case now.Before(t2):
+			end = t2
+		case now.Before(expiry):
+			rebind, end = true, expiry
+		default:
+			klog.Errorf("dhcp lease %s of %s expired, the address is no longer renewed", l.IP.String(), h.id.Key())
+			return
+		}
+
+		deadline := now.Add(attemptTimeout)
+		if deadline.After(end) {
+			deadline = end
+		}
+		renewed, err := h.renew(l, rebind, deadline)
+		if err == nil {
+			h.mu.Lock()
+			h.lease = renewed
+			h.mu.Unlock()
+			h.save()
+			klog.V(3).Infof("renew dhcp lease %s of %s, expires at %s", renewed.IP.String(), h.id.Key(), renewed.Expiry().Format(time.RFC3339))
+			continue
+		}
+		if isNetnsGone(err) {
+			klog.Warningf("netns of %s no longer exists, stop renewing dhcp lease %s", h.id.Key(), l.IP.String())
+			h.forget()
+			return
+		}
+		if err == errNak {
+			klog.Errorf("dhcp server nak the renewal of %s for %s, the address is no longer valid", h.id.Key(), l.IP.String())
+			// 记录中标记为已过期, 便于通过 tsunamictl leases 发现
+			expired := *l
+			expired.Duration = time.Since(l.Acquired)
+			h.mu.Lock()
+			h.lease = &expired
+			h.mu.Unlock()
+			h.save()
+			return
+		}
+		klog.Warningf("failed to renew dhcp lease %s of %s: %s", l.IP.String(), h.id.Key(), err)
+
+		// RFC 2131: 失败后等待剩余时间的一半再重试
+		wait := time.Until(end) / 2
+		if wait < minRetryWait {
+			wait = minRetryWait
+		}
+		if !h.sleep(wait) {
+			return
+		}
+	}
+}
+
+// isNetnsGone 判断是否因为 Pod 网络命名空间已删除而无法打开连接, 此时 Pod 已被删除但没有调用 DEL
+func isNetnsGone(err error) bool {
+	var notExist ns.NSPathNotExistErr
+	return errors.As(err, &notExist)
+}
+
+func (h *holder) renew(l *Lease, rebind bool, deadline time.Time) (*Lease, error) {
+	s, _, err := h.open(h.netns, h.id, h.conf)
+	if err != nil {
+		return nil, err
+	}
+	defer s.close()
+	return s.renew(l, rebind, deadline)
+}
+
+// stop 停止维护租约, release 为 true 时通知服务器释放地址
+func (h *holder) stop(release bool) {
+	close(h.stopCh)
+	<-h.doneCh
+	if !release {
+		return
+	}
+	h.forget()
+
+	l := h.Lease()
+	s, _, err := h.open(h.netns, h.id, h.conf)
+	if err != nil {
+		// Pod 网络命名空间已删除时无法发送, 地址在租约过期后由服务器回收
+		klog.Warningf("failed to release dhcp lease %s of %s: %s", l.IP.String(), h.id.Key(), err)
+		return
+	}
+	defer s.close()
+	if err = s.release(l); err != nil {
+		klog.Warningf("failed to release dhcp lease %s of %s: %s", l.IP.String(), h.id.Key(), err)
+	}
+}
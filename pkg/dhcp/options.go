@@ -0,0 +1,408 @@
+package dhcp
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/binary"
+	"fmt"
+	"hash/fnv"
+	"net"
+	"time"
+
+	"github.com/containernetworking/cni/pkg/types"
+	"github.com/gitlayzer/tsunami/pkg/podroute"
+)
+
+// 使用到的 dhcp 选项代码
+const (
+	OptPad               = 0
+	OptSubnetMask        = 1
+	OptRouter            = 3
+	OptDNS               = 6
+	OptHostname          = 12
+	OptDomainName        = 15
+	OptMTU               = 26
+	OptStaticRoutes      = 33
+	OptRequestedIP       = 50
+	OptLeaseTime         = 51
+	OptMessageType       = 53
+	OptServerID          = 54
+	OptParamRequest      = 55
+	OptMaxMessageSize    = 57
+	OptRenewalTime       = 58
+	OptRebindingTime     = 59
+	OptVendorClass       = 60
+	OptClientID          = 61
+	OptClasslessRoutes   = 121
+	OptMSClasslessRoutes = 249
+	OptEnd               = 255
+)
+
+// option 61 的生成方式
+const (
+	// ClientIDPod 使用 命名空间/Pod 名称, 次要网卡再加上 /网卡名称, Pod 重建后不变
+	ClientIDPod = "pod"
+	// ClientIDContainer 与 cni dhcp 插件相同, 使用 容器 ID/网络名称/网卡名称
+	ClientIDContainer = "container"
+	// ClientIDMAC 使用硬件类型加 Pod 网卡的 MAC
+	ClientIDMAC = "mac"
+)
+
+// DefaultVendorClass 默认在 option 60 中发送的内容
+const DefaultVendorClass = "tsunami"
+
+// Pod 网卡获取 IPv6 地址的方式
+const (
+	// IPv6DHCP 通过 DHCPv6 IA_NA 获取地址, 由内置的 dhcp 守护进程维护租约
+	IPv6DHCP = "dhcpv6"
+	// IPv6SLAAC 等待路由通告生成的地址, 由 cni 插件在 Pod 网络命名空间中等待
+	IPv6SLAAC = "slaac"
+)
+
+// ClientConf dhcp 客户端的配置, 位于 delegate.ipam 中, 可以在 networks.<name>.dhcp 中按网络(地址池)覆盖.
+// 布尔字段为空时表示开启.
+type ClientConf struct {
+	// SendHostname 在 option 12 中发送 Pod 名称
+	SendHostname *bool `json:"sendHostname,omitempty"`
+	// ClientID option 61 的生成方式, 为 pod, container 或 mac, 默认为 pod
+	ClientID string `json:"clientID,omitempty"`
+	// VendorClass option 60 的内容, 默认为 tsunami
+	VendorClass string `json:"vendorClass,omitempty"`
+	// UseRoutes 使用 option 121/249/33 中的静态路由
+	UseRoutes *bool `json:"useRoutes,omitempty"`
+	// UseMTU 使用 option 26 设置 Pod 网卡的 MTU
+	UseMTU *bool `json:"useMTU,omitempty"`
+	// UseDNS 将 option 6/15 写入 cni 结果的 dns 中
+	UseDNS *bool `json:"useDNS,omitempty"`
+	// TimeoutMs 获取租约的最长时间(毫秒), 为 0 时为 30s, 开启备用地址时由 cni 插件设置
+	TimeoutMs int `json:"timeoutMs,omitempty"`
+	// IPv4 为 false 时不获取 IPv4 租约, 用于只有 IPv6 的网段
+	IPv4 *bool `json:"ipv4,omitempty"`
+	// IPv6 获取 IPv6 地址的方式, 为 dhcpv6 或 slaac, 为空时不获取
+	IPv6 string `json:"ipv6,omitempty"`
+}
+
+// IPv4Enabled 是否获取 IPv4 租约
+func (c *ClientConf) IPv4Enabled() bool {
+	return enabled(c.IPv4)
+}
+
+func enabled(b *bool) bool {
+	return b == nil || *b
+}
+
+// Validate 检查 clientID 的取值
+func (c *ClientConf) Validate() error {
+	switch c.ClientID {
+	case "", ClientIDPod, ClientIDContainer, ClientIDMAC:
+	default:
+		return fmt.Errorf("unknown clientID %q, must be one of pod, container and mac", c.ClientID)
+	}
+	if len(c.VendorClass) > 255 {
+		return fmt.Errorf("vendorClass is longer than 255 bytes")
+	}
+	if c.TimeoutMs < 0 {
+		return fmt.Errorf("timeoutMs must not be negative")
+	}
+	switch c.IPv6 {
+	case "", IPv6DHCP, IPv6SLAAC:
+	default:
+		return fmt.Errorf("unknown ipv6 %q, must be dhcpv6 or slaac", c.IPv6)
+	}
+	// 只使用 slaac 时 ipam 结果中没有地址, bridge 插件会失败
+	if !c.IPv4Enabled() && c.IPv6 != IPv6DHCP {
+		return fmt.Errorf("ipv4 can only be disabled when ipv6 is dhcpv6")
+	}
+	return nil
+}
+
+// Override 使用 o 中不为空的字段覆盖当前配置
+func (c *ClientConf) Override(o *ClientConf) {
+	if o == nil {
+		return
+	}
+	if o.SendHostname != nil {
+		c.SendHostname = o.SendHostname
+	}
+	if o.ClientID != "" {
+		c.ClientID = o.ClientID
+	}
+	if o.VendorClass != "" {
+		c.VendorClass = o.VendorClass
+	}
+	if o.UseRoutes != nil {
+		c.UseRoutes = o.UseRoutes
+	}
+	if o.UseMTU != nil {
+		c.UseMTU = o.UseMTU
+	}
+	if o.UseDNS != nil {
+		c.UseDNS = o.UseDNS
+	}
+	if o.TimeoutMs != 0 {
+		c.TimeoutMs = o.TimeoutMs
+	}
+	if o.IPv4 != nil {
+		c.IPv4 = o.IPv4
+	}
+	if o.IPv6 != "" {
+		c.IPv6 = o.IPv6
+	}
+}
+
+// Identity 租约所属的 Pod 网卡
+type Identity struct {
+	ContainerID  string
+	Network      string
+	IfName       string
+	PodName      string
+	PodNamespace string
+	MAC          net.HardwareAddr
+}
+
+// Key daemon 中区分租约使用的 key, 与 cni dhcp 插件一致
+func (id *Identity) Key() string {
+	return id.ContainerID + "/" + id.Network + "/" + id.IfName
+}
+
+// clientID 生成 option 61 的内容, 第一个字节为类型, 0 表示不是硬件地址
+func (c *ClientConf) clientID(id *Identity) []byte {
+	mode := c.ClientID
+	if mode == "" && id.PodName == "" {
+		mode = ClientIDContainer
+	}
+	switch mode {
+	case ClientIDMAC:
+		return append([]byte{1}, id.MAC...)
+	case ClientIDContainer:
+		return append([]byte{0}, id.Key()...)
+	}
+	v := id.PodNamespace + "/" + id.PodName
+	if id.IfName != podroute.PrimaryIfName {
+		v += "/" + id.IfName
+	}
+	return append([]byte{0}, v...)
+}
+
+// duid 生成 DHCPv6 的 client DUID, 与 option 61 使用相同的方式区分 Pod:
+// mac 为 DUID-LL, 其他方式为根据 option 61 的内容生成的 DUID-UUID, Pod 重建后不变
+func (c *ClientConf) duid(id *Identity) []byte {
+	cid := c.clientID(id)
+	if cid[0] == 1 {
+		return append([]byte{0, 3, 0, 1}, id.MAC...)
+	}
+	sum := sha1.Sum(cid[1:])
+	uuid := sum[:16]
+	// 与 RFC 4122 中基于名称的 UUID(版本 5) 的格式一致
+	uuid[6] = uuid[6]&0x0f | 0x50
+	uuid[8] = uuid[8]&0x3f | 0x80
+	return append([]byte{0, 4}, uuid...)
+}
+
+// iaid 根据网卡名称生成 IA_NA 的 IAID, 同一 Pod 的不同网卡使用不同的 IAID
+func iaid(id *Identity) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(id.IfName))
+	return h.Sum32()
+}
+
+// requestOptions6 生成 DHCPv6 请求中表明客户端身份以及请求参数的选项, 不包括 IA_NA
+func (c *ClientConf) requestOptions6(id *Identity) []Option6 {
+	opts := []Option6{{Code: Opt6ClientID, Data: c.duid(id)}}
+	if enabled(c.UseDNS) {
+		opts = append(opts, Option6{Code: Opt6ORO, Data: []byte{0, Opt6DNSServers, 0, Opt6DomainList}})
+	}
+
+	vendor := c.VendorClass
+	if vendor == "" {
+		vendor = DefaultVendorClass
+	}
+	// enterprise-number 为 0, 之后是一个带长度的字符串
+	v := []byte{0, 0, 0, 0, byte(len(vendor) >> 8), byte(len(vendor))}
+	opts = append(opts, Option6{Code: Opt6VendorClass, Data: append(v, vendor...)})
+
+	if enabled(c.SendHostname) && id.PodName != "" {
+		// 设置 N 标志, 只用于标识 Pod, 不要求服务器更新 DNS
+		opts = append(opts, Option6{Code: Opt6ClientFQDN, Data: append([]byte{0x04}, encodeDomain(id.PodName)...)})
+	}
+	return opts
+}
+
+// requestOptions 生成 DISCOVER 与 REQUEST 中表明客户端身份以及请求参数的选项
+func (c *ClientConf) requestOptions(id *Identity) map[byte][]byte {
+	params := []byte{OptSubnetMask, OptRouter, OptLeaseTime, OptServerID, OptRenewalTime, OptRebindingTime}
+	if enabled(c.UseDNS) {
+		params = append(params, OptDNS, OptDomainName)
+	}
+	if enabled(c.UseMTU) {
+		params = append(params, OptMTU)
+	}
+	if enabled(c.UseRoutes) {
+		params = append(params, OptStaticRoutes, OptClasslessRoutes, OptMSClasslessRoutes)
+	}
+
+	vendor := c.VendorClass
+	if vendor == "" {
+		vendor = DefaultVendorClass
+	}
+	opts := map[byte][]byte{
+		OptParamRequest:   params,
+		OptClientID:       c.clientID(id),
+		OptVendorClass:    []byte(vendor),
+		OptMaxMessageSize: {0x05, 0xdc}, // 1500
+	}
+	if enabled(c.SendHostname) && id.PodName != "" {
+		opts[OptHostname] = []byte(id.PodName)
+	}
+	return opts
+}
+
+// Lease dhcp 服务器分配的租约
+type Lease struct {
+	IP      net.IPNet
+	Gateway net.IP
+	Server  net.IP
+	// ServerMAC 发送 ACK 的设备(服务器或中继)的 MAC, 续租时单播给它
+	ServerMAC net.HardwareAddr
+	Routes    []*types.Route
+	DNS       types.DNS
+	MTU       int
+	// Duration 为 0 表示租约不会过期, T1, T2 分别为开始续租与重新绑定的时间, 均从 Acquired 开始计算
+	Duration time.Duration
+	T1       time.Duration
+	T2       time.Duration
+	Acquired time.Time
+	// ServerID DHCPv6 服务器的 DUID, 续租与释放时带上
+	ServerID []byte
+}
+
+// Expiry 返回租约过期的时间, 不会过期时返回零值
+func (l *Lease) Expiry() time.Time {
+	if l.Duration == 0 {
+		return time.Time{}
+	}
+	return l.Acquired.Add(l.Duration)
+}
+
+func optUint32(opts map[byte][]byte, code byte) (uint32, bool) {
+	if v := opts[code]; len(v) == 4 {
+		return binary.BigEndian.Uint32(v), true
+	}
+	return 0, false
+}
+
+// parseLease 根据 ACK 生成租约, conf 决定是否使用其中的路由, MTU 与 DNS
+func parseLease(ack *Message, conf *ClientConf, now time.Time) (l *Lease, err error) {
+	ip := ack.YIAddr.To4()
+	if ip == nil || ip.IsUnspecified() {
+		return nil, fmt.Errorf("dhcp ack has no address")
+	}
+	mask := ack.Options[OptSubnetMask]
+	if len(mask) != 4 {
+		mask = ip.DefaultMask()
+	}
+	l = &Lease{
+		IP:       net.IPNet{IP: ip, Mask: net.IPMask(mask)},
+		Server:   net.IP(ack.Options[OptServerID]).To4(),
+		Acquired: now,
+	}
+
+	// 0xffffffff 表示永久租约
+	if secs, ok := optUint32(ack.Options, OptLeaseTime); ok && secs != 0xffffffff {
+		l.Duration = time.Duration(secs) * time.Second
+		l.T1, l.T2 = l.Duration/2, l.Duration*7/8
+		if secs, ok := optUint32(ack.Options, OptRenewalTime); ok && time.Duration(secs)*time.Second < l.Duration {
+			l.T1 = time.Duration(secs) * time.Second
+		}
+		if secs, ok := optUint32(ack.Options, OptRebindingTime); ok && time.Duration(secs)*time.Second < l.Duration {
+			l.T2 = time.Duration(secs) * time.Second
+		}
+		if l.T2 < l.T1 {
+			l.T2 = l.T1
+		}
+	} else if !ok {
+		return nil, fmt.Errorf("dhcp ack has no lease time")
+	}
+
+	if v := ack.Options[OptRouter]; len(v) >= 4 {
+		l.Gateway = net.IP(append([]byte{}, v[:4]...))
+	}
+	if enabled(conf.UseRoutes) {
+		l.Routes, err = parseRoutes(ack.Options)
+		if err != nil {
+			return nil, err
+		}
+	}
+	// RFC 3442: 存在无类别静态路由时忽略 option 3 与 option 33, 默认路由同样来自 option 121
+	if len(l.Routes) > 0 && (len(ack.Options[OptClasslessRoutes]) > 0 || len(ack.Options[OptMSClasslessRoutes]) > 0) {
+		l.Gateway = nil
+		for _, r := range l.Routes {
+			if ones, _ := r.Dst.Mask.Size(); ones == 0 {
+				l.Gateway = r.GW
+			}
+		}
+	} else if l.Gateway != nil {
+		// cni 规范要求即使有网关也需要在 routes 中包含默认路由
+		l.Routes = append(l.Routes, &types.Route{Dst: net.IPNet{IP: net.IPv4zero.To4(), Mask: net.CIDRMask(0, 32)}, GW: l.Gateway})
+	}
+
+	if enabled(conf.UseMTU) {
+		if v := ack.Options[OptMTU]; len(v) == 2 {
+			// 68 是 IPv4 要求的最小 MTU, 更小的值视为无效
+			if mtu := int(binary.BigEndian.Uint16(v)); mtu >= 68 {
+				l.MTU = mtu
+			}
+		}
+	}
+
+	if enabled(conf.UseDNS) {
+		for v := ack.Options[OptDNS]; len(v) >= 4; v = v[4:] {
+			l.DNS.Nameservers = append(l.DNS.Nameservers, net.IP(v[:4]).String())
+		}
+		l.DNS.Domain = string(bytes.TrimRight(ack.Options[OptDomainName], "\x00"))
+	}
+
+	return l, nil
+}
+
+// parseRoutes 解析静态路由, 优先使用 option 121, 其次是微软使用的 option 249, 最后是有类别的 option 33
+func parseRoutes(opts map[byte][]byte) (routes []*types.Route, err error) {
+	for _, code := range []byte{OptClasslessRoutes, OptMSClasslessRoutes} {
+		if v := opts[code]; len(v) > 0 {
+			return parseClasslessRoutes(v)
+		}
+	}
+
+	for v := opts[OptStaticRoutes]; len(v) >= 8; v = v[8:] {
+		dst := net.IP(append([]byte{}, v[0:4]...))
+		routes = append(routes, &types.Route{
+			Dst: net.IPNet{IP: dst, Mask: dst.DefaultMask()},
+			GW:  net.IP(append([]byte{}, v[4:8]...)),
+		})
+	}
+	return routes, nil
+}
+
+// parseClasslessRoutes 解析 RFC 3442 格式的路由: 前缀长度, 压缩后的目的网段, 网关.
+// 网关为 0.0.0.0 表示直连路由.
+func parseClasslessRoutes(v []byte) (routes []*types.Route, err error) {
+	for len(v) > 0 {
+		width := int(v[0])
+		if width > 32 {
+			return nil, fmt.Errorf("invalid classless route prefix length %d", width)
+		}
+		octets := (width + 7) / 8
+		if len(v) < 1+octets+4 {
+			return nil, fmt.Errorf("classless static route is truncated")
+		}
+		dst := make(net.IP, 4)
+		copy(dst, v[1:1+octets])
+		route := &types.Route{Dst: net.IPNet{IP: dst, Mask: net.CIDRMask(width, 32)}}
+		if gw := net.IP(v[1+octets : 5+octets]); !gw.Equal(net.IPv4zero) {
+			route.GW = append(net.IP{}, gw...)
+		}
+		routes = append(routes, route)
+		v = v[5+octets:]
+	}
+	return routes, nil
+}
@@ -0,0 +1,212 @@
+package dhcp
+
+import (
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func ack(opts map[byte][]byte) *Message {
+	opts[OptMessageType] = []byte{MsgAck}
+	return &Message{Op: opReply, YIAddr: net.ParseIP("192.168.1.100"), Options: opts}
+}
+
+func routeStrings(l *Lease) (routes []string) {
+	for _, r := range l.Routes {
+		routes = append(routes, r.Dst.String()+" via "+r.GW.String())
+	}
+	return routes
+}
+
+func TestParseLease(t *testing.T) {
+	no := false
+	tests := []struct {
+		name    string
+		conf    ClientConf
+		opts    map[byte][]byte
+		gateway string
+		routes  []string
+		mtu     int
+		dns     []string
+		domain  string
+	}{{
+		name: "router",
+		opts: map[byte][]byte{
+			OptSubnetMask: {255, 255, 255, 0},
+			OptRouter:     {192, 168, 1, 1},
+			OptDNS:        {192, 168, 1, 53, 8, 8, 8, 8},
+			OptDomainName: []byte("example.com\x00"),
+			OptMTU:        {0x05, 0x78},
+		},
+		gateway: "192.168.1.1",
+		routes:  []string{"0.0.0.0/0 via 192.168.1.1"},
+		mtu:     1400,
+		dns:     []string{"192.168.1.53", "8.8.8.8"},
+		domain:  "example.com",
+	}, {
+		// option 121 存在时忽略 option 3, 默认路由也来自 option 121
+		name: "classless",
+		opts: map[byte][]byte{
+			OptRouter:          {192, 168, 1, 1},
+			OptClasslessRoutes: {0, 192, 168, 1, 254, 16, 10, 96, 192, 168, 1, 2, 24, 172, 16, 5, 0, 0, 0, 0},
+		},
+		gateway: "192.168.1.254",
+		routes:  []string{"0.0.0.0/0 via 192.168.1.254", "10.96.0.0/16 via 192.168.1.2", "172.16.5.0/24 via <nil>"},
+	}, {
+		name: "microsoft classless",
+		opts: map[byte][]byte{
+			OptRouter:            {192, 168, 1, 1},
+			OptMSClasslessRoutes: {8, 10, 192, 168, 1, 2},
+		},
+		routes: []string{"10.0.0.0/8 via 192.168.1.2"},
+	}, {
+		name: "disabled",
+		conf: ClientConf{UseRoutes: &no, UseMTU: &no, UseDNS: &no},
+		opts: map[byte][]byte{
+			OptRouter:          {192, 168, 1, 1},
+			OptClasslessRoutes: {8, 10, 192, 168, 1, 2},
+			OptDNS:             {192, 168, 1, 53},
+			OptMTU:             {0x05, 0x78},
+		},
+		gateway: "192.168.1.1",
+		routes:  []string{"0.0.0.0/0 via 192.168.1.1"},
+	}}
+	for _, tt := range tests {
+		tt.opts[OptLeaseTime] = []byte{0, 0, 0x0e, 0x10}
+		l, err := parseLease(ack(tt.opts), &tt.conf, time.Now())
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if gw := l.Gateway; (gw == nil && tt.gateway != "") || (gw != nil && gw.String() != tt.gateway) {
+			t.Errorf("%s: gateway %s, want %s", tt.name, gw, tt.gateway)
+		}
+		if got := routeStrings(l); !reflect.DeepEqual(got, tt.routes) {
+			t.Errorf("%s: routes %v, want %v", tt.name, got, tt.routes)
+		}
+		if l.MTU != tt.mtu || !reflect.DeepEqual(l.DNS.Nameservers, tt.dns) || l.DNS.Domain != tt.domain {
+			t.Errorf("%s: unexpected mtu %d, dns %+v", tt.name, l.MTU, l.DNS)
+		}
+	}
+}
+
+func TestParseLeaseTimes(t *testing.T) {
+	l, err := parseLease(ack(map[byte][]byte{OptLeaseTime: {0, 0, 0x0e, 0x10}, OptRenewalTime: {0, 0, 0x03, 0x84}}), &ClientConf{}, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l.Duration != time.Hour || l.T1 != 15*time.Minute || l.T2 != time.Hour*7/8 {
+		t.Errorf("unexpected lease times: %s %s %s", l.Duration, l.T1, l.T2)
+	}
+	if l.IP.String() != "192.168.1.100/24" {
+		t.Errorf("classful mask should be used without option 1, got %s", l.IP.String())
+	}
+
+	l, err = parseLease(ack(map[byte][]byte{OptLeaseTime: {0xff, 0xff, 0xff, 0xff}}), &ClientConf{}, time.Now())
+	if err != nil || l.Duration != 0 || !l.Expiry().IsZero() {
+		t.Errorf("infinite lease should never expire: %v %+v", err, l)
+	}
+
+	if _, err = parseLease(ack(map[byte][]byte{}), &ClientConf{}, time.Now()); err == nil {
+		t.Errorf("ack without lease time should be rejected")
+	}
+	if _, err = parseLease(ack(map[byte][]byte{OptLeaseTime: {0, 0, 0, 60}, OptClasslessRoutes: {33, 0}}), &ClientConf{}, time.Now()); err == nil {
+		t.Errorf("invalid classless route should be rejected")
+	}
+}
+
+func TestRequestOptions(t *testing.T) {
+	mac := net.HardwareAddr{0x0a, 0x58, 0x0a, 0x00, 0x00, 0x01}
+	id := &Identity{ContainerID: "abc", Network: "mycninet", IfName: "eth0", PodName: "web-0", PodNamespace: "team", MAC: mac}
+	no := false
+
+	opts := (&ClientConf{}).requestOptions(id)
+	if string(opts[OptHostname]) != "web-0" || string(opts[OptVendorClass]) != DefaultVendorClass {
+		t.Errorf("unexpected hostname %q, vendor class %q", opts[OptHostname], opts[OptVendorClass])
+	}
+	if string(opts[OptClientID]) != "\x00team/web-0" {
+		t.Errorf("unexpected client id %q", opts[OptClientID])
+	}
+	if len(opts[OptParamRequest]) != 12 {
+		t.Errorf("unexpected parameter request list %v", opts[OptParamRequest])
+	}
+
+	conf := &ClientConf{SendHostname: &no, VendorClass: "storage", UseRoutes: &no, UseMTU: &no, UseDNS: &no}
+	opts = conf.requestOptions(&Identity{ContainerID: "abc", Network: "mycninet", IfName: "net1", PodName: "web-0", PodNamespace: "team"})
+	if _, ok := opts[OptHostname]; ok || string(opts[OptVendorClass]) != "storage" {
+		t.Errorf("unexpected hostname %q, vendor class %q", opts[OptHostname], opts[OptVendorClass])
+	}
+	if string(opts[OptClientID]) != "\x00team/web-0/net1" || len(opts[OptParamRequest]) != 6 {
+		t.Errorf("unexpected client id %q, parameters %v", opts[OptClientID], opts[OptParamRequest])
+	}
+
+	for mode, want := range map[string]string{
+		ClientIDContainer: "\x00abc/mycninet/eth0",
+		ClientIDMAC:       "\x01" + string(mac),
+	} {
+		if got := (&ClientConf{ClientID: mode}).clientID(id); string(got) != want {
+			t.Errorf("%s: client id %q, want %q", mode, got, want)
+		}
+	}
+	// 没有 Pod 信息时使用容器 ID
+	if got := (&ClientConf{}).clientID(&Identity{ContainerID: "abc", Network: "n", IfName: "eth0"}); string(got) != "\x00abc/n/eth0" {
+		t.Errorf("unexpected client id %q", got)
+	}
+}
+
+func TestClientConfOverride(t *testing.T) {
+	yes, no := true, false
+	conf := &ClientConf{ClientID: ClientIDMAC, UseDNS: &yes, VendorClass: "tsunami"}
+	conf.Override(&ClientConf{UseDNS: &no, VendorClass: "storage"})
+	if conf.ClientID != ClientIDMAC || *conf.UseDNS || conf.VendorClass != "storage" {
+		t.Errorf("unexpected conf after override: %+v", conf)
+	}
+	if err := (&ClientConf{ClientID: "hostname"}).Validate(); err == nil {
+		t.Errorf("unknown client id should be invalid")
+	}
+}
+
+func TestDUID(t *testing.T) {
+	mac := net.HardwareAddr{0x0a, 0x58, 0x0a, 0x00, 0x00, 0x01}
+	id := &Identity{ContainerID: "abc", Network: "mycninet", IfName: "eth0", PodName: "web-0", PodNamespace: "team", MAC: mac}
+
+	if got := (&ClientConf{ClientID: ClientIDMAC}).duid(id); string(got) != "\x00\x03\x00\x01"+string(mac) {
+		t.Errorf("mac mode should use DUID-LL, got %x", got)
+	}
+	// Pod 重建后容器 ID 与 MAC 变化, DUID 不变
+	duid := (&ClientConf{}).duid(id)
+	recreated := &Identity{ContainerID: "def", Network: "mycninet", IfName: "eth0", PodName: "web-0", PodNamespace: "team"}
+	if len(duid) != 18 || duid[1] != 4 || string(duid) != string((&ClientConf{}).duid(recreated)) {
+		t.Errorf("pod mode should use a stable DUID-UUID, got %x", duid)
+	}
+	if string(duid) == string((&ClientConf{ClientID: ClientIDContainer}).duid(id)) {
+		t.Errorf("container mode should use a different DUID")
+	}
+
+	net1 := *id
+	net1.IfName = "net1"
+	if iaid(id) == iaid(&net1) {
+		t.Errorf("interfaces should use different IAIDs")
+	}
+}
+
+func TestValidateIPv6(t *testing.T) {
+	no := false
+	for _, tt := range []struct {
+		conf  ClientConf
+		valid bool
+	}{
+		{ClientConf{IPv6: IPv6DHCP}, true},
+		{ClientConf{IPv6: IPv6SLAAC}, true},
+		{ClientConf{IPv6: IPv6DHCP, IPv4: &no}, true},
+		{ClientConf{IPv6: "stateless"}, false},
+		// 只有 slaac 时 ipam 结果中没有地址
+		{ClientConf{IPv6: IPv6SLAAC, IPv4: &no}, false},
+		{ClientConf{IPv4: &no}, false},
+	} {
+		if err := tt.conf.Validate(); (err == nil) != tt.valid {
+			t.Errorf("%+v: unexpected validation result %v", tt.conf, err)
+		}
+	}
+}
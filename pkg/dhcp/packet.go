@@ -0,0 +1,155 @@
+package dhcp
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+)
+
+// BOOTP 操作码
+const (
+	opRequest = 1
+	opReply   = 2
+)
+
+// 报文类型, 即 option 53 的值
+const (
+	MsgDiscover byte = 1
+	MsgOffer    byte = 2
+	MsgRequest  byte = 3
+	MsgDecline  byte = 4
+	MsgAck      byte = 5
+	MsgNak      byte = 6
+	MsgRelease  byte = 7
+)
+
+// 固定头部(236 字节)加上 magic cookie 的长度
+const headerLen = 240
+
+var magicCookie = []byte{99, 130, 83, 99}
+
+// Message dhcp 报文, 只包含客户端需要的字段
+type Message struct {
+	Op     byte
+	XID    uint32
+	Secs   uint16
+	Flags  uint16
+	CIAddr net.IP
+	YIAddr net.IP
+	SIAddr net.IP
+	GIAddr net.IP
+	CHAddr net.HardwareAddr
+	// Options 以选项代码为 key, 同一选项出现多次时按 RFC 3396 拼接
+	Options map[byte][]byte
+}
+
+// Type 返回 option 53 中的报文类型, 没有时返回 0
+func (m *Message) Type() byte {
+	if v := m.Options[OptMessageType]; len(v) == 1 {
+		return v[0]
+	}
+	return 0
+}
+
+// ip4 返回 4 字节的 IPv4 地址, 为空时返回 0.0.0.0
+func ip4(ip net.IP) []byte {
+	if v4 := ip.To4(); v4 != nil {
+		return v4
+	}
+	return net.IPv4zero.To4()
+}
+
+// Marshal 编码报文, 选项按代码排序, 报文类型总是第一个选项
+func (m *Message) Marshal() []byte {
+	b := make([]byte, headerLen, 576)
+	b[0] = m.Op
+	b[1] = 1 // 以太网
+	b[2] = 6
+	binary.BigEndian.PutUint32(b[4:8], m.XID)
+	binary.BigEndian.PutUint16(b[8:10], m.Secs)
+	binary.BigEndian.PutUint16(b[10:12], m.Flags)
+	copy(b[12:16], ip4(m.CIAddr))
+	copy(b[16:20], ip4(m.YIAddr))
+	copy(b[20:24], ip4(m.SIAddr))
+	copy(b[24:28], ip4(m.GIAddr))
+	copy(b[28:44], m.CHAddr)
+	copy(b[236:240], magicCookie)
+
+	codes := make([]int, 0, len(m.Options))
+	for code := range m.Options {
+		if code != OptMessageType {
+			codes = append(codes, int(code))
+		}
+	}
+	sort.Ints(codes)
+	if _, ok := m.Options[OptMessageType]; ok {
+		codes = append([]int{OptMessageType}, codes...)
+	}
+	for _, code := range codes {
+		v := m.Options[byte(code)]
+		// 超过 255 字节的选项拆分为多个
+		for len(v) > 255 {
+			b = append(b, byte(code), 255)
+			b = append(b, v[:255]...)
+			v = v[255:]
+		}
+		b = append(b, byte(code), byte(len(v)))
+		b = append(b, v...)
+	}
+	b = append(b, OptEnd)
+
+	// 部分 BOOTP 中继不接受小于 300 字节的报文
+	for len(b) < 300 {
+		b = append(b, OptPad)
+	}
+	return b
+}
+
+// ParseMessage 解析 dhcp 报文, 不处理 sname 与 file 字段中的选项
+func ParseMessage(b []byte) (m *Message, err error) {
+	if len(b) < headerLen {
+		return nil, fmt.Errorf("dhcp message too short: %d bytes", len(b))
+	}
+	if string(b[236:240]) != string(magicCookie) {
+		return nil, errors.New("invalid dhcp magic cookie")
+	}
+	hlen := int(b[2])
+	if hlen > 16 {
+		return nil, fmt.Errorf("invalid hardware address length %d", hlen)
+	}
+
+	m = &Message{
+		Op:      b[0],
+		XID:     binary.BigEndian.Uint32(b[4:8]),
+		Secs:    binary.BigEndian.Uint16(b[8:10]),
+		Flags:   binary.BigEndian.Uint16(b[10:12]),
+		CIAddr:  net.IP(append([]byte{}, b[12:16]...)),
+		YIAddr:  net.IP(append([]byte{}, b[16:20]...)),
+		SIAddr:  net.IP(append([]byte{}, b[20:24]...)),
+		GIAddr:  net.IP(append([]byte{}, b[24:28]...)),
+		CHAddr:  net.HardwareAddr(append([]byte{}, b[28:28+hlen]...)),
+		Options: map[byte][]byte{},
+	}
+
+	opts := b[headerLen:]
+	for len(opts) > 0 {
+		code := opts[0]
+		if code == OptEnd {
+			break
+		}
+		if code == OptPad {
+			opts = opts[1:]
+			continue
+		}
+		if len(opts) < 2 || len(opts) < 2+int(opts[1]) {
+			return nil, fmt.Errorf("option %d is truncated", code)
+		}
+		n := int(opts[1])
+		m.Options[code] = append(m.Options[code], opts[2:2+n]...)
+		opts = opts[2+n:]
+	}
+
+	return m, nil
+}
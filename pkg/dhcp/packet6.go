@@ -0,0 +1,236 @@
+package dhcp
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// DHCPv6 报文类型
+const (
+	Msg6Solicit   byte = 1
+	Msg6Advertise byte = 2
+	Msg6Request   byte = 3
+	Msg6Renew     byte = 5
+	Msg6Rebind    byte = 6
+	Msg6Reply     byte = 7
+	Msg6Release   byte = 8
+)
+
+// DHCPv6 选项代码
+const (
+	Opt6ClientID    = 1
+	Opt6ServerID    = 2
+	Opt6IANA        = 3
+	Opt6IAAddr      = 5
+	Opt6ORO         = 6
+	Opt6ElapsedTime = 8
+	Opt6StatusCode  = 13
+	Opt6VendorClass = 16
+	Opt6DNSServers  = 23
+	Opt6DomainList  = 24
+	Opt6ClientFQDN  = 39
+)
+
+// DHCPv6 状态码
+const (
+	status6Success      = 0
+	status6NoAddrsAvail = 2
+	status6NoBinding    = 3
+)
+
+// Option6 DHCPv6 选项, 同一选项可以出现多次
+type Option6 struct {
+	Code uint16
+	Data []byte
+}
+
+// Message6 DHCPv6 报文, 不包含中继报文
+type Message6 struct {
+	Type byte
+	// XID 只使用低 24 位
+	XID     uint32
+	Options []Option6
+}
+
+// Get 返回第一个 code 选项的内容, 不存在时返回 nil
+func (m *Message6) Get(code uint16) []byte {
+	for _, opt := range m.Options {
+		if opt.Code == code {
+			return opt.Data
+		}
+	}
+	return nil
+}
+
+// Add 追加一个选项
+func (m *Message6) Add(code uint16, data []byte) {
+	m.Options = append(m.Options, Option6{Code: code, Data: data})
+}
+
+func marshalOptions6(opts []Option6) (b []byte) {
+	for _, opt := range opts {
+		b = binary.BigEndian.AppendUint16(b, opt.Code)
+		b = binary.BigEndian.AppendUint16(b, uint16(len(opt.Data)))
+		b = append(b, opt.Data...)
+	}
+	return b
+}
+
+func parseOptions6(b []byte) (opts []Option6, err error) {
+	for len(b) > 0 {
+		if len(b) < 4 {
+			return nil, fmt.Errorf("dhcpv6 option header is truncated")
+		}
+		code, n := binary.BigEndian.Uint16(b[0:2]), int(binary.BigEndian.Uint16(b[2:4]))
+		if len(b) < 4+n {
+			return nil, fmt.Errorf("dhcpv6 option %d is truncated", code)
+		}
+		opts = append(opts, Option6{Code: code, Data: append([]byte{}, b[4:4+n]...)})
+		b = b[4+n:]
+	}
+	return opts, nil
+}
+
+// Marshal 编码报文, 选项按添加的顺序排列
+func (m *Message6) Marshal() []byte {
+	b := []byte{m.Type, byte(m.XID >> 16), byte(m.XID >> 8), byte(m.XID)}
+	return append(b, marshalOptions6(m.Options)...)
+}
+
+// ParseMessage6 解析 DHCPv6 报文
+func ParseMessage6(b []byte) (m *Message6, err error) {
+	if len(b) < 4 {
+		return nil, fmt.Errorf("dhcpv6 message too short: %d bytes", len(b))
+	}
+	m = &Message6{Type: b[0], XID: uint32(b[1])<<16 | uint32(b[2])<<8 | uint32(b[3])}
+	if m.Options, err = parseOptions6(b[4:]); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// status6 option 13 中的状态
+type status6 struct {
+	Code    uint16
+	Message string
+}
+
+func (s *status6) Error() string {
+	return fmt.Sprintf("dhcpv6 status %d: %s", s.Code, s.Message)
+}
+
+// parseStatus6 解析 opts 中的状态码, 没有该选项表示成功
+func parseStatus6(opts []Option6) *status6 {
+	for _, opt := range opts {
+		if opt.Code == Opt6StatusCode && len(opt.Data) >= 2 {
+			return &status6{Code: binary.BigEndian.Uint16(opt.Data), Message: string(opt.Data[2:])}
+		}
+	}
+	return &status6{Code: status6Success}
+}
+
+// iaAddr IA_NA 中的一个地址, 生存时间的单位为秒
+type iaAddr struct {
+	IP        net.IP
+	Preferred uint32
+	Valid     uint32
+}
+
+// iaNA 非临时地址的身份联盟(IA_NA), T1, T2 的单位为秒, 为 0 时由客户端决定
+type iaNA struct {
+	IAID   uint32
+	T1     uint32
+	T2     uint32
+	Addrs  []iaAddr
+	Status *status6
+}
+
+func (ia *iaNA) marshal() []byte {
+	b := binary.BigEndian.AppendUint32(nil, ia.IAID)
+	b = binary.BigEndian.AppendUint32(b, ia.T1)
+	b = binary.BigEndian.AppendUint32(b, ia.T2)
+	var opts []Option6
+	for _, addr := range ia.Addrs {
+		v := append([]byte{}, addr.IP.To16()...)
+		v = binary.BigEndian.AppendUint32(v, addr.Preferred)
+		v = binary.BigEndian.AppendUint32(v, addr.Valid)
+		opts = append(opts, Option6{Code: Opt6IAAddr, Data: v})
+	}
+	return append(b, marshalOptions6(opts)...)
+}
+
+// parseIANA 解析 IA_NA 选项, 地址自身的状态码不为成功时忽略该地址
+func parseIANA(b []byte) (ia *iaNA, err error) {
+	if len(b) < 12 {
+		return nil, fmt.Errorf("dhcpv6 IA_NA is truncated")
+	}
+	ia = &iaNA{
+		IAID: binary.BigEndian.Uint32(b[0:4]),
+		T1:   binary.BigEndian.Uint32(b[4:8]),
+		T2:   binary.BigEndian.Uint32(b[8:12]),
+	}
+	opts, err := parseOptions6(b[12:])
+	if err != nil {
+		return nil, err
+	}
+	ia.Status = parseStatus6(opts)
+	for _, opt := range opts {
+		if opt.Code != Opt6IAAddr {
+			continue
+		}
+		if len(opt.Data) < 24 {
+			return nil, fmt.Errorf("dhcpv6 IAADDR is truncated")
+		}
+		sub, err := parseOptions6(opt.Data[24:])
+		if err != nil {
+			return nil, err
+		}
+		if parseStatus6(sub).Code != status6Success {
+			continue
+		}
+		ia.Addrs = append(ia.Addrs, iaAddr{
+			IP:        net.IP(append([]byte{}, opt.Data[0:16]...)),
+			Preferred: binary.BigEndian.Uint32(opt.Data[16:20]),
+			Valid:     binary.BigEndian.Uint32(opt.Data[20:24]),
+		})
+	}
+	return ia, nil
+}
+
+// encodeDomain 按 DNS 报文的格式编码域名, 如 option 39 中的主机名
+func encodeDomain(name string) (b []byte) {
+	for _, label := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+		if label == "" || len(label) > 63 {
+			continue
+		}
+		b = append(b, byte(len(label)))
+		b = append(b, label...)
+	}
+	return b
+}
+
+// parseDomainList 解析 option 24 中按 DNS 报文格式编码的域名列表
+func parseDomainList(b []byte) (names []string, err error) {
+	var labels []string
+	for len(b) > 0 {
+		n := int(b[0])
+		if n == 0 {
+			if len(labels) > 0 {
+				names = append(names, strings.Join(labels, "."))
+			}
+			labels, b = nil, b[1:]
+			continue
+		}
+		if n > 63 || len(b) < 1+n {
+			return nil, fmt.Errorf("invalid domain in dhcpv6 domain list")
+		}
+		labels, b = append(labels, string(b[1:1+n])), b[1+n:]
+	}
+	// 最后一个域名可以没有结尾的空标签
+	if len(labels) > 0 {
+		names = append(names, strings.Join(labels, "."))
+	}
+	return names, nil
+}
@@ -0,0 +1,69 @@
+package dhcp
+
+import (
+	"bytes"
+	"net"
+	"reflect"
+	"testing"
+)
+
+func TestMessage6RoundTrip(t *testing.T) {
+	ia := &iaNA{IAID: 7, T1: 1800, T2: 2880, Addrs: []iaAddr{{IP: net.ParseIP("2001:db8::100"), Preferred: 3600, Valid: 7200}}}
+	m := &Message6{Type: Msg6Request, XID: 0xabcdef}
+	m.Add(Opt6ClientID, []byte{0, 3, 0, 1, 0x0a, 0x58, 0x0a, 0x00, 0x00, 0x01})
+	m.Add(Opt6IANA, ia.marshal())
+
+	got, err := ParseMessage6(m.Marshal())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Type != Msg6Request || got.XID != 0xabcdef || !bytes.Equal(got.Get(Opt6ClientID), m.Get(Opt6ClientID)) {
+		t.Errorf("unexpected message: %+v", got)
+	}
+	parsed, err := parseIANA(got.Get(Opt6IANA))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parsed.IAID != 7 || parsed.T1 != 1800 || parsed.T2 != 2880 || len(parsed.Addrs) != 1 ||
+		!parsed.Addrs[0].IP.Equal(ia.Addrs[0].IP) || parsed.Addrs[0].Valid != 7200 || parsed.Status.Code != status6Success {
+		t.Errorf("unexpected IA_NA: %+v", parsed)
+	}
+
+	if _, err = ParseMessage6([]byte{Msg6Reply, 0, 0, 1, 0, 1, 0, 8, 0}); err == nil {
+		t.Errorf("truncated option should be rejected")
+	}
+}
+
+func TestParseIANAStatus(t *testing.T) {
+	// IA_NA 自身的状态码为 NoAddrsAvail, 其中状态码为 NoBinding 的地址被忽略
+	addr := append(net.ParseIP("2001:db8::100").To16(), 0, 0, 0, 0, 0, 0, 0, 0)
+	addr = append(addr, marshalOptions6([]Option6{{Code: Opt6StatusCode, Data: []byte{0, status6NoBinding}}})...)
+	b := (&iaNA{IAID: 7}).marshal()
+	b = append(b, marshalOptions6([]Option6{
+		{Code: Opt6IAAddr, Data: addr},
+		{Code: Opt6StatusCode, Data: append([]byte{0, status6NoAddrsAvail}, "no addresses"...)},
+	})...)
+
+	ia, err := parseIANA(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ia.Addrs) != 0 || ia.Status.Code != status6NoAddrsAvail || ia.Status.Message != "no addresses" {
+		t.Errorf("unexpected IA_NA: %+v %+v", ia, ia.Status)
+	}
+}
+
+func TestDomainList(t *testing.T) {
+	b := append(encodeDomain("svc.cluster.local"), 0)
+	b = append(b, encodeDomain("example.com.")...)
+	names, err := parseDomainList(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"svc.cluster.local", "example.com"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("got %v, want %v", names, want)
+	}
+	if _, err = parseDomainList([]byte{5, 'a'}); err == nil {
+		t.Errorf("truncated label should be rejected")
+	}
+}
@@ -0,0 +1,74 @@
+package dhcp
+
+import (
+	"bytes"
+	"net"
+	"testing"
+)
+
+func TestMessageRoundTrip(t *testing.T) {
+	long := bytes.Repeat([]byte{'a'}, 300)
+	m := &Message{
+		Op:     opRequest,
+		XID:    0x12345678,
+		CIAddr: net.ParseIP("192.168.1.10"),
+		CHAddr: net.HardwareAddr{0x0a, 0x58, 0x0a, 0x00, 0x00, 0x01},
+		Options: map[byte][]byte{
+			OptMessageType: {MsgRequest},
+			OptHostname:    []byte("web-0"),
+			OptVendorClass: long,
+		},
+	}
+	b := m.Marshal()
+	if b[headerLen] != OptMessageType {
+		t.Errorf("message type should be the first option, got %d", b[headerLen])
+	}
+
+	got, err := ParseMessage(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.XID != m.XID || got.Type() != MsgRequest || !got.CIAddr.Equal(m.CIAddr) || got.CHAddr.String() != m.CHAddr.String() {
+		t.Errorf("unexpected message: %+v", got)
+	}
+	if string(got.Options[OptHostname]) != "web-0" {
+		t.Errorf("unexpected hostname %q", got.Options[OptHostname])
+	}
+	// 超过 255 字节的选项被拆分后重新拼接
+	if !bytes.Equal(got.Options[OptVendorClass], long) {
+		t.Errorf("long option is not concatenated, got %d bytes", len(got.Options[OptVendorClass]))
+	}
+}
+
+func TestParseMessageInvalid(t *testing.T) {
+	b := (&Message{Op: opReply, Options: map[byte][]byte{OptMessageType: {MsgAck}}}).Marshal()
+
+	short := append([]byte{}, b[:100]...)
+	badCookie := append([]byte{}, b...)
+	badCookie[236] = 0
+	truncated := append(append([]byte{}, b[:headerLen]...), OptRouter, 8, 10, 0)
+	for name, data := range map[string][]byte{"short": short, "cookie": badCookie, "truncated": truncated} {
+		if _, err := ParseMessage(data); err == nil {
+			t.Errorf("%s: expected error", name)
+		}
+	}
+}
+
+func TestFrame(t *testing.T) {
+	payload := []byte("dhcp")
+	src := net.HardwareAddr{0x0a, 0x58, 0x0a, 0x00, 0x00, 0x01}
+	frame := makeFrame(payload, src, net.HardwareAddr{0xff, 0xff, 0xff, 0xff, 0xff, 0xff}, nil, net.IPv4bcast)
+	if checksum(frame[14:34]) != 0 {
+		t.Errorf("invalid ipv4 header checksum")
+	}
+
+	// 客户端发出的报文目的端口为 67, 不会被当作应答
+	if p, _ := parseFrame(frame); p != nil {
+		t.Errorf("request should not be parsed as a reply")
+	}
+	frame[36], frame[37] = 0, clientPort
+	p, mac := parseFrame(frame)
+	if string(p) != "dhcp" || mac.String() != src.String() {
+		t.Errorf("unexpected payload %q from %s", p, mac)
+	}
+}
@@ -0,0 +1,173 @@
+package dhcp
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/gitlayzer/tsunami/pkg/store"
+	"github.com/gitlayzer/tsunami/utils/utilfile"
+	"k8s.io/klog"
+)
+
+// record 将租约转换为持久化的记录
+func (h *holder) record() *store.Lease {
+	l := h.Lease()
+	conf, _ := json.Marshal(h.conf)
+	rec := &store.Lease{
+		ContainerID:  h.id.ContainerID,
+		Network:      h.id.Network,
+		IfName:       h.id.IfName,
+		PodName:      h.id.PodName,
+		PodNamespace: h.id.PodNamespace,
+		NetNs:        h.netns,
+		MAC:          h.id.MAC.String(),
+		IPAddress:    l.IP.String(),
+		AcquiredAt:   l.Acquired,
+		ClientConf:   conf,
+	}
+	if l.Gateway != nil {
+		rec.Gateway = l.Gateway.String()
+	}
+	if l.Server != nil {
+		rec.Server = l.Server.String()
+	}
+	if l.ServerMAC != nil {
+		rec.ServerMAC = l.ServerMAC.String()
+	}
+	if h.v6 {
+		rec.Family = store.FamilyIPv6
+		rec.ServerID = hex.EncodeToString(l.ServerID)
+	}
+	if l.Duration != 0 {
+		rec.RenewAt = l.Acquired.Add(l.T1)
+		rec.RebindAt = l.Acquired.Add(l.T2)
+		rec.ExpiresAt = l.Expiry()
+	}
+	return rec
+}
+
+// fromRecord 根据持久化的记录恢复租约, 记录中没有路由, MTU 与 DNS, 下一次续租后会重新获得
+func fromRecord(rec *store.Lease) (id *Identity, conf *ClientConf, l *Lease, err error) {
+	id = &Identity{
+		ContainerID:  rec.ContainerID,
+		Network:      rec.Network,
+		IfName:       rec.IfName,
+		PodName:      rec.PodName,
+		PodNamespace: rec.PodNamespace,
+	}
+	if id.MAC, err = net.ParseMAC(rec.MAC); err != nil {
+		return nil, nil, nil, fmt.Errorf("invalid mac %q: %v", rec.MAC, err)
+	}
+
+	conf = &ClientConf{}
+	if len(rec.ClientConf) > 0 {
+		if err = json.Unmarshal(rec.ClientConf, conf); err != nil {
+			return nil, nil, nil, fmt.Errorf("invalid client conf: %v", err)
+		}
+	}
+
+	ip, ipNet, err := net.ParseCIDR(rec.IPAddress)
+	switch {
+	case err != nil:
+		return nil, nil, nil, fmt.Errorf("invalid address %q", rec.IPAddress)
+	case rec.Family == store.FamilyIPv6 && ip.To4() == nil:
+		l = &Lease{IP: net.IPNet{IP: ip, Mask: ipNet.Mask}, Acquired: rec.AcquiredAt}
+		if l.ServerID, err = hex.DecodeString(rec.ServerID); err != nil {
+			return nil, nil, nil, fmt.Errorf("invalid server id %q: %v", rec.ServerID, err)
+		}
+	case rec.Family == "" && ip.To4() != nil:
+		l = &Lease{
+			IP:       net.IPNet{IP: ip.To4(), Mask: ipNet.Mask},
+			Gateway:  net.ParseIP(rec.Gateway).To4(),
+			Server:   net.ParseIP(rec.Server).To4(),
+			Acquired: rec.AcquiredAt,
+		}
+		if rec.ServerMAC != "" {
+			if l.ServerMAC, err = net.ParseMAC(rec.ServerMAC); err != nil {
+				return nil, nil, nil, fmt.Errorf("invalid server mac %q: %v", rec.ServerMAC, err)
+			}
+		}
+	default:
+		return nil, nil, nil, fmt.Errorf("invalid address %q", rec.IPAddress)
+	}
+	if !rec.ExpiresAt.IsZero() {
+		l.Duration = rec.ExpiresAt.Sub(rec.AcquiredAt)
+		l.T1 = rec.RenewAt.Sub(rec.AcquiredAt)
+		l.T2 = rec.RebindAt.Sub(rec.AcquiredAt)
+	}
+	return id, conf, l, nil
+}
+
+// save 持久化当前租约, 失败只影响 daemon 重启后的恢复
+func (h *holder) save() {
+	if h.store == nil {
+		return
+	}
+	if err := h.store.SaveLease(h.record()); err != nil {
+		klog.Warningf("failed to save dhcp lease of %s: %s", h.id.Key(), err)
+	}
+}
+
+// family 租约记录的 Family
+func (h *holder) family() string {
+	if h.v6 {
+		return store.FamilyIPv6
+	}
+	return ""
+}
+
+// forget 删除租约的记录
+func (h *holder) forget() {
+	if h.store == nil {
+		return
+	}
+	if err := h.store.DeleteLease(h.id.ContainerID, h.id.Network, h.id.IfName, h.family()); err != nil {
+		klog.Warningf("failed to delete dhcp lease of %s: %s", h.id.Key(), err)
+	}
+}
+
+// restore 恢复上一次 daemon 持有的租约并继续续租.
+// Pod 网络命名空间已不存在的记录会被删除, 在 daemon 停止期间过期的租约只保留记录并告警.
+func (d *DHCP) restore() {
+	if d.store == nil {
+		return
+	}
+	records, err := d.store.ListLeases()
+	if err != nil {
+		klog.Warningf("failed to list dhcp leases: %s", err)
+		return
+	}
+
+	now := time.Now()
+	for _, rec := range records {
+		id, conf, l, err := fromRecord(rec)
+		if err != nil {
+			klog.Warningf("ignore invalid dhcp lease of %s/%s/%s: %s", rec.ContainerID, rec.Network, rec.IfName, err)
+			continue
+		}
+		open := open4(d.dial)
+		if rec.Family == store.FamilyIPv6 {
+			open = open6(d.dial6)
+		}
+		h := newHolder(id, conf, rec.NetNs, open, l)
+		h.store = d.store
+
+		if !utilfile.Exists(rec.NetNs) {
+			klog.Infof("netns of %s no longer exists, drop dhcp lease %s", id.Key(), rec.IPAddress)
+			h.forget()
+			continue
+		}
+		if rec.Expired(now) {
+			klog.Warningf("dhcp lease %s of pod %s/%s expired at %s while the daemon was down, the address is no longer renewed",
+				rec.IPAddress, rec.PodNamespace, rec.PodName, rec.ExpiresAt.Format(time.RFC3339))
+			continue
+		}
+
+		d.setLease(h.key(), h)
+		go h.maintain()
+		klog.Infof("resume dhcp lease %s of %s, expires at %s", rec.IPAddress, id.Key(), rec.ExpiresAt.Format(time.RFC3339))
+	}
+}
@@ -0,0 +1,130 @@
+package dhcp
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/containernetworking/cni/pkg/types/current"
+	"github.com/gitlayzer/tsunami/pkg/store"
+)
+
+func TestRecordRoundTrip(t *testing.T) {
+	no := false
+	acquired := time.Now().Truncate(time.Second)
+	l := &Lease{
+		IP:        net.IPNet{IP: net.ParseIP("192.168.1.100").To4(), Mask: net.CIDRMask(24, 32)},
+		Gateway:   net.ParseIP("192.168.1.1").To4(),
+		Server:    net.ParseIP("192.168.1.2").To4(),
+		ServerMAC: net.HardwareAddr{0x02, 0, 0, 0, 0, 0x67},
+		Duration:  time.Hour,
+		T1:        30 * time.Minute,
+		T2:        50 * time.Minute,
+		Acquired:  acquired,
+	}
+	h := newHolder(testID, &ClientConf{ClientID: ClientIDMAC, UseDNS: &no}, "/var/run/netns/test", nil, l)
+	rec := h.record()
+	if rec.IPAddress != "192.168.1.100/24" || rec.MAC != testID.MAC.String() || !rec.ExpiresAt.Equal(acquired.Add(time.Hour)) {
+		t.Errorf("unexpected record: %+v", rec)
+	}
+
+	id, conf, got, err := fromRecord(rec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id.Key() != testID.Key() || id.PodName != "web-0" || id.MAC.String() != testID.MAC.String() {
+		t.Errorf("unexpected identity: %+v", id)
+	}
+	if conf.ClientID != ClientIDMAC || *conf.UseDNS {
+		t.Errorf("unexpected conf: %+v", conf)
+	}
+	if got.IP.String() != l.IP.String() || !got.Server.Equal(l.Server) || got.ServerMAC.String() != l.ServerMAC.String() ||
+		got.Duration != l.Duration || got.T1 != l.T1 || got.T2 != l.T2 || !got.Acquired.Equal(acquired) {
+		t.Errorf("unexpected lease: %+v", got)
+	}
+
+	rec.MAC = "invalid"
+	if _, _, _, err = fromRecord(rec); err == nil {
+		t.Errorf("invalid mac should be rejected")
+	}
+}
+
+func TestRestore(t *testing.T) {
+	dir := t.TempDir()
+	st := store.New(dir)
+	// utilfile.Exists 只检查路径是否存在, 用普通文件代替网络命名空间
+	netns := filepath.Join(dir, "netns")
+	if err := os.WriteFile(netns, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	records := []*store.Lease{
+		{ContainerID: "live", Network: "n", IfName: "eth0", NetNs: netns, AcquiredAt: now.Add(-time.Minute),
+			RenewAt: now.Add(time.Hour), RebindAt: now.Add(2 * time.Hour), ExpiresAt: now.Add(3 * time.Hour)},
+		{ContainerID: "expired", Network: "n", IfName: "eth0", NetNs: netns, AcquiredAt: now.Add(-2 * time.Hour),
+			RenewAt: now.Add(-90 * time.Minute), RebindAt: now.Add(-70 * time.Minute), ExpiresAt: now.Add(-time.Hour)},
+		{ContainerID: "gone", Network: "n", IfName: "eth0", NetNs: filepath.Join(dir, "gone"), AcquiredAt: now,
+			RenewAt: now.Add(time.Hour), RebindAt: now.Add(2 * time.Hour), ExpiresAt: now.Add(3 * time.Hour)},
+	}
+	for _, rec := range records {
+		rec.MAC, rec.IPAddress = testID.MAC.String(), "192.168.1.100/24"
+		if err := st.SaveLease(rec); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	s := newFakeServer()
+	d := NewDHCP(st)
+	d.dial = fakeDial(s)
+	d.restore()
+	defer d.Stop()
+
+	if d.getLease("live/n/eth0") == nil {
+		t.Errorf("live lease should be resumed")
+	}
+	if d.getLease("expired/n/eth0") != nil || d.getLease("gone/n/eth0") != nil {
+		t.Errorf("expired and stale leases should not be resumed")
+	}
+	left, err := st.ListLeases()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 过期的租约保留记录以便在 tsunamictl leases 中发现, netns 已删除的记录被清理
+	var ids []string
+	for _, rec := range left {
+		ids = append(ids, rec.ContainerID)
+	}
+	if len(ids) != 2 || ids[0] == "gone" || ids[1] == "gone" {
+		t.Errorf("unexpected records left: %v", ids)
+	}
+}
+
+func TestAllocatePersist(t *testing.T) {
+	st := store.New(t.TempDir())
+	s := newFakeServer()
+	d := NewDHCP(st)
+	d.dial = fakeDial(s)
+	defer d.Stop()
+
+	args := ipamArgs(`{"name":"n","ipam":{"type":"dhcp"}}`)
+	if err := d.Allocate(args, &current.Result{}); err != nil {
+		t.Fatal(err)
+	}
+	list, err := st.ListLeases()
+	if err != nil || len(list) != 1 {
+		t.Fatalf("lease should be saved: %v %v", list, err)
+	}
+	if rec := list[0]; rec.PodName != "web-0" || rec.Server != "192.168.1.1" || rec.ExpiresAt.IsZero() {
+		t.Errorf("unexpected record: %+v", rec)
+	}
+
+	if err = d.Release(args, &struct{}{}); err != nil {
+		t.Fatal(err)
+	}
+	if list, _ = st.ListLeases(); len(list) != 0 {
+		t.Errorf("released lease should be deleted: %v", list)
+	}
+}
@@ -0,0 +1,170 @@
+package dhcp
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	clientPort = 68
+	serverPort = 67
+)
+
+func htons(v uint16) uint16 {
+	return v<<8 | v>>8
+}
+
+// rawConn 在 Pod 网卡上通过 AF_PACKET 套接字收发 dhcp 报文.
+// 获取地址之前网卡上没有 IP, 无法使用 UDP 套接字, 因此自行构造以太网, IPv4 与 UDP 头部.
+type rawConn struct {
+	fd  int
+	idx int
+	mac net.HardwareAddr
+	buf []byte
+}
+
+// dialRaw 在 netnsPath 中打开绑定到 ifName 的套接字, 返回的套接字在离开网络命名空间后仍然有效
+func dialRaw(netnsPath, ifName string) (c conn, mac net.HardwareAddr, err error) {
+	rc := &rawConn{fd: -1, buf: make([]byte, 1600)}
+	err = ns.WithNetNSPath(netnsPath, func(ns.NetNS) error {
+		link, err := netlink.LinkByName(ifName)
+		if err != nil {
+			return fmt.Errorf("failed to get link %s: %v", ifName, err)
+		}
+		rc.idx, rc.mac = link.Attrs().Index, link.Attrs().HardwareAddr
+		if len(rc.mac) != 6 {
+			return fmt.Errorf("%s has no ethernet address", ifName)
+		}
+
+		rc.fd, err = unix.Socket(unix.AF_PACKET, unix.SOCK_RAW, int(htons(unix.ETH_P_IP)))
+		if err != nil {
+			return fmt.Errorf("failed to create packet socket: %v", err)
+		}
+		return unix.Bind(rc.fd, &unix.SockaddrLinklayer{Ifindex: rc.idx, Protocol: htons(unix.ETH_P_IP)})
+	})
+	if err != nil {
+		if rc.fd >= 0 {
+			unix.Close(rc.fd)
+		}
+		return nil, nil, err
+	}
+	return rc, rc.mac, nil
+}
+
+// checksum 计算 IPv4 头部校验和
+func checksum(b []byte) uint16 {
+	var sum uint32
+	for i := 0; i+1 < len(b); i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(b[i:]))
+	}
+	for sum>>16 != 0 {
+		sum = sum&0xffff + sum>>16
+	}
+	return ^uint16(sum)
+}
+
+// makeFrame 将 dhcp 报文封装为以太网帧, UDP 校验和为 0 表示不校验
+func makeFrame(payload []byte, srcMAC, dstMAC net.HardwareAddr, src, dst net.IP) []byte {
+	frame := make([]byte, 14+20+8+len(payload))
+	copy(frame[0:6], dstMAC)
+	copy(frame[6:12], srcMAC)
+	binary.BigEndian.PutUint16(frame[12:14], unix.ETH_P_IP)
+
+	ip := frame[14:34]
+	ip[0] = 0x45
+	binary.BigEndian.PutUint16(ip[2:4], uint16(20+8+len(payload)))
+	ip[8] = 64
+	ip[9] = unix.IPPROTO_UDP
+	copy(ip[12:16], ip4(src))
+	copy(ip[16:20], ip4(dst))
+	binary.BigEndian.PutUint16(ip[10:12], checksum(ip))
+
+	udp := frame[34:42]
+	binary.BigEndian.PutUint16(udp[0:2], clientPort)
+	binary.BigEndian.PutUint16(udp[2:4], serverPort)
+	binary.BigEndian.PutUint16(udp[4:6], uint16(8+len(payload)))
+	copy(frame[42:], payload)
+	return frame
+}
+
+// parseFrame 从以太网帧中取出发往客户端端口的 UDP 载荷, 不是 dhcp 应答时返回 nil
+func parseFrame(frame []byte) (payload []byte, srcMAC net.HardwareAddr) {
+	if len(frame) < 14+20 || binary.BigEndian.Uint16(frame[12:14]) != unix.ETH_P_IP {
+		return nil, nil
+	}
+	ip := frame[14:]
+	ihl := int(ip[0]&0x0f) * 4
+	if ip[0]>>4 != 4 || ihl < 20 || ip[9] != unix.IPPROTO_UDP || len(ip) < ihl+8 {
+		return nil, nil
+	}
+	udp := ip[ihl:]
+	if binary.BigEndian.Uint16(udp[2:4]) != clientPort {
+		return nil, nil
+	}
+	n := int(binary.BigEndian.Uint16(udp[4:6]))
+	if n < 8 || n > len(udp) {
+		return nil, nil
+	}
+	return udp[8:n], net.HardwareAddr(frame[6:12])
+}
+
+func (c *rawConn) Send(m *Message, dst net.IP, dstMAC net.HardwareAddr) error {
+	if dst == nil {
+		dst = net.IPv4bcast
+	}
+	if dstMAC == nil {
+		dstMAC = net.HardwareAddr{0xff, 0xff, 0xff, 0xff, 0xff, 0xff}
+	}
+	frame := makeFrame(m.Marshal(), c.mac, dstMAC, m.CIAddr, dst)
+
+	addr := &unix.SockaddrLinklayer{Ifindex: c.idx, Protocol: htons(unix.ETH_P_IP), Halen: 6}
+	copy(addr.Addr[:], dstMAC)
+	if err := unix.Sendto(c.fd, frame, 0, addr); err != nil {
+		return fmt.Errorf("failed to send dhcp message: %v", err)
+	}
+	return nil
+}
+
+func (c *rawConn) Recv(deadline time.Time) (m *Message, srcMAC net.HardwareAddr, err error) {
+	for {
+		timeout := time.Until(deadline)
+		if timeout <= 0 {
+			return nil, nil, errTimeout
+		}
+		// SO_RCVTIMEO 为 0 表示一直阻塞, 因此至少等待 1 微秒
+		tv := unix.NsecToTimeval(int64(timeout) + 1000)
+		if err = unix.SetsockoptTimeval(c.fd, unix.SOL_SOCKET, unix.SO_RCVTIMEO, &tv); err != nil {
+			return nil, nil, fmt.Errorf("failed to set socket timeout: %v", err)
+		}
+
+		n, from, err := unix.Recvfrom(c.fd, c.buf, 0)
+		if err != nil {
+			if err == unix.EAGAIN || err == unix.EINTR {
+				continue
+			}
+			return nil, nil, fmt.Errorf("failed to receive dhcp message: %v", err)
+		}
+		if ll, ok := from.(*unix.SockaddrLinklayer); ok && ll.Pkttype == unix.PACKET_OUTGOING {
+			continue
+		}
+
+		payload, srcMAC := parseFrame(c.buf[:n])
+		if payload == nil {
+			continue
+		}
+		if m, err = ParseMessage(payload); err != nil {
+			continue
+		}
+		return m, append(net.HardwareAddr{}, srcMAC...), nil
+	}
+}
+
+func (c *rawConn) Close() error {
+	return unix.Close(c.fd)
+}
@@ -0,0 +1,131 @@
+package dhcp
+
+import (
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	clientPort6 = 546
+	serverPort6 = 547
+	// linkLocalTimeout 等待链路本地地址完成重复地址检测的最长时间
+	linkLocalTimeout = 5 * time.Second
+)
+
+// allServers6 所有 dhcp 中继与服务器的组播地址
+var allServers6 = net.ParseIP("ff02::1:2")
+
+// udpConn6 在 Pod 网卡上通过 UDP 套接字收发 DHCPv6 报文.
+// 与 DHCPv4 不同, 获取地址之前网卡上已经有链路本地地址, 邻居发现与校验和由内核处理.
+type udpConn6 struct {
+	fd  int
+	idx int
+	buf []byte
+}
+
+// linkLocal 等待网卡上的链路本地地址完成重复地址检测, 刚创建的 veth 上地址处于 tentative 状态, 无法绑定
+func linkLocal(link netlink.Link) (ip net.IP, err error) {
+	deadline := time.Now().Add(linkLocalTimeout)
+	for {
+		addrs, err := netlink.AddrList(link, netlink.FAMILY_V6)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list addresses of %s: %v", link.Attrs().Name, err)
+		}
+		for _, addr := range addrs {
+			if addr.IP.IsLinkLocalUnicast() && addr.Flags&unix.IFA_F_TENTATIVE == 0 {
+				return addr.IP, nil
+			}
+		}
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("%s has no usable ipv6 link-local address", link.Attrs().Name)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+// dialUDP6 在 netnsPath 中打开绑定到 ifName 链路本地地址的套接字, 返回的套接字在离开网络命名空间后仍然有效
+func dialUDP6(netnsPath, ifName string) (c conn6, mac net.HardwareAddr, err error) {
+	uc := &udpConn6{fd: -1, buf: make([]byte, 1600)}
+	err = ns.WithNetNSPath(netnsPath, func(ns.NetNS) error {
+		link, err := netlink.LinkByName(ifName)
+		if err != nil {
+			return fmt.Errorf("failed to get link %s: %v", ifName, err)
+		}
+		uc.idx, mac = link.Attrs().Index, link.Attrs().HardwareAddr
+		if len(mac) != 6 {
+			return fmt.Errorf("%s has no ethernet address", ifName)
+		}
+		ip, err := linkLocal(link)
+		if err != nil {
+			return err
+		}
+
+		uc.fd, err = unix.Socket(unix.AF_INET6, unix.SOCK_DGRAM, unix.IPPROTO_UDP)
+		if err != nil {
+			return fmt.Errorf("failed to create udp socket: %v", err)
+		}
+		if err = unix.SetsockoptInt(uc.fd, unix.SOL_SOCKET, unix.SO_REUSEADDR, 1); err != nil {
+			return fmt.Errorf("failed to set SO_REUSEADDR: %v", err)
+		}
+		if err = unix.SetsockoptString(uc.fd, unix.SOL_SOCKET, unix.SO_BINDTODEVICE, ifName); err != nil {
+			return fmt.Errorf("failed to bind socket to %s: %v", ifName, err)
+		}
+		addr := &unix.SockaddrInet6{Port: clientPort6, ZoneId: uint32(uc.idx)}
+		copy(addr.Addr[:], ip.To16())
+		if err = unix.Bind(uc.fd, addr); err != nil {
+			return fmt.Errorf("failed to bind [%s%%%s]:%d: %v", ip, ifName, clientPort6, err)
+		}
+		return nil
+	})
+	if err != nil {
+		if uc.fd >= 0 {
+			unix.Close(uc.fd)
+		}
+		return nil, nil, err
+	}
+	return uc, mac, nil
+}
+
+func (c *udpConn6) Send(m *Message6) error {
+	addr := &unix.SockaddrInet6{Port: serverPort6, ZoneId: uint32(c.idx)}
+	copy(addr.Addr[:], allServers6)
+	if err := unix.Sendto(c.fd, m.Marshal(), 0, addr); err != nil {
+		return fmt.Errorf("failed to send dhcpv6 message: %v", err)
+	}
+	return nil
+}
+
+func (c *udpConn6) Recv(deadline time.Time) (m *Message6, err error) {
+	for {
+		timeout := time.Until(deadline)
+		if timeout <= 0 {
+			return nil, errTimeout
+		}
+		// SO_RCVTIMEO 为 0 表示一直阻塞, 因此至少等待 1 微秒
+		tv := unix.NsecToTimeval(int64(timeout) + 1000)
+		if err = unix.SetsockoptTimeval(c.fd, unix.SOL_SOCKET, unix.SO_RCVTIMEO, &tv); err != nil {
+			return nil, fmt.Errorf("failed to set socket timeout: %v", err)
+		}
+
+		n, _, err := unix.Recvfrom(c.fd, c.buf, 0)
+		if err != nil {
+			if err == unix.EAGAIN || err == unix.EINTR {
+				continue
+			}
+			return nil, fmt.Errorf("failed to receive dhcpv6 message: %v", err)
+		}
+		if m, err = ParseMessage6(c.buf[:n]); err != nil {
+			continue
+		}
+		return m, nil
+	}
+}
+
+func (c *udpConn6) Close() error {
+	return unix.Close(c.fd)
+}
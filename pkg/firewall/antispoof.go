@@ -0,0 +1,147 @@
+package firewall
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// BridgeTable tsunami 在 bridge 族中使用的表, 所有经过网桥端口的二层帧都会经过这里
+const BridgeTable = "tsunami"
+
+// portChain 每个 Pod veth 端口对应的链名称
+func portChain(hostVeth string) string {
+	return "port_" + hostVeth
+}
+
+// InitAntiSpoofing 创建 bridge 表, 端口映射与 prerouting 链, 可以重复调用
+// 从 Pod veth 进入网桥的帧, 根据入端口跳转到该端口对应的链中检查
+func InitAntiSpoofing() error {
+	return Run(fmt.Sprintf(`add table bridge %[1]s
+add map bridge %[1]s ports { type ifname : verdict; }
+add chain bridge %[1]s prerouting { type filter hook prerouting priority -300; policy accept; }
+flush chain bridge %[1]s prerouting
+add rule bridge %[1]s prerouting iifname vmap @ports
+`, BridgeTable))
+}
+
+// CleanupAntiSpoofing 删除 bridge 表, 在卸载桥接网络时调用
+func CleanupAntiSpoofing() error {
+	return Run(fmt.Sprintf("add table bridge %[1]s\ndelete table bridge %[1]s\n", BridgeTable))
+}
+
+// AntiSpoofPort 需要绑定到 Pod veth 端口上的地址
+type AntiSpoofPort struct {
+	// HostVeth Pod veth 设备在宿主机上的一端, 即网桥的端口
+	HostVeth string
+	MAC      net.HardwareAddr
+	IPs      []net.IP
+}
+
+// portRules 生成端口链中的规则
+// 1. 源 MAC 必须为 Pod 的 MAC, ARP 中的发送者 MAC 与 IP 也必须是 Pod 自己的(允许 0.0.0.0 的探测报文)
+// 2. IPv4 源地址必须为 Pod 的 IP, 仅允许 0.0.0.0 发出 DHCP 请求; 丢弃 Pod 发出的 DHCP 应答
+// 3. IPv6 源地址必须为 Pod 的 IP 或链路本地地址; 丢弃 Pod 发出的路由通告与 DHCPv6 应答
+// 4. 其他类型的帧全部丢弃, 包括 802.1Q / 802.1ad 帧, 否则其中的 IP 与 ARP 不会经过以上检查
+func (p *AntiSpoofPort) portRules() string {
+	var v4, v6 []string
+	for _, ip := range p.IPs {
+		if ip.To4() != nil {
+			v4 = append(v4, ip.String())
+		} else {
+			v6 = append(v6, ip.String())
+		}
+	}
+
+	chain := fmt.Sprintf("bridge %s %s", BridgeTable, portChain(p.HostVeth))
+	var b strings.Builder
+	rule := func(format string, a ...interface{}) {
+		fmt.Fprintf(&b, "add rule %s %s\n", chain, fmt.Sprintf(format, a...))
+	}
+
+	rule("ether saddr != %s drop", p.MAC)
+	rule("ether type arp arp saddr ether != %s drop", p.MAC)
+	if len(v4) > 0 {
+		rule("ether type arp arp saddr ip != { 0.0.0.0, %s } drop", strings.Join(v4, ", "))
+	} else {
+		rule("ether type arp arp saddr ip != 0.0.0.0 drop")
+	}
+	rule("ether type ip udp sport 67 drop")
+	rule("ether type ip ip saddr 0.0.0.0 udp sport 68 udp dport 67 accept")
+	if len(v4) > 0 {
+		rule("ether type ip ip saddr != { %s } drop", strings.Join(v4, ", "))
+	} else {
+		rule("ether type ip drop")
+	}
+	rule("ether type ip6 icmpv6 type nd-router-advert drop")
+	rule("ether type ip6 udp sport 547 drop")
+	if len(v6) > 0 {
+		rule("ether type ip6 ip6 saddr != { ::, fe80::/10, %s } drop", strings.Join(v6, ", "))
+	} else {
+		rule("ether type ip6 ip6 saddr != { ::, fe80::/10 } drop")
+	}
+	rule("ether type { ip, arp, ip6 } accept")
+	rule("drop")
+
+	return b.String()
+}
+
+// AddAntiSpoofPort 为 Pod veth 端口添加过滤规则, 重复调用会覆盖之前的规则
+func AddAntiSpoofPort(p *AntiSpoofPort) error {
+	if p.HostVeth == "" || len(p.MAC) == 0 {
+		return fmt.Errorf("host veth and mac are required for anti spoofing")
+	}
+
+	chain := portChain(p.HostVeth)
+	script := fmt.Sprintf(`add chain bridge %[1]s %[2]s
+flush chain bridge %[1]s %[2]s
+%[4]sadd element bridge %[1]s ports { "%[3]s" : jump %[2]s }
+`, BridgeTable, chain, p.HostVeth, p.portRules())
+
+	// 端口已在映射中时 add element 会报错, 先删除旧的元素
+	if exists, _ := portExists(p.HostVeth); exists {
+		script = fmt.Sprintf("delete element bridge %s ports { \"%s\" }\n", BridgeTable, p.HostVeth) + script
+	}
+
+	return Run(script)
+}
+
+// DelAntiSpoofPort 移除 Pod veth 端口的过滤规则, 规则不存在时不报错(cmdDel 可能被重复调用)
+func DelAntiSpoofPort(hostVeth string) error {
+	exists, err := portExists(hostVeth)
+	if err != nil || !exists {
+		return err
+	}
+
+	return Run(fmt.Sprintf(`delete element bridge %[1]s ports { "%[3]s" }
+flush chain bridge %[1]s %[2]s
+delete chain bridge %[1]s %[2]s
+`, BridgeTable, portChain(hostVeth), hostVeth))
+}
+
+// portExists 判断端口对应的链是否存在
+func portExists(hostVeth string) (bool, error) {
+	out, err := List("chains", "bridge")
+	if err != nil {
+		return false, err
+	}
+
+	return strings.Contains(out, "chain "+portChain(hostVeth)+" {"), nil
+}
+
+// ListAntiSpoofPorts 列出所有已添加过滤规则的端口, 用于 gc 清理已经不存在的 veth
+func ListAntiSpoofPorts() (ports []string, err error) {
+	out, err := List("chains", "bridge")
+	if err != nil {
+		return nil, err
+	}
+
+	for _, line := range strings.Split(out, "\n") {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, "chain port_") {
+			ports = append(ports, strings.TrimSuffix(strings.TrimPrefix(line, "chain port_"), " {"))
+		}
+	}
+
+	return ports, nil
+}
@@ -0,0 +1,58 @@
+package firewall
+
+import (
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestPortRules(t *testing.T) {
+	mac, _ := net.ParseMAC("0a:58:c0:a8:01:32")
+	tests := []struct {
+		name    string
+		ips     []net.IP
+		want    []string
+		notWant []string
+	}{
+		{
+			name: "dual stack",
+			ips:  []net.IP{net.ParseIP("192.168.1.50"), net.ParseIP("2001:db8::50")},
+			want: []string{
+				"ether saddr != 0a:58:c0:a8:01:32 drop",
+				"ether type arp arp saddr ip != { 0.0.0.0, 192.168.1.50 } drop",
+				"ether type ip ip saddr != { 192.168.1.50 } drop",
+				"ether type ip6 ip6 saddr != { ::, fe80::/10, 2001:db8::50 } drop",
+			},
+		},
+		{
+			name: "without addresses only dhcp and link-local traffic is allowed",
+			want: []string{
+				"ether type arp arp saddr ip != 0.0.0.0 drop",
+				"ether type ip ip saddr 0.0.0.0 udp sport 68 udp dport 67 accept\nadd rule bridge tsunami port_veth0 ether type ip drop",
+				"ether type ip6 ip6 saddr != { ::, fe80::/10 } drop",
+			},
+			notWant: []string{"192.168.1.50"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rules := (&AntiSpoofPort{HostVeth: "veth0", MAC: mac, IPs: tt.ips}).portRules()
+			for _, want := range tt.want {
+				if !strings.Contains(rules, "add rule bridge tsunami port_veth0 "+want+"\n") {
+					t.Errorf("rules should contain %q:\n%s", want, rules)
+				}
+			}
+			for _, notWant := range tt.notWant {
+				if strings.Contains(rules, notWant) {
+					t.Errorf("rules should not contain %q:\n%s", notWant, rules)
+				}
+			}
+			// vlan 帧等其他类型的帧不能直接放行
+			tail := "add rule bridge tsunami port_veth0 ether type { ip, arp, ip6 } accept\nadd rule bridge tsunami port_veth0 drop\n"
+			if !strings.HasSuffix(rules, tail) {
+				t.Errorf("rules should end with %q:\n%s", tail, rules)
+			}
+		})
+	}
+}
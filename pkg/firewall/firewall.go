@@ -0,0 +1,42 @@
+package firewall
+
+import (
+	"bytes"
+	"fmt"
+	"os/exec"
+	"strings"
+
+	"k8s.io/klog"
+)
+
+// nftBinPath nft 命令的路径, daemon 镜像中通过 apk 安装
+var nftBinPath = "nft"
+
+// Run 通过 `nft -f -` 原子地执行一段 nftables 脚本, 脚本中的所有命令要么全部生效, 要么全部不生效
+func Run(script string) (err error) {
+	cmd := exec.Command(nftBinPath, "-f", "-")
+	cmd.Stdin = strings.NewReader(script)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+
+	klog.V(5).Infof("nft script:\n%s", script)
+	if err = cmd.Run(); err != nil {
+		return fmt.Errorf("failed to run nft: %v: %s", err, strings.TrimSpace(stderr.String()))
+	}
+
+	return nil
+}
+
+// List 获取 nftables 对象的内容, 如 List("chain", "bridge", "tsunami", "port_veth0")
+func List(args ...string) (out string, err error) {
+	cmd := exec.Command(nftBinPath, append([]string{"list"}, args...)...)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	if err = cmd.Run(); err != nil {
+		return "", fmt.Errorf("failed to run nft: %v: %s", err, strings.TrimSpace(stderr.String()))
+	}
+
+	return stdout.String(), nil
+}
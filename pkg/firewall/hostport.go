@@ -0,0 +1,185 @@
+package firewall
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strings"
+)
+
+// NATTable tsunami 实现 HostPort 使用的 inet 表
+const NATTable = "tsunami_hostport"
+
+// hostPortChain 每个容器对应的 DNAT 链名称
+func hostPortChain(containerID string) string {
+	return "hp_" + containerID
+}
+
+// PortMapping 一条端口映射, 与 cni runtimeConfig 中 portMappings 的含义一致
+type PortMapping struct {
+	HostPort      int
+	ContainerPort int
+	// Protocol tcp, udp 或 sctp
+	Protocol string
+	// HostIP 为空时映射节点上的所有地址
+	HostIP net.IP
+}
+
+// hostPortMasqMark 经过端口映射 DNAT 的报文上设置的标记位, 与 portmap 插件 masqAll 使用的默认标记位相同.
+// kube-proxy 使用 0x4000 与 0x8000, 不会冲突.
+const hostPortMasqMark = 0x2000
+
+// initHostPortsScript 生成 InitHostPorts 执行的 nft 脚本.
+// 目的地址为本机地址的流量, 依次根据 地址 . 协议 . 端口(指定了 HostIP 的映射)与 协议 . 端口 跳转到容器对应的链中做 DNAT.
+// DNAT 后经过网桥发给 Pod 的流量全部做 SNAT, 使回包经过本机完成反向转换,
+// 包括同网段主机直接访问 HostPort, Pod 访问自己的 HostPort(hairpin), 以及从本机 127.0.0.1 访问 HostPort.
+func initHostPortsScript(bridgeName string) string {
+	return fmt.Sprintf(`add table inet %[1]s
+add map inet %[1]s hostports { type inet_proto . inet_service : verdict; }
+add map inet %[1]s hostports4 { type ipv4_addr . inet_proto . inet_service : verdict; }
+add map inet %[1]s hostports6 { type ipv6_addr . inet_proto . inet_service : verdict; }
+add chain inet %[1]s prerouting { type nat hook prerouting priority -100; policy accept; }
+add chain inet %[1]s output { type nat hook output priority -100; policy accept; }
+add chain inet %[1]s postrouting { type nat hook postrouting priority 100; policy accept; }
+flush chain inet %[1]s prerouting
+flush chain inet %[1]s output
+flush chain inet %[1]s postrouting
+add rule inet %[1]s prerouting fib daddr type local ip daddr . meta l4proto . th dport vmap @hostports4
+add rule inet %[1]s prerouting fib daddr type local ip6 daddr . meta l4proto . th dport vmap @hostports6
+add rule inet %[1]s prerouting fib daddr type local meta l4proto . th dport vmap @hostports
+add rule inet %[1]s output fib daddr type local ip daddr . meta l4proto . th dport vmap @hostports4
+add rule inet %[1]s output fib daddr type local ip6 daddr . meta l4proto . th dport vmap @hostports6
+add rule inet %[1]s output fib daddr type local meta l4proto . th dport vmap @hostports
+add rule inet %[1]s postrouting oifname "%[2]s" meta mark and %#[3]x == %#[3]x masquerade
+`, NATTable, bridgeName, hostPortMasqMark)
+}
+
+// InitHostPorts 创建 nat 表, 端口映射与 prerouting / output / postrouting 链, 可以重复调用.
+func InitHostPorts(bridgeName string) (err error) {
+	if err = Run(initHostPortsScript(bridgeName)); err != nil {
+		return err
+	}
+
+	// 从 127.0.0.1 访问 HostPort 时, DNAT 后的报文需要经过网桥发给 Pod
+	path := fmt.Sprintf("/proc/sys/net/ipv4/conf/%s/route_localnet", bridgeName)
+	if err = os.WriteFile(path, []byte("1"), 0644); err != nil {
+		return fmt.Errorf("failed to enable route_localnet on %s: %v", bridgeName, err)
+	}
+
+	return nil
+}
+
+// CleanupHostPorts 删除 nat 表, 在卸载桥接网络时调用
+func CleanupHostPorts() error {
+	return Run(fmt.Sprintf("add table inet %[1]s\ndelete table inet %[1]s\n", NATTable))
+}
+
+// HostPortContainer 一个容器的所有端口映射
+type HostPortContainer struct {
+	ContainerID  string
+	IPs          []net.IP
+	PortMappings []PortMapping
+}
+
+// mapElement 端口映射表中的一个元素
+type mapElement struct {
+	// set 元素所在的映射表, hostports, hostports4 或 hostports6
+	set string
+	key string
+}
+
+// elements 生成端口映射表中的元素, 指定了 HostIP 的映射放在按地址族区分的表中, 以地址作为 key 的一部分.
+// 同一个地址, 协议与端口只能映射到一个容器.
+func (c *HostPortContainer) elements() (elems []mapElement) {
+	seen := map[mapElement]bool{}
+	for _, pm := range c.PortMappings {
+		e := mapElement{set: "hostports", key: fmt.Sprintf("%s . %d", pm.Protocol, pm.HostPort)}
+		if pm.HostIP != nil && !pm.HostIP.IsUnspecified() {
+			e.set = "hostports4"
+			if pm.HostIP.To4() == nil {
+				e.set = "hostports6"
+			}
+			e.key = fmt.Sprintf("%s . %s", pm.HostIP, e.key)
+		}
+		if !seen[e] {
+			seen[e] = true
+			elems = append(elems, e)
+		}
+	}
+	return elems
+}
+
+// chainRules 生成容器链中的 DNAT 规则, 每个端口映射对每个同族的容器 IP 生成一条, 同时标记报文以便在 postrouting 中做 SNAT
+func (c *HostPortContainer) chainRules() string {
+	chain := fmt.Sprintf("inet %s %s", NATTable, hostPortChain(c.ContainerID))
+	var b strings.Builder
+	for _, pm := range c.PortMappings {
+		for _, ip := range c.IPs {
+			family, nfproto, dst := "ip", "ipv4", fmt.Sprintf("%s:%d", ip, pm.ContainerPort)
+			if ip.To4() == nil {
+				family, nfproto, dst = "ip6", "ipv6", fmt.Sprintf("[%s]:%d", ip, pm.ContainerPort)
+			}
+
+			match := fmt.Sprintf("meta nfproto %s", nfproto)
+			if pm.HostIP != nil && !pm.HostIP.IsUnspecified() {
+				if (pm.HostIP.To4() == nil) != (ip.To4() == nil) {
+					continue
+				}
+				match += fmt.Sprintf(" %s daddr %s", family, pm.HostIP)
+			}
+			fmt.Fprintf(&b, "add rule %s %s %s dport %d meta mark set meta mark or %#x dnat %s to %s\n",
+				chain, match, pm.Protocol, pm.HostPort, hostPortMasqMark, family, dst)
+		}
+	}
+	return b.String()
+}
+
+// addHostPortsScript 生成 AddHostPorts 执行的 nft 脚本
+func addHostPortsScript(c *HostPortContainer) string {
+	chain := hostPortChain(c.ContainerID)
+	var b strings.Builder
+	fmt.Fprintf(&b, "add chain inet %[1]s %[2]s\nflush chain inet %[1]s %[2]s\n", NATTable, chain)
+	b.WriteString(c.chainRules())
+	for _, e := range c.elements() {
+		fmt.Fprintf(&b, "add element inet %s %s { %s : jump %s }\n", NATTable, e.set, e.key, chain)
+	}
+	return b.String()
+}
+
+// AddHostPorts 为容器添加端口映射.
+// 同一地址, 协议与端口已经映射到其他容器时, nft 会报错, 整个脚本都不会生效.
+func AddHostPorts(c *HostPortContainer) error {
+	if c.ContainerID == "" || len(c.IPs) == 0 {
+		return fmt.Errorf("container id and ips are required for host ports")
+	}
+	if len(c.PortMappings) == 0 {
+		return nil
+	}
+
+	return Run(addHostPortsScript(c))
+}
+
+// delHostPortsScript 生成 DelHostPorts 执行的 nft 脚本, 链被映射表中的元素引用时不能删除, 需要先删除元素
+func delHostPortsScript(c *HostPortContainer) string {
+	chain := hostPortChain(c.ContainerID)
+	var b strings.Builder
+	for _, e := range c.elements() {
+		fmt.Fprintf(&b, "delete element inet %s %s { %s }\n", NATTable, e.set, e.key)
+	}
+	fmt.Fprintf(&b, "flush chain inet %[1]s %[2]s\ndelete chain inet %[1]s %[2]s\n", NATTable, chain)
+	return b.String()
+}
+
+// DelHostPorts 移除容器的端口映射, 规则不存在时不报错(cmdDel 可能被重复调用)
+func DelHostPorts(c *HostPortContainer) error {
+	chain := hostPortChain(c.ContainerID)
+	out, err := List("chains", "inet")
+	if err != nil {
+		return err
+	}
+	if !strings.Contains(out, "chain "+chain+" {") {
+		return nil
+	}
+
+	return Run(delHostPortsScript(c))
+}
@@ -0,0 +1,97 @@
+package firewall
+
+import (
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestInitHostPortsScript(t *testing.T) {
+	script := initHostPortsScript("br0")
+	for _, want := range []string{
+		"add rule inet tsunami_hostport prerouting fib daddr type local ip daddr . meta l4proto . th dport vmap @hostports4\n" +
+			"add rule inet tsunami_hostport prerouting fib daddr type local ip6 daddr . meta l4proto . th dport vmap @hostports6\n" +
+			"add rule inet tsunami_hostport prerouting fib daddr type local meta l4proto . th dport vmap @hostports\n",
+		`add rule inet tsunami_hostport postrouting oifname "br0" meta mark and 0x2000 == 0x2000 masquerade`,
+	} {
+		if !strings.Contains(script, want) {
+			t.Errorf("script should contain %q:\n%s", want, script)
+		}
+	}
+}
+
+func TestHostPortsScript(t *testing.T) {
+	podIPs := []net.IP{net.ParseIP("192.168.1.50"), net.ParseIP("2001:db8::50")}
+
+	tests := []struct {
+		name     string
+		mappings []PortMapping
+		add      string
+		del      string
+	}{
+		{
+			name:     "all host addresses of both families",
+			mappings: []PortMapping{{HostPort: 8080, ContainerPort: 80, Protocol: "tcp"}},
+			add: `add chain inet tsunami_hostport hp_c1
+flush chain inet tsunami_hostport hp_c1
+add rule inet tsunami_hostport hp_c1 meta nfproto ipv4 tcp dport 8080 meta mark set meta mark or 0x2000 dnat ip to 192.168.1.50:80
+add rule inet tsunami_hostport hp_c1 meta nfproto ipv6 tcp dport 8080 meta mark set meta mark or 0x2000 dnat ip6 to [2001:db8::50]:80
+add element inet tsunami_hostport hostports { tcp . 8080 : jump hp_c1 }
+`,
+			del: `delete element inet tsunami_hostport hostports { tcp . 8080 }
+flush chain inet tsunami_hostport hp_c1
+delete chain inet tsunami_hostport hp_c1
+`,
+		},
+		{
+			name: "host ips are part of the map key",
+			mappings: []PortMapping{
+				{HostPort: 53, ContainerPort: 53, Protocol: "udp", HostIP: net.ParseIP("10.0.0.1")},
+				{HostPort: 53, ContainerPort: 53, Protocol: "udp", HostIP: net.ParseIP("fd00::1")},
+			},
+			add: `add chain inet tsunami_hostport hp_c1
+flush chain inet tsunami_hostport hp_c1
+add rule inet tsunami_hostport hp_c1 meta nfproto ipv4 ip daddr 10.0.0.1 udp dport 53 meta mark set meta mark or 0x2000 dnat ip to 192.168.1.50:53
+add rule inet tsunami_hostport hp_c1 meta nfproto ipv6 ip6 daddr fd00::1 udp dport 53 meta mark set meta mark or 0x2000 dnat ip6 to [2001:db8::50]:53
+add element inet tsunami_hostport hostports4 { 10.0.0.1 . udp . 53 : jump hp_c1 }
+add element inet tsunami_hostport hostports6 { fd00::1 . udp . 53 : jump hp_c1 }
+`,
+			del: `delete element inet tsunami_hostport hostports4 { 10.0.0.1 . udp . 53 }
+delete element inet tsunami_hostport hostports6 { fd00::1 . udp . 53 }
+flush chain inet tsunami_hostport hp_c1
+delete chain inet tsunami_hostport hp_c1
+`,
+		},
+		{
+			name: "unspecified host ip maps all addresses and duplicate keys are merged",
+			mappings: []PortMapping{
+				{HostPort: 443, ContainerPort: 8443, Protocol: "tcp", HostIP: net.IPv4zero},
+				{HostPort: 443, ContainerPort: 8443, Protocol: "tcp"},
+			},
+			add: `add chain inet tsunami_hostport hp_c1
+flush chain inet tsunami_hostport hp_c1
+add rule inet tsunami_hostport hp_c1 meta nfproto ipv4 tcp dport 443 meta mark set meta mark or 0x2000 dnat ip to 192.168.1.50:8443
+add rule inet tsunami_hostport hp_c1 meta nfproto ipv6 tcp dport 443 meta mark set meta mark or 0x2000 dnat ip6 to [2001:db8::50]:8443
+add rule inet tsunami_hostport hp_c1 meta nfproto ipv4 tcp dport 443 meta mark set meta mark or 0x2000 dnat ip to 192.168.1.50:8443
+add rule inet tsunami_hostport hp_c1 meta nfproto ipv6 tcp dport 443 meta mark set meta mark or 0x2000 dnat ip6 to [2001:db8::50]:8443
+add element inet tsunami_hostport hostports { tcp . 443 : jump hp_c1 }
+`,
+			del: `delete element inet tsunami_hostport hostports { tcp . 443 }
+flush chain inet tsunami_hostport hp_c1
+delete chain inet tsunami_hostport hp_c1
+`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &HostPortContainer{ContainerID: "c1", IPs: podIPs, PortMappings: tt.mappings}
+			if got := addHostPortsScript(c); got != tt.add {
+				t.Errorf("add script:\n%s\nwant:\n%s", got, tt.add)
+			}
+			if got := delHostPortsScript(c); got != tt.del {
+				t.Errorf("del script:\n%s\nwant:\n%s", got, tt.del)
+			}
+		})
+	}
+}
@@ -0,0 +1,408 @@
+package netpol
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+// Table NetworkPolicy 使用的 bridge 表, 与防欺骗规则分开, 每次同步时整体替换
+const Table = "tsunami_netpol"
+
+// LocalPod 本节点上由 tsunami 部署网络的 Pod 及其网桥端口
+type LocalPod struct {
+	Pod *corev1.Pod
+	// HostVeth Pod veth 设备在宿主机上的一端, 即网桥上对应的端口
+	HostVeth string
+}
+
+// portMatch 一条端口匹配, port 为 0 表示该协议的所有端口
+type portMatch struct {
+	proto   string
+	port    int32
+	endPort int32
+}
+
+func (p portMatch) String() string {
+	if p.port == 0 {
+		return fmt.Sprintf("meta l4proto %s", p.proto)
+	}
+	if p.endPort > p.port {
+		return fmt.Sprintf("%s dport %d-%d", p.proto, p.port, p.endPort)
+	}
+	return fmt.Sprintf("%s dport %d", p.proto, p.port)
+}
+
+// peerAddr 一个对端地址, 来自 ipBlock 或选中的 Pod
+type peerAddr struct {
+	cidr   *net.IPNet
+	except []*net.IPNet
+	// pod 对端为 Pod 时不为空, egress 中的命名端口需要根据它解析
+	pod *corev1.Pod
+}
+
+// match 生成地址匹配表达式, dir 为 saddr 或 daddr
+func (a peerAddr) match(dir string) string {
+	family := "ip"
+	if a.cidr.IP.To4() == nil {
+		family = "ip6"
+	}
+
+	expr := fmt.Sprintf("%s %s %s", family, dir, a.cidr)
+	for _, except := range a.except {
+		expr += fmt.Sprintf(" %s %s != %s", family, dir, except)
+	}
+	return expr
+}
+
+// compiler 编译时使用的集群状态
+type compiler struct {
+	pods       []*corev1.Pod
+	namespaces map[string]labels.Set
+}
+
+// protocolName 将 Kubernetes 的协议名称转换为 nftables 的协议名称
+func protocolName(proto *corev1.Protocol) string {
+	if proto == nil {
+		return "tcp"
+	}
+	return strings.ToLower(string(*proto))
+}
+
+// podIPs 返回 Pod 的所有 IP, 使用宿主机网络的 Pod 视为节点本身, 不参与匹配
+func podIPs(pod *corev1.Pod) (ips []net.IP) {
+	if pod.Spec.HostNetwork {
+		return nil
+	}
+	for _, podIP := range pod.Status.PodIPs {
+		if ip := net.ParseIP(podIP.IP); ip != nil {
+			ips = append(ips, ip)
+		}
+	}
+	if len(ips) == 0 {
+		if ip := net.ParseIP(pod.Status.PodIP); ip != nil {
+			ips = append(ips, ip)
+		}
+	}
+	return ips
+}
+
+// hostNet 将单个 IP 转换为主机网段
+func hostNet(ip net.IP) *net.IPNet {
+	if ip4 := ip.To4(); ip4 != nil {
+		return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}
+}
+
+// resolvePorts 解析规则中的端口, 命名端口根据 pod 的容器端口解析, pod 为空或解析失败时跳过该端口.
+// 第二个返回值为 false 表示规则指定了端口, 但没有一个能解析成功, 此时规则不匹配任何流量.
+func resolvePorts(ports []networkingv1.NetworkPolicyPort, pod *corev1.Pod) ([]portMatch, bool) {
+	if len(ports) == 0 {
+		return nil, true
+	}
+
+	var matches []portMatch
+	for _, p := range ports {
+		proto := protocolName(p.Protocol)
+		if p.Port == nil {
+			matches = append(matches, portMatch{proto: proto})
+			continue
+		}
+
+		if p.Port.IntVal != 0 || p.Port.StrVal == "" {
+			m := portMatch{proto: proto, port: p.Port.IntVal}
+			if p.EndPort != nil {
+				m.endPort = *p.EndPort
+			}
+			matches = append(matches, m)
+			continue
+		}
+
+		// 命名端口
+		if pod == nil {
+			continue
+		}
+		for _, container := range pod.Spec.Containers {
+			for _, cp := range container.Ports {
+				cpProto := "tcp"
+				if cp.Protocol != "" {
+					cpProto = strings.ToLower(string(cp.Protocol))
+				}
+				if cp.Name == p.Port.StrVal && cpProto == proto {
+					matches = append(matches, portMatch{proto: proto, port: cp.ContainerPort})
+				}
+			}
+		}
+	}
+
+	return matches, len(matches) > 0
+}
+
+// selectorMatches 判断标签选择器是否选中 set, 选择器格式错误时不选中任何对象
+func selectorMatches(selector *metav1.LabelSelector, set labels.Set) bool {
+	s, err := metav1.LabelSelectorAsSelector(selector)
+	if err != nil {
+		return false
+	}
+	return s.Matches(set)
+}
+
+// resolvePeers 解析 from / to 中的对端地址, policyNS 为 NetworkPolicy 所在的命名空间
+func (c *compiler) resolvePeers(peers []networkingv1.NetworkPolicyPeer, policyNS string) (addrs []peerAddr) {
+	for _, peer := range peers {
+		if peer.IPBlock != nil {
+			_, cidr, err := net.ParseCIDR(peer.IPBlock.CIDR)
+			if err != nil {
+				continue
+			}
+			addr := peerAddr{cidr: cidr}
+			for _, e := range peer.IPBlock.Except {
+				if _, except, err := net.ParseCIDR(e); err == nil {
+					addr.except = append(addr.except, except)
+				}
+			}
+			addrs = append(addrs, addr)
+			continue
+		}
+
+		if peer.PodSelector == nil && peer.NamespaceSelector == nil {
+			continue
+		}
+
+		for _, pod := range c.pods {
+			// 未指定 namespaceSelector 时只选择 NetworkPolicy 所在命名空间中的 Pod
+			if peer.NamespaceSelector == nil {
+				if pod.Namespace != policyNS {
+					continue
+				}
+			} else if !selectorMatches(peer.NamespaceSelector, c.namespaces[pod.Namespace]) {
+				continue
+			}
+			if peer.PodSelector != nil && !selectorMatches(peer.PodSelector, labels.Set(pod.Labels)) {
+				continue
+			}
+
+			for _, ip := range podIPs(pod) {
+				addrs = append(addrs, peerAddr{cidr: hostNet(ip), pod: pod})
+			}
+		}
+	}
+
+	return addrs
+}
+
+// policyTypes 返回 NetworkPolicy 生效的方向, 未指定时总是包含 Ingress, 有 egress 规则时包含 Egress
+func policyTypes(policy *networkingv1.NetworkPolicy) (ingress, egress bool) {
+	if len(policy.Spec.PolicyTypes) == 0 {
+		return true, len(policy.Spec.Egress) > 0
+	}
+	for _, t := range policy.Spec.PolicyTypes {
+		switch t {
+		case networkingv1.PolicyTypeIngress:
+			ingress = true
+		case networkingv1.PolicyTypeEgress:
+			egress = true
+		}
+	}
+	return
+}
+
+// ingressRules 生成本地 Pod 入方向的放行规则, 每条为不含动作的匹配表达式, 空字符串表示放行全部
+func (c *compiler) ingressRules(policy *networkingv1.NetworkPolicy, local *corev1.Pod) (rules []string) {
+	for _, rule := range policy.Spec.Ingress {
+		ports, ok := resolvePorts(rule.Ports, local)
+		if !ok {
+			continue
+		}
+
+		var addrs []string
+		if len(rule.From) == 0 {
+			addrs = []string{""}
+		}
+		for _, addr := range c.resolvePeers(rule.From, policy.Namespace) {
+			addrs = append(addrs, addr.match("saddr"))
+		}
+
+		rules = append(rules, combine(addrs, ports)...)
+	}
+	return rules
+}
+
+// egressRules 生成本地 Pod 出方向的放行规则, 命名端口根据目标 Pod 解析
+func (c *compiler) egressRules(policy *networkingv1.NetworkPolicy) (rules []string) {
+	for _, rule := range policy.Spec.Egress {
+		if len(rule.To) == 0 {
+			rules = append(rules, c.egressToAll(rule.Ports)...)
+			continue
+		}
+
+		for _, addr := range c.resolvePeers(rule.To, policy.Namespace) {
+			ports, ok := resolvePorts(rule.Ports, addr.pod)
+			if !ok {
+				continue
+			}
+			rules = append(rules, combine([]string{addr.match("daddr")}, ports)...)
+		}
+	}
+	return rules
+}
+
+// egressToAll 生成目标为任意地址的出方向规则, 数字端口对所有地址生效,
+// 命名端口根据集群中所有 Pod 的容器端口解析为到该 Pod 的规则, 没有 Pod 定义该名称时跳过
+func (c *compiler) egressToAll(ports []networkingv1.NetworkPolicyPort) (rules []string) {
+	if len(ports) == 0 {
+		return []string{""}
+	}
+
+	var numeric, named []networkingv1.NetworkPolicyPort
+	for _, p := range ports {
+		if p.Port != nil && p.Port.IntVal == 0 && p.Port.StrVal != "" {
+			named = append(named, p)
+		} else {
+			numeric = append(numeric, p)
+		}
+	}
+
+	if len(numeric) > 0 {
+		matches, _ := resolvePorts(numeric, nil)
+		rules = append(rules, combine([]string{""}, matches)...)
+	}
+	if len(named) == 0 {
+		return rules
+	}
+	for _, pod := range c.pods {
+		matches, ok := resolvePorts(named, pod)
+		if !ok {
+			continue
+		}
+		for _, ip := range podIPs(pod) {
+			rules = append(rules, combine([]string{peerAddr{cidr: hostNet(ip)}.match("daddr")}, matches)...)
+		}
+	}
+	return rules
+}
+
+// combine 将地址与端口两两组合成匹配表达式
+// 不使用匿名集合, 因为集合中重叠的网段或端口范围会导致 nft 报错
+func combine(addrs []string, ports []portMatch) (rules []string) {
+	for _, addr := range addrs {
+		if len(ports) == 0 {
+			rules = append(rules, addr)
+			continue
+		}
+		for _, port := range ports {
+			rules = append(rules, strings.TrimSpace(addr+" "+port.String()))
+		}
+	}
+	return rules
+}
+
+// Compile 根据集群中的 NetworkPolicy, Pod 与 Namespace, 为本节点上的 Pod 生成完整的 nftables 脚本.
+//
+// 入方向匹配发往 Pod 端口的帧, 出方向匹配从 Pod 端口进入的帧, 已建立连接的回包总是放行:
+//   - bridge 族的 forward 钩子处理经过网桥转发的流量(Pod 之间, Pod 与物理网络之间).
+//   - bridge 族的 output 钩子处理本机经过网桥发给 Pod 的流量, 只检查 DNAT 之后的, 即 kube-proxy 转发的 service 流量,
+//     此时源地址仍然是客户端 Pod 的地址. kubelet 探针等节点直接访问 Pod 的流量不受限制.
+//   - inet 族的 forward 钩子处理 Pod 发往网桥地址后由本机路由的流量, 如 DNAT 之后的 service 流量,
+//     按 Pod 的源地址匹配出方向的规则, 目的地址已经是后端 Pod 的地址.
+func Compile(policies []*networkingv1.NetworkPolicy, pods []*corev1.Pod, namespaces []*corev1.Namespace, locals []*LocalPod) string {
+	c := &compiler{pods: pods, namespaces: map[string]labels.Set{}}
+	for _, ns := range namespaces {
+		c.namespaces[ns.Name] = labels.Set(ns.Labels)
+	}
+
+	sort.Slice(policies, func(i, j int) bool {
+		if policies[i].Namespace != policies[j].Namespace {
+			return policies[i].Namespace < policies[j].Namespace
+		}
+		return policies[i].Name < policies[j].Name
+	})
+	sort.Slice(locals, func(i, j int) bool {
+		return locals[i].HostVeth < locals[j].HostVeth
+	})
+
+	// 链需要在被 jump 引用之前创建, 因此 Pod 端口的链与 forward / output 链中的规则分开生成
+	var chains, jumps, outJumps, inetChains, inetJumps strings.Builder
+	for _, local := range locals {
+		var ingress, egress []string
+		var isolatedIngress, isolatedEgress bool
+		for _, policy := range policies {
+			if policy.Namespace != local.Pod.Namespace ||
+				!selectorMatches(&policy.Spec.PodSelector, labels.Set(local.Pod.Labels)) {
+				continue
+			}
+
+			hasIngress, hasEgress := policyTypes(policy)
+			if hasIngress {
+				isolatedIngress = true
+				ingress = append(ingress, c.ingressRules(policy, local.Pod)...)
+			}
+			if hasEgress {
+				isolatedEgress = true
+				egress = append(egress, c.egressRules(policy)...)
+			}
+		}
+
+		// 没有被任何 NetworkPolicy 选中的方向不做限制
+		if isolatedIngress {
+			chain := "ing_" + local.HostVeth
+			writeChain(&chains, "bridge", chain, ingress, "udp sport 67 udp dport 68")
+			fmt.Fprintf(&jumps, "add rule bridge %s forward oifname \"%s\" jump %s\n", Table, local.HostVeth, chain)
+			fmt.Fprintf(&outJumps, "add rule bridge %s output oifname \"%s\" ct status dnat jump %s\n", Table, local.HostVeth, chain)
+		}
+		if isolatedEgress {
+			chain := "eg_" + local.HostVeth
+			writeChain(&chains, "bridge", chain, egress, "udp sport 68 udp dport 67")
+			fmt.Fprintf(&jumps, "add rule bridge %s forward iifname \"%s\" jump %s\n", Table, local.HostVeth, chain)
+
+			// 经过本机路由的流量在 inet 族中的入口网卡是网桥, 因此按 Pod 的地址区分
+			if ips := podIPs(local.Pod); len(ips) > 0 {
+				writeChain(&inetChains, "inet", chain, egress, "udp sport 68 udp dport 67")
+				for _, ip := range ips {
+					fmt.Fprintf(&inetJumps, "add rule inet %s forward %s jump %s\n", Table, peerAddr{cidr: hostNet(ip)}.match("saddr"), chain)
+				}
+			}
+		}
+	}
+
+	var b strings.Builder
+	// 先创建再删除, 保证表不存在时脚本也能执行成功
+	for _, family := range []string{"bridge", "inet"} {
+		fmt.Fprintf(&b, "add table %[1]s %[2]s\ndelete table %[1]s %[2]s\nadd table %[1]s %[2]s\n", family, Table)
+	}
+	fmt.Fprintf(&b, "add chain bridge %s forward { type filter hook forward priority 0; policy accept; }\n", Table)
+	fmt.Fprintf(&b, "add chain bridge %s output { type filter hook output priority 0; policy accept; }\n", Table)
+	fmt.Fprintf(&b, "add chain inet %s forward { type filter hook forward priority 0; policy accept; }\n", Table)
+	b.WriteString(chains.String())
+	b.WriteString(inetChains.String())
+	fmt.Fprintf(&b, "add rule bridge %s forward ct state established,related accept\n", Table)
+	b.WriteString(jumps.String())
+	fmt.Fprintf(&b, "add rule bridge %s output ct state established,related accept\n", Table)
+	b.WriteString(outJumps.String())
+	fmt.Fprintf(&b, "add rule inet %s forward ct state established,related accept\n", Table)
+	b.WriteString(inetJumps.String())
+
+	return b.String()
+}
+
+// writeChain 生成一个 Pod 端口的链: 非 IP 流量, 邻居发现与 dhcp 总是放行, 匹配任一规则时返回调用的链继续检查, 否则丢弃.
+// family 为 bridge 或 inet, inet 族中没有链路层头部, 只会看到 IP 流量.
+func writeChain(b *strings.Builder, family, chain string, rules []string, dhcp string) {
+	fmt.Fprintf(b, "add chain %s %s %s\n", family, Table, chain)
+	if family == "bridge" {
+		fmt.Fprintf(b, "add rule bridge %s %s ether type != { ip, ip6 } return\n", Table, chain)
+	}
+	fmt.Fprintf(b, "add rule %s %s %s icmpv6 type { nd-router-solicit, nd-router-advert, nd-neighbor-solicit, nd-neighbor-advert } return\n", family, Table, chain)
+	fmt.Fprintf(b, "add rule %s %s %s %s return\n", family, Table, chain, dhcp)
+	for _, rule := range rules {
+		fmt.Fprintf(b, "add rule %s %s %s %s\n", family, Table, chain, strings.TrimSpace(rule+" return"))
+	}
+	fmt.Fprintf(b, "add rule %s %s %s drop\n", family, Table, chain)
+}
@@ -0,0 +1,226 @@
+package netpol
+
+import (
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+)
+
+// testPod 构造带有 IP 与容器端口的 Pod
+func testPod(ns, name, ip string, labels map[string]string, ports ...corev1.ContainerPort) *corev1.Pod {
+	return &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Namespace: ns, Name: name, Labels: labels},
+		Spec:       corev1.PodSpec{Containers: []corev1.Container{{Name: "app", Ports: ports}}},
+		Status:     corev1.PodStatus{PodIP: ip},
+	}
+}
+
+func testPolicy(ns, name string, spec networkingv1.NetworkPolicySpec) *networkingv1.NetworkPolicy {
+	return &networkingv1.NetworkPolicy{ObjectMeta: metav1.ObjectMeta{Namespace: ns, Name: name}, Spec: spec}
+}
+
+func namedPort(name string) networkingv1.NetworkPolicyPort {
+	port := intstr.FromString(name)
+	return networkingv1.NetworkPolicyPort{Port: &port}
+}
+
+func numericPort(port int) networkingv1.NetworkPolicyPort {
+	p := intstr.FromInt(port)
+	return networkingv1.NetworkPolicyPort{Port: &p}
+}
+
+func TestCompile(t *testing.T) {
+	web := testPod("default", "web", "192.168.1.10", map[string]string{"app": "web"},
+		corev1.ContainerPort{Name: "http", ContainerPort: 8080})
+	client := testPod("default", "client", "192.168.1.11", map[string]string{"app": "client"})
+	db := testPod("db", "mysql", "192.168.1.20", map[string]string{"app": "mysql"},
+		corev1.ContainerPort{Name: "mysql", ContainerPort: 3306})
+	pods := []*corev1.Pod{web, client, db}
+	namespaces := []*corev1.Namespace{
+		{ObjectMeta: metav1.ObjectMeta{Name: "default"}},
+		{ObjectMeta: metav1.ObjectMeta{Name: "db", Labels: map[string]string{"team": "db"}}},
+	}
+	selectWeb := metav1.LabelSelector{MatchLabels: map[string]string{"app": "web"}}
+
+	tests := []struct {
+		name     string
+		policies []*networkingv1.NetworkPolicy
+		local    *corev1.Pod
+		want     []string
+		notWant  []string
+	}{
+		{
+			name:     "pods not selected by any policy are not isolated",
+			policies: []*networkingv1.NetworkPolicy{testPolicy("default", "deny", networkingv1.NetworkPolicySpec{PodSelector: selectWeb})},
+			local:    client,
+			notWant:  []string{"jump"},
+		},
+		{
+			name:     "ingress without rules denies all",
+			policies: []*networkingv1.NetworkPolicy{testPolicy("default", "deny", networkingv1.NetworkPolicySpec{PodSelector: selectWeb})},
+			local:    web,
+			want: []string{
+				`add rule bridge tsunami_netpol forward oifname "veth0" jump ing_veth0`,
+				"add rule bridge tsunami_netpol ing_veth0 udp sport 67 udp dport 68 return\nadd rule bridge tsunami_netpol ing_veth0 drop",
+			},
+			notWant: []string{"eg_veth0"},
+		},
+		{
+			name: "ingress is also checked for service traffic sent by the node through the bridge",
+			policies: []*networkingv1.NetworkPolicy{testPolicy("default", "from-client", networkingv1.NetworkPolicySpec{
+				PodSelector: selectWeb,
+				Ingress: []networkingv1.NetworkPolicyIngressRule{{From: []networkingv1.NetworkPolicyPeer{
+					{PodSelector: &metav1.LabelSelector{MatchLabels: map[string]string{"app": "client"}}},
+				}}},
+			})},
+			local: web,
+			want: []string{
+				"add chain bridge tsunami_netpol output { type filter hook output priority 0; policy accept; }",
+				"add rule bridge tsunami_netpol output ct state established,related accept\n" +
+					`add rule bridge tsunami_netpol output oifname "veth0" ct status dnat jump ing_veth0`,
+				"ing_veth0 ip saddr 192.168.1.11/32 return",
+			},
+			notWant: []string{"eg_veth0"},
+		},
+		{
+			name: "empty from allows all sources on the named port",
+			policies: []*networkingv1.NetworkPolicy{testPolicy("default", "http", networkingv1.NetworkPolicySpec{
+				PodSelector: selectWeb,
+				Ingress:     []networkingv1.NetworkPolicyIngressRule{{Ports: []networkingv1.NetworkPolicyPort{namedPort("http")}}},
+			})},
+			local: web,
+			want:  []string{"add rule bridge tsunami_netpol ing_veth0 tcp dport 8080 return"},
+		},
+		{
+			name: "pod selector only selects pods in the policy namespace",
+			policies: []*networkingv1.NetworkPolicy{testPolicy("default", "from-pods", networkingv1.NetworkPolicySpec{
+				PodSelector: selectWeb,
+				Ingress: []networkingv1.NetworkPolicyIngressRule{{From: []networkingv1.NetworkPolicyPeer{
+					{PodSelector: &metav1.LabelSelector{}},
+				}}},
+			})},
+			local: web,
+			want: []string{
+				"ing_veth0 ip saddr 192.168.1.10/32 return",
+				"ing_veth0 ip saddr 192.168.1.11/32 return",
+			},
+			notWant: []string{"192.168.1.20"},
+		},
+		{
+			name: "namespace selector selects pods in other namespaces",
+			policies: []*networkingv1.NetworkPolicy{testPolicy("default", "from-db", networkingv1.NetworkPolicySpec{
+				PodSelector: selectWeb,
+				Ingress: []networkingv1.NetworkPolicyIngressRule{{From: []networkingv1.NetworkPolicyPeer{
+					{NamespaceSelector: &metav1.LabelSelector{MatchLabels: map[string]string{"team": "db"}}},
+				}}},
+			})},
+			local:   web,
+			want:    []string{"ing_veth0 ip saddr 192.168.1.20/32 return"},
+			notWant: []string{"192.168.1.11"},
+		},
+		{
+			name: "ip block with except",
+			policies: []*networkingv1.NetworkPolicy{testPolicy("default", "from-cidr", networkingv1.NetworkPolicySpec{
+				PodSelector: selectWeb,
+				Ingress: []networkingv1.NetworkPolicyIngressRule{{
+					From:  []networkingv1.NetworkPolicyPeer{{IPBlock: &networkingv1.IPBlock{CIDR: "10.0.0.0/8", Except: []string{"10.1.0.0/16"}}}},
+					Ports: []networkingv1.NetworkPolicyPort{numericPort(80)},
+				}},
+			})},
+			local: web,
+			want:  []string{"ing_veth0 ip saddr 10.0.0.0/8 ip saddr != 10.1.0.0/16 tcp dport 80 return"},
+		},
+		{
+			name: "peer without selectors or ip block matches nothing",
+			policies: []*networkingv1.NetworkPolicy{testPolicy("default", "empty-peer", networkingv1.NetworkPolicySpec{
+				PodSelector: selectWeb,
+				Ingress:     []networkingv1.NetworkPolicyIngressRule{{From: []networkingv1.NetworkPolicyPeer{{}}}},
+			})},
+			local:   web,
+			want:    []string{"ing_veth0 udp sport 67 udp dport 68 return\nadd rule bridge tsunami_netpol ing_veth0 drop"},
+			notWant: []string{"saddr"},
+		},
+		{
+			name: "egress to selected pods resolves named ports per pod",
+			policies: []*networkingv1.NetworkPolicy{testPolicy("default", "to-db", networkingv1.NetworkPolicySpec{
+				PodSelector: selectWeb,
+				PolicyTypes: []networkingv1.PolicyType{networkingv1.PolicyTypeEgress},
+				Egress: []networkingv1.NetworkPolicyEgressRule{{
+					To:    []networkingv1.NetworkPolicyPeer{{NamespaceSelector: &metav1.LabelSelector{}}},
+					Ports: []networkingv1.NetworkPolicyPort{namedPort("mysql")},
+				}},
+			})},
+			local:   web,
+			want:    []string{"eg_veth0 ip daddr 192.168.1.20/32 tcp dport 3306 return"},
+			notWant: []string{"ing_veth0", "daddr 192.168.1.11"},
+		},
+		{
+			name: "egress with empty to keeps numeric ports and resolves named ports against all pods",
+			policies: []*networkingv1.NetworkPolicy{testPolicy("default", "to-any", networkingv1.NetworkPolicySpec{
+				PodSelector: selectWeb,
+				PolicyTypes: []networkingv1.PolicyType{networkingv1.PolicyTypeEgress},
+				Egress: []networkingv1.NetworkPolicyEgressRule{{
+					Ports: []networkingv1.NetworkPolicyPort{numericPort(53), namedPort("mysql"), namedPort("unknown")},
+				}},
+			})},
+			local: web,
+			want: []string{
+				"add rule bridge tsunami_netpol eg_veth0 tcp dport 53 return",
+				"eg_veth0 ip daddr 192.168.1.20/32 tcp dport 3306 return",
+			},
+			notWant: []string{"daddr 192.168.1.11"},
+		},
+		{
+			name: "egress is also checked after dnat for traffic routed by the node",
+			policies: []*networkingv1.NetworkPolicy{testPolicy("default", "to-db", networkingv1.NetworkPolicySpec{
+				PodSelector: selectWeb,
+				PolicyTypes: []networkingv1.PolicyType{networkingv1.PolicyTypeEgress},
+				Egress: []networkingv1.NetworkPolicyEgressRule{{
+					To:    []networkingv1.NetworkPolicyPeer{{NamespaceSelector: &metav1.LabelSelector{MatchLabels: map[string]string{"team": "db"}}}},
+					Ports: []networkingv1.NetworkPolicyPort{numericPort(3306)},
+				}},
+			})},
+			local: web,
+			want: []string{
+				"add chain inet tsunami_netpol forward { type filter hook forward priority 0; policy accept; }",
+				"add chain inet tsunami_netpol eg_veth0\n",
+				"add rule inet tsunami_netpol eg_veth0 ip daddr 192.168.1.20/32 tcp dport 3306 return\nadd rule inet tsunami_netpol eg_veth0 drop",
+				"add rule inet tsunami_netpol forward ct state established,related accept\n" +
+					"add rule inet tsunami_netpol forward ip saddr 192.168.1.10/32 jump eg_veth0",
+			},
+			notWant: []string{"add rule inet tsunami_netpol eg_veth0 ether", "output oifname"},
+		},
+		{
+			name: "egress with empty to and only named ports",
+			policies: []*networkingv1.NetworkPolicy{testPolicy("default", "to-mysql", networkingv1.NetworkPolicySpec{
+				PodSelector: selectWeb,
+				PolicyTypes: []networkingv1.PolicyType{networkingv1.PolicyTypeEgress},
+				Egress: []networkingv1.NetworkPolicyEgressRule{{
+					Ports: []networkingv1.NetworkPolicyPort{namedPort("mysql")},
+				}},
+			})},
+			local: web,
+			want:  []string{"eg_veth0 ip daddr 192.168.1.20/32 tcp dport 3306 return"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			script := Compile(tt.policies, pods, namespaces, []*LocalPod{{Pod: tt.local, HostVeth: "veth0"}})
+			for _, want := range tt.want {
+				if !strings.Contains(script, want) {
+					t.Errorf("script should contain %q:\n%s", want, script)
+				}
+			}
+			for _, notWant := range tt.notWant {
+				if strings.Contains(script, notWant) {
+					t.Errorf("script should not contain %q:\n%s", notWant, script)
+				}
+			}
+		})
+	}
+}
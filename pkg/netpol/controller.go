@@ -0,0 +1,166 @@
+package netpol
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/gitlayzer/tsunami/pkg/firewall"
+	"github.com/gitlayzer/tsunami/pkg/store"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/informers"
+	clientset "k8s.io/client-go/kubernetes"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	networkinglisters "k8s.io/client-go/listers/networking/v1"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/klog"
+)
+
+// resyncPeriod 定期全量同步的间隔, 本地 Pod 来自磁盘上的记录, 没有事件通知, 需要依靠定期同步发现
+const resyncPeriod = 30 * time.Second
+
+// Controller 监听 NetworkPolicy, Pod 与 Namespace, 将其编译为本节点 Pod 网桥端口上的 nftables 规则
+type Controller struct {
+	factory   informers.SharedInformerFactory
+	podLister corelisters.PodLister
+	nsLister  corelisters.NamespaceLister
+	npLister  networkinglisters.NetworkPolicyLister
+	store     *store.Store
+	// syncCh 有变化时通知同步, 容量为 1, 多次变化合并为一次同步
+	syncCh chan struct{}
+	// lastScript 上一次成功下发的规则, 没有变化时不重复下发
+	lastScript string
+}
+
+// NewController 创建 Controller 对象
+func NewController(client clientset.Interface, podStore *store.Store) *Controller {
+	factory := informers.NewSharedInformerFactory(client, 0)
+	c := &Controller{
+		factory:   factory,
+		podLister: factory.Core().V1().Pods().Lister(),
+		nsLister:  factory.Core().V1().Namespaces().Lister(),
+		npLister:  factory.Networking().V1().NetworkPolicies().Lister(),
+		store:     podStore,
+		syncCh:    make(chan struct{}, 1),
+	}
+
+	handler := cache.ResourceEventHandlerFuncs{
+		AddFunc:    func(interface{}) { c.enqueue() },
+		UpdateFunc: func(interface{}, interface{}) { c.enqueue() },
+		DeleteFunc: func(interface{}) { c.enqueue() },
+	}
+	factory.Core().V1().Pods().Informer().AddEventHandler(handler)
+	factory.Core().V1().Namespaces().Informer().AddEventHandler(handler)
+	factory.Networking().V1().NetworkPolicies().Informer().AddEventHandler(handler)
+
+	return c
+}
+
+// NewInClusterController 使用 in cluster 配置创建 Controller 对象
+func NewInClusterController(podStore *store.Store) (*Controller, error) {
+	cfg, err := rest.InClusterConfig()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get in cluster config: %v", err)
+	}
+
+	client, err := clientset.NewForConfig(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create clientset: %v", err)
+	}
+
+	return NewController(client, podStore), nil
+}
+
+// enqueue 通知同步, 已有待处理的通知时直接返回
+func (c *Controller) enqueue() {
+	select {
+	case c.syncCh <- struct{}{}:
+	default:
+	}
+}
+
+// Run 启动 informer 并持续同步规则, 直到 stopCh 关闭
+func (c *Controller) Run(stopCh <-chan struct{}) {
+	c.factory.Start(stopCh)
+	for typ, ok := range c.factory.WaitForCacheSync(stopCh) {
+		if !ok {
+			klog.Errorf("failed to wait for %v cache sync", typ)
+			return
+		}
+	}
+	klog.Info("network policy controller started")
+
+	ticker := time.NewTicker(resyncPeriod)
+	defer ticker.Stop()
+	c.enqueue()
+	for {
+		select {
+		case <-stopCh:
+			return
+		case <-ticker.C:
+		case <-c.syncCh:
+		}
+		if err := c.sync(); err != nil {
+			klog.Errorf("failed to sync network policy: %s", err)
+		}
+	}
+}
+
+// localPods 根据磁盘上的记录获取本节点上的 Pod, 一个 Pod 有多个网卡时每个网卡都会返回
+func (c *Controller) localPods() (locals []*LocalPod, err error) {
+	attachments, err := c.store.List()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, a := range attachments {
+		if a.HostVeth == "" || a.PodName == "" {
+			continue
+		}
+		pod, err := c.podLister.Pods(a.PodNamespace).Get(a.PodName)
+		if err != nil {
+			// Pod 已经删除, 等待 cni DEL 清理记录
+			continue
+		}
+		locals = append(locals, &LocalPod{Pod: pod, HostVeth: a.HostVeth})
+	}
+
+	return locals, nil
+}
+
+// sync 全量生成并下发规则
+func (c *Controller) sync() (err error) {
+	locals, err := c.localPods()
+	if err != nil {
+		return err
+	}
+	pods, err := c.podLister.List(labels.Everything())
+	if err != nil {
+		return err
+	}
+	namespaces, err := c.nsLister.List(labels.Everything())
+	if err != nil {
+		return err
+	}
+	policies, err := c.npLister.List(labels.Everything())
+	if err != nil {
+		return err
+	}
+
+	script := Compile(policies, pods, namespaces, locals)
+	if script == c.lastScript {
+		return nil
+	}
+	if err = firewall.Run(script); err != nil {
+		return err
+	}
+	c.lastScript = script
+	klog.V(3).Infof("sync network policy: %d policies, %d local pod ports", len(policies), len(locals))
+
+	return nil
+}
+
+// Cleanup 删除 NetworkPolicy 使用的 bridge 与 inet 表
+func Cleanup() (err error) {
+	return firewall.Run(fmt.Sprintf("add table bridge %[1]s\ndelete table bridge %[1]s\nadd table inet %[1]s\ndelete table inet %[1]s\n", Table))
+}
@@ -0,0 +1,839 @@
+// Package nlfake 提供 nlwrap.Handle 的内存实现, 用于在没有 root 权限与网络命名空间的环境中测试网络配置逻辑.
+// 只模拟 tsunami 用到的行为: 网卡与 master, IPv4/IPv6 地址, 路由表, 策略路由规则与 qdisc,
+// 以及内核在地址变化时自动增删路由的行为, 错误与内核一样通过 errno 表示.
+package nlfake
+
+import (
+	"bytes"
+	"net"
+	"sort"
+	"sync"
+
+	"github.com/gitlayzer/tsunami/pkg/nlwrap"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// Handle 内存中的网络命名空间, 零值不可用, 需要通过 New 创建
+type Handle struct {
+	mu sync.Mutex
+
+	nextIndex int
+	links     map[int]netlink.Link
+	hairpin   map[int]bool
+	addrs     map[int][]netlink.Addr
+	routes    []netlink.Route
+	rules     []netlink.Rule
+	qdiscs    map[int][]netlink.Qdisc
+}
+
+var _ nlwrap.Handle = &Handle{}
+
+// New 创建一个只有 lo 网卡的网络命名空间
+func New() *Handle {
+	h := &Handle{
+		nextIndex: 1,
+		links:     map[int]netlink.Link{},
+		hairpin:   map[int]bool{},
+		addrs:     map[int][]netlink.Addr{},
+		qdiscs:    map[int][]netlink.Qdisc{},
+	}
+	lo := &netlink.Device{LinkAttrs: netlink.LinkAttrs{Name: "lo", MTU: 65536}}
+	_ = h.LinkAdd(lo)
+	_ = h.LinkSetUp(lo)
+	return h
+}
+
+// fail 构造与 nlwrap 中真实实现一致的错误
+func fail(op, obj string, errno unix.Errno) error {
+	return &nlwrap.Error{Op: op, Obj: obj, Err: errno}
+}
+
+// copyLink 返回网卡的副本, 调用方修改返回值不会影响命名空间中的状态
+func copyLink(link netlink.Link) netlink.Link {
+	switch l := link.(type) {
+	case *netlink.Bridge:
+		c := *l
+		return &c
+	case *netlink.Veth:
+		c := *l
+		return &c
+	case *netlink.Dummy:
+		c := *l
+		return &c
+	case *netlink.Device:
+		c := *l
+		return &c
+	}
+	return &netlink.GenericLink{LinkAttrs: *link.Attrs(), LinkType: link.Type()}
+}
+
+// lookup 查找调用方传入的网卡, 优先使用索引, 其次使用名称
+func (h *Handle) lookup(link netlink.Link) (netlink.Link, bool) {
+	if link == nil {
+		return nil, false
+	}
+	if index := link.Attrs().Index; index != 0 {
+		l, ok := h.links[index]
+		return l, ok
+	}
+	return h.byName(link.Attrs().Name)
+}
+
+func (h *Handle) byName(name string) (netlink.Link, bool) {
+	for _, l := range h.links {
+		if l.Attrs().Name == name {
+			return l, true
+		}
+	}
+	return nil, false
+}
+
+// LinkByName 根据名称获取网卡
+func (h *Handle) LinkByName(name string) (netlink.Link, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	l, ok := h.byName(name)
+	if !ok {
+		return nil, fail("link get", name, unix.ENODEV)
+	}
+	return copyLink(l), nil
+}
+
+// LinkByIndex 根据索引获取网卡
+func (h *Handle) LinkByIndex(index int) (netlink.Link, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	l, ok := h.links[index]
+	if !ok {
+		return nil, fail("link get", "", unix.ENODEV)
+	}
+	return copyLink(l), nil
+}
+
+// LinkList 按索引顺序获取所有网卡
+func (h *Handle) LinkList() ([]netlink.Link, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	indexes := make([]int, 0, len(h.links))
+	for index := range h.links {
+		indexes = append(indexes, index)
+	}
+	sort.Ints(indexes)
+
+	links := make([]netlink.Link, 0, len(indexes))
+	for _, index := range indexes {
+		links = append(links, copyLink(h.links[index]))
+	}
+	return links, nil
+}
+
+// LinkAdd 创建网卡并为其分配索引, 与 netlink 库一样会回写 link 的 Index
+func (h *Handle) LinkAdd(link netlink.Link) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	attrs := link.Attrs()
+	if _, ok := h.byName(attrs.Name); ok {
+		return fail("link add", attrs.Name, unix.EEXIST)
+	}
+
+	attrs.Index = h.nextIndex
+	h.nextIndex++
+	stored := copyLink(link)
+	if stored.Attrs().MTU == 0 {
+		stored.Attrs().MTU = 1500
+	}
+	stored.Attrs().Flags &^= net.FlagUp
+	h.links[attrs.Index] = stored
+	return nil
+}
+
+// LinkDel 删除网卡, 网卡上的地址, 路由与 qdisc 一并删除, 从属于该网卡的设备脱离 master
+func (h *Handle) LinkDel(link netlink.Link) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	l, ok := h.lookup(link)
+	if !ok {
+		return fail("link del", link.Attrs().Name, unix.ENODEV)
+	}
+	index := l.Attrs().Index
+
+	delete(h.links, index)
+	delete(h.addrs, index)
+	delete(h.qdiscs, index)
+	delete(h.hairpin, index)
+	h.removeRoutes(func(r netlink.Route) bool { return r.LinkIndex == index })
+	for _, slave := range h.links {
+		if slave.Attrs().MasterIndex == index {
+			slave.Attrs().MasterIndex = 0
+		}
+	}
+	return nil
+}
+
+// LinkModify 修改网桥的组播侦听与老化时间, 其他类型的网卡不支持
+func (h *Handle) LinkModify(link netlink.Link) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	l, ok := h.lookup(link)
+	if !ok {
+		return fail("link modify", link.Attrs().Name, unix.ENODEV)
+	}
+	br, ok := l.(*netlink.Bridge)
+	mod, isBridge := link.(*netlink.Bridge)
+	if !ok || !isBridge {
+		return fail("link modify", link.Attrs().Name, unix.EOPNOTSUPP)
+	}
+	if mod.MulticastSnooping != nil {
+		v := *mod.MulticastSnooping
+		br.MulticastSnooping = &v
+	}
+	if mod.AgeingTime != nil {
+		v := *mod.AgeingTime
+		br.AgeingTime = &v
+	}
+	return nil
+}
+
+// setAttrs 找到网卡后修改其属性
+func (h *Handle) setAttrs(op string, link netlink.Link, fn func(attrs *netlink.LinkAttrs) unix.Errno) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	l, ok := h.lookup(link)
+	if !ok {
+		return fail(op, link.Attrs().Name, unix.ENODEV)
+	}
+	if errno := fn(l.Attrs()); errno != 0 {
+		return fail(op, link.Attrs().Name, errno)
+	}
+	return nil
+}
+
+// LinkSetUp 启动网卡
+func (h *Handle) LinkSetUp(link netlink.Link) error {
+	return h.setAttrs("link set up", link, func(attrs *netlink.LinkAttrs) unix.Errno {
+		attrs.Flags |= net.FlagUp
+		attrs.OperState = netlink.OperUp
+		return 0
+	})
+}
+
+// LinkSetMTU 设置网卡的 MTU
+func (h *Handle) LinkSetMTU(link netlink.Link, mtu int) error {
+	return h.setAttrs("link set mtu", link, func(attrs *netlink.LinkAttrs) unix.Errno {
+		if mtu < 68 {
+			return unix.EINVAL
+		}
+		attrs.MTU = mtu
+		return 0
+	})
+}
+
+// LinkSetHardwareAddr 设置网卡的 MAC 地址
+func (h *Handle) LinkSetHardwareAddr(link netlink.Link, hwaddr net.HardwareAddr) error {
+	return h.setAttrs("link set address", link, func(attrs *netlink.LinkAttrs) unix.Errno {
+		attrs.HardwareAddr = append(net.HardwareAddr(nil), hwaddr...)
+		return 0
+	})
+}
+
+// LinkSetMaster 将网卡接入 master, master 必须是网桥
+func (h *Handle) LinkSetMaster(link, master netlink.Link) error {
+	if master == nil {
+		return h.LinkSetNoMaster(link)
+	}
+
+	h.mu.Lock()
+	m, ok := h.lookup(master)
+	h.mu.Unlock()
+	if !ok {
+		return fail("link set master", link.Attrs().Name, unix.ENODEV)
+	}
+	if _, ok = m.(*netlink.Bridge); !ok {
+		return fail("link set master", link.Attrs().Name, unix.EOPNOTSUPP)
+	}
+
+	return h.setAttrs("link set master", link, func(attrs *netlink.LinkAttrs) unix.Errno {
+		if attrs.Index == m.Attrs().Index {
+			return unix.ELOOP
+		}
+		attrs.MasterIndex = m.Attrs().Index
+		return 0
+	})
+}
+
+// LinkSetNoMaster 将网卡从 master 中拔出
+func (h *Handle) LinkSetNoMaster(link netlink.Link) error {
+	return h.setAttrs("link set nomaster", link, func(attrs *netlink.LinkAttrs) unix.Errno {
+		attrs.MasterIndex = 0
+		return 0
+	})
+}
+
+// LinkSetHairpin 设置网桥端口的 hairpin 模式, 网卡没有接入网桥时返回 EOPNOTSUPP
+func (h *Handle) LinkSetHairpin(link netlink.Link, mode bool) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	l, ok := h.lookup(link)
+	if !ok {
+		return fail("link set hairpin", link.Attrs().Name, unix.ENODEV)
+	}
+	if l.Attrs().MasterIndex == 0 {
+		return fail("link set hairpin", link.Attrs().Name, unix.EOPNOTSUPP)
+	}
+	h.hairpin[l.Attrs().Index] = mode
+	return nil
+}
+
+// Hairpin 返回网桥端口的 hairpin 模式
+func (h *Handle) Hairpin(name string) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	l, ok := h.byName(name)
+	return ok && h.hairpin[l.Attrs().Index]
+}
+
+// SetPromiscOn 开启混杂模式
+func (h *Handle) SetPromiscOn(link netlink.Link) error {
+	return h.setAttrs("link set promisc on", link, func(attrs *netlink.LinkAttrs) unix.Errno {
+		attrs.Promisc = 1
+		return 0
+	})
+}
+
+// SetPromiscOff 关闭混杂模式
+func (h *Handle) SetPromiscOff(link netlink.Link) error {
+	return h.setAttrs("link set promisc off", link, func(attrs *netlink.LinkAttrs) unix.Errno {
+		attrs.Promisc = 0
+		return 0
+	})
+}
+
+// family 返回 IP 地址所属的地址族
+func family(ip net.IP) int {
+	if ip.To4() != nil {
+		return netlink.FAMILY_V4
+	}
+	return netlink.FAMILY_V6
+}
+
+// zeroNet 返回地址族对应的默认网段, netlink 库返回的默认路由 Dst 不为 nil
+func zeroNet(fam int) *net.IPNet {
+	if fam == netlink.FAMILY_V6 {
+		return &net.IPNet{IP: net.IPv6zero, Mask: net.CIDRMask(0, 128)}
+	}
+	return &net.IPNet{IP: net.IPv4zero.To4(), Mask: net.CIDRMask(0, 32)}
+}
+
+// hostNet 返回单个地址对应的 /32 或 /128 网段
+func hostNet(ip net.IP) *net.IPNet {
+	if v4 := ip.To4(); v4 != nil {
+		return &net.IPNet{IP: v4, Mask: net.CIDRMask(32, 32)}
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}
+}
+
+// prefixNet 返回地址所在的网段
+func prefixNet(ipnet *net.IPNet) *net.IPNet {
+	ip := ipnet.IP
+	if v4 := ip.To4(); v4 != nil {
+		ip = v4
+	}
+	return &net.IPNet{IP: ip.Mask(ipnet.Mask), Mask: ipnet.Mask}
+}
+
+// AddrList 获取网卡上的地址, link 为 nil 时获取所有网卡的地址
+func (h *Handle) AddrList(link netlink.Link, fam int) ([]netlink.Addr, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	var indexes []int
+	if link != nil {
+		l, ok := h.lookup(link)
+		if !ok {
+			return nil, fail("addr list", link.Attrs().Name, unix.ENODEV)
+		}
+		indexes = []int{l.Attrs().Index}
+	} else {
+		for index := range h.addrs {
+			indexes = append(indexes, index)
+		}
+		sort.Ints(indexes)
+	}
+
+	var addrs []netlink.Addr
+	for _, index := range indexes {
+		for _, addr := range h.addrs[index] {
+			if fam == netlink.FAMILY_ALL || family(addr.IP) == fam {
+				addrs = append(addrs, addr)
+			}
+		}
+	}
+	return addrs, nil
+}
+
+// AddrAdd 为网卡添加地址.
+// 与内核一致, 同一网段中的第一个地址为主地址, 会生成 proto kernel scope link 的直连路由, 后续地址标记为 secondary;
+// local 表中同时生成到该地址的 local 路由.
+func (h *Handle) AddrAdd(link netlink.Link, addr *netlink.Addr) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	obj := addr.IPNet.String()
+	l, ok := h.lookup(link)
+	if !ok {
+		return fail("addr add", obj, unix.ENODEV)
+	}
+	index := l.Attrs().Index
+
+	prefix := prefixNet(addr.IPNet)
+	secondary := false
+	for _, a := range h.addrs[index] {
+		if a.IP.Equal(addr.IP) {
+			return fail("addr add", obj, unix.EEXIST)
+		}
+		if prefixNet(a.IPNet).String() == prefix.String() {
+			secondary = true
+		}
+	}
+
+	stored := *addr
+	stored.IPNet = &net.IPNet{IP: addr.IP, Mask: addr.Mask}
+	stored.LinkIndex = index
+	if stored.Label == "" && family(addr.IP) == netlink.FAMILY_V4 {
+		stored.Label = l.Attrs().Name
+	}
+	if secondary {
+		stored.Flags |= unix.IFA_F_SECONDARY
+	}
+	h.addrs[index] = append(h.addrs[index], stored)
+
+	fam := family(addr.IP)
+	h.routes = append(h.routes, netlink.Route{
+		LinkIndex: index,
+		Dst:       hostNet(addr.IP),
+		Src:       addr.IP,
+		Scope:     netlink.SCOPE_HOST,
+		Protocol:  unix.RTPROT_KERNEL,
+		Table:     unix.RT_TABLE_LOCAL,
+		Type:      unix.RTN_LOCAL,
+		Family:    fam,
+	})
+	if !secondary {
+		route := netlink.Route{
+			LinkIndex: index,
+			Dst:       prefix,
+			Scope:     netlink.SCOPE_LINK,
+			Protocol:  unix.RTPROT_KERNEL,
+			Table:     unix.RT_TABLE_MAIN,
+			Type:      unix.RTN_UNICAST,
+			Family:    fam,
+		}
+		if fam == netlink.FAMILY_V4 {
+			route.Src = addr.IP
+		} else {
+			route.Scope = netlink.SCOPE_UNIVERSE
+			route.Priority = 256
+		}
+		h.routes = append(h.routes, route)
+	}
+	return nil
+}
+
+// AddrDel 删除网卡上的地址.
+// 与内核(promote_secondaries 关闭时)一致: 删除主地址时同网段的 secondary 地址一并删除;
+// 源地址为被删除地址的路由(包括直连路由)被删除; 网卡上不再有该地址族的地址时, 经过该网卡的所有路由都被删除.
+func (h *Handle) AddrDel(link netlink.Link, addr *netlink.Addr) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	obj := addr.IPNet.String()
+	l, ok := h.lookup(link)
+	if !ok {
+		return fail("addr del", obj, unix.ENODEV)
+	}
+	index := l.Attrs().Index
+
+	var target *netlink.Addr
+	for i := range h.addrs[index] {
+		if h.addrs[index][i].IP.Equal(addr.IP) {
+			target = &h.addrs[index][i]
+			break
+		}
+	}
+	if target == nil {
+		return fail("addr del", obj, unix.EADDRNOTAVAIL)
+	}
+
+	removed := []net.IP{target.IP}
+	primary := target.Flags&unix.IFA_F_SECONDARY == 0
+	prefix := prefixNet(target.IPNet).String()
+	var kept []netlink.Addr
+	for _, a := range h.addrs[index] {
+		switch {
+		case a.IP.Equal(target.IP):
+		case primary && prefixNet(a.IPNet).String() == prefix:
+			removed = append(removed, a.IP)
+		default:
+			kept = append(kept, a)
+		}
+	}
+	h.addrs[index] = kept
+
+	fam := family(addr.IP)
+	h.removeRoutes(func(r netlink.Route) bool {
+		for _, ip := range removed {
+			if r.Src.Equal(ip) {
+				return true
+			}
+		}
+		return false
+	})
+	if primary && fam == netlink.FAMILY_V6 {
+		h.removeRoutes(func(r netlink.Route) bool {
+			return r.LinkIndex == index && r.Protocol == unix.RTPROT_KERNEL && r.Dst.String() == prefix
+		})
+	}
+
+	for _, a := range kept {
+		if family(a.IP) == fam {
+			return nil
+		}
+	}
+	h.removeRoutes(func(r netlink.Route) bool {
+		return r.LinkIndex == index && r.Family == fam
+	})
+	return nil
+}
+
+// removeRoutes 删除满足条件的路由
+func (h *Handle) removeRoutes(match func(r netlink.Route) bool) {
+	kept := h.routes[:0]
+	for _, r := range h.routes {
+		if !match(r) {
+			kept = append(kept, r)
+		}
+	}
+	h.routes = kept
+}
+
+// normalize 按照内核的方式补全路由的默认字段
+// ip6DefaultPriority 内核中 IPv6 路由的默认优先级, 即 IP6_RT_PRIO_USER
+const ip6DefaultPriority = 1024
+
+func normalize(route *netlink.Route) netlink.Route {
+	r := *route
+	fam := netlink.FAMILY_V4
+	switch {
+	case r.Dst != nil && r.Dst.IP != nil:
+		fam = family(r.Dst.IP)
+	case r.Gw != nil:
+		fam = family(r.Gw)
+	case r.Src != nil:
+		fam = family(r.Src)
+	}
+	r.Family = fam
+	if r.Dst == nil || r.Dst.IP == nil {
+		r.Dst = zeroNet(fam)
+	} else {
+		r.Dst = prefixNet(r.Dst)
+	}
+	if r.Table == 0 {
+		r.Table = unix.RT_TABLE_MAIN
+	}
+	// 与内核一致, 没有指定 metric 的 IPv6 路由优先级为 1024
+	if r.Priority == 0 && fam == netlink.FAMILY_V6 {
+		r.Priority = ip6DefaultPriority
+	}
+	if r.Protocol == 0 {
+		r.Protocol = unix.RTPROT_BOOT
+	}
+	if r.Type == 0 {
+		r.Type = unix.RTN_UNICAST
+	}
+	if fam == netlink.FAMILY_V6 && r.Priority == 0 {
+		r.Priority = 1024
+	}
+	return r
+}
+
+// sameKey 判断两条路由是否为内核中的同一条: 路由表, 目的网段与优先级都相同
+func sameKey(a, b netlink.Route) bool {
+	return a.Table == b.Table && a.Dst.String() == b.Dst.String() && a.Priority == b.Priority && a.Tos == b.Tos
+}
+
+// resolve 检查路由的网卡与网关是否可达, 没有指定网卡时根据网关选择网卡
+func (h *Handle) resolve(r *netlink.Route) unix.Errno {
+	if r.LinkIndex != 0 {
+		if _, ok := h.links[r.LinkIndex]; !ok {
+			return unix.ENODEV
+		}
+	}
+	if r.Gw == nil {
+		if r.LinkIndex == 0 {
+			return unix.ENODEV
+		}
+		return 0
+	}
+	if r.Flags&int(netlink.FLAG_ONLINK) != 0 {
+		if r.LinkIndex == 0 {
+			return unix.EINVAL
+		}
+		return 0
+	}
+	for _, nh := range h.routes {
+		if nh.Gw != nil || (nh.Table != r.Table && nh.Table != unix.RT_TABLE_MAIN) || nh.Type != unix.RTN_UNICAST {
+			continue
+		}
+		if r.LinkIndex != 0 && nh.LinkIndex != r.LinkIndex {
+			continue
+		}
+		if nh.Dst.Contains(r.Gw) && nh.Dst.String() != zeroNet(r.Family).String() {
+			r.LinkIndex = nh.LinkIndex
+			return 0
+		}
+	}
+	return unix.ENETUNREACH
+}
+
+// RouteList 获取 main 表中的路由, link 为 nil 时获取所有网卡的路由
+func (h *Handle) RouteList(link netlink.Link, fam int) ([]netlink.Route, error) {
+	if link == nil {
+		return h.RouteListFiltered(fam, nil, 0)
+	}
+	return h.RouteListFiltered(fam, &netlink.Route{LinkIndex: link.Attrs().Index}, netlink.RT_FILTER_OIF)
+}
+
+// RouteListFiltered 按照过滤条件获取路由, 与 netlink 库一样, 只有指定 RT_FILTER_TABLE 时才会返回 main 表以外的路由
+func (h *Handle) RouteListFiltered(fam int, filter *netlink.Route, filterMask uint64) ([]netlink.Route, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	var routes []netlink.Route
+	for _, r := range h.routes {
+		if fam != netlink.FAMILY_ALL && r.Family != fam {
+			continue
+		}
+		if r.Table != unix.RT_TABLE_MAIN && (filter == nil || filterMask&netlink.RT_FILTER_TABLE == 0) {
+			continue
+		}
+		if filter != nil {
+			switch {
+			case filterMask&netlink.RT_FILTER_TABLE != 0 && filter.Table != unix.RT_TABLE_UNSPEC && r.Table != filter.Table:
+				continue
+			case filterMask&netlink.RT_FILTER_PROTOCOL != 0 && r.Protocol != filter.Protocol:
+				continue
+			case filterMask&netlink.RT_FILTER_SCOPE != 0 && r.Scope != filter.Scope:
+				continue
+			case filterMask&netlink.RT_FILTER_TYPE != 0 && r.Type != filter.Type:
+				continue
+			case filterMask&netlink.RT_FILTER_OIF != 0 && r.LinkIndex != filter.LinkIndex:
+				continue
+			case filterMask&netlink.RT_FILTER_GW != 0 && !r.Gw.Equal(filter.Gw):
+				continue
+			case filterMask&netlink.RT_FILTER_SRC != 0 && !r.Src.Equal(filter.Src):
+				continue
+			case filterMask&netlink.RT_FILTER_DST != 0:
+				dst := filter.Dst
+				if dst == nil {
+					dst = zeroNet(r.Family)
+				}
+				if r.Dst.String() != dst.String() {
+					continue
+				}
+			}
+		}
+		c := r
+		c.Dst = &net.IPNet{IP: r.Dst.IP, Mask: r.Dst.Mask}
+		routes = append(routes, c)
+	}
+	sortRoutes(routes)
+	return routes, nil
+}
+
+// sortRoutes 按照内核导出路由的顺序排序: 路由表, 目的地址, 前缀长度由长到短, 优先级
+// 默认路由因此排在最前面, 与真实环境中 RouteList 的返回顺序一致
+func sortRoutes(routes []netlink.Route) {
+	sort.SliceStable(routes, func(i, j int) bool {
+		a, b := routes[i], routes[j]
+		if a.Table != b.Table {
+			return a.Table < b.Table
+		}
+		if c := bytes.Compare(a.Dst.IP.To16(), b.Dst.IP.To16()); c != 0 {
+			return c < 0
+		}
+		ai, _ := a.Dst.Mask.Size()
+		bi, _ := b.Dst.Mask.Size()
+		if ai != bi {
+			return ai > bi
+		}
+		return a.Priority < b.Priority
+	})
+}
+
+// RouteAdd 添加路由, 同一路由表中目的网段与优先级相同的路由已存在时返回 EEXIST, 网关不可达时返回 ENETUNREACH
+func (h *Handle) RouteAdd(route *netlink.Route) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	r := normalize(route)
+	for _, existing := range h.routes {
+		if sameKey(existing, r) {
+			return fail("route add", r.Dst.String(), unix.EEXIST)
+		}
+	}
+	if errno := h.resolve(&r); errno != 0 {
+		return fail("route add", r.Dst.String(), errno)
+	}
+	h.routes = append(h.routes, r)
+	return nil
+}
+
+// RouteReplace 添加或替换路由
+func (h *Handle) RouteReplace(route *netlink.Route) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	r := normalize(route)
+	if errno := h.resolve(&r); errno != 0 {
+		return fail("route replace", r.Dst.String(), errno)
+	}
+	for i, existing := range h.routes {
+		if sameKey(existing, r) {
+			h.routes[i] = r
+			return nil
+		}
+	}
+	h.routes = append(h.routes, r)
+	return nil
+}
+
+// RouteDel 删除路由, 与内核一样只比较调用方指定了的字段, 没有匹配的路由时返回 ESRCH
+func (h *Handle) RouteDel(route *netlink.Route) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	want := normalize(route)
+	for i, r := range h.routes {
+		switch {
+		case r.Table != want.Table || r.Dst.String() != want.Dst.String():
+		case route.Priority != 0 && r.Priority != route.Priority:
+		case route.LinkIndex != 0 && r.LinkIndex != route.LinkIndex:
+		case route.Gw != nil && !r.Gw.Equal(route.Gw):
+		case route.Src != nil && !r.Src.Equal(route.Src):
+		case route.Protocol != 0 && r.Protocol != route.Protocol:
+		case route.Scope != netlink.SCOPE_UNIVERSE && r.Scope != route.Scope:
+		default:
+			h.routes = append(h.routes[:i], h.routes[i+1:]...)
+			return nil
+		}
+	}
+	return fail("route del", want.Dst.String(), unix.ESRCH)
+}
+
+// ipNetEqual 比较两个可能为 nil 的网段
+func ipNetEqual(a, b *net.IPNet) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return a.String() == b.String()
+}
+
+// sameRule 判断两条策略路由规则是否相同
+func sameRule(a, b *netlink.Rule) bool {
+	return a.Priority == b.Priority && a.Table == b.Table && a.Mark == b.Mark &&
+		ipNetEqual(a.Src, b.Src) && ipNetEqual(a.Dst, b.Dst) && a.IifName == b.IifName && a.OifName == b.OifName
+}
+
+// RuleAdd 添加策略路由规则, 相同的规则已存在时返回 EEXIST
+func (h *Handle) RuleAdd(rule *netlink.Rule) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for i := range h.rules {
+		if sameRule(&h.rules[i], rule) {
+			return fail("rule add", "", unix.EEXIST)
+		}
+	}
+	h.rules = append(h.rules, *rule)
+	return nil
+}
+
+// RuleDel 删除策略路由规则, 规则不存在时返回 ENOENT
+func (h *Handle) RuleDel(rule *netlink.Rule) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for i := range h.rules {
+		if sameRule(&h.rules[i], rule) {
+			h.rules = append(h.rules[:i], h.rules[i+1:]...)
+			return nil
+		}
+	}
+	return fail("rule del", "", unix.ENOENT)
+}
+
+// Rules 返回当前所有的策略路由规则
+func (h *Handle) Rules() []netlink.Rule {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	return append([]netlink.Rule(nil), h.rules...)
+}
+
+// QdiscList 获取网卡上的 qdisc
+func (h *Handle) QdiscList(link netlink.Link) ([]netlink.Qdisc, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	l, ok := h.lookup(link)
+	if !ok {
+		return nil, fail("qdisc list", link.Attrs().Name, unix.ENODEV)
+	}
+	return append([]netlink.Qdisc(nil), h.qdiscs[l.Attrs().Index]...), nil
+}
+
+// QdiscReplace 添加或替换网卡上同一 parent 下的 qdisc
+func (h *Handle) QdiscReplace(qdisc netlink.Qdisc) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	attrs := qdisc.Attrs()
+	if _, ok := h.links[attrs.LinkIndex]; !ok {
+		return fail("qdisc replace", qdisc.Type(), unix.ENODEV)
+	}
+	qdiscs := h.qdiscs[attrs.LinkIndex]
+	for i, q := range qdiscs {
+		if q.Attrs().Parent == attrs.Parent {
+			qdiscs[i] = qdisc
+			return nil
+		}
+	}
+	h.qdiscs[attrs.LinkIndex] = append(qdiscs, qdisc)
+	return nil
+}
+
+// QdiscDel 删除网卡上同一 parent 下的 qdisc, 不存在时返回 ENOENT
+func (h *Handle) QdiscDel(qdisc netlink.Qdisc) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	attrs := qdisc.Attrs()
+	qdiscs := h.qdiscs[attrs.LinkIndex]
+	for i, q := range qdiscs {
+		if q.Attrs().Parent == attrs.Parent {
+			h.qdiscs[attrs.LinkIndex] = append(qdiscs[:i], qdiscs[i+1:]...)
+			return nil
+		}
+	}
+	return fail("qdisc del", qdisc.Type(), unix.ENOENT)
+}
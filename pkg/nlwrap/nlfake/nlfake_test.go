@@ -0,0 +1,240 @@
+package nlfake
+
+import (
+	"net"
+	"testing"
+
+	"github.com/gitlayzer/tsunami/pkg/nlwrap"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+func mustAddr(t *testing.T, s string) *netlink.Addr {
+	t.Helper()
+	addr, err := netlink.ParseAddr(s)
+	if err != nil {
+		t.Fatalf("parse addr %s: %v", s, err)
+	}
+	return addr
+}
+
+func mustCIDR(t *testing.T, s string) *net.IPNet {
+	t.Helper()
+	_, ipnet, err := net.ParseCIDR(s)
+	if err != nil {
+		t.Fatalf("parse cidr %s: %v", s, err)
+	}
+	return ipnet
+}
+
+func addDevice(t *testing.T, h *Handle, name string) netlink.Link {
+	t.Helper()
+	link := &netlink.Device{LinkAttrs: netlink.LinkAttrs{Name: name}}
+	if err := h.LinkAdd(link); err != nil {
+		t.Fatalf("link add %s: %v", name, err)
+	}
+	if err := h.LinkSetUp(link); err != nil {
+		t.Fatalf("link set up %s: %v", name, err)
+	}
+	return link
+}
+
+func TestLinkErrors(t *testing.T) {
+	h := New()
+	addDevice(t, h, "eth0")
+
+	if err := h.LinkAdd(&netlink.Device{LinkAttrs: netlink.LinkAttrs{Name: "eth0"}}); !nlwrap.IsExist(err) {
+		t.Errorf("duplicate link add: got %v, want EEXIST", err)
+	}
+	if _, err := h.LinkByName("eth1"); !nlwrap.IsLinkNotFound(err) {
+		t.Errorf("missing link get: got %v, want ENODEV", err)
+	}
+	if err := h.LinkDel(&netlink.Device{LinkAttrs: netlink.LinkAttrs{Name: "eth1"}}); !nlwrap.IsNotExist(err) {
+		t.Errorf("missing link del: got %v, want not exist", err)
+	}
+}
+
+func TestLinkDelDetachesSlaves(t *testing.T) {
+	h := New()
+	eth0 := addDevice(t, h, "eth0")
+	br := &netlink.Bridge{LinkAttrs: netlink.LinkAttrs{Name: "br0"}}
+	if err := h.LinkAdd(br); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.LinkSetMaster(eth0, br); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.LinkSetHairpin(eth0, true); err != nil {
+		t.Fatal(err)
+	}
+
+	link, _ := h.LinkByName("eth0")
+	if link.Attrs().MasterIndex != br.Index {
+		t.Fatalf("master index: got %d, want %d", link.Attrs().MasterIndex, br.Index)
+	}
+	if !h.Hairpin("eth0") {
+		t.Errorf("hairpin should be on")
+	}
+
+	if err := h.LinkDel(br); err != nil {
+		t.Fatal(err)
+	}
+	link, _ = h.LinkByName("eth0")
+	if link.Attrs().MasterIndex != 0 {
+		t.Errorf("eth0 should be detached after bridge is deleted")
+	}
+	if err := h.LinkSetHairpin(eth0, true); err == nil {
+		t.Errorf("hairpin on a link without master should fail")
+	}
+}
+
+func TestAddrAddCreatesRoutes(t *testing.T) {
+	h := New()
+	eth0 := addDevice(t, h, "eth0")
+
+	if err := h.AddrAdd(eth0, mustAddr(t, "192.168.1.10/24")); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.AddrAdd(eth0, mustAddr(t, "192.168.1.11/24")); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.AddrAdd(eth0, mustAddr(t, "192.168.1.10/24")); !nlwrap.IsExist(err) {
+		t.Errorf("duplicate addr add: got %v, want EEXIST", err)
+	}
+
+	addrs, _ := h.AddrList(eth0, netlink.FAMILY_V4)
+	if len(addrs) != 2 {
+		t.Fatalf("got %d addrs, want 2", len(addrs))
+	}
+	if addrs[0].Flags&unix.IFA_F_SECONDARY != 0 || addrs[1].Flags&unix.IFA_F_SECONDARY == 0 {
+		t.Errorf("second address in the same subnet should be secondary: %+v", addrs)
+	}
+
+	routes, _ := h.RouteList(eth0, netlink.FAMILY_V4)
+	if len(routes) != 1 {
+		t.Fatalf("got %d main routes, want only the prefix route: %+v", len(routes), routes)
+	}
+	r := routes[0]
+	if r.Dst.String() != "192.168.1.0/24" || r.Scope != netlink.SCOPE_LINK || r.Protocol != unix.RTPROT_KERNEL || !r.Src.Equal(net.ParseIP("192.168.1.10")) {
+		t.Errorf("unexpected prefix route: %+v", r)
+	}
+
+	local, _ := h.RouteListFiltered(netlink.FAMILY_V4, &netlink.Route{Table: unix.RT_TABLE_LOCAL}, netlink.RT_FILTER_TABLE)
+	if len(local) != 2 {
+		t.Errorf("got %d local routes, want 2", len(local))
+	}
+}
+
+func TestRouteAdd(t *testing.T) {
+	h := New()
+	eth0 := addDevice(t, h, "eth0")
+	if err := h.AddrAdd(eth0, mustAddr(t, "192.168.1.10/24")); err != nil {
+		t.Fatal(err)
+	}
+
+	unreachable := &netlink.Route{Dst: mustCIDR(t, "10.0.0.0/8"), Gw: net.ParseIP("172.16.0.1")}
+	if err := h.RouteAdd(unreachable); err == nil {
+		t.Errorf("route via unreachable gateway should fail")
+	}
+
+	def := &netlink.Route{LinkIndex: eth0.Attrs().Index, Gw: net.ParseIP("192.168.1.1")}
+	if err := h.RouteAdd(def); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.RouteAdd(def); !nlwrap.IsExist(err) {
+		t.Errorf("duplicate route add: got %v, want EEXIST", err)
+	}
+	metric := *def
+	metric.Priority = 200
+	if err := h.RouteAdd(&metric); err != nil {
+		t.Errorf("same dst with different metric should be allowed: %v", err)
+	}
+
+	// 没有指定网卡时根据网关选择
+	svc := &netlink.Route{Dst: mustCIDR(t, "10.96.0.0/12"), Gw: net.ParseIP("192.168.1.1")}
+	if err := h.RouteAdd(svc); err != nil {
+		t.Fatal(err)
+	}
+
+	routes, _ := h.RouteList(eth0, netlink.FAMILY_V4)
+	if len(routes) != 4 {
+		t.Fatalf("got %d routes, want 4: %+v", len(routes), routes)
+	}
+	if routes[0].Dst.String() != "0.0.0.0/0" || routes[0].Priority != 0 {
+		t.Errorf("default route should be listed first with dst 0.0.0.0/0: %+v", routes[0])
+	}
+	for _, r := range routes {
+		if r.LinkIndex != eth0.Attrs().Index {
+			t.Errorf("route %+v should be bound to eth0", r)
+		}
+	}
+
+	if err := h.RouteDel(&netlink.Route{Dst: mustCIDR(t, "10.96.0.0/12")}); err != nil {
+		t.Errorf("route del by dst: %v", err)
+	}
+	if err := h.RouteDel(&netlink.Route{Dst: mustCIDR(t, "10.96.0.0/12")}); !nlwrap.IsNotExist(err) {
+		t.Errorf("missing route del: got %v, want ESRCH", err)
+	}
+}
+
+func TestAddrDelRemovesRoutes(t *testing.T) {
+	h := New()
+	eth0 := addDevice(t, h, "eth0")
+	for _, a := range []string{"192.168.1.10/24", "192.168.2.10/24"} {
+		if err := h.AddrAdd(eth0, mustAddr(t, a)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	routes := []*netlink.Route{
+		{LinkIndex: eth0.Attrs().Index, Gw: net.ParseIP("192.168.1.1")},
+		{LinkIndex: eth0.Attrs().Index, Dst: mustCIDR(t, "10.0.0.0/8"), Gw: net.ParseIP("192.168.2.1"), Src: net.ParseIP("192.168.2.10")},
+	}
+	for _, r := range routes {
+		if err := h.RouteAdd(r); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// 删除一个地址时, 以它为源地址的路由被删除, 其他路由保留
+	if err := h.AddrDel(eth0, mustAddr(t, "192.168.2.10/24")); err != nil {
+		t.Fatal(err)
+	}
+	list, _ := h.RouteList(eth0, netlink.FAMILY_V4)
+	if len(list) != 2 {
+		t.Fatalf("got %d routes, want default and 192.168.1.0/24: %+v", len(list), list)
+	}
+
+	// 删除最后一个地址时, 经过该网卡的路由全部被删除
+	if err := h.AddrDel(eth0, mustAddr(t, "192.168.1.10/24")); err != nil {
+		t.Fatal(err)
+	}
+	list, _ = h.RouteList(eth0, netlink.FAMILY_V4)
+	if len(list) != 0 {
+		t.Errorf("all routes should be removed with the last address: %+v", list)
+	}
+
+	if err := h.AddrDel(eth0, mustAddr(t, "192.168.1.10/24")); !nlwrap.IsNotExist(err) {
+		t.Errorf("missing addr del: got %v, want EADDRNOTAVAIL", err)
+	}
+}
+
+func TestRules(t *testing.T) {
+	h := New()
+	rule := netlink.NewRule()
+	rule.Table = 100
+	rule.Priority = 1000
+	rule.Src = mustCIDR(t, "192.168.1.20/32")
+
+	if err := h.RuleAdd(rule); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.RuleAdd(rule); !nlwrap.IsExist(err) {
+		t.Errorf("duplicate rule add: got %v, want EEXIST", err)
+	}
+	if err := h.RuleDel(rule); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.RuleDel(rule); !nlwrap.IsNotExist(err) {
+		t.Errorf("missing rule del: got %v, want ENOENT", err)
+	}
+}
@@ -0,0 +1,247 @@
+// Package nlwrap 对 netlink 的常用操作做一层封装, 返回带有操作信息的错误,
+// 调用方通过 errors.Is(err, unix.EEXIST) 等判断 errno, 而不是比较错误字符串.
+// 所有操作都通过 Handle 接口完成, 单元测试中可以替换为 nlfake 中的内存实现.
+package nlwrap
+
+import (
+	"errors"
+	"fmt"
+	"net"
+
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// Error netlink 操作失败时返回的错误, Err 为内核返回的 errno
+type Error struct {
+	// Op 操作名称, 如 route add
+	Op string
+	// Obj 操作的对象, 如网卡名称或路由
+	Obj string
+	Err error
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s %s: %v", e.Op, e.Obj, e.Err)
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// wrap 将 netlink 返回的错误包装为 *Error.
+// netlink 库在网卡不存在时返回 LinkNotFoundError 而不是 errno, 这里统一转换为 ENODEV.
+func wrap(op, obj string, err error) error {
+	if err == nil {
+		return nil
+	}
+
+	var notFound netlink.LinkNotFoundError
+	if errors.As(err, &notFound) {
+		err = unix.ENODEV
+	}
+	return &Error{Op: op, Obj: obj, Err: err}
+}
+
+// IsLinkNotFound 判断错误是否为网卡不存在
+func IsLinkNotFound(err error) bool {
+	return errors.Is(err, unix.ENODEV)
+}
+
+// IsExist 判断错误是否为对象已存在, 如重复添加地址, 路由或策略路由规则
+func IsExist(err error) bool {
+	return errors.Is(err, unix.EEXIST)
+}
+
+// IsNotExist 判断错误是否为对象不存在.
+// 删除不存在的路由时内核返回 ESRCH, 删除不存在的地址或策略路由规则时返回 EADDRNOTAVAIL 或 ENOENT.
+func IsNotExist(err error) bool {
+	return errors.Is(err, unix.ESRCH) || errors.Is(err, unix.ENOENT) ||
+		errors.Is(err, unix.EADDRNOTAVAIL) || IsLinkNotFound(err)
+}
+
+// routeObj 路由在错误信息中的表示
+func routeObj(route *netlink.Route) string {
+	dst := "default"
+	if route.Dst != nil {
+		dst = route.Dst.String()
+	}
+	if route.Gw != nil {
+		return fmt.Sprintf("%s via %s", dst, route.Gw)
+	}
+	return dst
+}
+
+// Handle pkg/bridge, pkg/podroute 与 pkg/cninet 使用的 netlink 操作.
+// 实现需要与内核保持一致的错误语义: 网卡不存在时返回 ENODEV, 对象已存在时返回 EEXIST,
+// 删除不存在的路由时返回 ESRCH, 删除不存在的地址与策略路由规则时返回 EADDRNOTAVAIL 与 ENOENT.
+type Handle interface {
+	LinkByName(name string) (netlink.Link, error)
+	LinkByIndex(index int) (netlink.Link, error)
+	LinkList() ([]netlink.Link, error)
+	LinkAdd(link netlink.Link) error
+	LinkDel(link netlink.Link) error
+	// LinkModify 修改网卡的类型相关属性, 如网桥的老化时间
+	LinkModify(link netlink.Link) error
+	LinkSetUp(link netlink.Link) error
+	LinkSetMTU(link netlink.Link, mtu int) error
+	LinkSetHardwareAddr(link netlink.Link, hwaddr net.HardwareAddr) error
+	LinkSetMaster(link, master netlink.Link) error
+	LinkSetNoMaster(link netlink.Link) error
+	LinkSetHairpin(link netlink.Link, mode bool) error
+	SetPromiscOn(link netlink.Link) error
+	SetPromiscOff(link netlink.Link) error
+
+	AddrList(link netlink.Link, family int) ([]netlink.Addr, error)
+	AddrAdd(link netlink.Link, addr *netlink.Addr) error
+	AddrDel(link netlink.Link, addr *netlink.Addr) error
+
+	// RouteList 获取 main 表中的路由, link 为 nil 时获取所有网卡的路由
+	RouteList(link netlink.Link, family int) ([]netlink.Route, error)
+	RouteListFiltered(family int, filter *netlink.Route, filterMask uint64) ([]netlink.Route, error)
+	RouteAdd(route *netlink.Route) error
+	RouteReplace(route *netlink.Route) error
+	RouteDel(route *netlink.Route) error
+
+	RuleAdd(rule *netlink.Rule) error
+	RuleDel(rule *netlink.Rule) error
+
+	QdiscList(link netlink.Link) ([]netlink.Qdisc, error)
+	QdiscReplace(qdisc netlink.Qdisc) error
+	QdiscDel(qdisc netlink.Qdisc) error
+}
+
+// kernel 直接调用 netlink 库的 Handle 实现, 操作当前线程所在的网络命名空间
+type kernel struct{}
+
+// NewHandle 返回操作内核的 Handle
+func NewHandle() Handle {
+	return kernel{}
+}
+
+func (kernel) LinkByName(name string) (netlink.Link, error) {
+	link, err := netlink.LinkByName(name)
+	return link, wrap("link get", name, err)
+}
+
+func (kernel) LinkByIndex(index int) (netlink.Link, error) {
+	link, err := netlink.LinkByIndex(index)
+	return link, wrap("link get", fmt.Sprintf("index %d", index), err)
+}
+
+func (kernel) LinkList() ([]netlink.Link, error) {
+	links, err := netlink.LinkList()
+	return links, wrap("link list", "", err)
+}
+
+func (kernel) LinkAdd(link netlink.Link) error {
+	return wrap("link add", link.Attrs().Name, netlink.LinkAdd(link))
+}
+
+func (kernel) LinkDel(link netlink.Link) error {
+	return wrap("link del", link.Attrs().Name, netlink.LinkDel(link))
+}
+
+func (kernel) LinkModify(link netlink.Link) error {
+	return wrap("link modify", link.Attrs().Name, netlink.LinkModify(link))
+}
+
+func (kernel) LinkSetUp(link netlink.Link) error {
+	return wrap("link set up", link.Attrs().Name, netlink.LinkSetUp(link))
+}
+
+func (kernel) LinkSetMTU(link netlink.Link, mtu int) error {
+	return wrap("link set mtu", link.Attrs().Name, netlink.LinkSetMTU(link, mtu))
+}
+
+func (kernel) LinkSetHardwareAddr(link netlink.Link, hwaddr net.HardwareAddr) error {
+	return wrap("link set address", link.Attrs().Name, netlink.LinkSetHardwareAddr(link, hwaddr))
+}
+
+func (kernel) LinkSetMaster(link, master netlink.Link) error {
+	return wrap("link set master", link.Attrs().Name, netlink.LinkSetMaster(link, master))
+}
+
+func (kernel) LinkSetNoMaster(link netlink.Link) error {
+	return wrap("link set nomaster", link.Attrs().Name, netlink.LinkSetNoMaster(link))
+}
+
+func (kernel) LinkSetHairpin(link netlink.Link, mode bool) error {
+	return wrap("link set hairpin", link.Attrs().Name, netlink.LinkSetHairpin(link, mode))
+}
+
+func (kernel) SetPromiscOn(link netlink.Link) error {
+	return wrap("link set promisc on", link.Attrs().Name, netlink.SetPromiscOn(link))
+}
+
+func (kernel) SetPromiscOff(link netlink.Link) error {
+	return wrap("link set promisc off", link.Attrs().Name, netlink.SetPromiscOff(link))
+}
+
+func (kernel) AddrList(link netlink.Link, family int) ([]netlink.Addr, error) {
+	addrs, err := netlink.AddrList(link, family)
+	return addrs, wrap("addr list", link.Attrs().Name, err)
+}
+
+func (kernel) AddrAdd(link netlink.Link, addr *netlink.Addr) error {
+	return wrap("addr add", addr.IPNet.String(), netlink.AddrAdd(link, addr))
+}
+
+func (kernel) AddrDel(link netlink.Link, addr *netlink.Addr) error {
+	return wrap("addr del", addr.IPNet.String(), netlink.AddrDel(link, addr))
+}
+
+func (kernel) RouteList(link netlink.Link, family int) ([]netlink.Route, error) {
+	routes, err := netlink.RouteList(link, family)
+	return routes, wrap("route list", "", err)
+}
+
+func (kernel) RouteListFiltered(family int, filter *netlink.Route, filterMask uint64) ([]netlink.Route, error) {
+	routes, err := netlink.RouteListFiltered(family, filter, filterMask)
+	return routes, wrap("route list", "", err)
+}
+
+func (kernel) RouteAdd(route *netlink.Route) error {
+	return wrap("route add", routeObj(route), netlink.RouteAdd(route))
+}
+
+func (kernel) RouteReplace(route *netlink.Route) error {
+	return wrap("route replace", routeObj(route), netlink.RouteReplace(route))
+}
+
+func (kernel) RouteDel(route *netlink.Route) error {
+	return wrap("route del", routeObj(route), netlink.RouteDel(route))
+}
+
+// ruleObj 策略路由规则在错误信息中的表示
+func ruleObj(rule *netlink.Rule) string {
+	src, dst := "all", "all"
+	if rule.Src != nil {
+		src = rule.Src.String()
+	}
+	if rule.Dst != nil {
+		dst = rule.Dst.String()
+	}
+	return fmt.Sprintf("from %s to %s table %d", src, dst, rule.Table)
+}
+
+func (kernel) RuleAdd(rule *netlink.Rule) error {
+	return wrap("rule add", ruleObj(rule), netlink.RuleAdd(rule))
+}
+
+func (kernel) RuleDel(rule *netlink.Rule) error {
+	return wrap("rule del", ruleObj(rule), netlink.RuleDel(rule))
+}
+
+func (kernel) QdiscList(link netlink.Link) ([]netlink.Qdisc, error) {
+	qdiscs, err := netlink.QdiscList(link)
+	return qdiscs, wrap("qdisc list", link.Attrs().Name, err)
+}
+
+func (kernel) QdiscReplace(qdisc netlink.Qdisc) error {
+	return wrap("qdisc replace", qdisc.Type(), netlink.QdiscReplace(qdisc))
+}
+
+func (kernel) QdiscDel(qdisc netlink.Qdisc) error {
+	return wrap("qdisc del", qdisc.Type(), netlink.QdiscDel(qdisc))
+}
@@ -0,0 +1,106 @@
+package podevent
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	k8stypes "k8s.io/apimachinery/pkg/types"
+	clientset "k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+)
+
+// component 事件的来源组件
+const component = "tsunami"
+
+// dhcp 备用地址相关的 Pod 注解
+const (
+	// FallbackAnnotation dhcp 超时后 Pod 使用的备用地址
+	FallbackAnnotation = "tsunami.io/dhcp-fallback"
+	// RecoveredAnnotation dhcp 恢复后服务器提供的地址, 重建 Pod 后即可重新获取租约
+	RecoveredAnnotation = "tsunami.io/dhcp-recovered"
+)
+
+// Recorder 为 Pod 创建 Event, 由持有集群凭证的 daemon 使用
+// cni 插件没有集群凭证, 需要通过 daemon 的 unix socket 转发
+type Recorder struct {
+	client   clientset.Interface
+	nodeName string
+}
+
+// NewRecorder 创建 Recorder 对象
+func NewRecorder(client clientset.Interface, nodeName string) *Recorder {
+	return &Recorder{client: client, nodeName: nodeName}
+}
+
+// NewInClusterRecorder 使用 in cluster 配置创建 Recorder 对象
+func NewInClusterRecorder(nodeName string) (*Recorder, error) {
+	cfg, err := rest.InClusterConfig()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get in cluster config: %v", err)
+	}
+
+	client, err := clientset.NewForConfig(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create clientset: %v", err)
+	}
+
+	return NewRecorder(client, nodeName), nil
+}
+
+// Event 为 Pod 创建一条 Event, eventType 为 corev1.EventTypeNormal 或 corev1.EventTypeWarning
+func (r *Recorder) Event(namespace, name, eventType, reason, message string) (err error) {
+	pod, err := r.client.CoreV1().Pods(namespace).Get(context.Background(), name, metav1.GetOptions{})
+	if err != nil {
+		return fmt.Errorf("failed to get pod %s/%s: %v", namespace, name, err)
+	}
+
+	now := metav1.NewTime(time.Now())
+	event := &corev1.Event{
+		ObjectMeta: metav1.ObjectMeta{
+			GenerateName: name + ".",
+			Namespace:    namespace,
+		},
+		InvolvedObject: corev1.ObjectReference{
+			Kind:            "Pod",
+			APIVersion:      "v1",
+			Namespace:       namespace,
+			Name:            name,
+			UID:             pod.UID,
+			ResourceVersion: pod.ResourceVersion,
+		},
+		Reason:         reason,
+		Message:        message,
+		Type:           eventType,
+		Source:         corev1.EventSource{Component: component, Host: r.nodeName},
+		FirstTimestamp: now,
+		LastTimestamp:  now,
+		Count:          1,
+	}
+
+	if _, err = r.client.CoreV1().Events(namespace).Create(context.Background(), event, metav1.CreateOptions{}); err != nil {
+		return fmt.Errorf("failed to create event for pod %s/%s: %v", namespace, name, err)
+	}
+
+	return nil
+}
+
+// Annotate 为 Pod 添加或更新注解
+func (r *Recorder) Annotate(namespace, name string, annotations map[string]string) (err error) {
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{"annotations": annotations},
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = r.client.CoreV1().Pods(namespace).Patch(context.Background(), name, k8stypes.MergePatchType, patch, metav1.PatchOptions{})
+	if err != nil {
+		return fmt.Errorf("failed to annotate pod %s/%s: %v", namespace, name, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,222 @@
+package podroute
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/gitlayzer/tsunami/pkg/nlwrap"
+	"github.com/vishvananda/netlink"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/klog"
+
+	"github.com/gitlayzer/tsunami/utils/restapi"
+)
+
+// Pod 上的带宽注解, 与 kubelet 以及 bandwidth 插件使用的注解相同, 值为如 10M 的 quantity, 单位为 bit/s
+const (
+	AnnotationIngressBandwidth = "kubernetes.io/ingress-bandwidth"
+	AnnotationEgressBandwidth  = "kubernetes.io/egress-bandwidth"
+)
+
+// 与 kubelet 对带宽注解的限制一致
+var (
+	minBandwidth = resource.MustParse("1k")
+	maxBandwidth = resource.MustParse("1P")
+)
+
+// tbfLatencyMs TBF 队列中数据包允许的最大排队时间, 与 bandwidth 插件一致
+const tbfLatencyMs = 25
+
+// minBurstBytes 未指定突发量时, 使用 100ms 的流量作为突发量, 但至少要能容纳若干个完整的数据包
+const minBurstBytes = 64 * 1024
+
+// parseBandwidth 解析一个带宽注解, 注解不存在时返回 0
+func parseBandwidth(annotations map[string]string, key string) (uint64, error) {
+	v, ok := annotations[key]
+	if !ok {
+		return 0, nil
+	}
+
+	q, err := resource.ParseQuantity(v)
+	if err != nil {
+		return 0, fmt.Errorf("failed to parse annotation %s: %v", key, err)
+	}
+	if q.Cmp(minBandwidth) < 0 || q.Cmp(maxBandwidth) > 0 {
+		return 0, fmt.Errorf("annotation %s %s is out of range [%s, %s]", key, v, minBandwidth.String(), maxBandwidth.String())
+	}
+	return uint64(q.Value()), nil
+}
+
+// ParseBandwidthAnnotations 从 Pod 注解中解析带宽限制, 供 cni server 使用, 没有设置时返回 nil
+func ParseBandwidthAnnotations(annotations map[string]string) (spec *restapi.BandwidthSpec, err error) {
+	spec = &restapi.BandwidthSpec{}
+	if spec.IngressRate, err = parseBandwidth(annotations, AnnotationIngressBandwidth); err != nil {
+		return nil, err
+	}
+	if spec.EgressRate, err = parseBandwidth(annotations, AnnotationEgressBandwidth); err != nil {
+		return nil, err
+	}
+
+	if spec.IngressRate == 0 && spec.EgressRate == 0 {
+		return nil, nil
+	}
+	return spec, nil
+}
+
+// makeTBF 根据速率与突发量(均以 bit 为单位)构造 TBF 队列, 计算方式与 bandwidth 插件一致
+func makeTBF(linkIndex int, rateBits, burstBits uint64) (qdisc *netlink.Tbf, err error) {
+	rate := rateBits / 8
+	if rate == 0 {
+		return nil, fmt.Errorf("rate %d bit/s is too small", rateBits)
+	}
+
+	burst := burstBits / 8
+	if burst == 0 {
+		burst = rate / 10
+		if burst < minBurstBytes {
+			burst = minBurstBytes
+		}
+	}
+	if burst > math.MaxUint32 {
+		return nil, fmt.Errorf("burst %d bit is too large", burstBits)
+	}
+
+	limit := rate*tbfLatencyMs/1000 + burst
+	if limit > math.MaxUint32 {
+		return nil, fmt.Errorf("rate %d bit/s is too large", rateBits)
+	}
+
+	return &netlink.Tbf{
+		QdiscAttrs: netlink.QdiscAttrs{
+			LinkIndex: linkIndex,
+			Handle:    netlink.MakeHandle(1, 0),
+			Parent:    netlink.HANDLE_ROOT,
+		},
+		Rate:   rate,
+		Limit:  uint32(limit),
+		Buffer: netlink.Xmittime(rate, uint32(burst)),
+	}, nil
+}
+
+// setTBF 在网卡的根队列上设置 TBF, 已存在时替换
+func setTBF(link netlink.Link, rateBits, burstBits uint64) (err error) {
+	qdisc, err := makeTBF(link.Attrs().Index, rateBits, burstBits)
+	if err != nil {
+		return err
+	}
+	if err = nl.QdiscReplace(qdisc); err != nil {
+		return fmt.Errorf("failed to set tbf qdisc on %s: %v", link.Attrs().Name, err)
+	}
+	klog.V(3).Infof("set tbf qdisc on %s, rate: %d bit/s", link.Attrs().Name, rateBits)
+
+	return nil
+}
+
+// delTBF 移除网卡根队列上的 TBF, 不存在时直接返回
+func delTBF(link netlink.Link) (err error) {
+	qdiscs, err := nl.QdiscList(link)
+	if err != nil {
+		return fmt.Errorf("failed to list qdiscs of %s: %v", link.Attrs().Name, err)
+	}
+
+	for _, qdisc := range qdiscs {
+		if _, ok := qdisc.(*netlink.Tbf); !ok || qdisc.Attrs().Parent != netlink.HANDLE_ROOT {
+			continue
+		}
+		if err = nl.QdiscDel(qdisc); err != nil {
+			return fmt.Errorf("failed to delete tbf qdisc of %s: %v", link.Attrs().Name, err)
+		}
+	}
+
+	return nil
+}
+
+// SetBandwidth 为 Pod 设置带宽限制.
+// 进入 Pod 的流量从宿主机一侧的 veth 发出, 在其上限速; Pod 发出的流量从 Pod 网卡发出, 在 Pod 网络命名空间中限速.
+func SetBandwidth(netnsPath, ifName string, spec *restapi.BandwidthSpec) (err error) {
+	if spec == nil {
+		return nil
+	}
+
+	if spec.IngressRate > 0 {
+		veth, err := GetVethInfo(netnsPath, ifName)
+		if err != nil {
+			return err
+		}
+		hostLink, err := nl.LinkByIndex(veth.HostIndex)
+		if err != nil {
+			return fmt.Errorf("faliled to get host veth of pod: %s", err)
+		}
+		if err = setTBF(hostLink, spec.IngressRate, spec.IngressBurst); err != nil {
+			return err
+		}
+	}
+
+	if spec.EgressRate > 0 {
+		netns, err := ns.GetNS(netnsPath)
+		if err != nil {
+			return fmt.Errorf("failed to open netns %q: %v", netnsPath, err)
+		}
+		defer netns.Close()
+
+		err = netns.Do(func(_ ns.NetNS) (err error) {
+			link, err := nl.LinkByName(ifName)
+			if err != nil {
+				return fmt.Errorf("faliled to get %s link: %s", ifName, err)
+			}
+			return setTBF(link, spec.EgressRate, spec.EgressBurst)
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// DelBandwidth 移除 SetBandwidth 设置的带宽限制.
+// hostVeth 或 netnsPath 为空表示对应的一端已经不存在, 跳过该端.
+func DelBandwidth(hostVeth, netnsPath, ifName string, spec *restapi.BandwidthSpec) (err error) {
+	if spec == nil {
+		return nil
+	}
+
+	if spec.IngressRate > 0 && hostVeth != "" {
+		// veth 随 Pod 网络命名空间一起删除时, 其上的队列也随之消失
+		hostLink, err := nl.LinkByName(hostVeth)
+		if err != nil && !nlwrap.IsLinkNotFound(err) {
+			return err
+		}
+		if err == nil {
+			if err = delTBF(hostLink); err != nil {
+				return err
+			}
+		}
+	}
+
+	if spec.EgressRate > 0 && netnsPath != "" {
+		netns, err := ns.GetNS(netnsPath)
+		if err != nil {
+			return fmt.Errorf("failed to open netns %q: %v", netnsPath, err)
+		}
+		defer netns.Close()
+
+		err = netns.Do(func(_ ns.NetNS) (err error) {
+			// 网卡已经被删除时不需要清理
+			link, err := nl.LinkByName(ifName)
+			if nlwrap.IsLinkNotFound(err) {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			return delTBF(link)
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
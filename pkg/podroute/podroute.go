@@ -3,25 +3,50 @@ package podroute
 import (
 	"fmt"
 	"net"
+	"time"
 
 	"github.com/containernetworking/plugins/pkg/ns"
 	"github.com/gitlayzer/tsunami/pkg/cninet"
+	"github.com/gitlayzer/tsunami/pkg/nlwrap"
 	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
 	"k8s.io/klog"
 )
 
-// MakeServiceCIDRRoute 生成 Pod 到 ServiceIP 的路由
-func MakeServiceCIDRRoute(linkBridge netlink.Link, serviceCIDR string) (svcRoute *netlink.Route, err error) {
-	bridgeAddrs, err := netlink.AddrList(linkBridge, netlink.FAMILY_V4)
+// SelectBridgeAddr 从网桥的地址中选择 Pod 使用的网关地址
+// 优先选择与 Pod IP 处于同一网段的地址, 其次选择网桥的主地址(非 secondary), 而不是依赖地址的返回顺序
+func SelectBridgeAddr(linkBridge netlink.Link, podIP net.IP) (gw net.IP, err error) {
+	bridgeAddrs, err := nl.AddrList(linkBridge, netlink.FAMILY_V4)
 	if err != nil {
 		return nil, fmt.Errorf("failed to get bridge address: %v", err)
 	}
 
 	klog.V(3).Infof("bridge addresses: %+v, len: %d", bridgeAddrs, len(bridgeAddrs))
 
-	var gw net.IP
+	if podIP != nil {
+		for _, addr := range bridgeAddrs {
+			if addr.IPNet.Contains(podIP) {
+				return addr.IP, nil
+			}
+		}
+	}
+	for _, addr := range bridgeAddrs {
+		if addr.Flags&unix.IFA_F_SECONDARY == 0 {
+			return addr.IP, nil
+		}
+	}
 	if len(bridgeAddrs) > 0 {
-		gw = bridgeAddrs[0].IP
+		return bridgeAddrs[0].IP, nil
+	}
+
+	return nil, nil
+}
+
+// MakeServiceCIDRRoute 生成 Pod 到 ServiceIP 的路由, 网关为网桥上与 podIP 同网段的地址
+func MakeServiceCIDRRoute(linkBridge netlink.Link, serviceCIDR string, podIP net.IP) (svcRoute *netlink.Route, err error) {
+	gw, err := SelectBridgeAddr(linkBridge, podIP)
+	if err != nil {
+		return nil, err
 	}
 
 	// 创建路由规则，目的地址为 10.96.0.0/12，网关为 bridge 网卡的 IP 地址
@@ -43,15 +68,43 @@ func MakeServiceCIDRRoute(linkBridge netlink.Link, serviceCIDR string) (svcRoute
 	return
 }
 
+// PrimaryIfName 主网卡名称, 与 Multus 等多网卡方案的约定一致, 次要网络的网卡名称为 net1, net2 等
+const PrimaryIfName = "eth0"
+
+// PodRouteOpts SetRouteInPod 的参数
+type PodRouteOpts struct {
+	BridgeName    string
+	NetnsPath     string
+	IfName        string
+	ServiceIPCIDR string
+	// Primary 只有主网卡上才会添加默认路由
+	Primary bool
+	// ServiceRoute 是否在该网卡上添加到 service cidr 的路由
+	ServiceRoute bool
+	// PodIP Pod 在该网卡上的 IP, 用于选择网关地址与策略路由
+	PodIP net.IP
+	// Policy 不为空时, 集群流量通过策略路由走独立的路由表
+	Policy *PolicyOpts
+	// Tuning 不为空时, 还会修改 Pod 网卡的 MTU, MAC 与 sysctl
+	Tuning *Tuning
+}
+
 // SetRouteInPod 在 Pod 命名空间中设置路由规则，有两种情况
 // 1：默认路由, 一般 bridge + dhcp 会自动为 Pod 创建默认路由, 在 ESXI 环境下, 创建的 Pod 申请到 IP 后并不会创建, 后续可能需要适配
 // 2：Pod 到 ServiceIP 的路由, 需要设置宿主机为该 Pod 的网关, 否则拥有宿主机网络 IP 的 Pod 无法访问到 ServiceIP
-func SetRouteInPod(bridgeName, netnsPath, serviceIPCIDR string) (svcRoute *netlink.Route, err error) {
-	linkBridge, err := netlink.LinkByName(bridgeName)
+// 作为次要网络时, 默认路由只保留在主网卡上, service cidr 路由只在 opts.ServiceRoute 为 true 时添加
+func SetRouteInPod(opts *PodRouteOpts) (svcRoute *netlink.Route, err error) {
+	tuning := opts.Tuning
+	linkBridge, err := nl.LinkByName(opts.BridgeName)
 	if err != nil {
 		return nil, fmt.Errorf("faliled to get bridge link: %s", err)
 	}
 
+	// 网桥的 MTU 是其所有端口(包括物理网卡)中最小的, Pod 网卡的 MTU 不能超过它
+	if !tuning.IsEmpty() && tuning.MTU > linkBridge.Attrs().MTU {
+		return nil, fmt.Errorf("pod mtu %d exceeds the mtu %d of bridge %s", tuning.MTU, linkBridge.Attrs().MTU, opts.BridgeName)
+	}
+
 	// 获取宿主机上的默认路由, 之后需要在设置容器中默认路由时使用ta的网关.
 	hostDefRoute, err := cninet.GetDefaultRoute()
 	if err != nil {
@@ -59,42 +112,172 @@ func SetRouteInPod(bridgeName, netnsPath, serviceIPCIDR string) (svcRoute *netli
 		klog.Warning(err)
 	}
 
-	svcRoute, err = MakeServiceCIDRRoute(linkBridge, serviceIPCIDR)
-	if err != nil {
-		return nil, fmt.Errorf("faliled to generate service route: %s", err)
+	// 策略路由表中是 IPv4 的路由, 只有 IPv6 地址(如 SLAAC)的网卡不需要
+	policy := opts.Policy
+	if policy != nil && opts.PodIP.To4() == nil {
+		klog.Infof("skip policy routing on %s, pod has no ipv4 address", opts.IfName)
+		policy = nil
+	}
+	// 次要网卡上没有 service cidr 路由, 网关地址需要单独选择
+	var policyGw net.IP
+	if policy != nil {
+		if policyGw, err = SelectBridgeAddr(linkBridge, opts.PodIP); err != nil {
+			return nil, err
+		}
 	}
 
-	netns, err := ns.GetNS(netnsPath)
+	if opts.ServiceRoute {
+		svcRoute, err = MakeServiceCIDRRoute(linkBridge, opts.ServiceIPCIDR, opts.PodIP)
+		if err != nil {
+			return nil, fmt.Errorf("faliled to generate service route: %s", err)
+		}
+	}
+
+	netns, err := ns.GetNS(opts.NetnsPath)
 	if err != nil {
-		return nil, fmt.Errorf("failed to open netns %q: %v", netnsPath, err)
+		return nil, fmt.Errorf("failed to open netns %q: %v", opts.NetnsPath, err)
 	}
 	defer netns.Close()
 
+	// Pod 中 veth 设备在宿主机上的对端索引
+	var peerIndex int
 	err = netns.Do(func(containerNS ns.NetNS) (err error) {
-		link, err := netlink.LinkByName("eth0")
+		link, err := nl.LinkByName(opts.IfName)
 		if err != nil {
-			return fmt.Errorf("faliled to get eth0 link: %s", err)
+			return fmt.Errorf("faliled to get %s link: %s", opts.IfName, err)
 		}
-		
-		// 判断容器中是否存在默认路由, 如果不存在则创建(需要使用宿主机的网关).
-		_, err = cninet.GetDefaultRoute()
-		if err != nil {
-			klog.Warning(err)
-			defRoute := cninet.MakeDefaultRoute(hostDefRoute.Gw)
-			defRoute.LinkIndex = link.Attrs().Index
-			err = netlink.RouteAdd(defRoute)
+		peerIndex = link.Attrs().ParentIndex
+
+		if !tuning.IsEmpty() {
+			if err = applyTuning(link, tuning); err != nil {
+				return err
+			}
+		}
+
+		if opts.Primary {
+			// 判断容器中是否存在默认路由, 如果不存在则创建(需要使用宿主机的网关).
+			_, err = cninet.GetDefaultRoute()
 			if err != nil {
-				return fmt.Errorf("faliled to add default route: %s", err)
+				klog.Warning(err)
+				if hostDefRoute == nil {
+					return fmt.Errorf("faliled to add default route: no default route on host")
+				}
+				defRoute := cninet.MakeDefaultRoute(hostDefRoute.Gw)
+				defRoute.LinkIndex = link.Attrs().Index
+				err = nl.RouteAdd(defRoute)
+				if err != nil {
+					return fmt.Errorf("faliled to add default route: %s", err)
+				}
 			}
+		} else if err = delDefaultRoutes(link); err != nil {
+			return err
 		}
-		// 添加到service cidr的路由.
-		svcRoute.LinkIndex = link.Attrs().Index
-		err = netlink.RouteAdd(svcRoute)
+
+		if svcRoute != nil {
+			// 添加到service cidr的路由, 启用策略路由时放在独立的路由表中.
+			svcRoute.LinkIndex = link.Attrs().Index
+			if policy != nil {
+				svcRoute.Table = policy.PodTable
+			}
+			// 重复执行 ADD 时路由已经存在
+			err = nl.RouteAdd(svcRoute)
+			if err != nil && !nlwrap.IsExist(err) {
+				return fmt.Errorf("faliled to add service cidr route: %s", err)
+			}
+		}
+
+		if policy != nil {
+			return setPodPolicy(link, policy, opts.PodIP, policyGw)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// 宿主机上到 Pod 的回程路由.
+	if policy != nil {
+		if err = SetHostPolicy(linkBridge, policy, opts.PodIP, policyGw); err != nil {
+			return nil, err
+		}
+	}
+
+	// 宿主机一侧的 veth 设备需要与 Pod 网卡保持相同的 MTU, 否则大包会被丢弃
+	if !tuning.IsEmpty() && tuning.MTU != 0 && peerIndex != 0 {
+		peer, err := nl.LinkByIndex(peerIndex)
 		if err != nil {
-			return fmt.Errorf("faliled to add service cidr route: %s", err)
+			return nil, fmt.Errorf("faliled to get host veth of pod: %s", err)
 		}
+		if err = nl.LinkSetMTU(peer, tuning.MTU); err != nil {
+			return nil, fmt.Errorf("faliled to set mtu of host veth %s: %s", peer.Attrs().Name, err)
+		}
+	}
+
+	return svcRoute, nil
+}
+
+// delDefaultRoutes 移除次要网卡上的默认路由
+// dhcp 会根据 router 选项在每个网卡上都添加默认路由, 与主网卡的默认路由冲突
+func delDefaultRoutes(link netlink.Link) (err error) {
+	routes, err := nl.RouteList(link, netlink.FAMILY_V4)
+	if err != nil {
+		return fmt.Errorf("faliled to list routes of %s: %s", link.Attrs().Name, err)
+	}
+
+	for _, route := range routes {
+		// netlink 库返回的默认路由 Dst 为 0.0.0.0/0 而不是 nil
+		if route.Dst != nil {
+			if ones, _ := route.Dst.Mask.Size(); ones != 0 {
+				continue
+			}
+		}
+		if err = nl.RouteDel(&route); err != nil {
+			return fmt.Errorf("faliled to delete default route of %s: %s", link.Attrs().Name, err)
+		}
+		klog.V(3).Infof("delete default route %+v on secondary interface %s", route, link.Attrs().Name)
+	}
+
+	return nil
+}
+
+// AnnounceInPod 在 Pod 网络命名空间中, 从指定网卡为其地址发送免费 ARP / 非请求 NA
+// 用于静态 IP 的 Pod, 该 IP 之前可能属于其他节点上的 Pod, 上游交换机中还保留着旧的表项
+func AnnounceInPod(netnsPath, ifName string, count int) (err error) {
+	if count <= 0 {
 		return nil
+	}
+
+	netns, err := ns.GetNS(netnsPath)
+	if err != nil {
+		return fmt.Errorf("failed to open netns %q: %v", netnsPath, err)
+	}
+	defer netns.Close()
+
+	return netns.Do(func(_ ns.NetNS) (err error) {
+		link, err := nl.LinkByName(ifName)
+		if err != nil {
+			return fmt.Errorf("faliled to get %s link: %s", ifName, err)
+		}
+		return cninet.AnnounceAddrs(link, count)
 	})
+}
 
-	return svcRoute, err
-}
\ No newline at end of file
+// ProbeInBridge 从宿主机网桥上对 Pod 的静态 IP 做重复地址检测
+// 此时地址可能已经由 cni server 配置在 Pod 网卡上, 因此忽略 Pod 网卡自身的应答
+func ProbeInBridge(bridgeName, netnsPath, ifName string, ip net.IP, timeout time.Duration) (err error) {
+	if timeout <= 0 {
+		return nil
+	}
+
+	linkBridge, err := nl.LinkByName(bridgeName)
+	if err != nil {
+		return fmt.Errorf("faliled to get bridge link: %s", err)
+	}
+
+	veth, err := GetVethInfo(netnsPath, ifName)
+	if err != nil {
+		return err
+	}
+
+	return cninet.Probe(linkBridge, ip, timeout, []net.HardwareAddr{veth.PodMAC})
+}
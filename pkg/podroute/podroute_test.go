@@ -0,0 +1,366 @@
+package podroute
+
+import (
+	"net"
+	"testing"
+
+	"github.com/gitlayzer/tsunami/pkg/nlwrap/nlfake"
+	"github.com/gitlayzer/tsunami/utils/restapi"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// newBridge 创建带有多个地址的网桥 br0
+func newBridge(t *testing.T, addrs ...string) (*nlfake.Handle, netlink.Link) {
+	t.Helper()
+	h := nlfake.New()
+	t.Cleanup(SetNetlinkHandle(h))
+
+	br := &netlink.Bridge{LinkAttrs: netlink.LinkAttrs{Name: "br0"}}
+	if err := h.LinkAdd(br); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.LinkSetUp(br); err != nil {
+		t.Fatal(err)
+	}
+	for _, a := range addrs {
+		addr, err := netlink.ParseAddr(a)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = h.AddrAdd(br, addr); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return h, br
+}
+
+func TestSelectBridgeAddr(t *testing.T) {
+	_, br := newBridge(t, "192.168.1.10/24", "192.168.1.11/24", "172.16.0.1/16")
+
+	tests := []struct {
+		podIP string
+		want  string
+	}{
+		{"172.16.3.4", "172.16.0.1"},
+		{"192.168.1.50", "192.168.1.10"},
+		// 没有同网段的地址时使用主地址
+		{"10.0.0.1", "192.168.1.10"},
+		{"", "192.168.1.10"},
+	}
+	for _, tt := range tests {
+		gw, err := SelectBridgeAddr(br, net.ParseIP(tt.podIP))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !gw.Equal(net.ParseIP(tt.want)) {
+			t.Errorf("pod ip %q: got %s, want %s", tt.podIP, gw, tt.want)
+		}
+	}
+}
+
+func TestSelectBridgeAddrWithoutAddress(t *testing.T) {
+	_, br := newBridge(t)
+
+	gw, err := SelectBridgeAddr(br, net.ParseIP("192.168.1.50"))
+	if err != nil || gw != nil {
+		t.Errorf("got %v, %v, want nil gateway", gw, err)
+	}
+}
+
+func TestMakeServiceCIDRRoute(t *testing.T) {
+	_, br := newBridge(t, "192.168.1.10/24")
+
+	route, err := MakeServiceCIDRRoute(br, "", net.ParseIP("192.168.1.50"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if route.Dst.String() != "10.96.0.0/12" || !route.Gw.Equal(net.ParseIP("192.168.1.10")) {
+		t.Errorf("unexpected default service route: %s", route)
+	}
+
+	route, err = MakeServiceCIDRRoute(br, "10.100.0.0/16", net.ParseIP("192.168.1.50"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if route.Dst.String() != "10.100.0.0/16" {
+		t.Errorf("got dst %s, want 10.100.0.0/16", route.Dst)
+	}
+
+	if _, err = MakeServiceCIDRRoute(br, "10.100.0.0", nil); err == nil {
+		t.Errorf("invalid service cidr should fail")
+	}
+}
+
+func TestHostPolicy(t *testing.T) {
+	h, br := newBridge(t, "192.168.1.10/24")
+	policy := &PolicyOpts{PodTable: DefaultPodTable, HostTable: DefaultHostTable, RulePriority: DefaultRulePriority}
+	podIP, gw := net.ParseIP("192.168.1.50"), net.ParseIP("192.168.1.10")
+
+	hostRoutes := func() []netlink.Route {
+		routes, _ := h.RouteListFiltered(netlink.FAMILY_V4, &netlink.Route{Table: policy.HostTable}, netlink.RT_FILTER_TABLE)
+		return routes
+	}
+
+	// 重复调用不报错, 也不会产生重复的规则与路由
+	for i := 0; i < 2; i++ {
+		if err := SetHostPolicy(br, policy, podIP, gw); err != nil {
+			t.Fatalf("set host policy #%d: %v", i+1, err)
+		}
+	}
+	rules := h.Rules()
+	if len(rules) != 1 || rules[0].Table != policy.HostTable || rules[0].Dst.String() != "192.168.1.50/32" {
+		t.Errorf("unexpected rules: %+v", rules)
+	}
+	routes := hostRoutes()
+	if len(routes) != 1 || routes[0].Dst.String() != "192.168.1.50/32" || !routes[0].Src.Equal(gw) || routes[0].Scope != netlink.SCOPE_LINK {
+		t.Errorf("unexpected host routes: %+v", routes)
+	}
+	if main, _ := h.RouteList(br, netlink.FAMILY_V4); len(main) != 1 {
+		t.Errorf("main table should not be changed: %+v", main)
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := DelHostPolicy(policy, podIP); err != nil {
+			t.Fatalf("del host policy #%d: %v", i+1, err)
+		}
+	}
+	if rules = h.Rules(); len(rules) != 0 {
+		t.Errorf("rules should be removed: %+v", rules)
+	}
+	if routes = hostRoutes(); len(routes) != 0 {
+		t.Errorf("host routes should be removed: %+v", routes)
+	}
+}
+
+func TestSetPodPolicy(t *testing.T) {
+	h, eth0 := newBridge(t, "192.168.1.50/24")
+	_, cluster, _ := net.ParseCIDR("10.244.0.0/16")
+	policy := &PolicyOpts{PodTable: DefaultPodTable, HostTable: DefaultHostTable, RulePriority: DefaultRulePriority, ClusterCIDRs: []*net.IPNet{cluster}}
+	podIP := net.ParseIP("192.168.1.50")
+
+	// 网桥上没有地址时无法选择网关
+	if err := setPodPolicy(eth0, policy, podIP, nil); err == nil {
+		t.Errorf("policy without bridge address should fail")
+	}
+
+	// 次要网卡上没有 service cidr 路由, 网关直接来自网桥地址
+	gw := net.ParseIP("192.168.1.10")
+	if err := setPodPolicy(eth0, policy, podIP, gw); err != nil {
+		t.Fatal(err)
+	}
+	routes, _ := h.RouteListFiltered(netlink.FAMILY_V4, &netlink.Route{Table: policy.PodTable}, netlink.RT_FILTER_TABLE)
+	if len(routes) != 1 || routes[0].Dst.String() != "10.244.0.0/16" || !routes[0].Gw.Equal(gw) {
+		t.Errorf("unexpected pod routes: %+v", routes)
+	}
+	rules := h.Rules()
+	if len(rules) != 1 || rules[0].Src.String() != "192.168.1.50/32" || rules[0].Table != policy.PodTable {
+		t.Errorf("unexpected rules: %+v", rules)
+	}
+}
+
+func TestHostIPNet(t *testing.T) {
+	tests := map[string]string{
+		"192.168.1.50":    "192.168.1.50/32",
+		"2001:db8::50":    "2001:db8::50/128",
+		"::ffff:10.0.0.1": "10.0.0.1/32",
+	}
+	for ip, want := range tests {
+		if got := hostIPNet(net.ParseIP(ip)).String(); got != want {
+			t.Errorf("%s: got %s, want %s", ip, got, want)
+		}
+	}
+}
+
+func TestDelDefaultRoutes(t *testing.T) {
+	h, eth0 := newBridge(t, "192.168.1.50/24")
+	_, dst, _ := net.ParseCIDR("10.0.0.0/8")
+	for _, r := range []*netlink.Route{
+		{LinkIndex: eth0.Attrs().Index, Gw: net.ParseIP("192.168.1.1")},
+		{LinkIndex: eth0.Attrs().Index, Dst: dst, Gw: net.ParseIP("192.168.1.1")},
+	} {
+		if err := h.RouteAdd(r); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := delDefaultRoutes(eth0); err != nil {
+		t.Fatal(err)
+	}
+	routes, _ := h.RouteList(eth0, netlink.FAMILY_V4)
+	for _, r := range routes {
+		if ones, _ := r.Dst.Mask.Size(); ones == 0 {
+			t.Errorf("default route should be removed: %s", r)
+		}
+	}
+	if len(routes) != 2 {
+		t.Errorf("got %d routes, want the prefix route and 10.0.0.0/8", len(routes))
+	}
+}
+
+func TestMakeRoute(t *testing.T) {
+	_, eth0 := newBridge(t, "192.168.1.50/24")
+
+	tests := []struct {
+		spec    restapi.RouteSpec
+		scope   netlink.Scope
+		wantErr bool
+	}{
+		{spec: restapi.RouteSpec{Dst: "10.0.0.0/8", Gw: "192.168.1.1", Metric: 10}, scope: netlink.SCOPE_UNIVERSE},
+		{spec: restapi.RouteSpec{Dst: "172.16.0.0/12"}, scope: netlink.SCOPE_LINK},
+		{spec: restapi.RouteSpec{Dst: "10.0.0.0"}, wantErr: true},
+		{spec: restapi.RouteSpec{Dst: "10.0.0.0/8", Gw: "gateway"}, wantErr: true},
+		{spec: restapi.RouteSpec{Dst: "10.0.0.0/8", Metric: -1}, wantErr: true},
+	}
+	for _, tt := range tests {
+		route, err := MakeRoute(tt.spec, eth0.Attrs().Index)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("%+v: expected error", tt.spec)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%+v: %v", tt.spec, err)
+			continue
+		}
+		if route.Scope != tt.scope || route.LinkIndex != eth0.Attrs().Index || route.Priority != tt.spec.Metric {
+			t.Errorf("%+v: unexpected route %s", tt.spec, route)
+		}
+		if err = nl.RouteAdd(route); err != nil {
+			t.Errorf("%+v: route add: %v", tt.spec, err)
+		}
+	}
+}
+
+func TestBandwidthQdisc(t *testing.T) {
+	h, br := newBridge(t)
+
+	if err := setTBF(br, 8_000_000, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := setTBF(br, 16_000_000, 0); err != nil {
+		t.Fatal(err)
+	}
+	qdiscs, _ := h.QdiscList(br)
+	if len(qdiscs) != 1 {
+		t.Fatalf("tbf should be replaced, got %d qdiscs", len(qdiscs))
+	}
+	if tbf, ok := qdiscs[0].(*netlink.Tbf); !ok || tbf.Rate != 2_000_000 || tbf.Attrs().Parent != netlink.HANDLE_ROOT {
+		t.Errorf("unexpected qdisc: %+v", qdiscs[0])
+	}
+
+	if err := delTBF(br); err != nil {
+		t.Fatal(err)
+	}
+	if err := delTBF(br); err != nil {
+		t.Errorf("delete missing tbf: %v", err)
+	}
+	if qdiscs, _ = h.QdiscList(br); len(qdiscs) != 0 {
+		t.Errorf("tbf should be removed: %+v", qdiscs)
+	}
+}
+
+func TestSLAACAddrs(t *testing.T) {
+	h := nlfake.New()
+	t.Cleanup(SetNetlinkHandle(h))
+	eth0 := &netlink.Veth{LinkAttrs: netlink.LinkAttrs{Name: "eth0"}}
+	if err := h.LinkAdd(eth0); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.LinkSetUp(eth0); err != nil {
+		t.Fatal(err)
+	}
+	link, _ := h.LinkByName("eth0")
+	for _, a := range []struct {
+		addr  string
+		flags int
+	}{
+		{"fe80::1/64", 0},
+		{"2001:db8:1::10/64", 0},
+		// 手动配置, 正在重复地址检测与临时地址都不是 SLAAC 生成的可用地址
+		{"2001:db8:2::10/64", unix.IFA_F_PERMANENT},
+		{"2001:db8:3::10/64", unix.IFA_F_TENTATIVE},
+		{"2001:db8:4::10/64", unix.IFA_F_TEMPORARY},
+	} {
+		addr, err := netlink.ParseAddr(a.addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		addr.Flags = a.flags
+		if err = h.AddrAdd(link, addr); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	addrs, gw, err := slaacAddrs(link)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(addrs) != 1 || addrs[0].String() != "2001:db8:1::10/64" || gw != nil {
+		t.Fatalf("unexpected slaac addresses %v, gateway %s", addrs, gw)
+	}
+
+	route := &netlink.Route{LinkIndex: link.Attrs().Index, Gw: net.ParseIP("fe80::ff")}
+	if err = h.RouteAdd(route); err != nil {
+		t.Fatal(err)
+	}
+	if _, gw, err = slaacAddrs(link); err != nil || !gw.Equal(net.ParseIP("fe80::ff")) {
+		t.Errorf("unexpected gateway %s: %v", gw, err)
+	}
+}
+
+func TestSysctlPath(t *testing.T) {
+	tests := map[string]string{
+		"net.ipv4.ip_forward":                   "net/ipv4/ip_forward",
+		"net.ipv4.conf.eth0.rp_filter":          "net/ipv4/conf/eth0/rp_filter",
+		"net.ipv4.conf.eth0.100.rp_filter":      "net/ipv4/conf/eth0.100/rp_filter",
+		"net.ipv6.conf.net1.10.20.accept_ra":    "net/ipv6/conf/net1.10.20/accept_ra",
+		"net.ipv4.neigh.eth0.100.gc_stale_time": "net/ipv4/neigh/eth0.100/gc_stale_time",
+		"net.core.somaxconn":                    "net/core/somaxconn",
+	}
+	for key, want := range tests {
+		if got := sysctlPath(key); got != want {
+			t.Errorf("%s: got %s, want %s", key, got, want)
+		}
+	}
+}
+
+func TestCheckRoute(t *testing.T) {
+	h, eth0 := newBridge(t, "192.168.1.50/24", "2001:db8::50/64")
+	add := func(spec restapi.RouteSpec) {
+		t.Helper()
+		route, err := MakeRoute(spec, eth0.Attrs().Index)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = h.RouteAdd(route); err != nil {
+			t.Fatal(err)
+		}
+	}
+	add(restapi.RouteSpec{Dst: "2001:db8:1::/48", Gw: "2001:db8::1"})
+	add(restapi.RouteSpec{Dst: "10.0.0.0/8", Gw: "192.168.1.1", Metric: 10})
+	add(restapi.RouteSpec{Dst: "172.16.0.0/12", Gw: "192.168.1.1", Table: 100})
+
+	tests := []struct {
+		spec    restapi.RouteSpec
+		missing bool
+	}{
+		// 内核中优先级为 1024
+		{spec: restapi.RouteSpec{Dst: "2001:db8:1::/48", Gw: "2001:db8::1"}},
+		{spec: restapi.RouteSpec{Dst: "10.0.0.0/8", Gw: "192.168.1.1", Metric: 10}},
+		{spec: restapi.RouteSpec{Dst: "10.0.0.0/8", Gw: "192.168.1.1"}, missing: true},
+		{spec: restapi.RouteSpec{Dst: "172.16.0.0/12", Gw: "192.168.1.1", Table: 100}},
+		// 只在 100 表中存在, 不能当作 main 表中的路由
+		{spec: restapi.RouteSpec{Dst: "172.16.0.0/12", Gw: "192.168.1.1"}, missing: true},
+	}
+	for _, tt := range tests {
+		route, err := MakeRoute(tt.spec, eth0.Attrs().Index)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = checkRoute(route); (err != nil) != tt.missing {
+			t.Errorf("%+v: missing %v, got %v", tt.spec, tt.missing, err)
+		}
+	}
+}
@@ -0,0 +1,123 @@
+package podroute
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/gitlayzer/tsunami/pkg/nlwrap"
+	"github.com/vishvananda/netlink"
+	"k8s.io/klog"
+)
+
+// 策略路由的默认值
+const (
+	DefaultPodTable     = 100
+	DefaultHostTable    = 101
+	DefaultRulePriority = 1000
+)
+
+// PolicyOpts 策略路由的配置
+// Pod 中: from <podIP> lookup PodTable, PodTable 中是经过节点的 service cidr 与 ClusterCIDRs 路由
+// 宿主机上: to <podIP> lookup HostTable, HostTable 中是经过网桥到 Pod 的回程路由
+// 两侧使用同一个网桥地址, 保证 service, 节点与 Pod 之间的流量都对称地经过 kube-proxy
+type PolicyOpts struct {
+	PodTable     int
+	HostTable    int
+	RulePriority int
+	// ClusterCIDRs 除 service cidr 之外需要经过节点转发的网段, 如其他网络方案的 Pod cidr
+	ClusterCIDRs []*net.IPNet
+}
+
+// hostIPNet 将单个 IP 转换为 /32 或 /128 网段
+func hostIPNet(ip net.IP) *net.IPNet {
+	if ip4 := ip.To4(); ip4 != nil {
+		return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}
+}
+
+// setPodPolicy 在 Pod 网络命名空间中添加策略路由, 需要在 netns.Do 中调用
+// gw 为网桥上的地址, 与 SetHostPolicy 使用的相同
+func setPodPolicy(link netlink.Link, policy *PolicyOpts, podIP, gw net.IP) (err error) {
+	if podIP == nil {
+		return fmt.Errorf("pod ip is required for policy routing")
+	}
+	if gw == nil {
+		return fmt.Errorf("no bridge address for policy routing")
+	}
+
+	for _, cidr := range policy.ClusterCIDRs {
+		route := &netlink.Route{
+			LinkIndex: link.Attrs().Index,
+			Dst:       cidr,
+			Gw:        gw,
+			Table:     policy.PodTable,
+		}
+		if err = nl.RouteReplace(route); err != nil {
+			return fmt.Errorf("faliled to add cluster cidr route %s: %s", route, err)
+		}
+	}
+
+	// 路由表中查不到目标地址时会继续匹配后续的规则, 因此其他流量仍然走 main 表
+	rule := netlink.NewRule()
+	rule.Priority = policy.RulePriority
+	rule.Table = policy.PodTable
+	rule.Src = hostIPNet(podIP)
+	if err = nl.RuleAdd(rule); err != nil && !nlwrap.IsExist(err) {
+		return fmt.Errorf("faliled to add rule %s: %s", rule, err)
+	}
+	klog.V(3).Infof("add pod rule %s", rule)
+
+	return nil
+}
+
+// SetHostPolicy 在宿主机上添加到 Pod 的回程路由与规则, 源地址为 Pod 的网关地址
+func SetHostPolicy(linkBridge netlink.Link, policy *PolicyOpts, podIP, gw net.IP) (err error) {
+	if podIP == nil {
+		return fmt.Errorf("pod ip is required for policy routing")
+	}
+
+	route := &netlink.Route{
+		LinkIndex: linkBridge.Attrs().Index,
+		Dst:       hostIPNet(podIP),
+		Src:       gw,
+		Scope:     netlink.SCOPE_LINK,
+		Table:     policy.HostTable,
+	}
+	if err = nl.RouteReplace(route); err != nil {
+		return fmt.Errorf("faliled to add host route %s: %s", route, err)
+	}
+
+	rule := netlink.NewRule()
+	rule.Priority = policy.RulePriority
+	rule.Table = policy.HostTable
+	rule.Dst = hostIPNet(podIP)
+	if err = nl.RuleAdd(rule); err != nil && !nlwrap.IsExist(err) {
+		return fmt.Errorf("faliled to add rule %s: %s", rule, err)
+	}
+	klog.V(3).Infof("add host rule %s", rule)
+
+	return nil
+}
+
+// DelHostPolicy 移除 SetHostPolicy 添加的路由与规则, 已不存在时不报错
+// Pod 中的规则与路由会随着网络命名空间一起被删除, 不需要单独清理
+func DelHostPolicy(policy *PolicyOpts, podIP net.IP) (err error) {
+	rule := netlink.NewRule()
+	rule.Priority = policy.RulePriority
+	rule.Table = policy.HostTable
+	rule.Dst = hostIPNet(podIP)
+	if err = nl.RuleDel(rule); err != nil && !nlwrap.IsNotExist(err) {
+		return fmt.Errorf("faliled to delete rule %s: %s", rule, err)
+	}
+
+	route := &netlink.Route{
+		Dst:   hostIPNet(podIP),
+		Table: policy.HostTable,
+	}
+	if err = nl.RouteDel(route); err != nil && !nlwrap.IsNotExist(err) {
+		return fmt.Errorf("faliled to delete host route %s: %s", route, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,179 @@
+package podroute
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/gitlayzer/tsunami/pkg/nlwrap"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+	"k8s.io/klog"
+
+	"github.com/gitlayzer/tsunami/utils/restapi"
+)
+
+// AnnotationRoutes Pod 上额外路由的注解, 格式为 RouteSpec 的 json 数组, 如
+// [{"dst": "10.10.0.0/16", "gw": "192.168.1.254", "metric": 100}]
+const AnnotationRoutes = "tsunami.io/routes"
+
+// ParseRouteAnnotation 从 Pod 注解中解析额外路由, 供 cni server 使用
+func ParseRouteAnnotation(annotations map[string]string) (specs []restapi.RouteSpec, err error) {
+	v, ok := annotations[AnnotationRoutes]
+	if !ok {
+		return nil, nil
+	}
+
+	if err = json.Unmarshal([]byte(v), &specs); err != nil {
+		return nil, fmt.Errorf("failed to parse annotation %s: %v", AnnotationRoutes, err)
+	}
+	for _, spec := range specs {
+		if _, err = MakeRoute(spec, 0); err != nil {
+			return nil, err
+		}
+	}
+
+	return specs, nil
+}
+
+// parseScope 将 RouteSpec 中的 scope 字符串转换为 netlink.Scope
+func parseScope(scope string, hasGw bool) (netlink.Scope, error) {
+	switch scope {
+	case "":
+		if hasGw {
+			return netlink.SCOPE_UNIVERSE, nil
+		}
+		return netlink.SCOPE_LINK, nil
+	case "universe", "global":
+		return netlink.SCOPE_UNIVERSE, nil
+	case "link":
+		return netlink.SCOPE_LINK, nil
+	case "host":
+		return netlink.SCOPE_HOST, nil
+	}
+
+	return 0, fmt.Errorf("unknown route scope %q", scope)
+}
+
+// MakeRoute 根据 RouteSpec 生成路由对象, 路由绑定到 linkIndex 对应的网卡上
+func MakeRoute(spec restapi.RouteSpec, linkIndex int) (route *netlink.Route, err error) {
+	_, dst, err := net.ParseCIDR(spec.Dst)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse route dst %q: %v", spec.Dst, err)
+	}
+
+	var gw net.IP
+	if spec.Gw != "" {
+		if gw = net.ParseIP(spec.Gw); gw == nil {
+			return nil, fmt.Errorf("failed to parse route gw %q", spec.Gw)
+		}
+	}
+
+	if spec.Metric < 0 || spec.Table < 0 {
+		return nil, fmt.Errorf("route metric and table must not be negative")
+	}
+
+	scope, err := parseScope(spec.Scope, gw != nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return &netlink.Route{
+		LinkIndex: linkIndex,
+		Dst:       dst,
+		Gw:        gw,
+		Priority:  spec.Metric,
+		Table:     spec.Table,
+		Scope:     scope,
+	}, nil
+}
+
+// doRoutes 在 Pod 网络命名空间中为每条路由执行 fn
+func doRoutes(netnsPath, ifName string, specs []restapi.RouteSpec, fn func(route *netlink.Route) error) (err error) {
+	if len(specs) == 0 {
+		return nil
+	}
+
+	netns, err := ns.GetNS(netnsPath)
+	if err != nil {
+		return fmt.Errorf("failed to open netns %q: %v", netnsPath, err)
+	}
+	defer netns.Close()
+
+	return netns.Do(func(_ ns.NetNS) (err error) {
+		link, err := nl.LinkByName(ifName)
+		if err != nil {
+			return fmt.Errorf("faliled to get %s link: %s", ifName, err)
+		}
+
+		for _, spec := range specs {
+			route, err := MakeRoute(spec, link.Attrs().Index)
+			if err != nil {
+				return err
+			}
+			if err = fn(route); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// AddRoutes 在 Pod 网络命名空间中添加额外路由, 已存在的路由会被替换
+func AddRoutes(netnsPath, ifName string, specs []restapi.RouteSpec) error {
+	return doRoutes(netnsPath, ifName, specs, func(route *netlink.Route) error {
+		if err := nl.RouteReplace(route); err != nil {
+			return fmt.Errorf("faliled to add route %s: %s", route, err)
+		}
+		klog.V(3).Infof("add route %s", route)
+		return nil
+	})
+}
+
+// DelRoutes 移除 AddRoutes 添加的路由, 路由已不存在时不报错(cmdDel 可能被重复调用)
+func DelRoutes(netnsPath, ifName string, specs []restapi.RouteSpec) error {
+	return doRoutes(netnsPath, ifName, specs, func(route *netlink.Route) error {
+		if err := nl.RouteDel(route); err != nil {
+			if !nlwrap.IsNotExist(err) {
+				return fmt.Errorf("faliled to delete route %s: %s", route, err)
+			}
+		}
+		return nil
+	})
+}
+
+// ip6DefaultMetric 内核为没有指定 metric 的 IPv6 路由设置的优先级, 即 IP6_RT_PRIO_USER
+const ip6DefaultMetric = 1024
+
+// checkRoute 检查 MakeRoute 生成的路由是否存在于当前网络命名空间中, 需要在 netns.Do 中调用.
+// 期望的路由按照内核的规则补全: 没有指定路由表时为 main 表, 没有指定 metric 的 IPv6 路由优先级为 1024.
+func checkRoute(route *netlink.Route) error {
+	expected := *route
+	if expected.Table == 0 {
+		expected.Table = unix.RT_TABLE_MAIN
+	}
+	if expected.Priority == 0 && expected.Dst.IP.To4() == nil {
+		expected.Priority = ip6DefaultMetric
+	}
+
+	filterMask := netlink.RT_FILTER_DST | netlink.RT_FILTER_OIF | netlink.RT_FILTER_TABLE
+	if expected.Gw != nil {
+		filterMask |= netlink.RT_FILTER_GW
+	}
+	found, err := nl.RouteListFiltered(netlink.FAMILY_ALL, &expected, filterMask)
+	if err != nil {
+		return fmt.Errorf("failed to list routes: %s", err)
+	}
+	for _, r := range found {
+		if r.Priority == expected.Priority {
+			return nil
+		}
+	}
+	return fmt.Errorf("route %s is missing in pod", route)
+}
+
+// CheckRoutes 检查额外路由是否都存在于 Pod 网络命名空间中, 用于 cmdCheck
+func CheckRoutes(netnsPath, ifName string, specs []restapi.RouteSpec) error {
+	return doRoutes(netnsPath, ifName, specs, checkRoute)
+}
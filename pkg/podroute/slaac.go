@@ -0,0 +1,130 @@
+package podroute
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"time"
+
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/gitlayzer/tsunami/pkg/cninet"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+	"k8s.io/klog"
+)
+
+const (
+	// DefaultSLAACTimeout 等待路由通告生成地址的默认时间
+	DefaultSLAACTimeout = 10 * time.Second
+	// solicitInterval 没有收到路由通告时重新发送路由器请求的间隔, 即 RFC 4861 中的 RTR_SOLICITATION_INTERVAL
+	solicitInterval   = 4 * time.Second
+	slaacPollInterval = 100 * time.Millisecond
+)
+
+// slaacAddrs 返回网卡上已经可用的 SLAAC 地址与路由通告中的默认网关.
+// 手动配置的(permanent), 临时的(RFC 4941), 还在做重复地址检测或检测失败的地址都不算.
+func slaacAddrs(link netlink.Link) (addrs []*net.IPNet, gw net.IP, err error) {
+	list, err := nl.AddrList(link, netlink.FAMILY_V6)
+	if err != nil {
+		return nil, nil, fmt.Errorf("faliled to list addresses of %s: %s", link.Attrs().Name, err)
+	}
+	skip := unix.IFA_F_PERMANENT | unix.IFA_F_TENTATIVE | unix.IFA_F_TEMPORARY | unix.IFA_F_DADFAILED
+	for _, addr := range list {
+		if !addr.IP.IsGlobalUnicast() || addr.Flags&skip != 0 {
+			continue
+		}
+		addrs = append(addrs, &net.IPNet{IP: addr.IP, Mask: addr.Mask})
+	}
+
+	routes, err := nl.RouteList(link, netlink.FAMILY_V6)
+	if err != nil {
+		return nil, nil, fmt.Errorf("faliled to list routes of %s: %s", link.Attrs().Name, err)
+	}
+	for _, route := range routes {
+		if route.Gw == nil {
+			continue
+		}
+		if route.Dst == nil {
+			return addrs, route.Gw, nil
+		}
+		if ones, _ := route.Dst.Mask.Size(); ones == 0 {
+			return addrs, route.Gw, nil
+		}
+	}
+	return addrs, nil, nil
+}
+
+// setSysctl 修改当前网络命名空间中网卡的 IPv6 sysctl
+func setSysctl(ifName, key, value string) error {
+	path := fmt.Sprintf("/proc/sys/net/ipv6/conf/%s/%s", ifName, key)
+	if err := os.WriteFile(path, []byte(value), 0644); err != nil {
+		return fmt.Errorf("failed to set sysctl net.ipv6.conf.%s.%s=%s: %v", ifName, key, value, err)
+	}
+	return nil
+}
+
+// WaitSLAAC 在 Pod 网络命名空间中开启网卡的路由通告与无状态地址自动配置, 发送路由器请求,
+// 并等待根据路由通告生成的地址. 次要网卡不接受路由通告中的默认路由, 以免与主网卡冲突.
+// 超过 timeout 仍没有地址时返回错误.
+func WaitSLAAC(netnsPath, ifName string, primary bool, timeout time.Duration) (addrs []*net.IPNet, gw net.IP, err error) {
+	if timeout <= 0 {
+		timeout = DefaultSLAACTimeout
+	}
+
+	netns, err := ns.GetNS(netnsPath)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to open netns %q: %v", netnsPath, err)
+	}
+	defer netns.Close()
+
+	err = netns.Do(func(_ ns.NetNS) (err error) {
+		link, err := nl.LinkByName(ifName)
+		if err != nil {
+			return fmt.Errorf("faliled to get %s link: %s", ifName, err)
+		}
+
+		defrtr := "1"
+		if !primary {
+			defrtr = "0"
+		}
+		sysctls := [][2]string{{"disable_ipv6", "0"}, {"accept_ra", "1"}, {"autoconf", "1"}, {"accept_ra_defrtr", defrtr}}
+		for _, kv := range sysctls {
+			if err = setSysctl(ifName, kv[0], kv[1]); err != nil {
+				return err
+			}
+		}
+
+		deadline := time.Now().Add(timeout)
+		var solicited time.Time
+		for {
+			addrs, gw, err = slaacAddrs(link)
+			if err != nil {
+				return err
+			}
+			// 主网卡还需要等到默认路由, 路由通告中的地址与默认路由几乎同时生效
+			if len(addrs) > 0 && (gw != nil || !primary) {
+				return nil
+			}
+			if time.Now().After(deadline) {
+				break
+			}
+			if time.Since(solicited) >= solicitInterval {
+				if err = cninet.SolicitRouters(link); err != nil {
+					klog.Warningf("failed to send router solicitation on %s: %s", ifName, err)
+				}
+				solicited = time.Now()
+			}
+			time.Sleep(slaacPollInterval)
+		}
+
+		if len(addrs) == 0 {
+			return fmt.Errorf("no slaac address on %s after %s, check that router advertisements with autonomous prefixes reach the pod", ifName, timeout)
+		}
+		klog.Warningf("slaac addresses on %s have no default route after %s", ifName, timeout)
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return addrs, gw, nil
+}
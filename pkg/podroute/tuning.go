@@ -0,0 +1,128 @@
+package podroute
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/vishvananda/netlink"
+	"k8s.io/klog"
+)
+
+// Pod 上可以设置的网卡调优注解, 由 cni server 读取后通过 PodResponse 传给 cni 插件
+const (
+	AnnotationMTU     = "tsunami.io/mtu"
+	AnnotationMAC     = "tsunami.io/mac"
+	AnnotationSysctls = "tsunami.io/sysctls"
+)
+
+// 以太网允许的最小 MTU
+const minMTU = 68
+
+// Tuning Pod 网卡的调优配置, 为零值的字段不做修改
+type Tuning struct {
+	MTU int
+	// MAC 在获取地址之后才修改, 使用 dhcp 获取地址的 Pod 不支持
+	MAC net.HardwareAddr
+	// Sysctls 如 net.ipv4.conf.eth0.rp_filter: "0", 只允许 net. 开头的 sysctl
+	Sysctls map[string]string
+}
+
+// NewTuning 根据 cni server 返回的字符串构造 Tuning 对象, 并校验格式
+func NewTuning(mtu int, mac string, sysctls map[string]string) (t *Tuning, err error) {
+	t = &Tuning{MTU: mtu, Sysctls: sysctls}
+
+	if mtu != 0 && (mtu < minMTU || mtu > 65535) {
+		return nil, fmt.Errorf("mtu %d is out of range", mtu)
+	}
+
+	if mac != "" {
+		if t.MAC, err = net.ParseMAC(mac); err != nil {
+			return nil, fmt.Errorf("failed to parse mac %q: %v", mac, err)
+		}
+		// 组播地址不能作为网卡地址
+		if t.MAC[0]&0x01 != 0 {
+			return nil, fmt.Errorf("mac %s is a multicast address", mac)
+		}
+	}
+
+	for key := range sysctls {
+		if !strings.HasPrefix(key, "net.") || strings.Contains(key, "..") {
+			return nil, fmt.Errorf("sysctl %q is not allowed, only net.* is namespaced", key)
+		}
+	}
+
+	return t, nil
+}
+
+// ParseTuningAnnotations 从 Pod 注解中解析调优配置, 供 cni server 使用
+// tsunami.io/sysctls 的格式为 json 对象, 如 {"net.ipv4.conf.eth0.rp_filter": "0"}
+func ParseTuningAnnotations(annotations map[string]string) (t *Tuning, err error) {
+	var mtu int
+	if v, ok := annotations[AnnotationMTU]; ok {
+		if mtu, err = strconv.Atoi(v); err != nil {
+			return nil, fmt.Errorf("failed to parse annotation %s: %v", AnnotationMTU, err)
+		}
+	}
+
+	var sysctls map[string]string
+	if v, ok := annotations[AnnotationSysctls]; ok {
+		if err = json.Unmarshal([]byte(v), &sysctls); err != nil {
+			return nil, fmt.Errorf("failed to parse annotation %s: %v", AnnotationSysctls, err)
+		}
+	}
+
+	return NewTuning(mtu, annotations[AnnotationMAC], sysctls)
+}
+
+// IsEmpty 判断是否不需要做任何修改
+func (t *Tuning) IsEmpty() bool {
+	return t == nil || (t.MTU == 0 && t.MAC == nil && len(t.Sysctls) == 0)
+}
+
+// sysctlPath 把 sysctl 名称转换为 /proc/sys 下的相对路径.
+// net.ipv4.conf.<网卡>.xxx 这类 sysctl 中的网卡名称可能带有点, 如 eth0.100, 需要保留为一级目录.
+func sysctlPath(key string) string {
+	parts := strings.Split(key, ".")
+	if len(parts) > 5 && parts[0] == "net" && (parts[1] == "ipv4" || parts[1] == "ipv6") &&
+		(parts[2] == "conf" || parts[2] == "neigh") {
+		ifName := strings.Join(parts[3:len(parts)-1], ".")
+		parts = append(parts[:3], ifName, parts[len(parts)-1])
+	}
+	return strings.Join(parts, "/")
+}
+
+// applyTuning 在 Pod 网络命名空间中修改网卡的 MAC, MTU 与 sysctl
+func applyTuning(link netlink.Link, t *Tuning) (err error) {
+	name := link.Attrs().Name
+
+	// veth 设备支持在 up 状态下修改 MAC, 不会导致已有路由被删除
+	if t.MAC != nil {
+		if err = nl.LinkSetHardwareAddr(link, t.MAC); err != nil {
+			return fmt.Errorf("failed to set mac of %s to %s: %v", name, t.MAC, err)
+		}
+		klog.V(3).Infof("set mac of %s to %s", name, t.MAC)
+	}
+
+	if t.MTU != 0 {
+		if err = nl.LinkSetMTU(link, t.MTU); err != nil {
+			return fmt.Errorf("failed to set mtu of %s to %d: %v", name, t.MTU, err)
+		}
+		klog.V(3).Infof("set mtu of %s to %d", name, t.MTU)
+	}
+
+	// /proc/sys/net 下的内容与打开文件的线程所在的网络命名空间对应
+	for key, value := range t.Sysctls {
+		path := filepath.Join("/proc/sys", sysctlPath(key))
+		if err = os.WriteFile(path, []byte(value), 0644); err != nil {
+			return fmt.Errorf("failed to set sysctl %s=%s: %v", key, value, err)
+		}
+		klog.V(3).Infof("set sysctl %s=%s", key, value)
+	}
+
+	return nil
+}
@@ -0,0 +1,51 @@
+package podroute
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/containernetworking/plugins/pkg/ns"
+)
+
+// VethInfo Pod 网卡及其在宿主机上的对端
+type VethInfo struct {
+	PodMAC net.HardwareAddr
+	// HostVeth 宿主机一侧 veth 设备的名称, 即网桥上对应的端口
+	HostVeth  string
+	HostIndex int
+}
+
+// GetVethInfo 获取 Pod 网卡的 MAC, 以及宿主机一侧 veth 设备的名称
+func GetVethInfo(netnsPath, ifName string) (info *VethInfo, err error) {
+	netns, err := ns.GetNS(netnsPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open netns %q: %v", netnsPath, err)
+	}
+	defer netns.Close()
+
+	info = &VethInfo{}
+	err = netns.Do(func(_ ns.NetNS) (err error) {
+		link, err := nl.LinkByName(ifName)
+		if err != nil {
+			return fmt.Errorf("faliled to get %s link: %s", ifName, err)
+		}
+		info.PodMAC = link.Attrs().HardwareAddr
+		// veth 设备的 IFLA_LINK 属性为对端的索引
+		info.HostIndex = link.Attrs().ParentIndex
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if info.HostIndex == 0 {
+		return nil, fmt.Errorf("%s in pod is not a veth device", ifName)
+	}
+	hostLink, err := nl.LinkByIndex(info.HostIndex)
+	if err != nil {
+		return nil, fmt.Errorf("faliled to get host veth of pod: %s", err)
+	}
+	info.HostVeth = hostLink.Attrs().Name
+
+	return info, nil
+}
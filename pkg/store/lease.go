@@ -0,0 +1,124 @@
+package store
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gitlayzer/tsunami/utils/utilfile"
+)
+
+// Lease 内置 dhcp 守护进程持有的租约, 每次获取与续租后写入, 释放后删除.
+// daemon 重启后据此继续续租.
+type Lease struct {
+	ContainerID  string `json:"container_id"`
+	Network      string `json:"network"`
+	IfName       string `json:"if_name"`
+	PodName      string `json:"pod_name,omitempty"`
+	PodNamespace string `json:"pod_namespace,omitempty"`
+	NetNs        string `json:"net_ns"`
+	MAC          string `json:"mac"`
+	// IPAddress 点分十进制+掩码字符串, 如`192.168.0.1/24`
+	IPAddress string `json:"address"`
+	Gateway   string `json:"gateway,omitempty"`
+	Server    string `json:"server,omitempty"`
+	// ServerMAC 续租时单播的目的 MAC
+	ServerMAC  string    `json:"server_mac,omitempty"`
+	AcquiredAt time.Time `json:"acquired_at"`
+	// RenewAt, RebindAt 即 T1, T2 对应的时间, ExpiresAt 为零值表示永久租约
+	RenewAt   time.Time `json:"renew_at"`
+	RebindAt  time.Time `json:"rebind_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+	// ClientConf 获取租约时使用的 dhcp 客户端配置, 续租时沿用
+	ClientConf json.RawMessage `json:"client_conf,omitempty"`
+	// Family 为 FamilyIPv6 时是 DHCPv6 的租约, ServerID 为服务器 DUID 的十六进制
+	Family   string `json:"family,omitempty"`
+	ServerID string `json:"server_id,omitempty"`
+}
+
+// FamilyIPv6 DHCPv6 租约记录的 Family, DHCPv4 的记录为空
+const FamilyIPv6 = "ipv6"
+
+// Expired 判断租约在 now 时是否已经过期
+func (l *Lease) Expired(now time.Time) bool {
+	return !l.ExpiresAt.IsZero() && !now.Before(l.ExpiresAt)
+}
+
+func (s *Store) leasesDir() string {
+	return filepath.Join(s.dir, "leases")
+}
+
+func (s *Store) leasePath(containerID, network, ifName, family string) string {
+	if family != "" {
+		return filepath.Join(s.leasesDir(), fmt.Sprintf("%s_%s_%s_%s.json", containerID, network, ifName, family))
+	}
+	return filepath.Join(s.leasesDir(), fmt.Sprintf("%s_%s_%s.json", containerID, network, ifName))
+}
+
+// SaveLease 写入(或覆盖) 租约记录
+func (s *Store) SaveLease(l *Lease) (err error) {
+	content, err := json.Marshal(l)
+	if err != nil {
+		return fmt.Errorf("failed to marshal lease: %v", err)
+	}
+
+	if err = utilfile.WriteFileAtomic(s.leasePath(l.ContainerID, l.Network, l.IfName, l.Family), content, 0644); err != nil {
+		return fmt.Errorf("failed to write lease: %v", err)
+	}
+
+	return
+}
+
+// DeleteLease 删除租约记录, 记录不存在时不报错
+func (s *Store) DeleteLease(containerID, network, ifName, family string) (err error) {
+	err = os.Remove(s.leasePath(containerID, network, ifName, family))
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove lease: %v", err)
+	}
+
+	return nil
+}
+
+// ListLeases 列出所有租约记录, 按 Pod 命名空间/名称排序
+func (s *Store) ListLeases() (list []*Lease, err error) {
+	entries, err := os.ReadDir(s.leasesDir())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to read lease dir: %v", err)
+	}
+
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".json") {
+			continue
+		}
+
+		content, err := os.ReadFile(filepath.Join(s.leasesDir(), entry.Name()))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read lease %s: %v", entry.Name(), err)
+		}
+
+		l := &Lease{}
+		if err = json.Unmarshal(content, l); err != nil {
+			return nil, fmt.Errorf("failed to parse lease %s: %v", entry.Name(), err)
+		}
+		list = append(list, l)
+	}
+
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].PodNamespace != list[j].PodNamespace {
+			return list[i].PodNamespace < list[j].PodNamespace
+		}
+		if list[i].PodName != list[j].PodName {
+			return list[i].PodName < list[j].PodName
+		}
+		return list[i].IfName < list[j].IfName
+	})
+
+	return
+}
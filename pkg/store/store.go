@@ -0,0 +1,189 @@
+package store
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gitlayzer/tsunami/utils/restapi"
+	"github.com/gitlayzer/tsunami/utils/utilfile"
+)
+
+// DefaultDir 本地状态目录, CNI 插件与 daemon 共享(daemon 以 hostPath 方式挂载)
+const DefaultDir = "/var/lib/cni/tsunami"
+
+// IP 地址的来源
+const (
+	SourceDHCP   = "dhcp"
+	SourceStatic = "static"
+	// SourceFallback dhcp 超时后由 cni server 从 IPPool 的备用范围中分配
+	SourceFallback = "fallback"
+)
+
+// Attachment 记录一次 cmdAdd 为 Pod 部署的网络信息.
+// 由 CNI 插件在 cmdAdd 成功后写入, cmdDel 时删除, daemon 只读取.
+type Attachment struct {
+	ContainerID  string `json:"container_id"`
+	IfName       string `json:"if_name"`
+	PodName      string `json:"pod_name"`
+	PodNamespace string `json:"pod_namespace"`
+	NetNs        string `json:"net_ns"`
+	Bridge       string `json:"bridge"`
+	// HostVeth Pod veth 设备在宿主机上的一端
+	HostVeth string `json:"host_veth,omitempty"`
+	MAC      string `json:"mac,omitempty"`
+	// IPAddress 点分十进制+掩码字符串, 如`192.168.0.1/24`
+	IPAddress string `json:"address"`
+	Gateway   string `json:"gateway,omitempty"`
+	// IPs 网卡上的全部地址(带掩码), 双栈时包含 IPv6 地址, 为空时只有 IPAddress
+	IPs []string `json:"ips,omitempty"`
+	// Source IP 地址的来源, dhcp, static 或 fallback
+	Source string `json:"source"`
+	// Routes 在 Pod 中额外添加的路由, cmdDel 时移除, cmdCheck 时检查
+	Routes []restapi.RouteSpec `json:"routes,omitempty"`
+	// Bandwidth 在 Pod 网卡与宿主机 veth 上设置的带宽限制, cmdDel 时移除
+	Bandwidth *restapi.BandwidthSpec `json:"bandwidth,omitempty"`
+	// PortMappings 由 daemon 添加的 HostPort 映射, cmdDel 时移除
+	PortMappings []restapi.PortMapping `json:"port_mappings,omitempty"`
+	CreatedAt    time.Time             `json:"created_at"`
+}
+
+// AllIPs 返回网卡上的全部地址(不带掩码)
+func (a *Attachment) AllIPs() (ips []net.IP) {
+	addrs := a.IPs
+	if len(addrs) == 0 && a.IPAddress != "" {
+		addrs = []string{a.IPAddress}
+	}
+	for _, addr := range addrs {
+		if ip, _, err := net.ParseCIDR(addr); err == nil {
+			ips = append(ips, ip)
+		}
+	}
+	return ips
+}
+
+// Store 基于目录的 Attachment 存储, 每个 Attachment 对应一个 json 文件
+type Store struct {
+	dir string
+}
+
+// New 创建 Store 对象, dir 为空时使用 DefaultDir
+func New(dir string) *Store {
+	if dir == "" {
+		dir = DefaultDir
+	}
+	return &Store{dir: dir}
+}
+
+// Dir 返回 Store 使用的目录
+func (s *Store) Dir() string {
+	return s.dir
+}
+
+func (s *Store) podsDir() string {
+	return filepath.Join(s.dir, "pods")
+}
+
+func (s *Store) path(containerID, ifName string) string {
+	return filepath.Join(s.podsDir(), fmt.Sprintf("%s_%s.json", containerID, ifName))
+}
+
+// Save 写入(或覆盖) Attachment 记录
+func (s *Store) Save(a *Attachment) (err error) {
+	content, err := json.Marshal(a)
+	if err != nil {
+		return fmt.Errorf("failed to marshal attachment: %v", err)
+	}
+
+	if err = utilfile.WriteFileAtomic(s.path(a.ContainerID, a.IfName), content, 0644); err != nil {
+		return fmt.Errorf("failed to write attachment: %v", err)
+	}
+
+	return
+}
+
+// Load 读取指定容器与接口的 Attachment 记录
+func (s *Store) Load(containerID, ifName string) (a *Attachment, err error) {
+	content, err := os.ReadFile(s.path(containerID, ifName))
+	if err != nil {
+		return nil, err
+	}
+
+	a = &Attachment{}
+	if err = json.Unmarshal(content, a); err != nil {
+		return nil, fmt.Errorf("failed to parse attachment: %v", err)
+	}
+
+	return
+}
+
+// Delete 删除 Attachment 记录, 记录不存在时不报错(cmdDel 可能被重复调用)
+func (s *Store) Delete(containerID, ifName string) (err error) {
+	err = os.Remove(s.path(containerID, ifName))
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove attachment: %v", err)
+	}
+
+	return nil
+}
+
+// List 列出所有 Attachment 记录, 按 Pod 命名空间/名称排序
+func (s *Store) List() (list []*Attachment, err error) {
+	entries, err := os.ReadDir(s.podsDir())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to read store dir: %v", err)
+	}
+
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".json") {
+			continue
+		}
+
+		content, err := os.ReadFile(filepath.Join(s.podsDir(), entry.Name()))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read attachment %s: %v", entry.Name(), err)
+		}
+
+		a := &Attachment{}
+		if err = json.Unmarshal(content, a); err != nil {
+			return nil, fmt.Errorf("failed to parse attachment %s: %v", entry.Name(), err)
+		}
+		list = append(list, a)
+	}
+
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].PodNamespace != list[j].PodNamespace {
+			return list[i].PodNamespace < list[j].PodNamespace
+		}
+		if list[i].PodName != list[j].PodName {
+			return list[i].PodName < list[j].PodName
+		}
+		return list[i].IfName < list[j].IfName
+	})
+
+	return
+}
+
+// FindPod 根据 Pod 命名空间与名称查找 Attachment 记录
+func (s *Store) FindPod(namespace, name string) (found []*Attachment, err error) {
+	list, err := s.List()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, a := range list {
+		if a.PodNamespace == namespace && a.PodName == name {
+			found = append(found, a)
+		}
+	}
+
+	return
+}
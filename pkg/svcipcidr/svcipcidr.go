@@ -2,8 +2,12 @@ package svcipcidr
 
 import (
 	"context"
+	"fmt"
+	"net"
+	"sort"
 	"strings"
 
+	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/labels"
 	clientset "k8s.io/client-go/kubernetes"
@@ -11,48 +15,117 @@ import (
 	"k8s.io/klog"
 )
 
-// GetServiceIPCIDR 从 apiserver 组件对象中获取 service IP CIDR
-func GetServiceIPCIDR() (serviceIPCIDR string, err error) {
+// serviceCIDRFlag kube-apiserver 中指定 service IP CIDR 的参数
+const serviceCIDRFlag = "--service-cluster-ip-range"
+
+// Discoverer 从 kube-apiserver Pod 的启动参数中获取 service IP CIDR
+type Discoverer struct {
+	client clientset.Interface
+}
+
+// NewDiscoverer 创建 Discoverer, client 可以是 client-go 中的 fake clientset
+func NewDiscoverer(client clientset.Interface) *Discoverer {
+	return &Discoverer{client: client}
+}
+
+// NewInClusterDiscoverer 使用 Pod 中的 ServiceAccount 创建 Discoverer
+func NewInClusterDiscoverer() (*Discoverer, error) {
 	cfg, err := rest.InClusterConfig()
 	if err != nil {
-		klog.Errorf("failed to get in cluster config: %v", err)
-		return "", err
+		return nil, fmt.Errorf("failed to get in cluster config: %v", err)
 	}
 
 	// 创建 clientset 客户端
 	client, err := clientset.NewForConfig(cfg)
 	if err != nil {
-		klog.Errorf("failed to create clientset: %v", err)
-		return "", err
+		return nil, fmt.Errorf("failed to create clientset: %v", err)
 	}
+	return NewDiscoverer(client), nil
+}
 
+// ServiceIPCIDR 从 kube-system 中的 kube-apiserver Pod 获取 service IP CIDR.
+// 参数可以在容器的 command 或 args 中, 格式可以是 `--flag=value` 或 `--flag value`.
+// 有多个副本时优先使用 Running 状态的 Pod, 副本之间的配置不一致时使用第一个并打印警告.
+// 双栈集群中参数的值为逗号分隔的多个 CIDR, 只返回第一个.
+func (d *Discoverer) ServiceIPCIDR(ctx context.Context) (serviceIPCIDR string, err error) {
 	// 设置一个 获取 kube-apiserver pod 的 label
 	labelSet := labels.Set{
 		"component": "kube-apiserver",
 	}
 
 	// 使用 labelSelector 获取 kube-apiserver Pod
-	podListOpts := metav1.ListOptions{
+	podList, err := d.client.CoreV1().Pods(metav1.NamespaceSystem).List(ctx, metav1.ListOptions{
 		LabelSelector: labelSet.String(),
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to list kube-apiserver pods: %v", err)
+	}
+	if len(podList.Items) == 0 {
+		return "", fmt.Errorf("no kube-apiserver pod found in %s", metav1.NamespaceSystem)
 	}
 
-	// 获取 kube-apiserver Pod
-	podList, err := client.CoreV1().Pods("kube-system").List(context.Background(), podListOpts)
-	if err != nil {
-		klog.Errorf("failed to list pods: %v", err)
-		return "", err
+	pods := podList.Items
+	sort.SliceStable(pods, func(i, j int) bool {
+		ri, rj := pods[i].Status.Phase == corev1.PodRunning, pods[j].Status.Phase == corev1.PodRunning
+		if ri != rj {
+			return ri
+		}
+		return pods[i].Name < pods[j].Name
+	})
+
+	var from string
+	for i := range pods {
+		value, ok := flagValue(&pods[i], serviceCIDRFlag)
+		if !ok {
+			klog.Warningf("flag %s not found in pod %s", serviceCIDRFlag, pods[i].Name)
+			continue
+		}
+		if serviceIPCIDR == "" {
+			serviceIPCIDR, from = value, pods[i].Name
+		} else if value != serviceIPCIDR {
+			klog.Warningf("service ip cidr %s in pod %s differs from %s in pod %s, use the latter", value, pods[i].Name, serviceIPCIDR, from)
+		}
+	}
+	if serviceIPCIDR == "" {
+		return "", fmt.Errorf("flag %s not found in kube-apiserver pods", serviceCIDRFlag)
+	}
+
+	serviceIPCIDR = strings.TrimSpace(strings.Split(serviceIPCIDR, ",")[0])
+	if _, _, err = net.ParseCIDR(serviceIPCIDR); err != nil {
+		return "", fmt.Errorf("invalid service ip cidr %q in pod %s: %v", serviceIPCIDR, from, err)
 	}
 
-	// 遍历 kube-apiserver Pod 的命令行参数，获取 service IP CIDR
-	pod := podList.Items[0]
-	cmds := pod.Spec.Containers[0].Command
-	for _, cmd := range cmds {
-		if strings.Contains(cmd, "service-cluster-ip-range") {
-			// 获取 service IP CIDR 后, 退出循环
-			serviceIPCIDR = strings.Split(cmd, "=")[1]
-			break
+	return serviceIPCIDR, nil
+}
+
+// flagValue 在 Pod 所有容器的 command 与 args 中查找参数的值.
+// 以 `sh -c "kube-apiserver --flag=value"` 方式启动时参数在同一个字符串中, 因此按空白字符拆分后再查找.
+func flagValue(pod *corev1.Pod, flag string) (value string, ok bool) {
+	for _, c := range pod.Spec.Containers {
+		var fields []string
+		for _, arg := range append(append([]string{}, c.Command...), c.Args...) {
+			fields = append(fields, strings.Fields(arg)...)
+		}
+
+		for i, field := range fields {
+			if strings.HasPrefix(field, flag+"=") {
+				return strings.TrimPrefix(field, flag+"="), true
+			}
+			if field == flag && i+1 < len(fields) {
+				return fields[i+1], true
+			}
 		}
 	}
+	return "", false
+}
+
+// GetServiceIPCIDR 从 apiserver 组件对象中获取 service IP CIDR
+func GetServiceIPCIDR() (serviceIPCIDR string, err error) {
+	d, err := NewInClusterDiscoverer()
+	if err != nil {
+		klog.Errorf("failed to create service ip cidr discoverer: %v", err)
+		return "", err
+	}
 
-	return
+	return d.ServiceIPCIDR(context.Background())
 }
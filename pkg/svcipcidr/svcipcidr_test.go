@@ -0,0 +1,137 @@
+package svcipcidr
+
+import (
+	"context"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+// apiserverPod 构造 kubeadm 方式部署的 kube-apiserver 静态 Pod
+func apiserverPod(name string, phase corev1.PodPhase, command, args []string) *corev1.Pod {
+	return &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: metav1.NamespaceSystem,
+			Labels:    map[string]string{"component": "kube-apiserver", "tier": "control-plane"},
+		},
+		Spec: corev1.PodSpec{
+			Containers: []corev1.Container{{Name: "kube-apiserver", Command: command, Args: args}},
+		},
+		Status: corev1.PodStatus{Phase: phase},
+	}
+}
+
+func TestServiceIPCIDR(t *testing.T) {
+	tests := []struct {
+		name    string
+		objects []runtime.Object
+		want    string
+		wantErr bool
+	}{
+		{
+			name:    "no apiserver pods",
+			objects: []runtime.Object{},
+			wantErr: true,
+		},
+		{
+			name: "pods with other labels are ignored",
+			objects: []runtime.Object{&corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{Name: "etcd-master", Namespace: metav1.NamespaceSystem, Labels: map[string]string{"component": "etcd"}},
+				Spec: corev1.PodSpec{Containers: []corev1.Container{{
+					Command: []string{"etcd", "--service-cluster-ip-range=10.0.0.0/16"},
+				}}},
+			}},
+			wantErr: true,
+		},
+		{
+			name: "flag in command with equal sign",
+			objects: []runtime.Object{apiserverPod("kube-apiserver-master", corev1.PodRunning,
+				[]string{"kube-apiserver", "--advertise-address=192.168.1.10", "--service-cluster-ip-range=10.96.0.0/12"}, nil)},
+			want: "10.96.0.0/12",
+		},
+		{
+			name: "flag in args with separate value",
+			objects: []runtime.Object{apiserverPod("kube-apiserver-master", corev1.PodRunning,
+				[]string{"kube-apiserver"}, []string{"--secure-port=6443", "--service-cluster-ip-range", "10.100.0.0/16"})},
+			want: "10.100.0.0/16",
+		},
+		{
+			name: "flag in shell command",
+			objects: []runtime.Object{apiserverPod("kube-apiserver-master", corev1.PodRunning,
+				[]string{"/bin/sh", "-c", "exec kube-apiserver --service-cluster-ip-range 10.32.0.0/24 --v=2"}, nil)},
+			want: "10.32.0.0/24",
+		},
+		{
+			name: "similar flag names do not match",
+			objects: []runtime.Object{apiserverPod("kube-apiserver-master", corev1.PodRunning,
+				[]string{"kube-apiserver", "--secondary-service-cluster-ip-range=fd00::/108"}, nil)},
+			wantErr: true,
+		},
+		{
+			name: "flag without value",
+			objects: []runtime.Object{apiserverPod("kube-apiserver-master", corev1.PodRunning,
+				[]string{"kube-apiserver", "--service-cluster-ip-range"}, nil)},
+			wantErr: true,
+		},
+		{
+			name: "invalid cidr",
+			objects: []runtime.Object{apiserverPod("kube-apiserver-master", corev1.PodRunning,
+				[]string{"kube-apiserver", "--service-cluster-ip-range=10.96.0.0"}, nil)},
+			wantErr: true,
+		},
+		{
+			name: "dual stack",
+			objects: []runtime.Object{apiserverPod("kube-apiserver-master", corev1.PodRunning,
+				[]string{"kube-apiserver", "--service-cluster-ip-range=10.96.0.0/12,fd00:10:96::/112"}, nil)},
+			want: "10.96.0.0/12",
+		},
+		{
+			name: "multiple replicas",
+			objects: []runtime.Object{
+				apiserverPod("kube-apiserver-master-1", corev1.PodRunning, []string{"kube-apiserver", "--service-cluster-ip-range=10.96.0.0/12"}, nil),
+				apiserverPod("kube-apiserver-master-2", corev1.PodRunning, []string{"kube-apiserver"}, []string{"--service-cluster-ip-range=10.96.0.0/12"}),
+				apiserverPod("kube-apiserver-master-3", corev1.PodRunning, []string{"kube-apiserver", "--service-cluster-ip-range", "10.96.0.0/12"}, nil),
+			},
+			want: "10.96.0.0/12",
+		},
+		{
+			name: "multiple replicas prefer running pods",
+			objects: []runtime.Object{
+				apiserverPod("kube-apiserver-master-1", corev1.PodPending, []string{"kube-apiserver", "--service-cluster-ip-range=10.200.0.0/16"}, nil),
+				apiserverPod("kube-apiserver-master-2", corev1.PodRunning, []string{"kube-apiserver", "--service-cluster-ip-range=10.96.0.0/12"}, nil),
+			},
+			want: "10.96.0.0/12",
+		},
+		{
+			name: "multiple replicas with flag missing on one",
+			objects: []runtime.Object{
+				apiserverPod("kube-apiserver-master-1", corev1.PodRunning, []string{"kube-apiserver"}, nil),
+				apiserverPod("kube-apiserver-master-2", corev1.PodRunning, []string{"kube-apiserver", "--service-cluster-ip-range=10.96.0.0/12"}, nil),
+			},
+			want: "10.96.0.0/12",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := fake.NewSimpleClientset(tt.objects...)
+			got, err := NewDiscoverer(client).ServiceIPCIDR(context.Background())
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("expected error, got %q", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,319 @@
+//go:build integration
+
+// Package integration 在真实的网络命名空间中测试桥接网络的部署与 cni 插件的 ADD/DEL 流程.
+// 需要 root 权限, 运行方式见 README 中的集成测试一节.
+package integration
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/containernetworking/cni/pkg/types/current"
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/containernetworking/plugins/pkg/testutils"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// 宿主机网络的固定参数, 与 dhcp 替身分配的地址处于同一网段
+const (
+	bridgeName = "tsunami-br0"
+	uplinkName = "uplink0"
+	uplinkAddr = "10.99.0.2/24"
+	gatewayIP  = "10.99.0.1"
+	staticDst  = "10.98.0.0/16"
+	staticGw   = "10.99.0.254"
+	serviceDst = "10.96.0.0/12"
+)
+
+// pluginPath 编译好的 cni-tsunami 插件所在的目录, 同时作为 CNI_PATH 的第一个目录
+var pluginPath string
+
+func TestMain(m *testing.M) {
+	if os.Geteuid() != 0 {
+		fmt.Println("skip integration tests: root privileges are required")
+		os.Exit(0)
+	}
+
+	dir, err := os.MkdirTemp("", "tsunami-integration")
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	pluginPath = dir
+
+	// 插件二进制的名称需要与 netconf 中的 type 一致
+	build := exec.Command("go", "build", "-o", filepath.Join(dir, "cni-tsunami"), "github.com/gitlayzer/tsunami/cmd/cni")
+	build.Stdout, build.Stderr = os.Stdout, os.Stderr
+	if err = build.Run(); err != nil {
+		fmt.Printf("failed to build cni plugin: %v\n", err)
+		os.RemoveAll(dir)
+		os.Exit(1)
+	}
+
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+// newNS 创建一个网络命名空间, 测试结束时删除
+func newNS(t *testing.T) ns.NetNS {
+	t.Helper()
+	netns, err := testutils.NewNS()
+	if err != nil {
+		t.Fatalf("failed to create netns: %v", err)
+	}
+	t.Cleanup(func() {
+		netns.Close()
+		testutils.UnmountNS(netns)
+	})
+	return netns
+}
+
+// withNS 在网络命名空间中执行 fn, 出错时结束测试
+func withNS(t *testing.T, netns ns.NetNS, fn func() error) {
+	t.Helper()
+	if err := netns.Do(func(ns.NetNS) error { return fn() }); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// newHost 创建作为宿主机的网络命名空间, 其中的 dummy 网卡充当物理网卡,
+// 配置与 dhcp 获取到的一致: 一个地址, 默认路由与一条静态路由
+func newHost(t *testing.T) ns.NetNS {
+	t.Helper()
+	host := newNS(t)
+
+	withNS(t, host, func() (err error) {
+		lo, err := netlink.LinkByName("lo")
+		if err != nil {
+			return err
+		}
+		if err = netlink.LinkSetUp(lo); err != nil {
+			return err
+		}
+
+		// 内核没有 dummy 模块时, 使用对端留在宿主机中的 veth 代替
+		var uplink netlink.Link = &netlink.Dummy{LinkAttrs: netlink.LinkAttrs{Name: uplinkName}}
+		if err = netlink.LinkAdd(uplink); errors.Is(err, unix.EOPNOTSUPP) {
+			peer := uplinkName + "-peer"
+			uplink = &netlink.Veth{LinkAttrs: netlink.LinkAttrs{Name: uplinkName}, PeerName: peer}
+			if err = netlink.LinkAdd(uplink); err != nil {
+				return err
+			}
+			if err = netlink.LinkSetUp(&netlink.Veth{LinkAttrs: netlink.LinkAttrs{Name: peer}}); err != nil {
+				return err
+			}
+		}
+		if err != nil {
+			return err
+		}
+		if err = netlink.LinkSetUp(uplink); err != nil {
+			return err
+		}
+		addr, _ := netlink.ParseAddr(uplinkAddr)
+		if err = netlink.AddrAdd(uplink, addr); err != nil {
+			return err
+		}
+
+		_, dst, _ := net.ParseCIDR(staticDst)
+		routes := []*netlink.Route{
+			{LinkIndex: uplink.Attrs().Index, Gw: net.ParseIP(gatewayIP), Protocol: unix.RTPROT_DHCP, Src: addr.IP, Priority: 100},
+			{LinkIndex: uplink.Attrs().Index, Dst: dst, Gw: net.ParseIP(staticGw)},
+		}
+		for _, r := range routes {
+			if err = netlink.RouteAdd(r); err != nil {
+				return fmt.Errorf("failed to add route %s: %v", r, err)
+			}
+		}
+		return nil
+	})
+	return host
+}
+
+// linkState 网卡上的 IPv4 地址与 main 表路由, 路由中不包含网卡索引, 便于比较不同网卡上的配置
+type linkState struct {
+	Addrs  []string
+	Routes []string
+}
+
+// getLinkState 获取网卡的状态, 需要在网卡所在的网络命名空间中调用
+func getLinkState(name string) (s linkState, err error) {
+	link, err := netlink.LinkByName(name)
+	if err != nil {
+		return s, err
+	}
+
+	addrs, err := netlink.AddrList(link, netlink.FAMILY_V4)
+	if err != nil {
+		return s, err
+	}
+	for _, a := range addrs {
+		s.Addrs = append(s.Addrs, a.IPNet.String())
+	}
+
+	routes, err := netlink.RouteList(link, netlink.FAMILY_V4)
+	if err != nil {
+		return s, err
+	}
+	for _, r := range routes {
+		s.Routes = append(s.Routes, (&netlink.Route{
+			Dst: r.Dst, Gw: r.Gw, Src: r.Src, Scope: r.Scope, Protocol: r.Protocol, Priority: r.Priority,
+		}).String())
+	}
+	sort.Strings(s.Addrs)
+	sort.Strings(s.Routes)
+	return s, nil
+}
+
+func (s linkState) String() string {
+	return fmt.Sprintf("addrs: %v, routes: %v", s.Addrs, s.Routes)
+}
+
+func (s linkState) equal(o linkState) bool {
+	return s.String() == o.String()
+}
+
+// stateIn 在网络命名空间中获取网卡的状态
+func stateIn(t *testing.T, netns ns.NetNS, name string) (s linkState) {
+	t.Helper()
+	withNS(t, netns, func() (err error) {
+		s, err = getLinkState(name)
+		return err
+	})
+	return s
+}
+
+// netConf 生成 cni-tsunami 的配置, ipam 使用 dhcp, 通过 dhcp 替身分配地址
+func netConf(serverSocket, dhcpSocket string) []byte {
+	conf := map[string]interface{}{
+		"cniVersion":     "0.3.1",
+		"name":           "mycninet",
+		"type":           "cni-tsunami",
+		"serviceIPCIDR":  serviceDst,
+		"server_socket":  serverSocket,
+		"probeTimeoutMs": 200,
+		"dns": map[string]interface{}{
+			"nameservers": []string{"10.96.0.10"},
+			"search":      []string{"svc.cluster.local"},
+		},
+		"delegate": map[string]interface{}{
+			"cniVersion":  "0.3.1",
+			"name":        "mycninet",
+			"type":        "bridge",
+			"bridge":      bridgeName,
+			"hairpinMode": true,
+			"ipam": map[string]interface{}{
+				"type":             "dhcp",
+				"daemonSocketPath": dhcpSocket,
+			},
+		},
+	}
+	content, _ := json.Marshal(conf)
+	return content
+}
+
+// pod 一次 cni 调用对应的 Pod
+type pod struct {
+	Name        string
+	Namespace   string
+	ContainerID string
+	IfName      string
+	NetNS       ns.NetNS
+}
+
+// runCNI 在宿主机网络命名空间中执行 cni 插件, 返回插件的标准输出
+func runCNI(host ns.NetNS, command string, p *pod, conf []byte) (out []byte, err error) {
+	netnsPath := ""
+	if p.NetNS != nil {
+		netnsPath = p.NetNS.Path()
+	}
+	cniPath := pluginPath
+	if extra := os.Getenv("CNI_PATH"); extra != "" {
+		cniPath += string(os.PathListSeparator) + extra
+	}
+
+	err = host.Do(func(ns.NetNS) error {
+		// 子进程继承当前线程的网络命名空间, ns.Do 中的线程是锁定的
+		cmd := exec.Command(filepath.Join(pluginPath, "cni-tsunami"))
+		cmd.Env = append(os.Environ(),
+			"CNI_COMMAND="+command,
+			"CNI_CONTAINERID="+p.ContainerID,
+			"CNI_NETNS="+netnsPath,
+			"CNI_IFNAME="+p.IfName,
+			"CNI_PATH="+cniPath,
+			fmt.Sprintf("CNI_ARGS=IgnoreUnknown=1;K8S_POD_NAMESPACE=%s;K8S_POD_NAME=%s;K8S_POD_INFRA_CONTAINER_ID=%s",
+				p.Namespace, p.Name, p.ContainerID),
+		)
+		cmd.Stdin = bytes.NewReader(conf)
+		var stdout, stderr bytes.Buffer
+		cmd.Stdout, cmd.Stderr = &stdout, &stderr
+		if runErr := cmd.Run(); runErr != nil {
+			return fmt.Errorf("cni %s failed: %v\nstdout: %s\nstderr: %s", command, runErr, stdout.String(), lastLines(stderr.String(), 20))
+		}
+		out = stdout.Bytes()
+		return nil
+	})
+	return out, err
+}
+
+// lastLines 返回最后 n 行, 插件的日志较多
+func lastLines(s string, n int) string {
+	lines := strings.Split(strings.TrimRight(s, "\n"), "\n")
+	if len(lines) > n {
+		lines = lines[len(lines)-n:]
+	}
+	return strings.Join(lines, "\n")
+}
+
+// cniAdd 执行 ADD 并解析结果
+func cniAdd(t *testing.T, host ns.NetNS, p *pod, conf []byte) *current.Result {
+	t.Helper()
+	out, err := runCNI(host, "ADD", p, conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err := current.NewResult(out)
+	if err != nil {
+		t.Fatalf("failed to parse result %s: %v", out, err)
+	}
+	// 结果的版本需要与配置一致, current.Result 的 Version() 总是返回 0.4.0, 因此读取原始的字段
+	version := struct {
+		CNIVersion string `json:"cniVersion"`
+	}{}
+	if err = json.Unmarshal(out, &version); err != nil || version.CNIVersion != "0.3.1" {
+		t.Fatalf("result version %q, want 0.3.1: %v", version.CNIVersion, err)
+	}
+	res, err := current.NewResultFromResult(result)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return res
+}
+
+// cniDel 执行 DEL
+func cniDel(t *testing.T, host ns.NetNS, p *pod, conf []byte) {
+	t.Helper()
+	if _, err := runCNI(host, "DEL", p, conf); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// hasBinary 判断 CNI_PATH 中是否存在指定的插件
+func hasBinary(name string) bool {
+	for _, dir := range filepath.SplitList(os.Getenv("CNI_PATH")) {
+		if _, err := os.Stat(filepath.Join(dir, name)); err == nil {
+			return true
+		}
+	}
+	return false
+}
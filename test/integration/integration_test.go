@@ -0,0 +1,334 @@
+//go:build integration
+
+package integration
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/containernetworking/cni/pkg/types/current"
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/containernetworking/plugins/pkg/testutils"
+	"github.com/gitlayzer/tsunami/pkg/bridge"
+	"github.com/gitlayzer/tsunami/pkg/store"
+	"github.com/vishvananda/netlink"
+)
+
+// installBridge 在宿主机网络命名空间中部署桥接网络
+func installBridge(t *testing.T, host ns.NetNS) {
+	t.Helper()
+	on, ageing := true, uint32(300)
+	opts := &bridge.Options{MulticastSnooping: &on, AgeingTime: &ageing}
+	withNS(t, host, func() error {
+		return bridge.InstallBridgeNetwork(bridgeName, uplinkName, opts)
+	})
+}
+
+// containerID 生成随机的容器 ID
+func containerID(t *testing.T) string {
+	t.Helper()
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		t.Fatal(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// newPod 创建 Pod 及其网络命名空间, 测试结束时清理 store 中可能残留的记录
+func newPod(t *testing.T, name string) *pod {
+	p := &pod{
+		Name:        name,
+		Namespace:   "default",
+		ContainerID: containerID(t),
+		IfName:      "eth0",
+		NetNS:       newNS(t),
+	}
+	t.Cleanup(func() { store.New(store.DefaultDir).Delete(p.ContainerID, p.IfName) })
+	return p
+}
+
+// removeNetNS 删除 Pod 的网络命名空间, 与 kubelet 在 DEL 之后销毁 sandbox 一致
+func removeNetNS(t *testing.T, p *pod) {
+	t.Helper()
+	p.NetNS.Close()
+	if err := testutils.UnmountNS(p.NetNS); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestInstallUninstallBridgeNetwork(t *testing.T) {
+	host := newHost(t)
+	before := stateIn(t, host, uplinkName)
+
+	// 重复部署不改变结果, daemon 重启时会再次调用
+	for i := 0; i < 2; i++ {
+		installBridge(t, host)
+
+		if got := stateIn(t, host, bridgeName); !got.equal(before) {
+			t.Fatalf("install #%d: bridge should take over uplink config\nwant: %s\ngot:  %s", i+1, before, got)
+		}
+		if got := stateIn(t, host, uplinkName); len(got.Addrs) != 0 || len(got.Routes) != 0 {
+			t.Fatalf("install #%d: uplink should have no addresses or routes left: %s", i+1, got)
+		}
+	}
+
+	withNS(t, host, func() error {
+		br, err := netlink.LinkByName(bridgeName)
+		if err != nil {
+			return err
+		}
+		uplink, err := netlink.LinkByName(uplinkName)
+		if err != nil {
+			return err
+		}
+		if uplink.Attrs().MasterIndex != br.Attrs().Index {
+			t.Errorf("uplink should be attached to the bridge")
+		}
+		if ageing := br.(*netlink.Bridge).AgeingTime; ageing == nil || *ageing != 300*100 {
+			t.Errorf("bridge ageing time should be applied: %v", ageing)
+		}
+		return nil
+	})
+
+	withNS(t, host, func() error {
+		return bridge.UninstallBridgeNetwork(bridgeName, uplinkName)
+	})
+	if got := stateIn(t, host, uplinkName); !got.equal(before) {
+		t.Errorf("uplink should be restored\nwant: %s\ngot:  %s", before, got)
+	}
+	withNS(t, host, func() error {
+		if _, err := netlink.LinkByName(bridgeName); err == nil {
+			t.Errorf("bridge should be removed")
+		}
+		return nil
+	})
+}
+
+func TestRestoreFromSnapshot(t *testing.T) {
+	host := newHost(t)
+	before := stateIn(t, host, uplinkName)
+
+	var snap *bridge.Snapshot
+	withNS(t, host, func() (err error) {
+		snap, err = bridge.TakeSnapshot(bridgeName, uplinkName)
+		return err
+	})
+	installBridge(t, host)
+
+	withNS(t, host, func() error {
+		return bridge.RestoreFromSnapshot(snap)
+	})
+	if got := stateIn(t, host, uplinkName); !got.equal(before) {
+		t.Errorf("uplink should be restored\nwant: %s\ngot:  %s", before, got)
+	}
+}
+
+// checkPod 检查 Pod 网卡的地址与路由, 以及宿主机一侧 veth 的状态
+func checkPod(t *testing.T, host ns.NetNS, p *pod, address string) {
+	t.Helper()
+
+	withNS(t, p.NetNS, func() error {
+		link, err := netlink.LinkByName(p.IfName)
+		if err != nil {
+			return err
+		}
+		addrs, err := netlink.AddrList(link, netlink.FAMILY_V4)
+		if err != nil {
+			return err
+		}
+		if len(addrs) != 1 || addrs[0].IPNet.String() != address {
+			t.Errorf("pod address: got %v, want %s", addrs, address)
+		}
+
+		routes, err := netlink.RouteList(link, netlink.FAMILY_V4)
+		if err != nil {
+			return err
+		}
+		var hasDefault, hasService bool
+		for _, r := range routes {
+			switch r.Dst.String() {
+			case "0.0.0.0/0":
+				hasDefault = r.Gw.Equal(net.ParseIP(gatewayIP))
+			case serviceDst:
+				// service cidr 路由的网关为网桥地址
+				hasService = r.Gw.Equal(net.ParseIP("10.99.0.2"))
+			}
+		}
+		if !hasDefault || !hasService {
+			t.Errorf("pod should have default route via %s and service route via bridge: %v", gatewayIP, routes)
+		}
+		return nil
+	})
+
+	attachment, err := store.New(store.DefaultDir).Load(p.ContainerID, p.IfName)
+	if err != nil {
+		t.Fatalf("attachment should be saved: %v", err)
+	}
+	if attachment.IPAddress != address || attachment.HostVeth == "" {
+		t.Errorf("unexpected attachment: %+v", attachment)
+	}
+
+	withNS(t, host, func() error {
+		veth, err := netlink.LinkByName(attachment.HostVeth)
+		if err != nil {
+			return err
+		}
+		br, err := netlink.LinkByName(bridgeName)
+		if err != nil {
+			return err
+		}
+		if veth.Attrs().MasterIndex != br.Attrs().Index {
+			t.Errorf("host veth %s should be attached to the bridge", attachment.HostVeth)
+		}
+		protinfo, err := netlink.LinkGetProtinfo(veth)
+		if err != nil {
+			return err
+		}
+		if !protinfo.Hairpin {
+			t.Errorf("hairpin mode should be enabled on %s", attachment.HostVeth)
+		}
+		return nil
+	})
+}
+
+// checkDeleted 检查 DEL 之后的清理: store 中的记录被删除, 重复 DEL 不报错,
+// 网络命名空间销毁后宿主机一侧的 veth 也随之消失, 此时 DEL 仍然成功
+func checkDeleted(t *testing.T, host ns.NetNS, p *pod, conf []byte) {
+	t.Helper()
+
+	attachment, err := store.New(store.DefaultDir).Load(p.ContainerID, p.IfName)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cniDel(t, host, p, conf)
+	if _, err = store.New(store.DefaultDir).Load(p.ContainerID, p.IfName); err == nil {
+		t.Errorf("attachment should be deleted")
+	}
+	cniDel(t, host, p, conf)
+
+	removeNetNS(t, p)
+	// 内核异步销毁网络命名空间, veth 需要等待一段时间才会消失
+	withNS(t, host, func() error {
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			_, err := netlink.LinkByName(attachment.HostVeth)
+			if err != nil {
+				return nil
+			}
+			if time.Now().After(deadline) {
+				t.Errorf("host veth %s should be removed with the pod netns", attachment.HostVeth)
+				return nil
+			}
+			time.Sleep(50 * time.Millisecond)
+		}
+	})
+	cniDel(t, host, p, conf)
+}
+
+func TestStaticPodAddDel(t *testing.T) {
+	host := newHost(t)
+	installBridge(t, host)
+	server, serverSocket := newCNIServer(t, host)
+	conf := netConf(serverSocket, "")
+
+	p := newPod(t, "static-pod")
+	address := "10.99.0.50/24"
+	server.setStatic(p.Name, address)
+
+	// 重复 ADD 时结果不变, 已经存在的路由不会导致失败
+	var results []*current.Result
+	for i := 0; i < 2; i++ {
+		res := cniAdd(t, host, p, conf)
+		if len(res.IPs) != 1 || res.IPs[0].Address.String() != address {
+			t.Fatalf("add #%d: unexpected result: %s", i+1, res)
+		}
+		results = append(results, res)
+		checkPod(t, host, p, address)
+	}
+	if len(results[1].Routes) != 1 {
+		t.Errorf("result should have the default route: %s", results[1])
+	}
+	// search 来自 cni server, nameservers 来自配置
+	if dns := results[1].DNS; len(dns.Nameservers) != 1 || dns.Nameservers[0] != "10.96.0.10" ||
+		len(dns.Search) != 1 || dns.Search[0] != "static.svc.cluster.local" {
+		t.Errorf("unexpected dns in result: %+v", dns)
+	}
+	if len(server.adds) != 2 || server.adds[0].CNI0 != bridgeName || server.adds[0].NetNs != p.NetNS.Path() {
+		t.Errorf("unexpected requests to cni server: %+v", server.adds)
+	}
+
+	checkDeleted(t, host, p, conf)
+}
+
+func TestDHCPPodAddDel(t *testing.T) {
+	if !hasBinary("bridge") || !hasBinary("dhcp") {
+		t.Skip("bridge and dhcp plugins are required in CNI_PATH")
+	}
+
+	host := newHost(t)
+	installBridge(t, host)
+	_, serverSocket := newCNIServer(t, host)
+	dhcp, dhcpSocket := newDHCP(t)
+	conf := netConf(serverSocket, dhcpSocket)
+
+	first, second := newPod(t, "dhcp-pod-1"), newPod(t, "dhcp-pod-2")
+	for i, p := range []*pod{first, second} {
+		address := []string{"10.99.0.100/24", "10.99.0.101/24"}[i]
+		res := cniAdd(t, host, p, conf)
+		if len(res.IPs) != 1 || res.IPs[0].Address.String() != address {
+			t.Fatalf("unexpected result: %s", res)
+		}
+		if len(res.DNS.Nameservers) != 1 || res.DNS.Search[0] != "svc.cluster.local" {
+			t.Errorf("dns from netconf should be in result: %+v", res.DNS)
+		}
+		checkPod(t, host, p, address)
+	}
+
+	checkDeleted(t, host, first, conf)
+	checkDeleted(t, host, second, conf)
+	t.Logf("released leases: %v", dhcp.released)
+}
+
+func TestDHCPFallback(t *testing.T) {
+	if !hasBinary("bridge") || !hasBinary("dhcp") {
+		t.Skip("bridge and dhcp plugins are required in CNI_PATH")
+	}
+
+	host := newHost(t)
+	installBridge(t, host)
+	server, serverSocket := newCNIServer(t, host)
+	dhcp, dhcpSocket := newDHCP(t)
+	dhcp.timeout = true
+	address := "10.99.0.200/24"
+	server.setFallback(address)
+
+	conf := map[string]interface{}{}
+	if err := json.Unmarshal(netConf(serverSocket, dhcpSocket), &conf); err != nil {
+		t.Fatal(err)
+	}
+	conf["dhcpFallback"] = map[string]interface{}{"timeoutMs": 1000}
+	content, _ := json.Marshal(conf)
+
+	p := newPod(t, "fallback-pod")
+	res := cniAdd(t, host, p, content)
+	if len(res.IPs) != 1 || res.IPs[0].Address.String() != address {
+		t.Fatalf("unexpected result: %s", res)
+	}
+	checkPod(t, host, p, address)
+
+	// 第一次请求得到 DoNothing, dhcp 超时后带上 fallback 再次请求
+	if len(server.adds) != 2 || server.adds[0].Fallback || !server.adds[1].Fallback {
+		t.Errorf("unexpected requests to cni server: %+v", server.adds)
+	}
+	attachment, err := store.New(store.DefaultDir).Load(p.ContainerID, p.IfName)
+	if err != nil || attachment.Source != store.SourceFallback {
+		t.Errorf("attachment should be marked as fallback: %+v %v", attachment, err)
+	}
+
+	checkDeleted(t, host, p, content)
+}
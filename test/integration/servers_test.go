@@ -0,0 +1,273 @@
+//go:build integration
+
+package integration
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/rpc"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/containernetworking/cni/pkg/types"
+	"github.com/containernetworking/cni/pkg/types/current"
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/gitlayzer/tsunami/pkg/cniapi"
+	"github.com/gitlayzer/tsunami/utils/restapi"
+	"github.com/vishvananda/netlink"
+)
+
+// serveUnix 在临时目录中的 unix socket 上提供 http 服务, 测试结束时关闭
+func serveUnix(t *testing.T, name string, handler http.Handler) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &http.Server{Handler: handler}
+	go server.Serve(l)
+	t.Cleanup(func() { server.Close() })
+	return path
+}
+
+// cniServer cni server 的替身.
+// 静态 IP 的 Pod 由它创建 veth 并配置地址, 与真实的 cni server 一样; 其他 Pod 返回 DoNothing, 由 bridge 与 dhcp 插件处理.
+type cniServer struct {
+	t    *testing.T
+	host ns.NetNS
+
+	mu sync.Mutex
+	// static Pod 名称到静态 IP(带掩码)的映射
+	static map[string]string
+	adds   []restapi.PodRequest
+	dels   []restapi.PodRequest
+	// fallback dhcp 超时后分配的备用地址(带掩码), 为空时返回 DoNothing
+	fallback string
+}
+
+// newCNIServer 启动 cni server 替身, 返回其 socket 路径
+func newCNIServer(t *testing.T, host ns.NetNS) (*cniServer, string) {
+	s := &cniServer{t: t, host: host, static: map[string]string{}}
+	mux := http.NewServeMux()
+	mux.HandleFunc(cniapi.PathAdd, s.handleAdd)
+	mux.HandleFunc(cniapi.PathDel, s.handleDel)
+	mux.HandleFunc(cniapi.PathCheck, s.handleCheck)
+	return s, serveUnix(t, "cni.sock", mux)
+}
+
+// setStatic 为 Pod 指定静态 IP
+func (s *cniServer) setStatic(podName, address string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.static[podName] = address
+}
+
+// setFallback 设置 dhcp 超时后分配的备用地址
+func (s *cniServer) setFallback(address string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.fallback = address
+}
+
+// decode 协商版本并解析请求, 失败时已经返回了错误
+func decode(w http.ResponseWriter, r *http.Request, req *restapi.PodRequest) bool {
+	if _, ok := cniapi.NegotiateRequest(w, r); !ok {
+		return false
+	}
+	if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+		cniapi.WriteError(w, cniapi.CodeDecodingFailure, "failed to decode request", err.Error())
+		return false
+	}
+	return true
+}
+
+func (s *cniServer) handleAdd(w http.ResponseWriter, r *http.Request) {
+	req := restapi.PodRequest{}
+	if !decode(w, r, &req) {
+		return
+	}
+
+	s.mu.Lock()
+	s.adds = append(s.adds, req)
+	address, ok := s.static[req.PodName]
+	if req.Fallback && s.fallback != "" {
+		address, ok = s.fallback, true
+	}
+	s.mu.Unlock()
+
+	resp := &restapi.PodResponse{DoNothing: true}
+	if ok {
+		if err := s.setupVeth(&req, address); err != nil {
+			cniapi.WriteError(w, cniapi.CodeRejected, "failed to setup veth", err.Error())
+			return
+		}
+		resp = &restapi.PodResponse{DNS: &cniapi.DNS{Search: []string{"static.svc.cluster.local"}}}
+		resp.SetIPs([]cniapi.IPConfig{{Address: address, Gateway: gatewayIP}})
+	}
+	json.NewEncoder(w).Encode(resp)
+}
+
+func (s *cniServer) handleDel(w http.ResponseWriter, r *http.Request) {
+	req := restapi.PodRequest{}
+	if !decode(w, r, &req) {
+		return
+	}
+
+	s.mu.Lock()
+	s.dels = append(s.dels, req)
+	s.mu.Unlock()
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *cniServer) handleCheck(w http.ResponseWriter, r *http.Request) {
+	req := restapi.PodRequest{}
+	if !decode(w, r, &req) {
+		return
+	}
+
+	s.mu.Lock()
+	address, ok := s.static[req.PodName]
+	s.mu.Unlock()
+	if !ok {
+		cniapi.WriteError(w, cniapi.CodeUnknownContainer, "unknown container", req.ContainerID)
+		return
+	}
+	if len(req.IPs) != 1 || req.IPs[0] != address {
+		cniapi.WriteError(w, cniapi.CodeAddressMismatch, "address mismatch", fmt.Sprintf("%v, want %s", req.IPs, address))
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// hostVethName 宿主机一侧 veth 的名称
+func hostVethName(containerID string) string {
+	return "veth" + containerID[:8]
+}
+
+// setupVeth 创建 veth, 一端接入网桥, 另一端移入 Pod 网络命名空间并配置静态 IP, 已存在时直接返回
+func (s *cniServer) setupVeth(req *restapi.PodRequest, address string) (err error) {
+	podNS, err := ns.GetNS(req.NetNs)
+	if err != nil {
+		return err
+	}
+	defer podNS.Close()
+
+	exists := false
+	err = podNS.Do(func(ns.NetNS) error {
+		_, err := netlink.LinkByName(req.IfName)
+		exists = err == nil
+		return nil
+	})
+	if err != nil || exists {
+		return err
+	}
+
+	hostVeth, tmpName := hostVethName(req.ContainerID), "tmp"+req.ContainerID[:8]
+	err = s.host.Do(func(ns.NetNS) (err error) {
+		veth := &netlink.Veth{LinkAttrs: netlink.LinkAttrs{Name: hostVeth}, PeerName: tmpName}
+		if err = netlink.LinkAdd(veth); err != nil {
+			return fmt.Errorf("failed to add veth: %v", err)
+		}
+		br, err := netlink.LinkByName(req.CNI0)
+		if err != nil {
+			return err
+		}
+		if err = netlink.LinkSetMaster(veth, br); err != nil {
+			return err
+		}
+		if err = netlink.LinkSetUp(veth); err != nil {
+			return err
+		}
+		peer, err := netlink.LinkByName(tmpName)
+		if err != nil {
+			return err
+		}
+		return netlink.LinkSetNsFd(peer, int(podNS.Fd()))
+	})
+	if err != nil {
+		return err
+	}
+
+	return podNS.Do(func(ns.NetNS) (err error) {
+		link, err := netlink.LinkByName(tmpName)
+		if err != nil {
+			return err
+		}
+		if err = netlink.LinkSetName(link, req.IfName); err != nil {
+			return err
+		}
+		addr, err := netlink.ParseAddr(address)
+		if err != nil {
+			return err
+		}
+		if err = netlink.AddrAdd(link, addr); err != nil {
+			return err
+		}
+		return netlink.LinkSetUp(link)
+	})
+}
+
+// DHCP dhcp 插件守护进程的替身, 以 net/rpc 提供与 dhcp 插件相同的 Allocate / Release 方法.
+// 同一容器与网卡总是分配到同一个地址, 地址从 10.99.0.100 开始.
+type DHCP struct {
+	mu       sync.Mutex
+	leases   map[string]net.IP
+	next     byte
+	released []string
+	// timeout 为 true 时模拟 dhcp 服务器没有应答
+	timeout bool
+}
+
+// newDHCP 启动 dhcp 替身, 返回其 socket 路径
+func newDHCP(t *testing.T) (*DHCP, string) {
+	d := &DHCP{leases: map[string]net.IP{}, next: 100}
+	server := rpc.NewServer()
+	if err := server.Register(d); err != nil {
+		t.Fatal(err)
+	}
+	return d, serveUnix(t, "dhcp.sock", server)
+}
+
+// Allocate 为容器分配地址, 结果中包含网关与默认路由
+func (d *DHCP) Allocate(args *skel.CmdArgs, result *current.Result) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.timeout {
+		return errors.New("failed to discover dhcp server on eth0: timed out waiting for dhcp reply")
+	}
+	key := args.ContainerID + "/" + args.IfName
+	ip, ok := d.leases[key]
+	if !ok {
+		ip = net.IPv4(10, 99, 0, d.next).To4()
+		d.next++
+		d.leases[key] = ip
+	}
+
+	gw := net.ParseIP(gatewayIP).To4()
+	_, defNet, _ := net.ParseCIDR("0.0.0.0/0")
+	result.IPs = []*current.IPConfig{{
+		Version: "4",
+		Address: net.IPNet{IP: ip, Mask: net.CIDRMask(24, 32)},
+		Gateway: gw,
+	}}
+	result.Routes = []*types.Route{{Dst: *defNet, GW: gw}}
+	return nil
+}
+
+// Release 释放容器的地址
+func (d *DHCP) Release(args *skel.CmdArgs, reply *struct{}) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	key := args.ContainerID + "/" + args.IfName
+	delete(d.leases, key)
+	d.released = append(d.released, key)
+	return nil
+}
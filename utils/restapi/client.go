@@ -0,0 +1,233 @@
+package restapi
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// 客户端的默认参数
+const (
+	DefaultDialTimeout   = 2 * time.Second
+	DefaultTimeout       = 30 * time.Second
+	DefaultRetries       = 3
+	DefaultRetryInterval = 200 * time.Millisecond
+)
+
+// maxErrorBody 读取出错响应内容的上限
+const maxErrorBody = 4096
+
+// ClientOptions 通过 unix socket 访问 cni server 与 daemon 的客户端参数, 为 0 的字段使用默认值
+type ClientOptions struct {
+	// DialTimeout 建立连接的超时时间
+	DialTimeout time.Duration
+	// Timeout 单次请求从建立连接到读取完响应的超时时间
+	Timeout time.Duration
+	// Retries 连接失败等暂时性错误的重试次数, 小于 0 时不重试
+	Retries int
+	// RetryInterval 第一次重试前的等待时间, 之后每次翻倍
+	RetryInterval time.Duration
+}
+
+func (o *ClientOptions) withDefaults() ClientOptions {
+	opts := ClientOptions{}
+	if o != nil {
+		opts = *o
+	}
+	if opts.DialTimeout == 0 {
+		opts.DialTimeout = DefaultDialTimeout
+	}
+	if opts.Timeout == 0 {
+		opts.Timeout = DefaultTimeout
+	}
+	if opts.Retries == 0 {
+		opts.Retries = DefaultRetries
+	}
+	if opts.Retries < 0 {
+		opts.Retries = 0
+	}
+	if opts.RetryInterval == 0 {
+		opts.RetryInterval = DefaultRetryInterval
+	}
+	return opts
+}
+
+// UnreachableError 没有从服务端得到响应, 如 socket 不存在, 连接被拒绝或请求超时
+type UnreachableError struct {
+	Socket string
+	Path   string
+	// Attempts 已经尝试的次数
+	Attempts int
+	Err      error
+}
+
+func (e *UnreachableError) Error() string {
+	return fmt.Sprintf("server %s unreachable for %s after %d attempt(s): %v", e.Socket, e.Path, e.Attempts, e.Err)
+}
+
+func (e *UnreachableError) Unwrap() error {
+	return e.Err
+}
+
+// APIError 服务端返回了非成功的状态码, 即服务端拒绝了请求
+type APIError struct {
+	Path       string
+	StatusCode int
+	// Message 响应中 ErrorResponse 的 error 字段, 响应不是 json 时为原始内容
+	Message string
+	// Code 与 Details 来自响应中的 ErrorResponse, 旧版本的服务端不返回错误码
+	Code    uint
+	Details string
+}
+
+func (e *APIError) Error() string {
+	if e.Details != "" {
+		return fmt.Sprintf("request %s return %d %s: %s", e.Path, e.StatusCode, e.Message, e.Details)
+	}
+	return fmt.Sprintf("request %s return %d %s", e.Path, e.StatusCode, e.Message)
+}
+
+// IsUnreachable 判断错误是否由于服务端不可达
+func IsUnreachable(err error) bool {
+	var e *UnreachableError
+	return errors.As(err, &e)
+}
+
+// IsRejected 判断错误是否由于服务端拒绝了请求
+func IsRejected(err error) bool {
+	var e *APIError
+	return errors.As(err, &e)
+}
+
+// client 基于 net/http 的 unix socket 客户端, 由 CNIServerClient 与 CtlClient 共用
+type client struct {
+	socket string
+	opts   ClientOptions
+	http   *http.Client
+	// header 每个请求都携带的头
+	header http.Header
+	// respHeader 最近一次响应的头, client 不能并发使用
+	respHeader http.Header
+}
+
+func newClient(socketAddress string, opts *ClientOptions) *client {
+	o := opts.withDefaults()
+	dialer := &net.Dialer{Timeout: o.DialTimeout}
+	return &client{
+		socket:     socketAddress,
+		opts:       o,
+		header:     http.Header{},
+		respHeader: http.Header{},
+		http: &http.Client{
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+					return dialer.DialContext(ctx, "unix", socketAddress)
+				},
+				// cni 插件是短生命周期的进程, 不需要保持连接
+				DisableKeepAlives: true,
+			},
+			Timeout: o.Timeout,
+		},
+	}
+}
+
+// do 发送请求, 状态码为 expect 时将响应解析到 out 中, out 为 nil 时忽略响应内容.
+// 连接失败与 503 这类暂时性错误会重试, 其他错误直接返回.
+func (c *client) do(ctx context.Context, method, path string, in, out interface{}, expect int) (err error) {
+	var body []byte
+	if in != nil {
+		if body, err = json.Marshal(in); err != nil {
+			return fmt.Errorf("failed to encode request %s: %v", path, err)
+		}
+	}
+
+	interval := c.opts.RetryInterval
+	for attempt := 1; ; attempt++ {
+		var retry bool
+		retry, err = c.doOnce(ctx, method, path, body, out, expect)
+		if err == nil {
+			return nil
+		}
+		if !retry || attempt > c.opts.Retries {
+			if !IsRejected(err) {
+				err = &UnreachableError{Socket: c.socket, Path: path, Attempts: attempt, Err: err}
+			}
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			return &UnreachableError{Socket: c.socket, Path: path, Attempts: attempt, Err: err}
+		case <-time.After(interval):
+		}
+		interval *= 2
+	}
+}
+
+// doOnce 发送一次请求, retry 表示错误是否是暂时性的
+func (c *client) doOnce(ctx context.Context, method, path string, body []byte, out interface{}, expect int) (retry bool, err error) {
+	req, err := http.NewRequestWithContext(ctx, method, "http://unix"+path, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	for k, v := range c.header {
+		req.Header[k] = v
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	res, err := c.http.Do(req)
+	if err != nil {
+		return isTransient(ctx, err), err
+	}
+	defer res.Body.Close()
+	c.respHeader = res.Header
+
+	if res.StatusCode != expect {
+		apiErr := readError(res.Body)
+		apiErr.Path, apiErr.StatusCode = path, res.StatusCode
+		// 服务端正在启动或重启时返回 503
+		return res.StatusCode == http.StatusServiceUnavailable, apiErr
+	}
+
+	if out == nil {
+		io.Copy(io.Discard, res.Body)
+		return false, nil
+	}
+	if err = json.NewDecoder(res.Body).Decode(out); err != nil {
+		return false, fmt.Errorf("failed to decode response of %s: %v", path, err)
+	}
+	return false, nil
+}
+
+// isTransient 判断连接错误是否值得重试: 服务端重启期间 socket 不存在或拒绝连接.
+// 请求已经发出后的错误(如读取超时)不重试, 以免服务端重复处理.
+func isTransient(ctx context.Context, err error) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+	var opErr *net.OpError
+	if !errors.As(err, &opErr) || opErr.Op != "dial" {
+		return false
+	}
+	return errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, syscall.ENOENT) || errors.Is(err, syscall.EAGAIN)
+}
+
+// readError 读取出错响应的内容, 优先使用 ErrorResponse 中的字段
+func readError(r io.Reader) *APIError {
+	data, _ := io.ReadAll(io.LimitReader(r, maxErrorBody))
+	resp := &ErrorResponse{}
+	if err := json.Unmarshal(data, resp); err == nil && resp.Error != "" {
+		return &APIError{Message: resp.Error, Code: resp.Code, Details: resp.Details}
+	}
+	return &APIError{Message: strings.TrimSpace(string(data))}
+}
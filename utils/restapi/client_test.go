@@ -0,0 +1,233 @@
+package restapi
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gitlayzer/tsunami/pkg/cniapi"
+)
+
+// serve 在 path 上启动 http 服务, 测试结束时关闭
+func serve(t *testing.T, path string, handler http.HandlerFunc) {
+	t.Helper()
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &http.Server{Handler: handler}
+	go server.Serve(l)
+	t.Cleanup(func() { server.Close() })
+}
+
+// fastOptions 缩短重试间隔, 避免测试耗时过长
+var fastOptions = &ClientOptions{Timeout: time.Second, Retries: 2, RetryInterval: 10 * time.Millisecond}
+
+func TestCNIServerClientAdd(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), "cni.sock")
+	serve(t, socket, func(w http.ResponseWriter, r *http.Request) {
+		req := &PodRequest{}
+		if r.URL.Path != "/api/v1/add" || json.NewDecoder(r.Body).Decode(req) != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		json.NewEncoder(w).Encode(&PodResponse{IPAddress: "10.0.0.10/24", Gateway: "10.0.0.1", MTU: 1450})
+	})
+
+	resp, err := NewCNIServerClient(socket, fastOptions).Add(context.Background(), &PodRequest{PodName: "p"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.IPAddress != "10.0.0.10/24" || resp.Gateway != "10.0.0.1" || resp.MTU != 1450 {
+		t.Errorf("unexpected response: %+v", resp)
+	}
+}
+
+func TestRejected(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), "cni.sock")
+	var calls int32
+	serve(t, socket, func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(&ErrorResponse{Error: "pool exhausted"})
+	})
+
+	err := NewCNIServerClient(socket, fastOptions).Del(context.Background(), &PodRequest{})
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) || IsUnreachable(err) {
+		t.Fatalf("expected rejected error, got %v", err)
+	}
+	if apiErr.StatusCode != http.StatusConflict || apiErr.Message != "pool exhausted" {
+		t.Errorf("unexpected error: %+v", apiErr)
+	}
+	if calls := atomic.LoadInt32(&calls); calls != 1 {
+		t.Errorf("rejected request should not be retried, got %d calls", calls)
+	}
+}
+
+func TestPlainErrorBody(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), "cni.sock")
+	serve(t, socket, func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "boom", http.StatusInternalServerError)
+	})
+
+	_, err := NewCNIServerClient(socket, fastOptions).Add(context.Background(), &PodRequest{})
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) || apiErr.Message != "boom" {
+		t.Fatalf("expected error with plain body, got %v", err)
+	}
+}
+
+func TestUnreachable(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), "missing.sock")
+
+	err := NewCtlClient(socket, fastOptions).Event(context.Background(), &PodEventRequest{})
+	var unreachable *UnreachableError
+	if !errors.As(err, &unreachable) || IsRejected(err) {
+		t.Fatalf("expected unreachable error, got %v", err)
+	}
+	if unreachable.Attempts != 3 {
+		t.Errorf("expected 3 attempts, got %d", unreachable.Attempts)
+	}
+}
+
+func TestRetryUntilServerStarts(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), "ctl.sock")
+	// 服务端在第一次重试之后才启动
+	server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode([]PodInfo{{PodName: "p"}})
+	})}
+	t.Cleanup(func() { server.Close() })
+	time.AfterFunc(15*time.Millisecond, func() {
+		if l, err := net.Listen("unix", socket); err == nil {
+			server.Serve(l)
+		}
+	})
+
+	opts := &ClientOptions{Retries: 5, RetryInterval: 10 * time.Millisecond}
+	pods, err := NewCtlClient(socket, opts).Pods(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pods) != 1 || pods[0].PodName != "p" {
+		t.Errorf("unexpected pods: %+v", pods)
+	}
+}
+
+func TestRetryServiceUnavailable(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), "ctl.sock")
+	var calls int32
+	serve(t, socket, func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&calls, 1) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		json.NewEncoder(w).Encode(&ErrorResponse{})
+	})
+
+	if err := NewCtlClient(socket, fastOptions).Restore(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if calls := atomic.LoadInt32(&calls); calls != 2 {
+		t.Errorf("expected 2 calls, got %d", calls)
+	}
+}
+
+func TestTimeout(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), "cni.sock")
+	var calls int32
+	serve(t, socket, func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		<-r.Context().Done()
+	})
+
+	opts := &ClientOptions{Timeout: 50 * time.Millisecond, Retries: 2, RetryInterval: time.Millisecond}
+	_, err := NewCNIServerClient(socket, opts).Add(context.Background(), &PodRequest{})
+	if !IsUnreachable(err) {
+		t.Fatalf("expected unreachable error, got %v", err)
+	}
+	// 请求已经发出, 超时后不重试
+	if calls := atomic.LoadInt32(&calls); calls != 1 {
+		t.Errorf("timed out request should not be retried, got %d calls", calls)
+	}
+}
+
+func TestContextCanceled(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), "missing.sock")
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	opts := &ClientOptions{Retries: 100, RetryInterval: time.Second}
+	start := time.Now()
+	_, err := NewCtlClient(socket, opts).Status(ctx)
+	if !IsUnreachable(err) {
+		t.Fatalf("expected unreachable error, got %v", err)
+	}
+	if time.Since(start) > 500*time.Millisecond {
+		t.Errorf("canceled request should return immediately")
+	}
+}
+
+func TestCNIServerVersion(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), "cni.sock")
+	mux := http.NewServeMux()
+	mux.HandleFunc(cniapi.PathAdd, func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := cniapi.NegotiateRequest(w, r); !ok {
+			return
+		}
+		resp := &PodResponse{}
+		resp.SetIPs([]cniapi.IPConfig{{Address: "10.0.0.10/24", Gateway: "10.0.0.1"}, {Address: "fd00::10/64"}})
+		json.NewEncoder(w).Encode(resp)
+	})
+	mux.HandleFunc(cniapi.PathCheck, func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := cniapi.NegotiateRequest(w, r); !ok {
+			return
+		}
+		cniapi.WriteError(w, cniapi.CodeAddressMismatch, "address mismatch", "10.0.0.11/24 is not allocated")
+	})
+	serve(t, socket, mux.ServeHTTP)
+
+	client := NewCNIServerClient(socket, fastOptions)
+	resp, err := client.Add(context.Background(), &PodRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, err := client.ServerVersion(); err != nil || v != cniapi.Version {
+		t.Errorf("unexpected server version %s: %v", v, err)
+	}
+	if ips := resp.GetIPs(); len(ips) != 2 || resp.IPAddress != "10.0.0.10/24" {
+		t.Errorf("unexpected response: %+v", resp)
+	}
+
+	err = client.Check(context.Background(), &PodRequest{IPs: []string{"10.0.0.11/24"}})
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) || apiErr.Code != cniapi.CodeAddressMismatch || apiErr.StatusCode != http.StatusConflict {
+		t.Errorf("expected address mismatch, got %v", err)
+	}
+}
+
+func TestCheckLegacyServer(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), "cni.sock")
+	mux := http.NewServeMux()
+	mux.HandleFunc(cniapi.PathAdd, func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(&PodResponse{DoNothing: true})
+	})
+	serve(t, socket, mux.ServeHTTP)
+
+	client := NewCNIServerClient(socket, fastOptions)
+	if _, err := client.Add(context.Background(), &PodRequest{}); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := client.ServerVersion(); err != nil || v != cniapi.Legacy {
+		t.Errorf("server without version header should be 1.0, got %s %v", v, err)
+	}
+	if err := client.Check(context.Background(), &PodRequest{}); err != ErrCheckUnsupported {
+		t.Errorf("expected ErrCheckUnsupported, got %v", err)
+	}
+}
@@ -0,0 +1,240 @@
+package restapi
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/gitlayzer/tsunami/pkg/cniapi"
+)
+
+// LinkStatus 网络设备的状态
+type LinkStatus struct {
+	Name   string   `json:"name"`
+	Index  int      `json:"index"`
+	State  string   `json:"state"`
+	Master string   `json:"master,omitempty"`
+	MTU    int      `json:"mtu"`
+	Addrs  []string `json:"addrs"`
+	Error  string   `json:"error,omitempty"`
+}
+
+// DHCPStatus dhcp 守护进程的状态
+type DHCPStatus struct {
+	Pid          int    `json:"pid"`
+	Running      bool   `json:"running"`
+	Socket       string `json:"socket"`
+	SocketExists bool   `json:"socket_exists"`
+	// Builtin 为 true 时守护进程运行在 daemon 中, 没有 pid
+	Builtin bool `json:"builtin,omitempty"`
+}
+
+// StatusResponse tsunamictl status 的返回结果
+type StatusResponse struct {
+	Bridge LinkStatus `json:"bridge"`
+	Uplink LinkStatus `json:"uplink"`
+	// Routes 网桥设备上的路由, 即从物理网卡迁移过来的路由
+	Routes []string   `json:"routes"`
+	DHCP   DHCPStatus `json:"dhcp"`
+	// Snapshot 物理网卡快照文件路径, 为空表示没有快照
+	Snapshot string `json:"snapshot,omitempty"`
+}
+
+// PodInfo 本节点上由 tsunami 部署网络的 Pod
+type PodInfo struct {
+	PodName      string `json:"pod_name"`
+	PodNamespace string `json:"pod_namespace"`
+	ContainerID  string `json:"container_id"`
+	IfName       string `json:"if_name"`
+	NetNs        string `json:"net_ns"`
+	MAC          string `json:"mac,omitempty"`
+	IPAddress    string `json:"address"`
+	Gateway      string `json:"gateway,omitempty"`
+	Source       string `json:"source"`
+	// Stale 为 true 表示 Pod 的网络命名空间已经不存在
+	Stale bool `json:"stale"`
+}
+
+// 租约的状态
+const (
+	LeaseBound     = "bound"
+	LeaseRenewing  = "renewing"
+	LeaseRebinding = "rebinding"
+	LeaseExpired   = "expired"
+	// LeaseStale Pod 的网络命名空间已经不存在
+	LeaseStale = "stale"
+	// LeaseUnknown 使用 cni dhcp 插件的守护进程时没有租约记录, 只能列出地址
+	LeaseUnknown = "unknown"
+)
+
+// LeaseStatus tsunamictl leases 返回的 dhcp 租约
+type LeaseStatus struct {
+	PodName      string    `json:"pod_name"`
+	PodNamespace string    `json:"pod_namespace"`
+	ContainerID  string    `json:"container_id"`
+	IfName       string    `json:"if_name"`
+	MAC          string    `json:"mac,omitempty"`
+	IPAddress    string    `json:"address"`
+	Server       string    `json:"server,omitempty"`
+	RenewAt      time.Time `json:"renew_at"`
+	RebindAt     time.Time `json:"rebind_at"`
+	ExpiresAt    time.Time `json:"expires_at"`
+	State        string    `json:"state"`
+}
+
+// RoutesResponse tsunamictl routes 的返回结果
+type RoutesResponse struct {
+	Pod    string   `json:"pod"`
+	NetNs  string   `json:"net_ns"`
+	Routes []string `json:"routes"`
+}
+
+// GCResponse tsunamictl gc 的返回结果
+type GCResponse struct {
+	DryRun  bool      `json:"dry_run"`
+	Removed []PodInfo `json:"removed"`
+}
+
+// PodEventRequest cni 插件请求 daemon 为 Pod 创建 Event, cni 插件本身没有集群凭证
+type PodEventRequest struct {
+	PodName      string `json:"pod_name"`
+	PodNamespace string `json:"pod_namespace"`
+	// Type Normal 或 Warning
+	Type    string `json:"type"`
+	Reason  string `json:"reason"`
+	Message string `json:"message"`
+	// Annotations 同时为 Pod 添加的注解
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+// AntiSpoofRequest cni 插件请求 daemon 为 Pod veth 端口添加或移除防欺骗规则
+type AntiSpoofRequest struct {
+	ContainerID string `json:"container_id"`
+	// HostVeth Pod veth 设备在宿主机上的一端
+	HostVeth string `json:"host_veth"`
+	// 以下字段只在添加规则时需要
+	MAC string   `json:"mac,omitempty"`
+	IPs []string `json:"ips,omitempty"`
+}
+
+// HostPortRequest cni 插件请求 daemon 为容器添加或移除端口映射
+type HostPortRequest struct {
+	ContainerID  string        `json:"container_id"`
+	IPs          []string      `json:"ips"`
+	PortMappings []PortMapping `json:"port_mappings"`
+}
+
+// ErrorResponse 接口出错时返回的内容, 与 cni server 的格式一致
+type ErrorResponse = cniapi.ErrorResponse
+
+// DefaultCtlSocketPath daemon 诊断接口默认的 unix socket 路径
+const DefaultCtlSocketPath = "/run/cni/tsunami.sock"
+
+// CtlClient tsunamictl 与 cni 插件使用的客户端, 与 daemon 的 unix socket 通信
+type CtlClient struct {
+	*client
+}
+
+// NewCtlClient 创建 CtlClient 对象, opts 为 nil 时使用默认的超时与重试参数
+func NewCtlClient(socketAddress string, opts *ClientOptions) *CtlClient {
+	return &CtlClient{newClient(socketAddress, opts)}
+}
+
+// getJSON 发送 GET 请求, 并将结果解析到 v 中
+func (c *CtlClient) getJSON(ctx context.Context, path string, v interface{}) error {
+	return c.do(ctx, http.MethodGet, path, nil, v, http.StatusOK)
+}
+
+// postJSON 发送 POST 请求, 并将结果解析到 v 中
+func (c *CtlClient) postJSON(ctx context.Context, path string, v interface{}) error {
+	return c.do(ctx, http.MethodPost, path, nil, v, http.StatusOK)
+}
+
+// postBody 发送带 json 请求体的 POST 请求, 不关心返回内容
+func (c *CtlClient) postBody(ctx context.Context, path string, req interface{}) error {
+	return c.do(ctx, http.MethodPost, path, req, nil, http.StatusOK)
+}
+
+// Status 获取网桥, 物理网卡, 路由与 dhcp 子进程的状态
+func (c *CtlClient) Status(ctx context.Context) (*StatusResponse, error) {
+	resp := &StatusResponse{}
+	if err := c.getJSON(ctx, "/api/v1/status", resp); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// Pods 获取本节点上的 Pod 网络信息
+func (c *CtlClient) Pods(ctx context.Context) ([]PodInfo, error) {
+	var resp []PodInfo
+	if err := c.getJSON(ctx, "/api/v1/pods", &resp); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// Leases 获取本节点上 Pod 的 dhcp 租约
+func (c *CtlClient) Leases(ctx context.Context) ([]LeaseStatus, error) {
+	var resp []LeaseStatus
+	if err := c.getJSON(ctx, "/api/v1/leases", &resp); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// Routes 获取 Pod 网络命名空间中的路由
+func (c *CtlClient) Routes(ctx context.Context, namespace, name string) (*RoutesResponse, error) {
+	query := url.Values{}
+	query.Set("namespace", namespace)
+	query.Set("name", name)
+
+	resp := &RoutesResponse{}
+	if err := c.getJSON(ctx, "/api/v1/routes?"+query.Encode(), resp); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// GC 清理网络命名空间已经不存在的 Pod 记录
+func (c *CtlClient) GC(ctx context.Context, dryRun bool) (*GCResponse, error) {
+	query := url.Values{}
+	query.Set("dry_run", fmt.Sprintf("%t", dryRun))
+
+	resp := &GCResponse{}
+	if err := c.postJSON(ctx, "/api/v1/gc?"+query.Encode(), resp); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// Event 请求 daemon 为 Pod 创建 Event
+func (c *CtlClient) Event(ctx context.Context, req *PodEventRequest) error {
+	return c.postBody(ctx, "/api/v1/events", req)
+}
+
+// AddAntiSpoof 请求 daemon 为 Pod veth 端口添加防欺骗规则
+func (c *CtlClient) AddAntiSpoof(ctx context.Context, req *AntiSpoofRequest) error {
+	return c.postBody(ctx, "/api/v1/antispoof/add", req)
+}
+
+// DelAntiSpoof 请求 daemon 移除 Pod veth 端口的防欺骗规则
+func (c *CtlClient) DelAntiSpoof(ctx context.Context, req *AntiSpoofRequest) error {
+	return c.postBody(ctx, "/api/v1/antispoof/del", req)
+}
+
+// AddHostPorts 请求 daemon 为容器添加端口映射
+func (c *CtlClient) AddHostPorts(ctx context.Context, req *HostPortRequest) error {
+	return c.postBody(ctx, "/api/v1/hostport/add", req)
+}
+
+// DelHostPorts 请求 daemon 移除容器的端口映射
+func (c *CtlClient) DelHostPorts(ctx context.Context, req *HostPortRequest) error {
+	return c.postBody(ctx, "/api/v1/hostport/del", req)
+}
+
+// Restore 根据快照卸载桥接网络
+func (c *CtlClient) Restore(ctx context.Context) error {
+	return c.postJSON(ctx, "/api/v1/restore", &ErrorResponse{})
+}
@@ -2,72 +2,74 @@ package restapi
 
 import (
 	"context"
-	"fmt"
-	"net"
+	"errors"
 	"net/http"
 
-	"github.com/parnurzeal/gorequest"
+	"github.com/gitlayzer/tsunami/pkg/cniapi"
 )
 
-// PodRequest 由CNI插件调用时传入的pause容器信息
-type PodRequest struct {
-	PodName      string `json:"pod_name"`
-	PodNamespace string `json:"pod_namespace"`
-	ContainerID  string `json:"container_id"`
-	NetNs        string `json:"net_ns"`
-	// cni 插件使用的网桥设备的名称, 一般默认为cni0.
-	CNI0 string `json:"cni0"`
-}
+// 与 cni server 交互的类型定义在 cniapi 中, 这里保留别名供已有代码使用
+type (
+	// PodRequest 由CNI插件调用时传入的pause容器信息
+	PodRequest = cniapi.PodRequest
+	// PodResponse cni server add 的返回结果
+	PodResponse = cniapi.PodResponse
+	// RouteSpec 需要在 Pod 中额外添加的路由
+	RouteSpec = cniapi.RouteSpec
+	// BandwidthSpec Pod 的带宽限制
+	BandwidthSpec = cniapi.BandwidthSpec
+	// PortMapping 容器的端口映射
+	PortMapping = cniapi.PortMapping
+)
 
-// PodResponse ...
-type PodResponse struct {
-	// IPAddress 点分十进制+掩码字符串, 如`192.168.0.1/24`
-	IPAddress string `json:"address"`
-	Gateway   string `json:"gateway"`
-	DoNothing bool   `json:"do_nothing"`
-}
+// ErrCheckUnsupported cni server 的版本低于 1.1, 不支持 check 接口
+var ErrCheckUnsupported = errors.New("cni server does not support check")
 
-// CNIServerClient ...
+// CNIServerClient cni 插件访问 cni server 的客户端
 type CNIServerClient struct {
-	*gorequest.SuperAgent
+	*client
 }
 
 // NewCNIServerClient 由CNI插件调用以进行初始化,
-// 之后可以调用该client对象的Add/Del方法.
-func NewCNIServerClient(socketAddress string) *CNIServerClient {
-	request := gorequest.New()
-	request.Transport = &http.Transport{
-		DialContext: func(_ context.Context, _, _ string) (net.Conn, error) {
-			return net.Dial("unix", socketAddress)
-		},
+// 之后可以调用该client对象的Add/Del方法. opts 为 nil 时使用默认的超时与重试参数.
+func NewCNIServerClient(socketAddress string, opts *ClientOptions) *CNIServerClient {
+	c := newClient(socketAddress, opts)
+	c.header.Set(cniapi.VersionHeader, cniapi.Version.String())
+	return &CNIServerClient{c}
+}
+
+// ServerVersion 返回与 cni server 协商后的版本, 在收到过 server 的响应之后才有意义
+func (csc *CNIServerClient) ServerVersion() (cniapi.APIVersion, error) {
+	peer, err := cniapi.ParseVersion(csc.respHeader.Get(cniapi.VersionHeader))
+	if err != nil {
+		return peer, err
 	}
-	return &CNIServerClient{request}
+	return cniapi.Version.Negotiate(peer)
 }
 
 // Add CNI插件在pause插件创建完成后, 准备部署网络时调用此方法.
 // @param podReq: 由CNI插件调用时传入的pause容器信息.
-func (csc *CNIServerClient) Add(podReq *PodRequest) (*PodResponse, error) {
+func (csc *CNIServerClient) Add(ctx context.Context, podReq *PodRequest) (*PodResponse, error) {
 	resp := &PodResponse{}
-	// 貌似与unix socket建立的http连接, 就是通过这种URL(dummy)进行访问的?
-	res, body, errors := csc.Post("http://dummy/api/v1/add").Send(podReq).EndStruct(resp)
-	if len(errors) != 0 {
-		return nil, errors[0]
-	}
-	if res.StatusCode != 200 {
-		return nil, fmt.Errorf("request ip return %d %s", res.StatusCode, body)
+	if err := csc.do(ctx, http.MethodPost, cniapi.PathAdd, podReq, resp, http.StatusOK); err != nil {
+		return nil, err
 	}
 	return resp, nil
 }
 
-// Del ...
-func (csc *CNIServerClient) Del(podReq *PodRequest) error {
-	// 貌似与unix socket建立的http连接, 就是通过这种URL(dummy)进行访问的?
-	res, body, errors := csc.Post("http://dummy/api/v1/del").Send(podReq).End()
-	if len(errors) != 0 {
-		return errors[0]
-	}
-	if res.StatusCode != 204 {
-		return fmt.Errorf("delete ip return %d %s", res.StatusCode, body)
+// Del 通知 cni server 释放 Pod 的静态 IP
+func (csc *CNIServerClient) Del(ctx context.Context, podReq *PodRequest) error {
+	return csc.do(ctx, http.MethodPost, cniapi.PathDel, podReq, nil, http.StatusNoContent)
+}
+
+// Check 请求 cni server 确认 Pod 网卡上的地址与分配的一致.
+// server 不支持 check 时返回 ErrCheckUnsupported, 插件应当跳过这一项检查.
+func (csc *CNIServerClient) Check(ctx context.Context, podReq *PodRequest) error {
+	err := csc.do(ctx, http.MethodPost, cniapi.PathCheck, podReq, nil, http.StatusNoContent)
+	var apiErr *APIError
+	if errors.As(err, &apiErr) && apiErr.StatusCode == http.StatusNotFound && apiErr.Code == 0 {
+		// 1.0 版本的 server 没有注册该路径
+		return ErrCheckUnsupported
 	}
-	return nil
+	return err
 }
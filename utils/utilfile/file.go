@@ -1,6 +1,9 @@
 package utilfile
 
-import "os"
+import (
+	"os"
+	"path/filepath"
+)
 
 // Exists 判断给到的路径文件 / 目录是否存在, 返回 bool 值： true 存在， false 不存在
 func Exists(path string) bool {
@@ -14,3 +17,41 @@ func Exists(path string) bool {
 
 	return true
 }
+
+// WriteFileAtomic 先写入同目录下的临时文件, 再通过 rename 替换目标文件,
+// 保证读取方(如 kubelet)不会读到写了一半的文件.
+func WriteFileAtomic(path string, data []byte, perm os.FileMode) (err error) {
+	dir := filepath.Dir(path)
+	if err = os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	// 临时文件必须与目标文件在同一个文件系统中, rename 才是原子操作
+	tmpFile, err := os.CreateTemp(dir, "."+filepath.Base(path)+".tmp-")
+	if err != nil {
+		return err
+	}
+	tmpPath := tmpFile.Name()
+	defer func() {
+		if err != nil {
+			os.Remove(tmpPath)
+		}
+	}()
+
+	if _, err = tmpFile.Write(data); err != nil {
+		tmpFile.Close()
+		return err
+	}
+	if err = tmpFile.Sync(); err != nil {
+		tmpFile.Close()
+		return err
+	}
+	if err = tmpFile.Close(); err != nil {
+		return err
+	}
+	if err = os.Chmod(tmpPath, perm); err != nil {
+		return err
+	}
+
+	return os.Rename(tmpPath, path)
+}